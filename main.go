@@ -1,37 +1,49 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
 
 	"github.com/gorilla/mux"
 	managerid "github.com/josedelrio85/managerid/pkg"
-	"github.com/rs/cors"
+	"github.com/josedelrio85/managerid/pkg/identitypb"
+	"google.golang.org/grpc"
+	"gopkg.in/yaml.v3"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			importCommand(os.Args[2:])
+			return
+		case "config":
+			configCommand(os.Args[2:])
+			return
+		}
+	}
+
 	r := mux.NewRouter()
 
-	port := GetSetting("DB_PORT")
-	portInt, err := strconv.ParseInt(port, 10, 64)
-	if err != nil {
-		log.Fatalf("Error parsing to string Database's port %s, Err: %s", port, err)
-	}
+	config := loadConfig(os.Getenv("CONFIG_FILE"))
+	database := config.Database.Database()
+	events := managerid.NewEventBus(config.Limits.EventsBuffer)
+	database.Events = events
+	database.GeoIP = newGeoIP(config)
+	defer database.GeoIP.Close()
 
-	database := &managerid.Database{
-		Host:      GetSetting("DB_HOST"),
-		Port:      portInt,
-		User:      GetSetting("DB_USER"),
-		Password:  GetSetting("DB_PASS"),
-		DBName:    GetSetting("DB_NAME"),
-		Charset:   "utf8",
-		ParseTime: "True",
-		Loc:       "Local",
+	ch, err := config.ClientHandler(database, events, database.GeoIP)
+	if err != nil {
+		log.Fatalf("Error building the handler, Err: %s", err)
 	}
-	ch := managerid.ClientHandler{
-		Querier: database,
+	corsHandler, err := managerid.NewCORS(config.CORS)
+	if err != nil {
+		log.Fatalf("Error parsing CORS settings, Err: %s", err)
 	}
 
 	if err := database.Open(); err != nil {
@@ -43,23 +55,122 @@ func main() {
 		log.Fatalf("error creating the table. err: %s", err)
 	}
 
-	r.PathPrefix("/id/settle").Handler(ch.HandleFunction())
+	ch.Routes(r)
 
-	log.Fatal(http.ListenAndServe(":4000", cors.Default().Handler(r)))
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Server.GRPCPort))
+	if err != nil {
+		log.Fatalf("error listening gRPC port %d. err: %s", config.Server.GRPCPort, err)
+	}
+	grpcServer := grpc.NewServer()
+	identitypb.RegisterIdentityServiceServer(grpcServer, &managerid.IdentityServer{Handler: ch})
+	go func() {
+		log.Fatal(grpcServer.Serve(listener))
+	}()
+
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.Server.Port), corsHandler.Handler(managerid.WithRequestID(r))))
 
 }
 
-// GetSetting reads an ENV VAR setting, it does crash the service if with an
-// error message if any setting is not found.
+// importCommand resolves the NDJSON interactions of a file, or stdin if no file
+// is passed, and writes the results to stdout as NDJSON.
 //
-// - setting: The setting (ENV VAR) to read.
+// Usage: managerid import [-window n] [-chunk n] [file]
+func importCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	window := flags.Int("window", managerid.DefaultImportWindow, "number of records buffered to sort them by timestamp")
+	chunk := flags.Int("chunk", managerid.DefaultImportChunkSize, "number of records resolved in each transaction")
+	flags.Parse(args)
+
+	var input io.Reader = os.Stdin
+	if flags.NArg() > 0 {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			log.Fatalf("error opening import file. err: %s", err)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	config := loadConfig(os.Getenv("CONFIG_FILE"))
+	database := config.Database.Database()
+	database.GeoIP = newGeoIP(config)
+	defer database.GeoIP.Close()
+	bots, err := config.Bots.Policy(database.GeoIP)
+	if err != nil {
+		log.Fatalf("error loading the bot policy. err: %s", err)
+	}
+	internal, err := config.Internal.Policy()
+	if err != nil {
+		log.Fatalf("error loading the internal policy. err: %s", err)
+	}
+	if err := database.Open(); err != nil {
+		log.Fatalf("error opening database connection. err: %s", err)
+	}
+	defer database.Close()
+
+	if err := database.CreateTable(); err != nil {
+		log.Fatalf("error creating the table. err: %s", err)
+	}
+
+	importer := managerid.Importer{
+		Querier:   database,
+		Window:    *window,
+		ChunkSize: *chunk,
+		Internal:  internal,
+		Bots:      bots,
+	}
+	if err := importer.Import(input, os.Stdout); err != nil {
+		log.Fatalf("error importing interactions. err: %s", err)
+	}
+}
+
+// configCommand prints the effective configuration, the file of the -file
+// flag, or the CONFIG_FILE ENV VAR, overridden with the ENV VARS, as YAML with
+// the secrets redacted. The problems found are reported after it.
 //
-// Returns the setting value.
-func GetSetting(setting string) string {
-	value, ok := os.LookupEnv(setting)
-	if !ok {
-		log.Fatalf("Init error, %s ENV var not found", setting)
+// Usage: managerid config [-file path]
+func configCommand(args []string) {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	file := flags.String("file", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+	flags.Parse(args)
+
+	config, err := managerid.LoadConfig(*file, os.LookupEnv)
+	if config == nil {
+		log.Fatalf("error loading the configuration. err: %s", err)
+	}
+
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(config.Redacted()); err != nil {
+		log.Fatalf("error printing the configuration. err: %s", err)
+	}
+	encoder.Close()
+
+	if configErr, ok := err.(*managerid.ConfigError); ok {
+		for _, problem := range configErr.Problems {
+			log.Printf("invalid configuration: %s", problem)
+		}
+		os.Exit(1)
+	}
+}
+
+// loadConfig loads the Config of the YAML file passed as param, if it is not
+// empty, overridden with the ENV VARS. It does crash the service with every
+// problem found if it is not valid.
+func loadConfig(path string) *managerid.Config {
+	config, err := managerid.LoadConfig(path, os.LookupEnv)
+	if err != nil {
+		log.Fatalf("Init error, %s", err)
 	}
+	return config
+}
 
-	return value
+// newGeoIP loads the GeoIP databases of the Config, reloaded when they change.
+// Returns nil if no databases are set.
+func newGeoIP(config *managerid.Config) *managerid.GeoIP {
+	geoip, err := config.GeoIP.GeoIP()
+	if err != nil {
+		log.Fatalf("error loading the GeoIP databases. err: %s", err)
+	}
+	return geoip
 }
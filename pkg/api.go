@@ -2,9 +2,9 @@ package managerid
 
 import (
 	"encoding/json"
-	"fmt"
-	"log"
 	"net/http"
+
+	"github.com/josedelrio85/managerid/pkg/passport"
 )
 
 // Interaction is a struct that represents a single interaction in web environment.
@@ -12,46 +12,189 @@ type Interaction struct {
 	IP          string `json:"ip"`
 	Provider    string `json:"provider"`
 	Application string `json:"application"`
+	// UserAgent is only used to classify bots, it is not stored.
+	UserAgent string `json:"user_agent,omitempty"`
+	VisitContext
+
+	// Bot is the reason why the interaction was classified as a bot, see ClientHandler.Bots.
+	Bot string `json:"-"`
+	// Internal is set when the interaction comes from an internal network, see ClientHandler.Internal.
+	Internal bool `json:"-"`
 }
 
 // ClientHandler is a struct created to use its ch property as element that implements
 // http.Handler.Neededed to call HandleFunction as param in router Handler function.
 type ClientHandler struct {
 	ch      http.Handler
-	Interac Interaction
 	Querier Querier
+
+	// MaxBodySize is the maximum size in bytes of a request body.
+	// DefaultMaxBodySize is used when it is not set.
+	MaxBodySize int64
+	// StrictDecoding rejects payloads with unknown fields.
+	StrictDecoding bool
+
+	// MaxBatchSize is the maximum number of interactions accepted by HandleBatch.
+	// DefaultMaxBatchSize is used when it is not set.
+	MaxBatchSize int
+
+	// Idempotency stores the responses of the settle requests with an
+	// Idempotency-Key header. Keys are ignored when it is not set.
+	Idempotency IdempotencyStore
+
+	// Events is the EventBus streamed by HandleEvents, the same one the Querier
+	// publishes to. HandleEvents is unavailable when it is not set.
+	Events *EventBus
+
+	// Cookie is the signed cookie issued and read by the settle requests to reuse
+	// the identity of the visitor. No cookie is used when it is not set.
+	Cookie *SignedCookie
+
+	// Redirects holds the destinations allowed by HandleRedirect for every application.
+	// Every destination is rejected when it is not set.
+	Redirects RedirectAllowlist
+
+	// ClientIP derives the IP of the client from the request. It is used by the
+	// settle requests as its policy sets, and by the requests without body IP.
+	// When it is not set, settle requests must send the IP and the others use the
+	// IP of the connection.
+	ClientIP *ClientIPResolver
+
+	// Bots classifies the interactions as bots and sets what is done with them
+	// for every application. No interaction is classified when it is not set.
+	Bots *BotPolicy
+
+	// Internal holds the internal networks and sets what is done with their
+	// interactions for every application. No interaction is internal when it is not set.
+	Internal *InternalPolicy
+
+	// RateLimits throttles the requests that settle identities by client IP and
+	// by application, see WithRateLimit. No request is throttled when it is not set.
+	RateLimits *RateLimiter
+
+	// RequireAPIKey requires an API key in the settle and lookup requests, that
+	// only accept the applications and providers of the key, see WithAPIKey.
+	RequireAPIKey bool
+	// AdminToken is the bearer token of the admin endpoints, see WithAdmin.
+	// The admin endpoints are unavailable when it is not set.
+	AdminToken string
+
+	// Tokens signs the passport tokens returned by the v2 and gRPC settles.
+	// No token is returned when it is not set.
+	Tokens *passport.Signer
+
+	// Signatures verifies the HMAC-SHA256 signatures of the settle and lookup
+	// requests, see WithSignature. Requests are not verified when it is not set.
+	Signatures *SignatureVerifier
 }
 
 // HandleFunction is a function used to manage all received requests.
 // Only POST method accepted.
-// Decode the identity json request as Identity struct.
+// Decode the identity json request as Identity struct and validate it.
+// When ClientHandler.ClientIP is set, the IP is derived from the request as its policy sets.
 // Check if the data has matches in DB environment to make a decission.
-// Returns an StatusMethodNotAllowed state if other kind of request is received.
-// Returns StatusInternalServerError when decoding the body content fails.
+// Errors are returned as an APIError envelope:
+// StatusMethodNotAllowed if other kind of request is received.
+// StatusUnsupportedMediaType if the body is not declared as json.
+// StatusRequestEntityTooLarge if the body exceeds the maximum size.
+// StatusBadRequest or StatusUnprocessableEntity when decoding the body content fails.
+// StatusUnprocessableEntity with the invalid fields when the interaction is not valid.
+// StatusForbidden if the interaction is a bot or internal and its application rejects them,
+// or it is out of the scope of the API key or of the CORS policy of its origin.
+// StatusInternalServerError or StatusServiceUnavailable when the identity can not be resolved.
 func (ch *ClientHandler) HandleFunction() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			log.Println("Method not allowed.", http.StatusMethodNotAllowed)
-			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		identity, ok := ch.settle(w, r)
+		if !ok {
 			return
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&ch.Interac); err != nil {
-			message := fmt.Sprintf("error decoding interaction payload, err: %v", err)
-			log.Println(message)
-			http.Error(w, message, http.StatusInternalServerError)
-			return
-		}
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(identity)
+	})
+}
+
+// settle decodes, validates and resolves the interaction of a settle request.
+// This is the resolution core shared by every version of the API.
+// Returns the identity and true, or false if the error response is already written.
+func (ch *ClientHandler) settle(w http.ResponseWriter, r *http.Request) (*Identity, bool) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, methodNotAllowed(r))
+		return nil, false
+	}
+
+	if apiErr := checkContentType(r, "application/json"); apiErr != nil {
+		writeError(w, r, apiErr)
+		return nil, false
+	}
+
+	interaction := Interaction{}
+	if apiErr := ch.decodeBody(r, &interaction); apiErr != nil {
+		writeError(w, r, apiErr)
+		return nil, false
+	}
+	if ch.ClientIP != nil {
+		interaction.IP = ch.ClientIP.interactionIP(r, interaction.IP)
+	}
+	if interaction.UserAgent == "" {
+		interaction.UserAgent = r.UserAgent()
+	}
+	return ch.resolve(w, r, interaction)
+}
+
+// resolve validates and resolves the interaction of a request.
+// The internal and bot policies are applied first, the ephemeral identities are
+// returned without cookie.
+// The identity of a valid signed cookie, or of the ids sent back by the
+// JavaScript snippet, is reused, and when the signed cookie is enabled the cookie
+// of the resolved identity is set in the response.
+// Returns the identity and true, or false if the error response is already written.
+func (ch *ClientHandler) resolve(w http.ResponseWriter, r *http.Request, interaction Interaction) (*Identity, bool) {
+	if errs := interaction.Validate(); len(errs) > 0 {
+		writeError(w, r, validationError(errs))
+		return nil, false
+	}
+	if apiErr := apiKeyFromContext(r.Context()).authorize(interaction); apiErr != nil {
+		writeError(w, r, apiErr)
+		return nil, false
+	}
+	if apiErr := corsScopeFromContext(r.Context()).authorize(interaction); apiErr != nil {
+		writeError(w, r, apiErr)
+		return nil, false
+	}
 
-		identity, err := ch.Querier.GetIdentity(ch.Interac)
+	interaction, ephemeral, apiErr := ch.screen(interaction)
+	if apiErr != nil {
+		writeError(w, r, apiErr)
+		return nil, false
+	}
+	if ephemeral != nil {
+		return ephemeral, true
+	}
+
+	identity, err := ch.knownIdentity(r, interaction)
+	if err != nil {
+		internalError(w, r, "error performing known identity GetIdentityByID", err)
+		return nil, false
+	}
+	if identity != nil {
+		if interaction.VisitContext != (VisitContext{}) {
+			if err := ch.Querier.AddVisit(identity.PassportID, interaction.VisitContext); err != nil {
+				internalError(w, r, "error performing known identity AddVisit", err)
+				return nil, false
+			}
+		}
+		ch.Events.publishIdentity(identity)
+	} else {
+		identity, err = ch.Querier.GetIdentity(interaction)
 		if err != nil {
-			message := fmt.Sprintf("error performing interaction's CheckIdentity, err: %v", err)
-			log.Println(message)
-			http.Error(w, message, http.StatusInternalServerError)
-			return
+			internalError(w, r, "error performing interaction's CheckIdentity", err)
+			return nil, false
 		}
+	}
 
-		w.Header().Add("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(identity)
-	})
+	if ch.Cookie != nil {
+		ch.Cookie.Set(w, r, identity)
+	}
+	return identity, true
 }
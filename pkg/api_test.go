@@ -389,6 +389,7 @@ func setDownDb() {
 	defer dbInstance.Close()
 
 	for _, ident := range identities {
+		dbInstance.db.Where("passport_id = ?", ident.PassportID).Delete(&Visit{})
 		dbInstance.db.Delete(&ident)
 	}
 }
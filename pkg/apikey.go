@@ -0,0 +1,416 @@
+package managerid
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// APIKeyHeader is the header of the API key, it can also be sent as a bearer token.
+	APIKeyHeader = "X-API-Key"
+
+	// apiKeyPrefix starts every API key, followed by the key id and the secret.
+	apiKeyPrefix = "mid"
+	// apiKeyIDSize and apiKeySecretSize are the random bytes of the key id and the secret.
+	apiKeyIDSize     = 8
+	apiKeySecretSize = 32
+)
+
+// ErrAPIKeyNotFound is returned when looking up an API key that does not exist.
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKey is a struct that represents an API key, that allows to settle and look
+// up the identities of its applications and providers. Only the hash of its
+// secret is stored.
+type APIKey struct {
+	Idapikey *int   `gorm:"primary_key"`
+	KeyID    string `sql:"type:VARCHAR(32)" gorm:"unique_index:idx_api_keys_keyid"`
+	Hash     string `sql:"type:VARCHAR(64)"`
+	Name     string `sql:"type:VARCHAR(255)"`
+	// Applications and Providers are the allowed values, one per line. Every
+	// provider is allowed when Providers is empty.
+	Applications string `sql:"type:TEXT"`
+	Providers    string `sql:"type:TEXT"`
+	Createdat    time.Time
+	Revokedat    *time.Time
+}
+
+// TableName sets the default table name
+func (APIKey) TableName() string {
+	return "api_keys"
+}
+
+// APIKeyRequest is a struct that represents the body of a request to create an API key.
+type APIKeyRequest struct {
+	Name         string   `json:"name"`
+	Applications []string `json:"applications"`
+	Providers    []string `json:"providers,omitempty"`
+}
+
+// APIKeyResponse is a struct that represents an API key in the admin endpoints.
+// Key is only set when the key is created, it can not be recovered later.
+type APIKeyResponse struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Applications []string   `json:"applications"`
+	Providers    []string   `json:"providers"`
+	CreatedAt    time.Time  `json:"created_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	Key          string     `json:"key,omitempty"`
+}
+
+// NewAPIKey generates an API key with the name and scope passed as param.
+// Returns the APIKey to store and the key to hand to the client.
+func NewAPIKey(name string, applications, providers []string) (*APIKey, string, error) {
+	id := make([]byte, apiKeyIDSize)
+	secret := make([]byte, apiKeySecretSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	key := &APIKey{
+		KeyID:        hex.EncodeToString(id),
+		Hash:         hashAPIKeySecret(hex.EncodeToString(secret)),
+		Name:         name,
+		Applications: strings.Join(applications, "\n"),
+		Providers:    strings.Join(providers, "\n"),
+		Createdat:    time.Now(),
+	}
+	return key, fmt.Sprintf("%s_%s_%s", apiKeyPrefix, key.KeyID, hex.EncodeToString(secret)), nil
+}
+
+// Allows checks if the key allows the application and provider passed as param.
+func (k *APIKey) Allows(application, provider string) bool {
+	return containsLine(k.Applications, application) && (k.Providers == "" || containsLine(k.Providers, provider))
+}
+
+// authorize checks if the key allows the interaction. It is safe to call on a nil APIKey.
+// Returns the APIError with the fields that are not allowed, or nil.
+func (k *APIKey) authorize(interaction Interaction) *APIError {
+	if k == nil {
+		return nil
+	}
+	errs := []FieldError{}
+	if !containsLine(k.Applications, interaction.Application) {
+		errs = append(errs, FieldError{Field: "application", Message: "is not allowed by the API key"})
+	}
+	if k.Providers != "" && !containsLine(k.Providers, interaction.Provider) {
+		errs = append(errs, FieldError{Field: "provider", Message: "is not allowed by the API key"})
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &APIError{
+		Status:  http.StatusForbidden,
+		Code:    CodeForbidden,
+		Message: "interaction is out of the scope of the API key",
+		Details: errs,
+	}
+}
+
+// containsLine checks if value is one of the lines of values.
+func containsLine(values, value string) bool {
+	for _, line := range strings.Split(values, "\n") {
+		if line == value {
+			return true
+		}
+	}
+	return false
+}
+
+// response converts the key to its APIKeyResponse.
+func (k *APIKey) response() *APIKeyResponse {
+	lines := func(value string) []string {
+		if value == "" {
+			return []string{}
+		}
+		return strings.Split(value, "\n")
+	}
+	return &APIKeyResponse{
+		ID:           k.KeyID,
+		Name:         k.Name,
+		Applications: lines(k.Applications),
+		Providers:    lines(k.Providers),
+		CreatedAt:    k.Createdat,
+		RevokedAt:    k.Revokedat,
+	}
+}
+
+// hashAPIKeySecret returns the hex SHA-256 of the secret of a key.
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyContextKey is the key of the authenticated APIKey in the request context.
+type apiKeyContextKey struct{}
+
+// apiKeyFromContext returns the APIKey authenticated by WithAPIKey, or nil.
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// WithAPIKey is a middleware that requires an API key when ClientHandler.RequireAPIKey
+// is set, sent in the X-API-Key header or as a bearer token. The handlers only
+// accept the applications and providers of the key.
+// Errors are returned as an APIError envelope:
+// StatusUnauthorized if the key is missing, not valid or revoked.
+// StatusInternalServerError or StatusServiceUnavailable when the key can not be looked up.
+func (ch *ClientHandler) WithAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ch.RequireAPIKey {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		value := r.Header.Get(APIKeyHeader)
+		if value == "" {
+			value = bearerToken(r.Header.Get("Authorization"))
+		}
+		key, err := ch.authenticate(value)
+		if err != nil {
+			if apiErr, ok := err.(*APIError); ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="managerid"`)
+				writeError(w, r, apiErr)
+				return
+			}
+			internalError(w, r, "error performing GetAPIKey", err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	})
+}
+
+// authenticate looks up the API key passed as param and checks its secret.
+// Returns the key, an APIError if it is missing, not valid or revoked, or the
+// error of the lookup.
+func (ch *ClientHandler) authenticate(value string) (*APIKey, error) {
+	unauthorized := func(message string) error {
+		return &APIError{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: message}
+	}
+	if value == "" {
+		return nil, unauthorized("API key is required")
+	}
+
+	parts := strings.Split(value, "_")
+	if len(parts) != 3 || parts[0] != apiKeyPrefix {
+		return nil, unauthorized("API key is not valid")
+	}
+	key, err := ch.Querier.GetAPIKey(parts[1])
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, unauthorized("API key is not valid")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKeySecret(parts[2]))) != 1 {
+		return nil, unauthorized("API key is not valid")
+	}
+	if key.Revokedat != nil {
+		return nil, unauthorized("API key is revoked")
+	}
+	return key, nil
+}
+
+// bearerToken returns the token of an Authorization header with the Bearer scheme, or "".
+func bearerToken(authorization string) string {
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return ""
+}
+
+// WithAdmin is a middleware that requires ClientHandler.AdminToken as bearer token.
+// Errors are returned as an APIError envelope:
+// StatusServiceUnavailable if no admin token is set.
+// StatusUnauthorized if the token is missing or not valid.
+func (ch *ClientHandler) WithAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiErr := ch.checkAdmin(bearerToken(r.Header.Get("Authorization"))); apiErr != nil {
+			if apiErr.Status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="managerid-admin"`)
+			}
+			writeError(w, r, apiErr)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkAdmin compares the token passed as param with ClientHandler.AdminToken.
+// Returns an APIError if no admin token is set or the token is not valid.
+func (ch *ClientHandler) checkAdmin(token string) *APIError {
+	if ch.AdminToken == "" {
+		return &APIError{
+			Status:  http.StatusServiceUnavailable,
+			Code:    CodeUnavailable,
+			Message: "admin endpoints are not enabled",
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(ch.AdminToken)) != 1 {
+		return &APIError{
+			Status:  http.StatusUnauthorized,
+			Code:    CodeUnauthorized,
+			Message: "admin token is not valid",
+		}
+	}
+	return nil
+}
+
+// WithLookupAccess is a middleware that protects the endpoints that return the
+// stored identities, which hold personal data: they require an API key, as
+// WithAPIKey does, when ClientHandler.RequireAPIKey is set, and the admin token,
+// as WithAdmin does, otherwise. So they are never open, and they are disabled
+// when neither is configured.
+// Errors are returned as an APIError envelope, see WithAPIKey and WithAdmin.
+func (ch *ClientHandler) WithLookupAccess(next http.Handler) http.Handler {
+	withKey := ch.WithAPIKey(next)
+	withAdmin := ch.WithAdmin(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ch.RequireAPIKey {
+			withKey.ServeHTTP(w, r)
+			return
+		}
+		withAdmin.ServeHTTP(w, r)
+	})
+}
+
+// HandleAPIKeys is a function used to list and create API keys.
+// GET lists every key, newest first, without their secrets.
+// POST creates a key from an APIKeyRequest, the response holds the key, that
+// can not be recovered later.
+// Errors are returned as an APIError envelope:
+// StatusMethodNotAllowed if other kind of request is received.
+// StatusUnsupportedMediaType if the body is not declared as json.
+// StatusBadRequest or StatusUnprocessableEntity when decoding the body content fails.
+// StatusUnprocessableEntity with the invalid fields when the request is not valid.
+// StatusInternalServerError or StatusServiceUnavailable when the keys can not be listed or stored.
+func (ch *ClientHandler) HandleAPIKeys() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			keys, err := ch.Querier.GetAPIKeys()
+			if err != nil {
+				internalError(w, r, "error performing GetAPIKeys", err)
+				return
+			}
+			response := []*APIKeyResponse{}
+			for _, key := range keys {
+				response = append(response, key.response())
+			}
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(response)
+
+		case http.MethodPost:
+			if apiErr := checkContentType(r, "application/json"); apiErr != nil {
+				writeError(w, r, apiErr)
+				return
+			}
+			request := APIKeyRequest{}
+			if apiErr := ch.decodeBody(r, &request); apiErr != nil {
+				writeError(w, r, apiErr)
+				return
+			}
+			if errs := request.Validate(); len(errs) > 0 {
+				writeError(w, r, &APIError{
+					Status:  http.StatusUnprocessableEntity,
+					Code:    CodeValidation,
+					Message: "API key has invalid fields",
+					Details: errs,
+				})
+				return
+			}
+
+			key, secret, err := NewAPIKey(request.Name, request.Applications, request.Providers)
+			if err != nil {
+				internalError(w, r, "error generating API key", err)
+				return
+			}
+			if err := ch.Querier.CreateAPIKey(key); err != nil {
+				internalError(w, r, "error performing CreateAPIKey", err)
+				return
+			}
+			response := key.response()
+			response.Key = secret
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(response)
+
+		default:
+			writeError(w, r, methodNotAllowed(r))
+		}
+	})
+}
+
+// HandleAPIKey is a function used to revoke the API key of the id of the path.
+// Only DELETE method accepted. Revoking a revoked key keeps its revocation time.
+// Errors are returned as an APIError envelope:
+// StatusMethodNotAllowed if other kind of request is received.
+// StatusNotFound if there is no key with that id.
+// StatusInternalServerError or StatusServiceUnavailable when the key can not be revoked.
+func (ch *ClientHandler) HandleAPIKey() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeError(w, r, methodNotAllowed(r))
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+		key, err := ch.Querier.RevokeAPIKey(id, time.Now())
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			writeError(w, r, &APIError{
+				Status:  http.StatusNotFound,
+				Code:    CodeNotFound,
+				Message: fmt.Sprintf("API key %s not found", id),
+			})
+			return
+		}
+		if err != nil {
+			internalError(w, r, "error performing RevokeAPIKey", err)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(key.response())
+	})
+}
+
+// Validate checks the values of the request.
+// The name and at least one application are required, the applications and
+// providers must be printable text and fit in the identity columns.
+// Returns the errors found, or an empty slice if the request is valid.
+func (request APIKeyRequest) Validate() []FieldError {
+	errs := []FieldError{}
+	if message := validateText(request.Name); message != "" {
+		errs = append(errs, FieldError{Field: "name", Message: message})
+	}
+	if len(request.Applications) == 0 {
+		errs = append(errs, FieldError{Field: "applications", Message: "must have at least one application"})
+	}
+	for i, application := range request.Applications {
+		if message := validateText(application); message != "" {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("applications[%d]", i), Message: message})
+		}
+	}
+	for i, provider := range request.Providers {
+		if message := validateText(provider); message != "" {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("providers[%d]", i), Message: message})
+		}
+	}
+	return errs
+}
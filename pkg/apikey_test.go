@@ -0,0 +1,324 @@
+package managerid
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/josedelrio85/managerid/pkg/identitypb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAPIKey(t *testing.T) {
+	assert := assert.New(t)
+
+	key, secret, err := NewAPIKey("Backend", []string{"App", "Other"}, []string{"Prov"})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(strings.HasPrefix(secret, "mid_"+key.KeyID+"_"))
+	assert.NotContains(key.Hash, strings.Split(secret, "_")[2])
+	assert.Len(key.Hash, 64)
+
+	assert.True(key.Allows("App", "Prov"))
+	assert.True(key.Allows("Other", "Prov"))
+	assert.False(key.Allows("App", "Other"))
+	assert.False(key.Allows("Unknown", "Prov"))
+	assert.False(key.Allows("", ""))
+
+	apiErr := key.authorize(Interaction{Application: "Unknown", Provider: "Unknown"})
+	if assert.NotNil(apiErr) {
+		assert.Equal(http.StatusForbidden, apiErr.Status)
+		assert.Equal([]FieldError{
+			{Field: "application", Message: "is not allowed by the API key"},
+			{Field: "provider", Message: "is not allowed by the API key"},
+		}, apiErr.Details)
+	}
+	assert.Nil((*APIKey)(nil).authorize(Interaction{Application: "Unknown"}))
+
+	// every provider is allowed without providers
+	key, _, _ = NewAPIKey("Backend", []string{"App"}, nil)
+	assert.True(key.Allows("App", "Any"))
+	assert.Nil(key.authorize(Interaction{Application: "App", Provider: "Any"}))
+}
+
+func TestWithAPIKey(t *testing.T) {
+	assert := assert.New(t)
+
+	key, secret, _ := NewAPIKey("Backend", []string{"App"}, []string{"Prov"})
+	revoked, revokedSecret, _ := NewAPIKey("Old", []string{"App"}, nil)
+	at := time.Now()
+	revoked.Revokedat = &at
+	keys := map[string]*APIKey{key.KeyID: key, revoked.KeyID: revoked}
+
+	settled := []Interaction{}
+	ch := ClientHandler{
+		RequireAPIKey: true,
+		Querier: &FakeDb{
+			GetAPIKeyFunc: func(keyID string) (*APIKey, error) {
+				if key, ok := keys[keyID]; ok {
+					return key, nil
+				}
+				return nil, ErrAPIKeyNotFound
+			},
+			GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+				settled = append(settled, interaction)
+				return &Identity{PassportID: "id", PassportIDGrp: "group"}, nil
+			},
+			GetIdentitiesFunc: func(interactions []Interaction) ([]*Identity, error) {
+				settled = append(settled, interactions...)
+				idents := []*Identity{}
+				for range interactions {
+					idents = append(idents, &Identity{PassportID: "id", PassportIDGrp: "group"})
+				}
+				return idents, nil
+			},
+			GroupSizesFunc: func(groups []string) (map[string]int, error) {
+				return map[string]int{"group": 1}, nil
+			},
+			GetIdentityByIDFunc: func(passportID string) (*Identity, error) {
+				return &Identity{Provider: "Prov", Application: passportID, PassportID: passportID, PassportIDGrp: "group"}, nil
+			},
+			GetVisitsFunc: func(passportID string, limit int) ([]*Visit, error) {
+				return []*Visit{}, nil
+			},
+			SearchIdentitiesFunc: func(filter IdentityFilter) ([]*Identity, error) {
+				return []*Identity{}, nil
+			},
+		},
+	}
+	r := mux.NewRouter()
+	ch.Routes(r)
+
+	valid := `{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}`
+	tests := []struct {
+		Description string
+		Method      string
+		Path        string
+		Header      string
+		Value       string
+		Body        string
+		StatusCode  int
+		Code        string
+		Settled     int
+	}{
+		{Description: "when the key is missing", Method: http.MethodPost, Path: "/id/settle", Body: valid, StatusCode: http.StatusUnauthorized, Code: CodeUnauthorized},
+		{Description: "when the key is not valid", Method: http.MethodPost, Path: "/id/settle", Header: APIKeyHeader, Value: "garbage", Body: valid, StatusCode: http.StatusUnauthorized, Code: CodeUnauthorized},
+		{Description: "when the secret is wrong", Method: http.MethodPost, Path: "/id/settle", Header: APIKeyHeader, Value: "mid_" + key.KeyID + "_00", Body: valid, StatusCode: http.StatusUnauthorized, Code: CodeUnauthorized},
+		{Description: "when the key is revoked", Method: http.MethodPost, Path: "/id/settle", Header: APIKeyHeader, Value: revokedSecret, Body: valid, StatusCode: http.StatusUnauthorized, Code: CodeUnauthorized},
+		{Description: "when the key is valid", Method: http.MethodPost, Path: "/id/settle", Header: APIKeyHeader, Value: secret, Body: valid, StatusCode: http.StatusOK, Settled: 1},
+		{Description: "when the key is a bearer token", Method: http.MethodPost, Path: "/v2/id/settle", Header: "Authorization", Value: "Bearer " + secret, Body: valid, StatusCode: http.StatusOK, Settled: 1},
+		{Description: "when the application is out of scope", Method: http.MethodPost, Path: "/id/settle", Header: APIKeyHeader, Value: secret, Body: `{"ip": "127.0.0.1", "provider": "Prov", "application": "Other"}`, StatusCode: http.StatusForbidden, Code: CodeForbidden},
+		{Description: "when an interaction of the batch is out of scope", Method: http.MethodPost, Path: "/id/settle/batch", Header: APIKeyHeader, Value: secret, Body: `[` + valid + `, {"ip": "127.0.0.1", "provider": "Other", "application": "App"}]`, StatusCode: http.StatusOK, Settled: 1},
+		{Description: "when the search is in scope", Method: http.MethodGet, Path: "/identities?application=App&provider=Prov", Header: APIKeyHeader, Value: secret, StatusCode: http.StatusOK},
+		{Description: "when the search is not filtered", Method: http.MethodGet, Path: "/identities", Header: APIKeyHeader, Value: secret, StatusCode: http.StatusForbidden, Code: CodeForbidden},
+		{Description: "when the identity is in scope", Method: http.MethodGet, Path: "/identities/App", Header: APIKeyHeader, Value: secret, StatusCode: http.StatusOK},
+		{Description: "when the identity is out of scope", Method: http.MethodGet, Path: "/identities/Other", Header: APIKeyHeader, Value: secret, StatusCode: http.StatusNotFound, Code: CodeNotFound},
+	}
+
+	for _, test := range tests {
+		settled = []Interaction{}
+		req := httptest.NewRequest(test.Method, test.Path, strings.NewReader(test.Body))
+		if test.Header != "" {
+			req.Header.Set(test.Header, test.Value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(test.StatusCode, w.Code, test.Description)
+		assert.Len(settled, test.Settled, test.Description)
+		if test.Code != "" {
+			response := errorEnvelope{}
+			if assert.NoError(json.NewDecoder(w.Body).Decode(&response), test.Description) {
+				assert.Equal(test.Code, response.Error.Code, test.Description)
+			}
+		}
+		if test.StatusCode == http.StatusUnauthorized {
+			assert.NotEmpty(w.Header().Get("WWW-Authenticate"), test.Description)
+		}
+	}
+}
+
+func TestWithLookupAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	querier := &FakeDb{
+		SearchIdentitiesFunc: func(filter IdentityFilter) ([]*Identity, error) {
+			return []*Identity{}, nil
+		},
+	}
+
+	tests := []struct {
+		Description string
+		AdminToken  string
+		Token       string
+		StatusCode  int
+	}{
+		{Description: "when neither API keys nor the admin token are enabled", StatusCode: http.StatusServiceUnavailable},
+		{Description: "when the admin token is missing", AdminToken: "admin", StatusCode: http.StatusUnauthorized},
+		{Description: "when the admin token is not valid", AdminToken: "admin", Token: "wrong", StatusCode: http.StatusUnauthorized},
+		{Description: "when the admin token is valid", AdminToken: "admin", Token: "admin", StatusCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		ch := ClientHandler{Querier: querier, AdminToken: test.AdminToken}
+		r := mux.NewRouter()
+		ch.Routes(r)
+
+		req := httptest.NewRequest(http.MethodGet, "/identities", nil)
+		if test.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.Token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(test.StatusCode, w.Code, test.Description)
+	}
+}
+
+func TestIdentityServerAPIKey(t *testing.T) {
+	assert := assert.New(t)
+
+	key, secret, _ := NewAPIKey("Backend", []string{"App"}, nil)
+	ch := &ClientHandler{
+		RequireAPIKey: true,
+		Querier: &FakeDb{
+			GetAPIKeyFunc: func(keyID string) (*APIKey, error) {
+				if keyID != key.KeyID {
+					return nil, ErrAPIKeyNotFound
+				}
+				return key, nil
+			},
+			GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+				return &Identity{PassportID: "id", PassportIDGrp: "group", Match: MatchNewGroup}, nil
+			},
+			GroupSizesFunc: func(groups []string) (map[string]int, error) {
+				return map[string]int{"group": 1}, nil
+			},
+			GetGroupFunc: func(idgroup string) ([]*Identity, error) {
+				return []*Identity{
+					{Provider: "Prov", Application: "App", PassportID: "id", PassportIDGrp: "group"},
+					{Provider: "Prov", Application: "Other", PassportID: "other", PassportIDGrp: "group"},
+				}, nil
+			},
+		},
+	}
+	client := helperGRPCClient(t, ch)
+	interaction := &identitypb.Interaction{Ip: "127.0.0.1", Provider: "Prov", Application: "App"}
+
+	_, err := client.Settle(context.Background(), &identitypb.SettleRequest{Interaction: interaction})
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", secret)
+	_, err = client.Settle(ctx, &identitypb.SettleRequest{Interaction: interaction})
+	assert.NoError(err)
+
+	_, err = client.Settle(ctx, &identitypb.SettleRequest{Interaction: &identitypb.Interaction{Ip: "127.0.0.1", Provider: "Prov", Application: "Other"}})
+	assert.Equal(codes.PermissionDenied, status.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+secret)
+	group, err := client.GetGroup(ctx, &identitypb.GetGroupRequest{PassportIdGroup: "group"})
+	if assert.NoError(err) && assert.Len(group.GetIdentities(), 1) {
+		assert.Equal("id", group.GetIdentities()[0].GetPassportId())
+	}
+}
+
+func TestWithAPIKeyIdempotency(t *testing.T) {
+	assert := assert.New(t)
+
+	keyA, secretA, _ := NewAPIKey("A", []string{"AppA"}, nil)
+	keyB, secretB, _ := NewAPIKey("B", []string{"AppB"}, nil)
+	keys := map[string]*APIKey{keyA.KeyID: keyA, keyB.KeyID: keyB}
+	ch := ClientHandler{
+		RequireAPIKey: true,
+		Idempotency:   NewMemoryIdempotencyStore(time.Hour, 0),
+		Querier: &FakeDb{
+			GetAPIKeyFunc: func(keyID string) (*APIKey, error) {
+				if key, ok := keys[keyID]; ok {
+					return key, nil
+				}
+				return nil, ErrAPIKeyNotFound
+			},
+			GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+				return &Identity{PassportID: "id-" + interaction.Application, PassportIDGrp: "group"}, nil
+			},
+		},
+	}
+	r := mux.NewRouter()
+	ch.Routes(r)
+
+	body := `{"ip": "127.0.0.1", "provider": "Prov", "application": "AppA"}`
+	settle := func(secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/id/settle", strings.NewReader(body))
+		req.Header.Set(APIKeyHeader, secret)
+		req.Header.Set(IdempotencyKeyHeader, "same-key")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := settle(secretA)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "id-AppA")
+
+	// the key of other caller does not replay the stored response
+	w = settle(secretB)
+	assert.Equal(http.StatusForbidden, w.Code)
+	assert.Empty(w.Header().Get(IdempotentReplayedHeader))
+
+	w = settle(secretA)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("true", w.Header().Get(IdempotentReplayedHeader))
+}
+
+func TestWithAPIKeyEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	key, secret, _ := NewAPIKey("Backend", []string{"App"}, []string{"Prov"})
+	ch := ClientHandler{
+		RequireAPIKey: true,
+		Events:        NewEventBus(0),
+		Querier: &FakeDb{
+			GetAPIKeyFunc: func(keyID string) (*APIKey, error) {
+				if keyID == key.KeyID {
+					return key, nil
+				}
+				return nil, ErrAPIKeyNotFound
+			},
+		},
+	}
+	r := mux.NewRouter()
+	ch.Routes(r)
+
+	tests := []struct {
+		Description string
+		Key         string
+		Query       string
+		StatusCode  int
+	}{
+		{Description: "when the key is missing", Query: "?application=App&provider=Prov", StatusCode: http.StatusUnauthorized},
+		{Description: "when the application is not filtered", Key: secret, Query: "?provider=Prov", StatusCode: http.StatusForbidden},
+		{Description: "when the application is out of scope", Key: secret, Query: "?application=Other&provider=Prov", StatusCode: http.StatusForbidden},
+		{Description: "when the provider is not filtered", Key: secret, Query: "?application=App", StatusCode: http.StatusForbidden},
+		{Description: "when the filter is in scope", Key: secret, Query: "?application=App&provider=Prov", StatusCode: http.StatusOK},
+	}
+	for _, test := range tests {
+		// the stream ends as soon as it starts
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest(http.MethodGet, "/v1/events"+test.Query, nil).WithContext(ctx)
+		if test.Key != "" {
+			req.Header.Set(APIKeyHeader, test.Key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(test.StatusCode, w.Code, test.Description)
+	}
+}
@@ -0,0 +1,153 @@
+package managerid
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// DefaultMaxBatchSize is the maximum number of interactions of a batch request
+// when ClientHandler.MaxBatchSize is not set.
+const DefaultMaxBatchSize = 500
+
+// BatchResult is a struct that represents the outcome of a single interaction
+// of a batch request. Only one of Identity or Error is set.
+type BatchResult struct {
+	*Identity
+	Error *APIError `json:"error,omitempty"`
+}
+
+// HandleBatch is a function used to manage batch requests.
+// Only POST method accepted.
+// Decode the json request as an array of Interaction elements and validate them.
+// Every valid interaction is resolved in order, and the response holds a BatchResult
+// for each one, in the same order, with the error of the invalid ones.
+// Errors are returned as an APIError envelope:
+// StatusMethodNotAllowed if other kind of request is received.
+// StatusUnsupportedMediaType if the body is not declared as json.
+// StatusRequestEntityTooLarge if the body exceeds the maximum size.
+// StatusBadRequest or StatusUnprocessableEntity when the body is not an array.
+// StatusRequestEntityTooLarge when the array exceeds the maximum batch size.
+// StatusInternalServerError or StatusServiceUnavailable when resolving the batch fails.
+func (ch *ClientHandler) HandleBatch() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ch.checkBatchRequest(w, r) {
+			return
+		}
+
+		items := []json.RawMessage{}
+		if apiErr := ch.decodeBody(r, &items); apiErr != nil {
+			writeError(w, r, apiErr)
+			return
+		}
+
+		results, ok := ch.settleBatch(w, r, items)
+		if !ok {
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+}
+
+// checkBatchRequest checks the method and content type of a batch request.
+// Returns false if the error response is already written.
+func (ch *ClientHandler) checkBatchRequest(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, r, methodNotAllowed(r))
+		return false
+	}
+
+	if apiErr := checkContentType(r, "application/json"); apiErr != nil {
+		writeError(w, r, apiErr)
+		return false
+	}
+	return true
+}
+
+// settleBatch decodes, validates and resolves the interactions of a batch request.
+// This is the resolution core shared by every version of the API.
+// Returns a BatchResult per item and true, or false if the error response is already written.
+func (ch *ClientHandler) settleBatch(w http.ResponseWriter, r *http.Request, items []json.RawMessage) ([]BatchResult, bool) {
+	if max := ch.maxBatchSize(); len(items) > max {
+		writeError(w, r, &APIError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    CodeBatchTooLarge,
+			Message: fmt.Sprintf("batch of %d interactions exceeds the maximum of %d", len(items), max),
+		})
+		return nil, false
+	}
+
+	results := make([]BatchResult, len(items))
+	interactions := make([]Interaction, len(items))
+	for i, item := range items {
+		if apiErr := ch.decodeItem(item, &interactions[i]); apiErr != nil {
+			results[i].Error = apiErr
+		}
+		if interactions[i].UserAgent == "" {
+			interactions[i].UserAgent = r.UserAgent()
+		}
+	}
+
+	if err := ch.resolveBatch(apiKeyFromContext(r.Context()), corsScopeFromContext(r.Context()), interactions, results); err != nil {
+		internalError(w, r, "error performing batch GetIdentities", err)
+		return nil, false
+	}
+	return results, true
+}
+
+// resolveBatch validates and resolves the interactions whose result has no error yet.
+// When key or origin are not nil, only the interactions in their scope are resolved.
+// The identity, or the validation, scope or policy error, of every interaction is set in its result.
+// Returns an error if resolving the interactions fails.
+func (ch *ClientHandler) resolveBatch(key *APIKey, origin *corsScope, interactions []Interaction, results []BatchResult) error {
+	valid := []Interaction{}
+	positions := []int{}
+	for i, interaction := range interactions {
+		if results[i].Error != nil {
+			continue
+		}
+		if errs := interaction.Validate(); len(errs) > 0 {
+			results[i].Error = validationError(errs)
+			continue
+		}
+		if apiErr := key.authorize(interaction); apiErr != nil {
+			results[i].Error = apiErr
+			continue
+		}
+		if apiErr := origin.authorize(interaction); apiErr != nil {
+			results[i].Error = apiErr
+			continue
+		}
+		interaction, ephemeral, apiErr := ch.screen(interaction)
+		if apiErr != nil {
+			results[i].Error = apiErr
+			continue
+		}
+		if ephemeral != nil {
+			results[i].Identity = ephemeral
+			continue
+		}
+		valid = append(valid, interaction)
+		positions = append(positions, i)
+	}
+
+	identities, err := ch.Querier.GetIdentities(valid)
+	if err != nil {
+		return err
+	}
+
+	for i, identity := range identities {
+		results[positions[i]].Identity = identity
+	}
+	return nil
+}
+
+// maxBatchSize returns the configured maximum batch size or the default one.
+func (ch *ClientHandler) maxBatchSize() int {
+	if ch.MaxBatchSize > 0 {
+		return ch.MaxBatchSize
+	}
+	return DefaultMaxBatchSize
+}
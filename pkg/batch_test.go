@@ -0,0 +1,211 @@
+package managerid
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeQuerier := func() *FakeDb {
+		return &FakeDb{
+			GetIdentitiesFunc: func(interactions []Interaction) ([]*Identity, error) {
+				idents := []*Identity{}
+				for _, interaction := range interactions {
+					idents = append(idents, &Identity{PassportID: interaction.IP, PassportIDGrp: "group"})
+				}
+				return idents, nil
+			},
+		}
+	}
+
+	tests := []struct {
+		Description     string
+		TypeRequest     string
+		Body            string
+		MaxBatchSize    int
+		StatusCode      int
+		ExpectedResults []BatchResult
+	}{
+		{
+			Description: "when HandleBatch receive a GET request",
+			TypeRequest: http.MethodGet,
+			StatusCode:  http.StatusMethodNotAllowed,
+		},
+		{
+			Description: "when HandleBatch receive a body that is not an array",
+			TypeRequest: http.MethodPost,
+			Body:        `{"ip": "127.0.0.1"}`,
+			StatusCode:  http.StatusUnprocessableEntity,
+		},
+		{
+			Description: "when HandleBatch receive a malformed body",
+			TypeRequest: http.MethodPost,
+			Body:        `[{"ip": `,
+			StatusCode:  http.StatusBadRequest,
+		},
+		{
+			Description:  "when HandleBatch receive more interactions than the maximum batch size",
+			TypeRequest:  http.MethodPost,
+			Body:         `[{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}, {"ip": "127.0.0.2", "provider": "Prov", "application": "App"}]`,
+			MaxBatchSize: 1,
+			StatusCode:   http.StatusRequestEntityTooLarge,
+		},
+		{
+			Description: "when HandleBatch receive valid and invalid interactions, results keep the order",
+			TypeRequest: http.MethodPost,
+			Body: `[{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}, "garbage",
+				{"ip": "garbage", "provider": "Prov", "application": "App"},
+				{"ip": "127.0.0.4", "provider": "Prov", "application": "App"}]`,
+			StatusCode: http.StatusOK,
+			ExpectedResults: []BatchResult{
+				{Identity: &Identity{PassportID: "127.0.0.1", PassportIDGrp: "group"}},
+				{Error: &APIError{Code: CodeInvalidPayload, Message: "value of type string not allowed"}},
+				{Error: &APIError{Code: CodeValidation, Message: "interaction has invalid fields", Details: []FieldError{
+					{Field: "ip", Message: "must be a valid IPv4 or IPv6 address"},
+				}}},
+				{Identity: &Identity{PassportID: "127.0.0.4", PassportIDGrp: "group"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		ch := ClientHandler{
+			Querier:      fakeQuerier(),
+			MaxBatchSize: test.MaxBatchSize,
+		}
+		ts := httptest.NewServer(ch.HandleBatch())
+		defer ts.Close()
+
+		req, err := http.NewRequest(test.TypeRequest, ts.URL, bytes.NewBufferString(test.Body))
+		if err != nil {
+			t.Errorf("error creating the test Request: Err: %v", err)
+			return
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("error sending test Request: Err: %v", err)
+			return
+		}
+
+		assert.Equal(test.StatusCode, resp.StatusCode, test.Description)
+
+		if test.ExpectedResults != nil {
+			assert.Equal("application/json", resp.Header.Get("Content-Type"))
+
+			results := []BatchResult{}
+			if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+				t.Errorf("error unmarshaling the test response: Err: %v", err)
+			}
+			assert.Equal(test.ExpectedResults, results, test.Description)
+		}
+	}
+}
+
+func TestIdentitySetResolve(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	old := &Identity{IP: "1.1.1.1", Provider: "Prov", Application: "App", PassportIDGrp: "grp", PassportID: "old", Createdat: now.Add(-3 * time.Hour)}
+	recent := &Identity{IP: "1.1.1.1", Provider: "Prov", Application: "Other", PassportIDGrp: "grp", PassportID: "recent", Createdat: now.Add(-time.Hour)}
+	set := identitySet{}
+	set.add(old)
+	set.add(recent)
+
+	tests := []struct {
+		Description   string
+		Interaction   Interaction
+		At            time.Time
+		Created       bool
+		Match         string
+		PassportID    string
+		PassportIDGrp string
+	}{
+		{
+			Description: "Case 1 IP value has not coincidences. Should create new identity and group.",
+			Interaction: Interaction{IP: "2.2.2.2", Provider: "Prov", Application: "App"},
+			At:          now,
+			Created:     true,
+			Match:       MatchNewGroup,
+		},
+		{
+			Description:   "Case 2 IP+Provider+Application matches inside the window. Should reuse the matched identity.",
+			Interaction:   Interaction{IP: "1.1.1.1", Provider: "Prov", Application: "Other"},
+			At:            now,
+			Created:       false,
+			Match:         MatchReused,
+			PassportID:    "recent",
+			PassportIDGrp: "grp",
+		},
+		{
+			Description:   "Case 3 IP+Provider+Application matches outside the window. Should create new identity in the group.",
+			Interaction:   Interaction{IP: "1.1.1.1", Provider: "Prov", Application: "App"},
+			At:            now,
+			Created:       true,
+			Match:         MatchNewInGroup,
+			PassportIDGrp: "grp",
+		},
+		{
+			Description:   "Case 4 rows created after the moment are ignored.",
+			Interaction:   Interaction{IP: "1.1.1.1", Provider: "Prov", Application: "App"},
+			At:            now.Add(-150 * time.Minute),
+			Created:       false,
+			Match:         MatchReused,
+			PassportID:    "old",
+			PassportIDGrp: "grp",
+		},
+	}
+
+	for _, test := range tests {
+		ident, created := set.resolve(test.Interaction, test.At)
+
+		assert.Equal(test.Created, created, test.Description)
+		assert.Equal(test.Match, ident.Match, test.Description)
+		assert.Equal(test.Interaction.IP, ident.IP, test.Description)
+		if test.PassportID != "" {
+			assert.Equal(test.PassportID, ident.PassportID, test.Description)
+		}
+		if test.PassportIDGrp != "" {
+			assert.Equal(test.PassportIDGrp, ident.PassportIDGrp, test.Description)
+		}
+		if created {
+			assert.Equal(test.At, ident.Createdat, test.Description)
+		}
+	}
+}
+
+func TestGetIdentities(t *testing.T) {
+	assert := assert.New(t)
+
+	if err := dbInstance.Open(); err != nil {
+		t.Errorf("error opening database connection. err: %s", err)
+	}
+
+	ip := helperRandstring(10)
+	interactions := []Interaction{
+		{IP: ip, Provider: "TestProv", Application: "TestApp"},
+		{IP: ip, Provider: "TestProv", Application: "TestApp"},
+		{IP: ip, Provider: "TestProv", Application: "OtherApp"},
+	}
+
+	idents, err := dbInstance.GetIdentities(interactions)
+	assert.NoError(err)
+	assert.Len(idents, len(interactions))
+
+	for _, ident := range idents {
+		assert.NotNil(ident.Ididentity)
+		assert.Equal(idents[0].PassportIDGrp, ident.PassportIDGrp)
+	}
+	assert.Equal(idents[0].PassportID, idents[1].PassportID)
+	assert.NotEqual(idents[0].PassportID, idents[2].PassportID)
+
+	identities = append(identities, *idents[0], *idents[2])
+}
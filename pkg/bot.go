@@ -0,0 +1,173 @@
+package managerid
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// BotAction is what is done with the interactions classified as bots.
+type BotAction string
+
+// Values of BotAction.
+const (
+	// BotTag resolves the interaction as usual, the new identities store the bot reason.
+	BotTag BotAction = "tag"
+	// BotEphemeral returns a new identity that is neither stored nor published.
+	BotEphemeral BotAction = "ephemeral"
+	// BotReject rejects the interaction with StatusForbidden.
+	BotReject BotAction = "reject"
+)
+
+// Reasons why an interaction is classified as a bot, stored in Identity.Bot.
+const (
+	// BotUserAgent is set when the user agent matches a bot pattern.
+	BotUserAgent = "user_agent"
+	// BotNetwork is set when the IP belongs to a datacenter network.
+	BotNetwork = "network"
+	// BotASN is set when the IP belongs to a datacenter autonomous system.
+	BotASN = "asn"
+)
+
+// DefaultBotUserAgents are the case insensitive substrings of the user agents of
+// crawlers, uptime checks and HTTP libraries.
+var DefaultBotUserAgents = []string{
+	"bot", "crawl", "spider", "slurp", "archiver", "facebookexternalhit",
+	"headlesschrome", "phantomjs", "lighthouse", "pingdom", "uptime", "statuscake", "site24x7",
+	"curl/", "wget/", "python-requests", "python-urllib", "aiohttp", "go-http-client",
+	"java/", "okhttp", "apache-httpclient", "node-fetch", "axios/", "libwww-perl",
+}
+
+// BotClassifier is a struct used to classify interactions as bots by their user
+// agent and by the network of their IP.
+type BotClassifier struct {
+	// UserAgents are the lower case substrings of the bot user agents.
+	UserAgents []string
+	// Networks are the datacenter networks.
+	Networks []*net.IPNet
+	// ASNs are the datacenter autonomous systems, looked up with GeoIP.
+	ASNs []uint
+	// GeoIP looks up the autonomous system of the IPs. ASNs are ignored when it is not set.
+	GeoIP *GeoIP
+}
+
+// Classify returns the reason why the interaction is a bot, one of the Bot*
+// reasons, or an empty string if it is not a bot.
+func (c *BotClassifier) Classify(interaction Interaction) string {
+	if userAgent := strings.ToLower(interaction.UserAgent); userAgent != "" {
+		for _, pattern := range c.UserAgents {
+			if strings.Contains(userAgent, pattern) {
+				return BotUserAgent
+			}
+		}
+	}
+
+	ip := net.ParseIP(interaction.IP)
+	if ip == nil {
+		return ""
+	}
+	for _, network := range c.Networks {
+		if network.Contains(ip) {
+			return BotNetwork
+		}
+	}
+	if len(c.ASNs) > 0 && c.GeoIP != nil {
+		asn := c.GeoIP.Lookup(interaction.IP).ASN
+		for _, datacenter := range c.ASNs {
+			if asn != 0 && asn == datacenter {
+				return BotASN
+			}
+		}
+	}
+	return ""
+}
+
+// BotPolicy is a struct that holds the classifier and the action taken for the
+// bots of every application.
+type BotPolicy struct {
+	Classifier *BotClassifier
+	// Actions are the actions of every application, the "*" one is used by the
+	// applications that are not listed. BotTag is used when neither is set.
+	Actions map[string]BotAction
+}
+
+// action returns the action for the bots of the application.
+func (p *BotPolicy) action(application string) BotAction {
+	if action, ok := p.Actions[application]; ok {
+		return action
+	}
+	if action, ok := p.Actions["*"]; ok {
+		return action
+	}
+	return BotTag
+}
+
+// classify returns the reason why the interaction is a bot and the action for
+// its application, or an empty reason if it is not a bot. It is safe to call on a nil BotPolicy.
+func (p *BotPolicy) classify(interaction Interaction) (string, BotAction) {
+	if p == nil || p.Classifier == nil {
+		return "", ""
+	}
+	reason := p.Classifier.Classify(interaction)
+	if reason == "" {
+		return "", ""
+	}
+	return reason, p.action(interaction.Application)
+}
+
+// parseBotAction parses the case insensitive name of the BotAction of the application.
+func parseBotAction(application, value string) (BotAction, error) {
+	switch action := BotAction(strings.ToLower(value)); action {
+	case BotTag, BotEphemeral, BotReject:
+		return action, nil
+	}
+	return "", fmt.Errorf("invalid bot action %q of %s, expected tag, ephemeral or reject", value, application)
+}
+
+// parseApplicationEntries parses the application=value entries separated by
+// semicolons of the setting named as param.
+// Returns the trimmed value of every application.
+func parseApplicationEntries(value, setting, expected string) (map[string]string, error) {
+	entries := map[string]string{}
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		application := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || application == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, expected application=%s", setting, entry, expected)
+		}
+		entries[application] = strings.TrimSpace(parts[1])
+	}
+	return entries, nil
+}
+
+// ParseBotUserAgents parses a comma separated list of user agent substrings.
+func ParseBotUserAgents(value string) []string {
+	patterns := []string{}
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// ParseASNs parses a comma separated list of autonomous system numbers, with or
+// without the "AS" prefix.
+func ParseASNs(value string) ([]uint, error) {
+	asns := []uint{}
+	for _, asn := range strings.Split(value, ",") {
+		if asn = strings.TrimSpace(asn); asn == "" {
+			continue
+		}
+		number, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asn), "AS"), 10, 32)
+		if err != nil || number == 0 {
+			return nil, fmt.Errorf("invalid ASN %q", asn)
+		}
+		asns = append(asns, uint(number))
+	}
+	return asns, nil
+}
@@ -0,0 +1,248 @@
+package managerid
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBotClassifier(t *testing.T) {
+	assert := assert.New(t)
+
+	geoip, err := NewGeoIP([]string{"mmdb/testdata/asn.mmdb"}, 0)
+	if !assert.NoError(err) {
+		return
+	}
+	networks, err := ParseNetworks("203.0.113.0/24, 2001:db8:1::1")
+	if !assert.NoError(err) {
+		return
+	}
+	classifier := &BotClassifier{UserAgents: DefaultBotUserAgents, Networks: networks, ASNs: []uint{20712}, GeoIP: geoip}
+
+	tests := []struct {
+		Description string
+		Interaction Interaction
+		Expected    string
+	}{
+		{
+			Description: "when the user agent is a crawler",
+			Interaction: Interaction{IP: "192.0.2.1", UserAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"},
+			Expected:    BotUserAgent,
+		},
+		{
+			Description: "when the user agent is an HTTP library",
+			Interaction: Interaction{IP: "192.0.2.1", UserAgent: "curl/7.68.0"},
+			Expected:    BotUserAgent,
+		},
+		{
+			Description: "when the IP is in a datacenter network",
+			Interaction: Interaction{IP: "203.0.113.7", UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64)"},
+			Expected:    BotNetwork,
+		},
+		{
+			Description: "when the IP is a datacenter address",
+			Interaction: Interaction{IP: "2001:db8:1::1"},
+			Expected:    BotNetwork,
+		},
+		{
+			Description: "when the IP is in a datacenter autonomous system",
+			Interaction: Interaction{IP: "81.2.69.160"},
+			Expected:    BotASN,
+		},
+		{
+			Description: "when the interaction is a browser",
+			Interaction: Interaction{IP: "2001:db8::1", UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 14_0 like Mac OS X)"},
+			Expected:    "",
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.Expected, classifier.Classify(test.Interaction), test.Description)
+	}
+
+	// ASNs are ignored without GeoIP
+	classifier.GeoIP = nil
+	assert.Equal("", classifier.Classify(Interaction{IP: "81.2.69.160"}))
+}
+
+func TestBotsConfigPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	policy, err := BotsConfig{Enabled: true, Actions: map[string]string{"*": "tag", "App": "Reject", "Other": "ephemeral"}}.Policy(nil)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(map[string]BotAction{"*": BotTag, "App": BotReject, "Other": BotEphemeral}, policy.Actions)
+	assert.Equal(BotReject, policy.action("App"))
+	assert.Equal(BotTag, policy.action("Unknown"))
+	assert.Equal(BotTag, (&BotPolicy{}).action("App"))
+
+	for _, value := range []string{"", "block"} {
+		_, err := BotsConfig{Enabled: true, Actions: map[string]string{"App": value}}.Policy(nil)
+		assert.Error(err, value)
+	}
+
+	networks, err := ParseNetworks("10.0.0.0/8,192.0.2.1")
+	assert.NoError(err)
+	assert.Equal([]*net.IPNet{
+		{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+		{IP: net.IP{192, 0, 2, 1}, Mask: net.CIDRMask(32, 32)},
+	}, networks)
+	_, err = ParseNetworks("10.0.0.0/33")
+	assert.Error(err)
+
+	asns, err := ParseASNs("AS16509, 15169")
+	assert.NoError(err)
+	assert.Equal([]uint{16509, 15169}, asns)
+	_, err = ParseASNs("ASX")
+	assert.Error(err)
+
+	assert.Equal([]string{"monitorbot", "probe"}, ParseBotUserAgents("MonitorBot, ,probe"))
+}
+
+func TestHandleSettleV2Bots(t *testing.T) {
+	assert := assert.New(t)
+
+	settled := []Interaction{}
+	querier := &FakeDb{
+		GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+			settled = append(settled, interaction)
+			ident := &Identity{}
+			ident.createIdentity(interaction, "")
+			ident.Match = MatchNewGroup
+			return ident, nil
+		},
+		GetIdentitiesFunc: func(interactions []Interaction) ([]*Identity, error) {
+			settled = append(settled, interactions...)
+			idents := []*Identity{}
+			for _, interaction := range interactions {
+				ident := &Identity{}
+				ident.createIdentity(interaction, "")
+				ident.Match = MatchNewGroup
+				idents = append(idents, ident)
+			}
+			return idents, nil
+		},
+		GroupSizesFunc: func(groups []string) (map[string]int, error) {
+			sizes := map[string]int{}
+			for _, group := range groups {
+				sizes[group] = 1
+			}
+			return sizes, nil
+		},
+	}
+	ch := ClientHandler{
+		Querier: querier,
+		Bots: &BotPolicy{
+			Classifier: &BotClassifier{UserAgents: DefaultBotUserAgents},
+			Actions:    map[string]BotAction{"Tagged": BotTag, "Ephemeral": BotEphemeral, "Rejected": BotReject},
+		},
+	}
+
+	tests := []struct {
+		Description string
+		Application string
+		UserAgent   string
+		StatusCode  int
+		Match       string
+		Bot         string
+		Settled     int
+	}{
+		{Description: "when the interaction is not a bot", Application: "Rejected", UserAgent: "Mozilla/5.0", StatusCode: http.StatusOK, Match: MatchNewGroup, Settled: 1},
+		{Description: "when the bot is tagged", Application: "Tagged", UserAgent: "curl/7.68.0", StatusCode: http.StatusOK, Match: MatchNewGroup, Bot: BotUserAgent, Settled: 1},
+		{Description: "when the bot gets an ephemeral identity", Application: "Ephemeral", UserAgent: "curl/7.68.0", StatusCode: http.StatusOK, Match: MatchEphemeral, Bot: BotUserAgent},
+		{Description: "when the bot is rejected", Application: "Rejected", UserAgent: "curl/7.68.0", StatusCode: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		settled = []Interaction{}
+		body := `{"ip": "127.0.0.1", "provider": "Prov", "application": "` + test.Application + `", "user_agent": "` + test.UserAgent + `"}`
+		w := httptest.NewRecorder()
+		ch.HandleSettleV2().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v2/id/settle", strings.NewReader(body)))
+		assert.Equal(test.StatusCode, w.Code, test.Description)
+		assert.Len(settled, test.Settled, test.Description)
+		if test.StatusCode != http.StatusOK {
+			response := errorEnvelope{}
+			if assert.NoError(json.NewDecoder(w.Body).Decode(&response)) {
+				assert.Equal(CodeBotRejected, response.Error.Code, test.Description)
+			}
+			continue
+		}
+		response := SettleResponse{}
+		if assert.NoError(json.NewDecoder(w.Body).Decode(&response), test.Description) {
+			assert.Equal(test.Match, response.Match, test.Description)
+			assert.Equal(test.Bot, response.Bot, test.Description)
+			assert.Equal(1, response.GroupSize, test.Description)
+		}
+	}
+
+	// the User-Agent header is used when the interaction has none
+	settled = []Interaction{}
+	r := httptest.NewRequest(http.MethodPost, "/v2/id/settle", strings.NewReader(`{"ip": "127.0.0.1", "provider": "Prov", "application": "Tagged"}`))
+	r.Header.Set("User-Agent", "curl/7.68.0")
+	w := httptest.NewRecorder()
+	ch.HandleSettleV2().ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	response := SettleResponse{}
+	if assert.NoError(json.NewDecoder(w.Body).Decode(&response)) {
+		assert.Equal(BotUserAgent, response.Bot)
+	}
+	if assert.Len(settled, 1) {
+		assert.Equal("curl/7.68.0", settled[0].UserAgent)
+	}
+
+	// the batch applies the policy per interaction
+	settled = []Interaction{}
+	body := `{"interactions": [
+		{"ip": "127.0.0.1", "provider": "Prov", "application": "Tagged", "user_agent": "Mozilla/5.0"},
+		{"ip": "127.0.0.1", "provider": "Prov", "application": "Ephemeral", "user_agent": "python-requests/2.25"},
+		{"ip": "127.0.0.1", "provider": "Prov", "application": "Rejected", "user_agent": "python-requests/2.25"},
+		{"ip": "127.0.0.1", "provider": "Prov", "application": "Rejected"}
+	]}`
+	r = httptest.NewRequest(http.MethodPost, "/v2/id/settle/batch", strings.NewReader(body))
+	r.Header.Set("User-Agent", "curl/7.68.0")
+	w = httptest.NewRecorder()
+	ch.HandleBatchV2().ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Len(settled, 1)
+	results := []BatchResultV2{}
+	if assert.NoError(json.NewDecoder(w.Body).Decode(&results)) && assert.Len(results, 4) {
+		// the user agent of the interaction takes precedence over the header
+		assert.Equal(MatchNewGroup, results[0].Match)
+		assert.Empty(results[0].Bot)
+		assert.Equal(MatchEphemeral, results[1].Match)
+		if assert.NotNil(results[2].Error) {
+			assert.Equal(CodeBotRejected, results[2].Error.Code)
+		}
+		if assert.NotNil(results[3].Error) {
+			assert.Equal(CodeBotRejected, results[3].Error.Code)
+		}
+	}
+}
+
+func TestHandlePixelBots(t *testing.T) {
+	assert := assert.New(t)
+
+	querier := &FakeDb{
+		GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+			t.Error("the ephemeral identity must not be resolved")
+			return nil, nil
+		},
+	}
+	ch := ClientHandler{
+		Querier: querier,
+		Bots:    &BotPolicy{Classifier: &BotClassifier{UserAgents: DefaultBotUserAgents}, Actions: map[string]BotAction{"*": BotEphemeral}},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/pixel.gif?provider=Prov&application=App", nil)
+	req.Header.Set("User-Agent", "Pingdom.com_bot_version_1.4")
+	w := httptest.NewRecorder()
+	ch.HandlePixel().ServeHTTP(w, req)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Empty(w.Result().Cookies())
+}
@@ -0,0 +1,179 @@
+package managerid
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// IPPolicy is how the IP sent in the body of a settle request is used when the
+// client IP is derived from the request.
+type IPPolicy string
+
+// Values of IPPolicy.
+const (
+	// IPPolicyPrefer uses the body IP when it is sent, and the derived IP otherwise.
+	IPPolicyPrefer IPPolicy = "prefer"
+	// IPPolicyOverride uses the derived IP, the body IP is still validated when it is sent.
+	IPPolicyOverride IPPolicy = "override"
+	// IPPolicyIgnore uses the derived IP, the body IP is not read.
+	IPPolicyIgnore IPPolicy = "ignore"
+)
+
+// ParseIPPolicy parses the name of an IPPolicy.
+func ParseIPPolicy(value string) (IPPolicy, error) {
+	switch policy := IPPolicy(value); policy {
+	case IPPolicyPrefer, IPPolicyOverride, IPPolicyIgnore:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid IP policy %q, expected %s, %s or %s", value, IPPolicyPrefer, IPPolicyOverride, IPPolicyIgnore)
+}
+
+// Forwarding headers that can be set as ClientIPResolver.TrustedProxyHeader.
+const (
+	// HeaderXForwardedFor is the X-Forwarded-For header, the default.
+	HeaderXForwardedFor = "X-Forwarded-For"
+	// HeaderForwarded is the RFC 7239 Forwarded header.
+	HeaderForwarded = "Forwarded"
+	// HeaderXRealIP is the X-Real-IP header.
+	HeaderXRealIP = "X-Real-IP"
+)
+
+// ParseTrustedProxyHeader parses the case insensitive name of a forwarding header.
+func ParseTrustedProxyHeader(value string) (string, error) {
+	for _, header := range []string{HeaderXForwardedFor, HeaderForwarded, HeaderXRealIP} {
+		if strings.EqualFold(value, header) {
+			return header, nil
+		}
+	}
+	return "", fmt.Errorf("invalid trusted proxy header %q, expected %s, %s or %s", value, HeaderXForwardedFor, HeaderForwarded, HeaderXRealIP)
+}
+
+// ClientIPResolver is a struct used to derive the IP of the client from the
+// connection and, when it comes from a trusted proxy, the forwarding header it sets.
+type ClientIPResolver struct {
+	// TrustedProxies are the networks of the proxies whose headers are trusted.
+	TrustedProxies []*net.IPNet
+	// TrustedProxyHeader is the only forwarding header read, the one the trusted
+	// proxies set, HeaderXForwardedFor when it is not set. The other ones may
+	// come from the client and are ignored.
+	TrustedProxyHeader string
+	// Policy is how the body IP is used, IPPolicyPrefer when it is not set.
+	Policy IPPolicy
+}
+
+// ClientIP returns the IP of the client of the request.
+// When the connection comes from a trusted proxy, the addresses of the
+// TrustedProxyHeader are walked from the nearest to the farthest hop, and the
+// first one that is not a trusted proxy is the client.
+func (c *ClientIPResolver) ClientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !c.trusted(ip) {
+		return ip
+	}
+
+	header := c.TrustedProxyHeader
+	if header == "" {
+		header = HeaderXForwardedFor
+	}
+	hops := forwardedHops(r, header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// unknown or obfuscated addresses can not be walked
+			break
+		}
+		ip = hops[i]
+		if !c.trusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// interactionIP returns the IP to settle the interaction of the request with,
+// applying the policy to the body IP.
+// An invalid body IP is returned to be rejected by the validation.
+func (c *ClientIPResolver) interactionIP(r *http.Request, body string) string {
+	switch c.Policy {
+	case IPPolicyIgnore:
+		return c.ClientIP(r)
+	case IPPolicyOverride:
+		if body != "" && net.ParseIP(body) == nil {
+			return body
+		}
+		return c.ClientIP(r)
+	default:
+		if body != "" {
+			return body
+		}
+		return c.ClientIP(r)
+	}
+}
+
+// trusted checks if the IP belongs to a trusted proxy.
+func (c *ClientIPResolver) trusted(value string) bool {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return false
+	}
+	for _, network := range c.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHops returns the addresses of the forwarding header of the request,
+// from the farthest to the nearest hop.
+func forwardedHops(r *http.Request, header string) []string {
+	hops := []string{}
+	values := r.Header.Values(header)
+	switch header {
+	case HeaderForwarded:
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(parts) == 2 && strings.EqualFold(parts[0], "for") {
+					hops = append(hops, forwardedNode(parts[1]))
+				}
+			}
+		}
+	case HeaderXRealIP:
+		if value := strings.TrimSpace(r.Header.Get(header)); value != "" {
+			hops = append(hops, value)
+		}
+	default:
+		if len(values) > 0 {
+			for _, hop := range strings.Split(strings.Join(values, ","), ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedNode returns the IP of a node of the Forwarded header, without the
+// quotes, the brackets of IPv6 addresses and the port.
+func forwardedNode(node string) string {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+// clientIP returns the IP of the client of the request, derived as configured
+// in ClientHandler.ClientIP, or the IP of the connection if it is not set.
+func (ch *ClientHandler) clientIP(r *http.Request) string {
+	if ch.ClientIP == nil {
+		return remoteIP(r)
+	}
+	return ch.ClientIP.ClientIP(r)
+}
@@ -0,0 +1,197 @@
+package managerid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	assert := assert.New(t)
+
+	proxies, err := ParseNetworks("10.0.0.0/8, 192.0.2.1,2001:db8::/32")
+	if !assert.NoError(err) {
+		return
+	}
+	tests := []struct {
+		Description string
+		ProxyHeader string
+		RemoteAddr  string
+		Header      http.Header
+		Expected    string
+	}{
+		{
+			Description: "when the connection is not a trusted proxy its headers are ignored",
+			RemoteAddr:  "198.51.100.7:4000",
+			Header:      http.Header{"X-Forwarded-For": {"203.0.113.9"}},
+			Expected:    "198.51.100.7",
+		},
+		{
+			Description: "when a trusted proxy sends X-Forwarded-For",
+			RemoteAddr:  "10.1.2.3:4000",
+			Header:      http.Header{"X-Forwarded-For": {"203.0.113.9"}},
+			Expected:    "203.0.113.9",
+		},
+		{
+			Description: "when the client spoofs X-Forwarded-For the nearest untrusted hop is used",
+			RemoteAddr:  "10.1.2.3:4000",
+			Header:      http.Header{"X-Forwarded-For": {"1.1.1.1, 203.0.113.9", "192.0.2.1"}},
+			Expected:    "203.0.113.9",
+		},
+		{
+			Description: "when every hop is trusted the farthest is used",
+			RemoteAddr:  "10.1.2.3:4000",
+			Header:      http.Header{"X-Forwarded-For": {"10.0.0.1, 10.0.0.2"}},
+			Expected:    "10.0.0.1",
+		},
+		{
+			Description: "when a hop is not an IP the walk stops",
+			RemoteAddr:  "10.1.2.3:4000",
+			Header:      http.Header{"X-Forwarded-For": {"203.0.113.9, garbage, 10.0.0.2"}},
+			Expected:    "10.0.0.2",
+		},
+		{
+			Description: "when the client sends Forwarded through a proxy that sets X-Forwarded-For",
+			RemoteAddr:  "10.1.2.3:4000",
+			Header: http.Header{
+				"Forwarded":       {"for=1.2.3.4"},
+				"X-Forwarded-For": {"203.0.113.9"},
+			},
+			Expected: "203.0.113.9",
+		},
+		{
+			Description: "when the client sends X-Real-IP through a proxy that sets nothing",
+			RemoteAddr:  "10.1.2.3:4000",
+			Header:      http.Header{"X-Real-Ip": {"1.2.3.4"}},
+			Expected:    "10.1.2.3",
+		},
+		{
+			Description: "when a trusted proxy sends X-Real-IP",
+			ProxyHeader: HeaderXRealIP,
+			RemoteAddr:  "10.1.2.3:4000",
+			Header:      http.Header{"X-Real-Ip": {"203.0.113.9"}, "X-Forwarded-For": {"1.2.3.4"}},
+			Expected:    "203.0.113.9",
+		},
+		{
+			Description: "when a trusted proxy sends Forwarded",
+			ProxyHeader: HeaderForwarded,
+			RemoteAddr:  "[2001:db8::1]:4000",
+			Header: http.Header{
+				"Forwarded":       {`for="[2001:db8:cafe::17]:4711";proto=https, For=198.51.100.7:80;by=10.0.0.1`},
+				"X-Forwarded-For": {"203.0.113.9"},
+			},
+			Expected: "198.51.100.7",
+		},
+		{
+			Description: "when Forwarded holds an obfuscated node",
+			ProxyHeader: HeaderForwarded,
+			RemoteAddr:  "10.1.2.3:4000",
+			Header:      http.Header{"Forwarded": {"for=203.0.113.9, for=_hidden, for=10.0.0.2"}},
+			Expected:    "10.0.0.2",
+		},
+		{
+			Description: "when a trusted proxy sends no headers",
+			RemoteAddr:  "10.1.2.3:4000",
+			Expected:    "10.1.2.3",
+		},
+	}
+
+	for _, test := range tests {
+		resolver := &ClientIPResolver{TrustedProxies: proxies, TrustedProxyHeader: test.ProxyHeader}
+		req := httptest.NewRequest(http.MethodPost, "/id/settle", nil)
+		req.RemoteAddr = test.RemoteAddr
+		req.Header = test.Header
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		assert.Equal(test.Expected, resolver.ClientIP(req), test.Description)
+	}
+
+	header, err := ParseTrustedProxyHeader("x-real-ip")
+	assert.NoError(err)
+	assert.Equal(HeaderXRealIP, header)
+	_, err = ParseTrustedProxyHeader("X-Client-IP")
+	assert.Error(err)
+
+	_, err = ParseNetworks("10.0.0.0/8,ingress")
+	assert.Error(err)
+}
+
+func TestHandleFunctionClientIP(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		Description string
+		Policy      IPPolicy
+		Body        string
+		StatusCode  int
+		Expected    string
+	}{
+		{
+			Description: "prefer uses the body IP",
+			Policy:      IPPolicyPrefer,
+			Body:        `{"ip": "198.51.100.7", "provider": "Prov", "application": "App"}`,
+			StatusCode:  http.StatusOK,
+			Expected:    "198.51.100.7",
+		},
+		{
+			Description: "prefer derives the IP when the body has none",
+			Policy:      IPPolicyPrefer,
+			Body:        `{"provider": "Prov", "application": "App"}`,
+			StatusCode:  http.StatusOK,
+			Expected:    "203.0.113.9",
+		},
+		{
+			Description: "override replaces the body IP",
+			Policy:      IPPolicyOverride,
+			Body:        `{"ip": "198.51.100.7", "provider": "Prov", "application": "App"}`,
+			StatusCode:  http.StatusOK,
+			Expected:    "203.0.113.9",
+		},
+		{
+			Description: "override validates the body IP",
+			Policy:      IPPolicyOverride,
+			Body:        `{"ip": "garbage", "provider": "Prov", "application": "App"}`,
+			StatusCode:  http.StatusUnprocessableEntity,
+		},
+		{
+			Description: "ignore does not read the body IP",
+			Policy:      IPPolicyIgnore,
+			Body:        `{"ip": "garbage", "provider": "Prov", "application": "App"}`,
+			StatusCode:  http.StatusOK,
+			Expected:    "203.0.113.9",
+		},
+	}
+
+	proxies, _ := ParseNetworks("10.0.0.0/8")
+	for _, test := range tests {
+		settled := ""
+		ch := ClientHandler{
+			Querier: &FakeDb{
+				GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+					settled = interaction.IP
+					return &Identity{PassportID: "id", PassportIDGrp: "group"}, nil
+				},
+			},
+			ClientIP: &ClientIPResolver{TrustedProxies: proxies, Policy: test.Policy},
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/id/settle", strings.NewReader(test.Body))
+		req.RemoteAddr = "10.1.2.3:4000"
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		w := httptest.NewRecorder()
+		ch.HandleFunction().ServeHTTP(w, req)
+
+		assert.Equal(test.StatusCode, w.Code, test.Description)
+		assert.Equal(test.Expected, settled, test.Description)
+	}
+
+	policy, err := ParseIPPolicy("override")
+	assert.NoError(err)
+	assert.Equal(IPPolicyOverride, policy)
+	_, err = ParseIPPolicy("body")
+	assert.Error(err)
+}
@@ -0,0 +1,652 @@
+package managerid
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/josedelrio85/managerid/pkg/passport"
+	"gopkg.in/yaml.v3"
+)
+
+// Default ports of the Config.
+const (
+	DefaultHTTPPort     = 4000
+	DefaultGRPCPort     = 4001
+	DefaultDatabasePort = 3306
+)
+
+// redacted replaces the secrets of Config.Redacted.
+const redacted = "REDACTED"
+
+// Config is a struct that holds the settings of the service, loaded with
+// LoadConfig from a YAML file and the ENV VARS that override it.
+type Config struct {
+	Server    ServerConfig        `yaml:"server"`
+	Database  DatabaseConfig      `yaml:"database"`
+	Limits    LimitsConfig        `yaml:"limits"`
+	GeoIP     GeoIPConfig         `yaml:"geoip"`
+	Redirects map[string][]string `yaml:"redirect_allowlist"`
+	ClientIP  ClientIPConfig      `yaml:"client_ip"`
+	Cookie    CookieConfig        `yaml:"cookie"`
+	Bots      BotsConfig          `yaml:"bots"`
+	Internal  InternalConfig      `yaml:"internal"`
+	RateLimit RateLimitConfig     `yaml:"rate_limit"`
+	Auth      AuthConfig          `yaml:"auth"`
+	Signature SignatureConfig     `yaml:"signature"`
+	Tokens    TokensConfig        `yaml:"tokens"`
+	// CORS are the policies of every application, see NewCORS.
+	CORS map[string]CORSPolicy `yaml:"cors"`
+}
+
+// ServerConfig holds the ports the service listens on.
+type ServerConfig struct {
+	Port     int `yaml:"port"`
+	GRPCPort int `yaml:"grpc_port"`
+}
+
+// DatabaseConfig holds the settings of the MySQL connection.
+type DatabaseConfig struct {
+	Host      string `yaml:"host"`
+	Port      int    `yaml:"port"`
+	User      string `yaml:"user"`
+	Password  string `yaml:"password"`
+	Name      string `yaml:"name"`
+	Charset   string `yaml:"charset"`
+	ParseTime bool   `yaml:"parse_time"`
+	// Loc is the time zone of the dates, a name of the IANA database, Local or UTC.
+	Loc string `yaml:"loc"`
+}
+
+// LimitsConfig holds the limits of the requests and the buffers.
+type LimitsConfig struct {
+	MaxBatchSize          int           `yaml:"max_batch_size"`
+	MaxBodySize           int64         `yaml:"max_body_size"`
+	StrictDecoding        bool          `yaml:"strict_decoding"`
+	IdempotencyTTL        time.Duration `yaml:"idempotency_ttl"`
+	IdempotencyMaxEntries int           `yaml:"idempotency_max_entries"`
+	EventsBuffer          int           `yaml:"events_buffer"`
+}
+
+// GeoIPConfig holds the MMDB files of the GeoIP lookups.
+type GeoIPConfig struct {
+	Databases      []string      `yaml:"databases"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// ClientIPConfig holds the settings of the ClientIPResolver, enabled when it has
+// trusted proxies or a policy.
+type ClientIPConfig struct {
+	TrustedProxies     []string `yaml:"trusted_proxies"`
+	TrustedProxyHeader string   `yaml:"trusted_proxy_header"`
+	Policy             string   `yaml:"policy"`
+}
+
+// CookieConfig holds the settings of the SignedCookie, enabled when it has a secret.
+type CookieConfig struct {
+	Secret string `yaml:"secret"`
+	Name   string `yaml:"name"`
+	Domain string `yaml:"domain"`
+}
+
+// BotsConfig holds the settings of the BotPolicy.
+type BotsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Actions are the actions of every application, see BotPolicy.
+	Actions  map[string]string `yaml:"actions"`
+	Networks []string          `yaml:"networks"`
+	ASNs     []string          `yaml:"asns"`
+	// UserAgents are added to DefaultBotUserAgents.
+	UserAgents []string `yaml:"user_agents"`
+}
+
+// InternalConfig holds the settings of the InternalPolicy, enabled when it has networks.
+type InternalConfig struct {
+	Networks map[string][]string `yaml:"networks"`
+	Actions  map[string]string   `yaml:"actions"`
+}
+
+// RateLimitConfig holds the limits of the RateLimiter, written as in
+// ParseRateLimit, enabled when any is set.
+type RateLimitConfig struct {
+	IP           string            `yaml:"ip"`
+	Applications map[string]string `yaml:"applications"`
+}
+
+// AuthConfig holds the settings of the API keys.
+type AuthConfig struct {
+	RequireAPIKey bool   `yaml:"require_api_key"`
+	AdminToken    string `yaml:"admin_token"`
+}
+
+// SignatureConfig holds the settings of the SignatureVerifier, enabled when it
+// has clients or it is required.
+type SignatureConfig struct {
+	Required bool                `yaml:"required"`
+	Clients  map[string][]string `yaml:"clients"`
+	Window   time.Duration       `yaml:"window"`
+}
+
+// TokensConfig holds the settings of the passport tokens signer, enabled when it
+// has a signing key, see ParseTokenSigner.
+type TokensConfig struct {
+	Algorithm     string            `yaml:"algorithm"`
+	SigningKey    string            `yaml:"signing_key"`
+	KeyID         string            `yaml:"key_id"`
+	PublishedKeys map[string]string `yaml:"published_keys"`
+}
+
+// ConfigError is returned when a Config is not valid.
+type ConfigError struct {
+	// Problems are every problem found.
+	Problems []string
+}
+
+// Error returns every problem found.
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(e.Problems, "; "))
+}
+
+// DefaultConfig returns a Config with the default settings.
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{Port: DefaultHTTPPort, GRPCPort: DefaultGRPCPort},
+		Database: DatabaseConfig{
+			Port:      DefaultDatabasePort,
+			Charset:   "utf8",
+			ParseTime: true,
+			Loc:       "Local",
+		},
+		Limits: LimitsConfig{
+			MaxBatchSize:          DefaultMaxBatchSize,
+			MaxBodySize:           DefaultMaxBodySize,
+			IdempotencyTTL:        DefaultIdempotencyTTL,
+			IdempotencyMaxEntries: DefaultIdempotencyMaxEntries,
+			EventsBuffer:          DefaultEventsBuffer,
+		},
+		GeoIP:     GeoIPConfig{ReloadInterval: DefaultGeoIPReloadInterval},
+		Cookie:    CookieConfig{Name: DefaultSignedCookieName},
+		Signature: SignatureConfig{Window: DefaultSignatureWindow},
+		CORS:      map[string]CORSPolicy{"*": {Origins: []string{"*"}}},
+	}
+}
+
+// LoadConfig loads the Config of the YAML file passed as param over the
+// defaults, if the path is not empty, and overrides it with the ENV VARS found
+// by lookup, like os.LookupEnv.
+// Returns an error if the file can not be read, or the loaded Config and a
+// *ConfigError with every problem found if it is not valid.
+func LoadConfig(path string, lookup func(string) (string, bool)) (*Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the configuration file: %w", err)
+		}
+		// the decoder merges maps, so the default policies only apply when the
+		// file sets none
+		cors := c.CORS
+		c.CORS = nil
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error parsing the configuration file %s: %w", path, err)
+		}
+		if c.CORS == nil {
+			c.CORS = cors
+		}
+	}
+
+	problems := []string{}
+	for _, env := range configEnvs {
+		if value, ok := lookup(env.name); ok {
+			if err := env.set(c, value); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid %s: %s", env.name, err))
+			}
+		}
+	}
+	if err := c.Validate(); err != nil {
+		problems = append(problems, err.(*ConfigError).Problems...)
+	}
+	if len(problems) > 0 {
+		return c, &ConfigError{Problems: problems}
+	}
+	return c, nil
+}
+
+// configEnv is an ENV VAR that overrides a setting of the Config.
+type configEnv struct {
+	name string
+	set  func(c *Config, value string) error
+}
+
+// configEnvs are the ENV VARS of the settings, the lists are comma separated
+// and the maps are written as key=value entries separated by semicolons.
+var configEnvs = []configEnv{
+	{"HTTP_PORT", func(c *Config, value string) error { return setInt(&c.Server.Port, value) }},
+	{"GRPC_PORT", func(c *Config, value string) error { return setInt(&c.Server.GRPCPort, value) }},
+	{"DB_HOST", func(c *Config, value string) error { c.Database.Host = value; return nil }},
+	{"DB_PORT", func(c *Config, value string) error { return setInt(&c.Database.Port, value) }},
+	{"DB_USER", func(c *Config, value string) error { c.Database.User = value; return nil }},
+	{"DB_PASS", func(c *Config, value string) error { c.Database.Password = value; return nil }},
+	{"DB_NAME", func(c *Config, value string) error { c.Database.Name = value; return nil }},
+	{"DB_CHARSET", func(c *Config, value string) error { c.Database.Charset = value; return nil }},
+	{"DB_PARSE_TIME", func(c *Config, value string) error { return setBool(&c.Database.ParseTime, value) }},
+	{"DB_LOC", func(c *Config, value string) error { c.Database.Loc = value; return nil }},
+	{"BATCH_MAX_SIZE", func(c *Config, value string) error { return setInt(&c.Limits.MaxBatchSize, value) }},
+	{"MAX_BODY_SIZE", func(c *Config, value string) error {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number")
+		}
+		c.Limits.MaxBodySize = size
+		return nil
+	}},
+	{"STRICT_DECODING", func(c *Config, value string) error { return setBool(&c.Limits.StrictDecoding, value) }},
+	{"IDEMPOTENCY_TTL", func(c *Config, value string) error { return setDuration(&c.Limits.IdempotencyTTL, value) }},
+	{"IDEMPOTENCY_MAX_ENTRIES", func(c *Config, value string) error { return setInt(&c.Limits.IdempotencyMaxEntries, value) }},
+	{"EVENTS_BUFFER", func(c *Config, value string) error { return setInt(&c.Limits.EventsBuffer, value) }},
+	{"GEOIP_DATABASES", func(c *Config, value string) error { c.GeoIP.Databases = splitList(value); return nil }},
+	{"GEOIP_RELOAD_INTERVAL", func(c *Config, value string) error { return setDuration(&c.GeoIP.ReloadInterval, value) }},
+	{"REDIRECT_ALLOWLIST", func(c *Config, value string) error {
+		allowlist, err := ParseRedirectAllowlist(value)
+		c.Redirects = allowlist
+		return err
+	}},
+	{"TRUSTED_PROXIES", func(c *Config, value string) error { c.ClientIP.TrustedProxies = splitList(value); return nil }},
+	{"TRUSTED_PROXY_HEADER", func(c *Config, value string) error { c.ClientIP.TrustedProxyHeader = value; return nil }},
+	{"CLIENT_IP_POLICY", func(c *Config, value string) error { c.ClientIP.Policy = value; return nil }},
+	{"COOKIE_SECRET", func(c *Config, value string) error { c.Cookie.Secret = value; return nil }},
+	{"COOKIE_NAME", func(c *Config, value string) error { c.Cookie.Name = value; return nil }},
+	{"COOKIE_DOMAIN", func(c *Config, value string) error { c.Cookie.Domain = value; return nil }},
+	{"BOT_POLICY", func(c *Config, value string) (err error) {
+		c.Bots.Enabled = true
+		c.Bots.Actions, err = parseApplicationEntries(value, "bot policy", "action")
+		return err
+	}},
+	{"BOT_NETWORKS", func(c *Config, value string) error { c.Bots.Networks = splitList(value); return nil }},
+	{"BOT_ASNS", func(c *Config, value string) error { c.Bots.ASNs = splitList(value); return nil }},
+	{"BOT_USER_AGENTS", func(c *Config, value string) error { c.Bots.UserAgents = splitList(value); return nil }},
+	{"INTERNAL_NETWORKS", func(c *Config, value string) error {
+		entries, err := parseApplicationEntries(value, "internal networks", "cidr,cidr")
+		c.Internal.Networks = map[string][]string{}
+		for application, entry := range entries {
+			c.Internal.Networks[application] = splitList(entry)
+		}
+		return err
+	}},
+	{"INTERNAL_POLICY", func(c *Config, value string) (err error) {
+		c.Internal.Actions, err = parseApplicationEntries(value, "internal policy", "action")
+		return err
+	}},
+	{"RATE_LIMIT_IP", func(c *Config, value string) error { c.RateLimit.IP = value; return nil }},
+	{"RATE_LIMIT_APPLICATIONS", func(c *Config, value string) (err error) {
+		c.RateLimit.Applications, err = parseApplicationEntries(value, "application rate limits", "limit")
+		return err
+	}},
+	{"REQUIRE_API_KEY", func(c *Config, value string) error { return setBool(&c.Auth.RequireAPIKey, value) }},
+	{"ADMIN_TOKEN", func(c *Config, value string) error { c.Auth.AdminToken = value; return nil }},
+	{"REQUIRE_SIGNATURE", func(c *Config, value string) error { return setBool(&c.Signature.Required, value) }},
+	{"SIGNING_CLIENTS", func(c *Config, value string) (err error) {
+		c.Signature.Clients, err = ParseSigningClients(value)
+		return err
+	}},
+	{"SIGNATURE_WINDOW", func(c *Config, value string) error { return setDuration(&c.Signature.Window, value) }},
+	{"TOKEN_ALGORITHM", func(c *Config, value string) error { c.Tokens.Algorithm = value; return nil }},
+	{"TOKEN_SIGNING_KEY", func(c *Config, value string) error { c.Tokens.SigningKey = value; return nil }},
+	{"TOKEN_KEY_ID", func(c *Config, value string) error { c.Tokens.KeyID = value; return nil }},
+	{"TOKEN_PUBLISHED_KEYS", func(c *Config, value string) (err error) {
+		c.Tokens.PublishedKeys, err = parseApplicationEntries(value, "published keys", "key")
+		return err
+	}},
+	// the origins set the applications of the other CORS settings
+	{"CORS_ORIGINS", func(c *Config, value string) (err error) {
+		c.CORS, err = ParseCORSPolicies(value, "", "", "", "")
+		return err
+	}},
+	{"CORS_METHODS", func(c *Config, value string) error { return applyCORSSettings(c.CORS, value, "", "", "") }},
+	{"CORS_HEADERS", func(c *Config, value string) error { return applyCORSSettings(c.CORS, "", value, "", "") }},
+	{"CORS_CREDENTIALS", func(c *Config, value string) error { return applyCORSSettings(c.CORS, "", "", value, "") }},
+	{"CORS_MAX_AGE", func(c *Config, value string) error { return applyCORSSettings(c.CORS, "", "", "", value) }},
+}
+
+// setInt parses the value as an int of the field, left as is if it is not valid.
+func setInt(field *int, value string) error {
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("expected a number")
+	}
+	*field = parsed
+	return nil
+}
+
+// setBool parses the value as a bool of the field, left as is if it is not valid.
+func setBool(field *bool, value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("expected true or false")
+	}
+	*field = parsed
+	return nil
+}
+
+// setDuration parses the value as a duration of the field, left as is if it is not valid.
+func setDuration(field *time.Duration, value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("expected a duration like 30s or 1h")
+	}
+	*field = parsed
+	return nil
+}
+
+// Validate checks every setting of the Config.
+// Returns a *ConfigError with every problem found, or nil if it is valid.
+func (c *Config) Validate() error {
+	problems := []string{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	checkErr := func(section string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", section, err))
+		}
+	}
+
+	check(validPort(c.Server.Port), "server.port must be between 1 and 65535")
+	check(validPort(c.Server.GRPCPort), "server.grpc_port must be between 1 and 65535")
+	check(c.Server.Port != c.Server.GRPCPort, "server.port and server.grpc_port must be different")
+
+	check(c.Database.Host != "", "database.host is required")
+	check(validPort(c.Database.Port), "database.port must be between 1 and 65535")
+	check(c.Database.User != "", "database.user is required")
+	check(c.Database.Name != "", "database.name is required")
+	check(c.Database.Charset != "", "database.charset is required")
+	if _, err := time.LoadLocation(c.Database.Loc); err != nil || c.Database.Loc == "" {
+		problems = append(problems, fmt.Sprintf("database.loc %q is not a known time zone", c.Database.Loc))
+	}
+
+	check(c.Limits.MaxBatchSize > 0, "limits.max_batch_size must be positive")
+	check(c.Limits.MaxBodySize > 0, "limits.max_body_size must be positive")
+	check(c.Limits.IdempotencyTTL > 0, "limits.idempotency_ttl must be positive")
+	check(c.Limits.IdempotencyMaxEntries > 0, "limits.idempotency_max_entries must be positive")
+	check(c.Limits.EventsBuffer >= 0, "limits.events_buffer can not be negative")
+
+	check(c.GeoIP.ReloadInterval >= 0, "geoip.reload_interval can not be negative")
+	for _, path := range c.GeoIP.Databases {
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Sprintf("geoip: database %s can not be read", path))
+		}
+	}
+
+	_, err := c.ClientIP.Resolver()
+	checkErr("client_ip", err)
+	check(c.Cookie.Secret == "" || c.Cookie.Name != "", "cookie.name is required with a secret")
+	_, err = c.Cookie.SignedCookie()
+	checkErr("cookie", err)
+	_, err = c.Bots.Policy(nil)
+	checkErr("bots", err)
+	_, err = c.Internal.Policy()
+	checkErr("internal", err)
+	_, err = c.RateLimit.Limiter()
+	checkErr("rate_limit", err)
+	check(c.Signature.Window > 0, "signature.window must be positive")
+	for client, secrets := range c.Signature.Clients {
+		check(len(secrets) > 0, "signature.clients: %s has no secret", client)
+	}
+	_, err = c.Signature.Verifier()
+	checkErr("signature", err)
+	_, err = c.Tokens.Signer()
+	checkErr("tokens", err)
+	_, err = NewCORS(c.CORS)
+	checkErr("cors", err)
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// validPort checks if the port is a valid TCP port.
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// Redacted returns a copy of the Config with the secrets replaced, so it can be printed.
+func (c *Config) Redacted() *Config {
+	copied := *c
+	redact := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return redacted
+	}
+	copied.Database.Password = redact(c.Database.Password)
+	copied.Cookie.Secret = redact(c.Cookie.Secret)
+	copied.Auth.AdminToken = redact(c.Auth.AdminToken)
+	copied.Tokens.SigningKey = redact(c.Tokens.SigningKey)
+	if c.Signature.Clients != nil {
+		copied.Signature.Clients = map[string][]string{}
+		for client, secrets := range c.Signature.Clients {
+			for _, secret := range secrets {
+				copied.Signature.Clients[client] = append(copied.Signature.Clients[client], redact(secret))
+			}
+		}
+	}
+	return &copied
+}
+
+// ClientHandler returns a ClientHandler with the settings of the Config, the
+// Querier and the EventBus passed as param. The GeoIP looks up the autonomous
+// systems of the bot classifier.
+func (c *Config) ClientHandler(querier Querier, events *EventBus, geoip *GeoIP) (*ClientHandler, error) {
+	ch := &ClientHandler{
+		Querier:        querier,
+		MaxBatchSize:   c.Limits.MaxBatchSize,
+		MaxBodySize:    c.Limits.MaxBodySize,
+		StrictDecoding: c.Limits.StrictDecoding,
+		Idempotency:    NewMemoryIdempotencyStore(c.Limits.IdempotencyTTL, c.Limits.IdempotencyMaxEntries),
+		Events:         events,
+		Redirects:      c.RedirectAllowlist(),
+		RequireAPIKey:  c.Auth.RequireAPIKey,
+		AdminToken:     c.Auth.AdminToken,
+	}
+
+	var err error
+	if ch.ClientIP, err = c.ClientIP.Resolver(); err != nil {
+		return nil, err
+	}
+	if ch.Cookie, err = c.Cookie.SignedCookie(); err != nil {
+		return nil, err
+	}
+	if ch.Bots, err = c.Bots.Policy(geoip); err != nil {
+		return nil, err
+	}
+	if ch.Internal, err = c.Internal.Policy(); err != nil {
+		return nil, err
+	}
+	if ch.RateLimits, err = c.RateLimit.Limiter(); err != nil {
+		return nil, err
+	}
+	if ch.Signatures, err = c.Signature.Verifier(); err != nil {
+		return nil, err
+	}
+	if ch.Tokens, err = c.Tokens.Signer(); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// Database returns the Database of the settings.
+func (c DatabaseConfig) Database() *Database {
+	return &Database{
+		Host:      c.Host,
+		Port:      int64(c.Port),
+		User:      c.User,
+		Password:  c.Password,
+		DBName:    c.Name,
+		Charset:   c.Charset,
+		ParseTime: strconv.FormatBool(c.ParseTime),
+		Loc:       c.Loc,
+	}
+}
+
+// GeoIP loads the databases of the settings.
+// Returns nil if no databases are set.
+func (c GeoIPConfig) GeoIP() (*GeoIP, error) {
+	if len(c.Databases) == 0 {
+		return nil, nil
+	}
+	return NewGeoIP(c.Databases, c.ReloadInterval)
+}
+
+// RedirectAllowlist returns the RedirectAllowlist of the settings, with the
+// hosts in lower case.
+func (c *Config) RedirectAllowlist() RedirectAllowlist {
+	allowlist := RedirectAllowlist{}
+	for application, hosts := range c.Redirects {
+		for _, host := range hosts {
+			allowlist[application] = append(allowlist[application], strings.ToLower(host))
+		}
+	}
+	return allowlist
+}
+
+// Resolver returns the ClientIPResolver of the settings, or nil if it is not enabled.
+func (c ClientIPConfig) Resolver() (*ClientIPResolver, error) {
+	if len(c.TrustedProxies) == 0 && c.Policy == "" {
+		return nil, nil
+	}
+	proxies, err := ParseNetworks(strings.Join(c.TrustedProxies, ","))
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	header := HeaderXForwardedFor
+	if c.TrustedProxyHeader != "" {
+		if header, err = ParseTrustedProxyHeader(c.TrustedProxyHeader); err != nil {
+			return nil, err
+		}
+	}
+	policy := IPPolicyPrefer
+	if c.Policy != "" {
+		if policy, err = ParseIPPolicy(c.Policy); err != nil {
+			return nil, err
+		}
+	}
+	return &ClientIPResolver{TrustedProxies: proxies, TrustedProxyHeader: header, Policy: policy}, nil
+}
+
+// SignedCookie returns the SignedCookie of the settings, or nil if it is not enabled.
+// Returns an error if the secret is shorter than minCookieSecret.
+func (c CookieConfig) SignedCookie() (*SignedCookie, error) {
+	if c.Secret == "" {
+		return nil, nil
+	}
+	if len(c.Secret) < minCookieSecret {
+		return nil, fmt.Errorf("invalid secret of %d bytes, expected at least %d", len(c.Secret), minCookieSecret)
+	}
+	return &SignedCookie{Name: c.Name, Domain: c.Domain, Secret: []byte(c.Secret)}, nil
+}
+
+// Policy returns the BotPolicy of the settings, whose classifier looks up the
+// ASNs with the GeoIP passed as param, or nil if it is not enabled.
+func (c BotsConfig) Policy(geoip *GeoIP) (*BotPolicy, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	actions := map[string]BotAction{}
+	for application, value := range c.Actions {
+		action, err := parseBotAction(application, value)
+		if err != nil {
+			return nil, err
+		}
+		actions[application] = action
+	}
+	networks, err := ParseNetworks(strings.Join(c.Networks, ","))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bot networks: %w", err)
+	}
+	asns, err := ParseASNs(strings.Join(c.ASNs, ","))
+	if err != nil {
+		return nil, err
+	}
+	userAgents := append(append([]string{}, DefaultBotUserAgents...), ParseBotUserAgents(strings.Join(c.UserAgents, ","))...)
+	return &BotPolicy{
+		Classifier: &BotClassifier{UserAgents: userAgents, Networks: networks, ASNs: asns, GeoIP: geoip},
+		Actions:    actions,
+	}, nil
+}
+
+// Policy returns the InternalPolicy of the settings, or nil if it is not enabled.
+func (c InternalConfig) Policy() (*InternalPolicy, error) {
+	if len(c.Networks) == 0 {
+		return nil, nil
+	}
+	networks := map[string][]*net.IPNet{}
+	for application, cidrs := range c.Networks {
+		parsed, err := ParseNetworks(strings.Join(cidrs, ","))
+		if err != nil {
+			return nil, fmt.Errorf("invalid internal networks of %s: %w", application, err)
+		}
+		networks[application] = parsed
+	}
+	actions := map[string]InternalAction{}
+	for application, value := range c.Actions {
+		action, err := parseInternalAction(application, value)
+		if err != nil {
+			return nil, err
+		}
+		actions[application] = action
+	}
+	return &InternalPolicy{Networks: networks, Actions: actions}, nil
+}
+
+// Limiter returns the RateLimiter of the settings, or nil if no limit is set.
+func (c RateLimitConfig) Limiter() (*RateLimiter, error) {
+	if c.IP == "" && len(c.Applications) == 0 {
+		return nil, nil
+	}
+	ip := RateLimit{}
+	if c.IP != "" {
+		var err error
+		if ip, err = ParseRateLimit(c.IP); err != nil {
+			return nil, err
+		}
+	}
+	applications := map[string]RateLimit{}
+	for application, value := range c.Applications {
+		limit, err := ParseRateLimit(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit of %s: %w", application, err)
+		}
+		applications[application] = limit
+	}
+	return NewRateLimiter(ip, applications), nil
+}
+
+// Verifier returns the SignatureVerifier of the settings, or nil if it is not enabled.
+func (c SignatureConfig) Verifier() (*SignatureVerifier, error) {
+	if len(c.Clients) == 0 && !c.Required {
+		return nil, nil
+	}
+	if len(c.Clients) == 0 {
+		return nil, fmt.Errorf("required signatures need clients")
+	}
+	return NewSignatureVerifier(c.Clients, c.Window, c.Required), nil
+}
+
+// Signer returns the passport tokens signer of the settings, or nil if it is not enabled.
+func (c TokensConfig) Signer() (*passport.Signer, error) {
+	if c.SigningKey == "" {
+		return nil, nil
+	}
+	return NewTokenSigner(c.Algorithm, c.SigningKey, c.KeyID, c.PublishedKeys)
+}
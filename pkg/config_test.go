@@ -0,0 +1,219 @@
+package managerid
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+// envLookup returns a lookup function of the ENV VARS passed as param.
+func envLookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+// writeConfig writes the YAML configuration to a temporary file.
+// Returns the path of the file and a function that removes it.
+func writeConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	path, remove := writeConfig(t, `
+server:
+  port: 8080
+database:
+  host: db
+  user: managerid
+  password: s3cr3t
+  name: managerid
+  loc: UTC
+limits:
+  idempotency_ttl: 12h
+bots:
+  enabled: true
+  actions:
+    "*": reject
+  asns: [AS16509, 15169]
+cors:
+  App:
+    origins: [https://app.example.com]
+`)
+	defer remove()
+
+	config, err := LoadConfig(path, envLookup(map[string]string{
+		"DB_NAME":         "other",
+		"STRICT_DECODING": "true",
+		"CORS_METHODS":    "App=get,post",
+	}))
+	if !assert.NoError(err) {
+		return
+	}
+
+	// the file overrides the defaults
+	assert.Equal(8080, config.Server.Port)
+	assert.Equal(DefaultGRPCPort, config.Server.GRPCPort)
+	assert.Equal(DefaultDatabasePort, config.Database.Port)
+	assert.Equal("UTC", config.Database.Loc)
+	assert.Equal(12*time.Hour, config.Limits.IdempotencyTTL)
+	assert.Equal(DefaultMaxBatchSize, config.Limits.MaxBatchSize)
+	// the ENV VARS override the file
+	assert.Equal("other", config.Database.Name)
+	assert.True(config.Limits.StrictDecoding)
+	// the default CORS policies do not apply when the file sets them
+	assert.Equal(map[string]CORSPolicy{
+		"App": {Origins: []string{"https://app.example.com"}, Methods: []string{"GET", "POST"}},
+	}, config.CORS)
+
+	database := config.Database.Database()
+	assert.Equal("other", database.DBName)
+	assert.Equal("true", database.ParseTime)
+
+	ch, err := config.ClientHandler(&FakeDb{}, nil, nil)
+	if assert.NoError(err) {
+		assert.True(ch.StrictDecoding)
+		assert.Equal([]uint{16509, 15169}, ch.Bots.Classifier.ASNs)
+		assert.Equal(BotReject, ch.Bots.Actions["*"])
+		assert.Nil(ch.Cookie)
+		assert.Nil(ch.ClientIP)
+		assert.Nil(ch.RateLimits)
+		assert.Nil(ch.Signatures)
+		assert.Nil(ch.Tokens)
+	}
+
+	// without a file the ENV VARS are enough
+	config, err = LoadConfig("", envLookup(map[string]string{
+		"DB_HOST":       "db",
+		"DB_USER":       "managerid",
+		"DB_NAME":       "managerid",
+		"COOKIE_SECRET": "0123456789abcdef0123456789abcdef",
+	}))
+	if assert.NoError(err) {
+		assert.Equal(DefaultHTTPPort, config.Server.Port)
+		assert.Equal(map[string]CORSPolicy{"*": {Origins: []string{"*"}}}, config.CORS)
+		cookie, err := config.Cookie.SignedCookie()
+		if assert.NoError(err) {
+			assert.Equal(DefaultSignedCookieName, cookie.Name)
+		}
+	}
+
+	_, err = LoadConfig(path+".missing", envLookup(nil))
+	assert.Error(err)
+
+	// the application entries of the ENV VARS need an application
+	for _, value := range []string{"App", "=tag"} {
+		_, err = LoadConfig(path, envLookup(map[string]string{"BOT_POLICY": value}))
+		if assert.Error(err, value) {
+			assert.Contains(err.Error(), "invalid BOT_POLICY", value)
+		}
+	}
+
+	// unknown settings are rejected
+	unknown, removeUnknown := writeConfig(t, "database:\n  hots: db\n")
+	defer removeUnknown()
+	config, err = LoadConfig(unknown, envLookup(nil))
+	assert.Nil(config)
+	assert.Error(err)
+}
+
+func TestLoadConfigProblems(t *testing.T) {
+	assert := assert.New(t)
+
+	path, remove := writeConfig(t, `
+server:
+  grpc_port: 4000
+database:
+  loc: Nowhere/Unknown
+internal:
+  networks:
+    App: [10.0.0.0/33]
+cookie:
+  secret: s3cr3t
+signature:
+  required: true
+tokens:
+  signing_key: short
+cors:
+  App:
+    origins: ["*"]
+`)
+	defer remove()
+
+	config, err := LoadConfig(path, envLookup(map[string]string{
+		"BATCH_MAX_SIZE": "many",
+		"RATE_LIMIT_IP":  "10/d",
+		"BOT_POLICY":     "*=block",
+	}))
+	// the loaded configuration is returned along with the problems
+	assert.NotNil(config)
+	configErr, ok := err.(*ConfigError)
+	if !assert.True(ok) {
+		return
+	}
+	// every problem is reported at once
+	assert.Equal([]string{
+		"invalid BATCH_MAX_SIZE: expected a number",
+		"server.port and server.grpc_port must be different",
+		"database.host is required",
+		"database.user is required",
+		"database.name is required",
+		`database.loc "Nowhere/Unknown" is not a known time zone`,
+		"cookie: invalid secret of 6 bytes, expected at least 32",
+		`bots: invalid bot action "block" of *, expected tag, ephemeral or reject`,
+		`internal: invalid internal networks of App: invalid network "10.0.0.0/33"`,
+		`rate_limit: invalid rate limit "10/d", the unit must be s, m or h`,
+		"signature: required signatures need clients",
+		"tokens: invalid Ed25519 key, expected base64: illegal base64 data at input byte 4",
+		"cors: invalid CORS policies: App has the * origin, which is only allowed for the * application",
+	}, configErr.Problems)
+}
+
+func TestConfigRedacted(t *testing.T) {
+	assert := assert.New(t)
+
+	config := DefaultConfig()
+	config.Database.Password = "db-secret"
+	config.Cookie.Secret = "cookie-secret"
+	config.Auth.AdminToken = "admin-secret"
+	config.Tokens.SigningKey = "token-secret"
+	config.Tokens.PublishedKeys = map[string]string{"previous": "public"}
+	config.Signature.Clients = map[string][]string{"crm": {"new-secret", "old-secret"}}
+
+	printed, err := yaml.Marshal(config.Redacted())
+	if !assert.NoError(err) {
+		return
+	}
+	for _, secret := range []string{"db-secret", "cookie-secret", "admin-secret", "token-secret", "new-secret", "old-secret"} {
+		assert.NotContains(string(printed), secret)
+	}
+	assert.Contains(string(printed), "previous: public")
+
+	// the printed configuration is loaded back
+	path, remove := writeConfig(t, string(printed))
+	defer remove()
+	loaded, _ := LoadConfig(path, envLookup(nil))
+	if assert.NotNil(loaded) {
+		assert.Equal([]string{redacted, redacted}, loaded.Signature.Clients["crm"])
+	}
+
+	// the original is not changed
+	assert.Equal("db-secret", config.Database.Password)
+	assert.Equal([]string{"new-secret", "old-secret"}, config.Signature.Clients["crm"])
+}
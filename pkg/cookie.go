@@ -0,0 +1,142 @@
+package managerid
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultSignedCookieName is the name of the signed cookie when SignedCookie.Name is not set.
+const DefaultSignedCookieName = "managerid"
+
+// minCookieSecret is the minimum length of the secret of the signed cookie, the
+// size of the HMAC-SHA256 key.
+const minCookieSecret = 32
+
+// SignedCookie is a struct used to issue and verify a first party cookie that
+// holds the passport id and group of the visitor, signed with HMAC-SHA256.
+type SignedCookie struct {
+	// Name of the cookie, DefaultSignedCookieName is used when it is not set.
+	Name string
+	// Domain of the cookie, the host of the request is used when it is not set.
+	Domain string
+	// Secret is the key used to sign the cookie.
+	Secret []byte
+	// MaxAge is the lifetime of the cookie, one year is used when it is not set.
+	MaxAge time.Duration
+}
+
+// cookiePayload is the content of the signed cookie.
+type cookiePayload struct {
+	PassportID    string `json:"p"`
+	PassportIDGrp string `json:"g"`
+}
+
+// Set issues the cookie of the identity in the response.
+func (c *SignedCookie) Set(w http.ResponseWriter, r *http.Request, identity *Identity) {
+	maxAge := c.MaxAge
+	if maxAge <= 0 {
+		maxAge = passportCookieAge
+	}
+	cookie := newCookie(r, c.name(), c.sign(identity), maxAge)
+	cookie.Domain = c.Domain
+	http.SetCookie(w, cookie)
+}
+
+// Read verifies the cookie of the request.
+// Returns the passport id and group it holds, or an error if there is no
+// cookie or its signature is not valid.
+func (c *SignedCookie) Read(r *http.Request) (string, string, error) {
+	cookie, err := r.Cookie(c.name())
+	if err != nil {
+		return "", "", err
+	}
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 2 {
+		return "", "", errors.New("malformed signed cookie")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, c.mac(parts[0])) {
+		return "", "", errors.New("invalid signature of signed cookie")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", err
+	}
+	payload := cookiePayload{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return "", "", err
+	}
+	return payload.PassportID, payload.PassportIDGrp, nil
+}
+
+// sign returns the value of the cookie of the identity: the encoded payload and
+// its signature, separated by a dot.
+func (c *SignedCookie) sign(identity *Identity) string {
+	data, _ := json.Marshal(cookiePayload{
+		PassportID:    identity.PassportID,
+		PassportIDGrp: identity.PassportIDGrp,
+	})
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(c.mac(payload))
+}
+
+// mac returns the HMAC-SHA256 of the payload.
+func (c *SignedCookie) mac(payload string) []byte {
+	hash := hmac.New(sha256.New, c.Secret)
+	hash.Write([]byte(payload))
+	return hash.Sum(nil)
+}
+
+// name returns the configured name of the cookie or the default one.
+func (c *SignedCookie) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return DefaultSignedCookieName
+}
+
+// storedIDsContextKey is the context key of the ids sent back by the JavaScript
+// snippet, see HandleScriptSettle.
+type storedIDsContextKey struct{}
+
+// knownIdentity returns the identity of the signed cookie of the request, or of
+// the ids stored by the JavaScript snippet when there is no valid cookie, if it
+// belongs to the provider and application of the interaction, or nil if there is
+// no such identity and the interaction must be resolved.
+func (ch *ClientHandler) knownIdentity(r *http.Request, interaction Interaction) (*Identity, error) {
+	passportID, idgroup := "", ""
+	if ch.Cookie != nil {
+		passportID, idgroup, _ = ch.Cookie.Read(r)
+	}
+	if stored, ok := r.Context().Value(storedIDsContextKey{}).(cookiePayload); ok && passportID == "" {
+		passportID, idgroup = stored.PassportID, stored.PassportIDGrp
+	}
+	if passportID == "" || idgroup == "" {
+		return nil, nil
+	}
+
+	identity, err := ch.Querier.GetIdentityByID(passportID)
+	if errors.Is(err, ErrIdentityNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if identity.PassportIDGrp != idgroup ||
+		identity.Provider != interaction.Provider ||
+		identity.Application != interaction.Application {
+		return nil, nil
+	}
+
+	reused := *identity
+	reused.Match = MatchReused
+	return &reused, nil
+}
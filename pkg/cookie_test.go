@@ -0,0 +1,186 @@
+package managerid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedCookie(t *testing.T) {
+	assert := assert.New(t)
+
+	signer := &SignedCookie{Domain: "example.com", Secret: []byte("secret")}
+	w := httptest.NewRecorder()
+	signer.Set(w, httptest.NewRequest(http.MethodPost, "/id/settle", nil), &Identity{PassportID: "id", PassportIDGrp: "group"})
+
+	cookies := w.Result().Cookies()
+	if !assert.Len(cookies, 1) {
+		return
+	}
+	cookie := cookies[0]
+	assert.Equal(DefaultSignedCookieName, cookie.Name)
+	assert.Equal("example.com", cookie.Domain)
+	assert.True(cookie.HttpOnly)
+
+	tests := []struct {
+		Description string
+		Cookie      *http.Cookie
+		Signer      *SignedCookie
+		PassportID  string
+		Group       string
+		Valid       bool
+	}{
+		{
+			Description: "when the cookie is valid",
+			Cookie:      cookie,
+			Signer:      signer,
+			PassportID:  "id",
+			Group:       "group",
+			Valid:       true,
+		},
+		{
+			Description: "when there is no cookie",
+			Signer:      signer,
+		},
+		{
+			Description: "when the cookie was signed with other secret",
+			Cookie:      cookie,
+			Signer:      &SignedCookie{Secret: []byte("other")},
+		},
+		{
+			Description: "when the payload was modified",
+			Cookie:      &http.Cookie{Name: cookie.Name, Value: "eyJwIjoib3RoZXIiLCJnIjoiZ3JvdXAifQ" + cookie.Value[strings.Index(cookie.Value, "."):]},
+			Signer:      signer,
+		},
+		{
+			Description: "when the cookie is malformed",
+			Cookie:      &http.Cookie{Name: cookie.Name, Value: "garbage"},
+			Signer:      signer,
+		},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/id/settle", nil)
+		if test.Cookie != nil {
+			req.AddCookie(test.Cookie)
+		}
+
+		passportID, group, err := test.Signer.Read(req)
+		if !test.Valid {
+			assert.Error(err, test.Description)
+			continue
+		}
+		assert.NoError(err, test.Description)
+		assert.Equal(test.PassportID, passportID, test.Description)
+		assert.Equal(test.Group, group, test.Description)
+	}
+}
+
+func TestHandleFunctionCookie(t *testing.T) {
+	assert := assert.New(t)
+
+	stored := &Identity{IP: "127.0.0.1", Provider: "Prov", Application: "App", PassportID: "id", PassportIDGrp: "group"}
+	querier := &FakeDb{
+		GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+			return &Identity{IP: interaction.IP, Provider: interaction.Provider, Application: interaction.Application, PassportID: "new", PassportIDGrp: "other", Match: MatchNewGroup}, nil
+		},
+		GetIdentityByIDFunc: func(passportID string) (*Identity, error) {
+			if passportID != stored.PassportID {
+				return nil, ErrIdentityNotFound
+			}
+			return stored, nil
+		},
+	}
+	signer := &SignedCookie{Secret: []byte("secret")}
+	ch := ClientHandler{Querier: querier, Cookie: signer}
+
+	w := httptest.NewRecorder()
+	signer.Set(w, httptest.NewRequest(http.MethodPost, "/id/settle", nil), stored)
+	valid := w.Result().Cookies()[0]
+
+	tests := []struct {
+		Description  string
+		Cookie       *http.Cookie
+		Body         string
+		ExpectedBody string
+	}{
+		{
+			Description:  "when the request has no cookie the interaction is resolved",
+			Body:         `{"ip": "127.0.0.2", "provider": "Prov", "application": "App"}`,
+			ExpectedBody: `{"passport_id_group":"other","passport_id":"new"}`,
+		},
+		{
+			Description:  "when the cookie is valid its identity is reused from other IP",
+			Cookie:       valid,
+			Body:         `{"ip": "127.0.0.2", "provider": "Prov", "application": "App"}`,
+			ExpectedBody: `{"passport_id_group":"group","passport_id":"id"}`,
+		},
+		{
+			Description:  "when the cookie belongs to other application the interaction is resolved",
+			Cookie:       valid,
+			Body:         `{"ip": "127.0.0.2", "provider": "Prov", "application": "Other"}`,
+			ExpectedBody: `{"passport_id_group":"other","passport_id":"new"}`,
+		},
+		{
+			Description:  "when the cookie is not valid the interaction is resolved",
+			Cookie:       &http.Cookie{Name: valid.Name, Value: valid.Value + "x"},
+			Body:         `{"ip": "127.0.0.2", "provider": "Prov", "application": "App"}`,
+			ExpectedBody: `{"passport_id_group":"other","passport_id":"new"}`,
+		},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/id/settle", strings.NewReader(test.Body))
+		if test.Cookie != nil {
+			req.AddCookie(test.Cookie)
+		}
+		w := httptest.NewRecorder()
+		ch.HandleFunction().ServeHTTP(w, req)
+		resp := w.Result()
+
+		assert.Equal(http.StatusOK, resp.StatusCode, test.Description)
+		assert.Equal(test.ExpectedBody+"\n", w.Body.String(), test.Description)
+
+		// the cookie is issued for the resolved identity
+		if assert.Len(resp.Cookies(), 1, test.Description) {
+			req := httptest.NewRequest(http.MethodPost, "/id/settle", nil)
+			req.AddCookie(resp.Cookies()[0])
+			passportID, _, err := signer.Read(req)
+			assert.NoError(err, test.Description)
+			assert.Contains(test.ExpectedBody, passportID, test.Description)
+		}
+	}
+	assert.Equal(3, querier.GetIdentityCalls)
+}
+
+func TestWithIdempotencyCookie(t *testing.T) {
+	assert := assert.New(t)
+
+	querier := &FakeDb{
+		GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+			return &Identity{Provider: interaction.Provider, Application: interaction.Application, PassportID: "id", PassportIDGrp: "group", Match: MatchNewGroup}, nil
+		},
+	}
+	signer := &SignedCookie{Secret: []byte("secret")}
+	ch := ClientHandler{Querier: querier, Cookie: signer, Idempotency: NewMemoryIdempotencyStore(time.Hour, 0)}
+	handler := ch.WithIdempotency(ch.HandleFunction())
+
+	cookies := []string{}
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/id/settle", strings.NewReader(`{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}`))
+		req.Header.Set(IdempotencyKeyHeader, "key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(http.StatusOK, w.Code)
+		cookies = append(cookies, w.Header().Get("Set-Cookie"))
+	}
+
+	// the replay sets the cookie of the first response
+	assert.NotEmpty(cookies[0])
+	assert.Equal(cookies[0], cookies[1])
+	assert.Equal(1, querier.GetIdentityCalls)
+}
@@ -0,0 +1,365 @@
+package managerid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/cors"
+)
+
+// DefaultCORSMethods are the methods allowed when a CORSPolicy does not set them.
+var DefaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodHead}
+
+// corsExposedHeaders are the response headers readable by the allowed origins.
+var corsExposedHeaders = []string{RequestIDHeader, "Retry-After", IdempotentReplayedHeader}
+
+// CORSPolicy is a struct that represents the cross-origin requests allowed for
+// an application.
+type CORSPolicy struct {
+	// Origins are the allowed origins, as scheme://host[:port], with at most a
+	// "*" wildcard in the host, like https://*.example.com. The policy of the "*"
+	// application can also allow any origin with "*".
+	Origins []string `yaml:"origins"`
+	// Methods are the allowed methods, DefaultCORSMethods when it is not set.
+	Methods []string `yaml:"methods,omitempty"`
+	// Headers are the allowed request headers. The simple headers are allowed
+	// when it is not set.
+	Headers []string `yaml:"headers,omitempty"`
+	// Credentials allows the requests with cookies. It can not be used with the "*" origin.
+	Credentials bool `yaml:"credentials,omitempty"`
+	// MaxAge is how long the preflight responses are cached, in seconds.
+	MaxAge int `yaml:"max_age,omitempty"`
+}
+
+// CORS is a struct used to handle the cross-origin requests with the policy of
+// the application whose origins include the origin of the request. Preflight
+// requests do not tell the application, so an origin can only belong to one,
+// and the other requests of the origin are only accepted for its application.
+type CORS struct {
+	origins  []corsOrigin
+	policies map[string]*cors.Cors
+}
+
+// corsOrigin is an allowed origin of an application, split at its wildcard.
+type corsOrigin struct {
+	application string
+	prefix      string
+	suffix      string
+	wildcard    bool
+}
+
+// match checks if the lower case origin passed as param is the allowed origin.
+func (o corsOrigin) match(origin string) bool {
+	if !o.wildcard {
+		return origin == o.prefix
+	}
+	return len(origin) > len(o.prefix)+len(o.suffix) && strings.HasPrefix(origin, o.prefix) && strings.HasSuffix(origin, o.suffix)
+}
+
+// NewCORS validates the policies of every application, the "*" one applies to
+// the origins of no other application, and returns the CORS that applies them.
+// Returns an error with every problem found if they are not valid.
+func NewCORS(policies map[string]CORSPolicy) (*CORS, error) {
+	if errs := validateCORSPolicies(policies); len(errs) > 0 {
+		messages := []string{}
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		return nil, fmt.Errorf("invalid CORS policies: %s", strings.Join(messages, "; "))
+	}
+
+	c := &CORS{policies: map[string]*cors.Cors{}}
+	for _, application := range corsApplications(policies) {
+		policy := policies[application]
+		for _, origin := range policy.Origins {
+			origin = strings.ToLower(origin)
+			allowed := corsOrigin{application: application, prefix: origin}
+			if i := strings.Index(origin, "*"); i >= 0 {
+				allowed = corsOrigin{application: application, prefix: origin[:i], suffix: origin[i+1:], wildcard: true}
+			}
+			c.origins = append(c.origins, allowed)
+		}
+
+		methods := policy.Methods
+		if len(methods) == 0 {
+			methods = DefaultCORSMethods
+		}
+		c.policies[application] = cors.New(cors.Options{
+			AllowedOrigins:   policy.Origins,
+			AllowedMethods:   methods,
+			AllowedHeaders:   policy.Headers,
+			ExposedHeaders:   corsExposedHeaders,
+			AllowCredentials: policy.Credentials,
+			MaxAge:           policy.MaxAge,
+		})
+	}
+	return c, nil
+}
+
+// corsApplications returns the applications of the policies sorted, with the
+// "*" one last, so its origins are only matched when no other application does.
+func corsApplications(policies map[string]CORSPolicy) []string {
+	applications := []string{}
+	for application := range policies {
+		if application != "*" {
+			applications = append(applications, application)
+		}
+	}
+	sort.Strings(applications)
+	if _, ok := policies["*"]; ok {
+		applications = append(applications, "*")
+	}
+	return applications
+}
+
+// validateCORSPolicies checks the policies of every application.
+// Returns every problem found, or an empty slice if they are valid.
+func validateCORSPolicies(policies map[string]CORSPolicy) []error {
+	errs := []error{}
+	owners := map[string]string{}
+	for _, application := range corsApplications(policies) {
+		policy := policies[application]
+		if len(policy.Origins) == 0 {
+			errs = append(errs, fmt.Errorf("%s has no origins", application))
+		}
+		for _, origin := range policy.Origins {
+			if origin == "*" {
+				if application != "*" {
+					errs = append(errs, fmt.Errorf("%s has the * origin, which is only allowed for the * application", application))
+				}
+				if policy.Credentials {
+					errs = append(errs, fmt.Errorf("%s allows credentials, which can not be used with the * origin", application))
+				}
+				if len(policy.Origins) > 1 {
+					errs = append(errs, fmt.Errorf("%s has the * origin along with other origins", application))
+				}
+				continue
+			}
+			if err := validateCORSOrigin(origin); err != nil {
+				errs = append(errs, fmt.Errorf("%s has an invalid origin %q: %v", application, origin, err))
+				continue
+			}
+			key := strings.ToLower(origin)
+			if owner, ok := owners[key]; ok && owner != application {
+				errs = append(errs, fmt.Errorf("origin %q belongs to %s and %s, an origin can only belong to one application", origin, owner, application))
+			}
+			owners[key] = application
+		}
+		for _, method := range policy.Methods {
+			if !isToken(method) || method != strings.ToUpper(method) {
+				errs = append(errs, fmt.Errorf("%s has an invalid method %q", application, method))
+			}
+		}
+		for _, header := range policy.Headers {
+			if header != "*" && !isToken(header) {
+				errs = append(errs, fmt.Errorf("%s has an invalid header %q", application, header))
+			}
+		}
+		if policy.MaxAge < 0 {
+			errs = append(errs, fmt.Errorf("%s has a negative max age", application))
+		}
+	}
+	return errs
+}
+
+// validateCORSOrigin checks that the origin is a scheme and a host, with an
+// optional port and at most a wildcard in the host, as its whole first label.
+// The wildcard matches any prefix, so https://*example.com would also allow
+// https://evilexample.com, and a wildcard of a top level domain would allow
+// every site.
+func validateCORSOrigin(origin string) error {
+	if strings.Count(origin, "*") > 1 {
+		return errors.New("only one wildcard is allowed")
+	}
+	u, err := url.Parse(strings.Replace(origin, "*", "wildcard", 1))
+	if err != nil {
+		return errors.New("it is not a URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("the scheme must be http or https")
+	}
+	if u.Host == "" || u.User != nil || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		return errors.New("it must be scheme://host[:port] without path")
+	}
+	if strings.Contains(origin, "*") {
+		domain := strings.TrimPrefix(u.Hostname(), "wildcard.")
+		if domain == u.Hostname() || !strings.Contains(domain, ".") {
+			return errors.New("the wildcard must be the first label of a domain, like *.example.com")
+		}
+	}
+	return nil
+}
+
+// isToken checks if the value is a non empty HTTP token, like a method or a header name.
+func isToken(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, c := range value {
+		if c > 127 || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// corsScopeContextKey is the context key of the corsScope of a request.
+type corsScopeContextKey struct{}
+
+// corsScope is the application whose policy allows the origin of a request.
+type corsScope struct {
+	application string
+	policies    map[string]*cors.Cors
+}
+
+// corsScopeFromContext returns the corsScope set by CORS.Handler, or nil if no
+// policy allows the origin of the request.
+func corsScopeFromContext(ctx context.Context) *corsScope {
+	scope, _ := ctx.Value(corsScopeContextKey{}).(*corsScope)
+	return scope
+}
+
+// allows checks if the origin can call the API for the application: the one of
+// its policy, or any application without policy when it is the "*" one.
+// It is safe to call on a nil corsScope.
+func (s *corsScope) allows(application string) bool {
+	if s == nil || s.application == application {
+		return true
+	}
+	_, ok := s.policies[application]
+	return s.application == "*" && !ok
+}
+
+// authorize checks if the origin can call the API for the interaction. It is
+// safe to call on a nil corsScope.
+// Returns the APIError with the application field, or nil.
+func (s *corsScope) authorize(interaction Interaction) *APIError {
+	if s.allows(interaction.Application) {
+		return nil
+	}
+	return &APIError{
+		Status:  http.StatusForbidden,
+		Code:    CodeForbidden,
+		Message: "interaction is out of the scope of the CORS policy of the origin",
+		Details: []FieldError{{Field: "application", Message: "is not allowed for the origin"}},
+	}
+}
+
+// Handler is a middleware that applies the policy of the origin of the request.
+// Preflight requests of origins that are not allowed are answered without the
+// CORS headers, so the browser blocks the request. The other requests of an
+// allowed origin are only accepted by the handlers for the application of its policy.
+func (c *CORS) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if application, policy := c.policy(r.Header.Get("Origin")); policy != nil {
+			scope := &corsScope{application: application, policies: c.policies}
+			policy.Handler(next).ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), corsScopeContextKey{}, scope)))
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// policy returns the application of the origin and the handler of its policy,
+// or nil if no application allows it.
+func (c *CORS) policy(origin string) (string, *cors.Cors) {
+	if origin == "" {
+		return "", nil
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.origins {
+		if allowed.match(origin) {
+			return allowed.application, c.policies[allowed.application]
+		}
+	}
+	return "", nil
+}
+
+// ParseCORSPolicies parses the policies of every application from the settings
+// passed as param, written as application=value entries separated by
+// semicolons: the comma separated origins, methods and headers, and whether
+// credentials and how many seconds the preflight responses are cached.
+// The applications of the other settings must have origins.
+func ParseCORSPolicies(origins, methods, headers, credentials, maxAge string) (map[string]CORSPolicy, error) {
+	originEntries, err := parseApplicationEntries(origins, "CORS origins", "origins")
+	if err != nil {
+		return nil, err
+	}
+	policies := map[string]CORSPolicy{}
+	for application, entry := range originEntries {
+		policies[application] = CORSPolicy{Origins: splitList(entry)}
+	}
+	if err := applyCORSSettings(policies, methods, headers, credentials, maxAge); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// applyCORSSettings sets the methods, headers, credentials and max age settings,
+// written as in ParseCORSPolicies, in the policies passed as param.
+// The applications of the settings must have a policy.
+func applyCORSSettings(policies map[string]CORSPolicy, methods, headers, credentials, maxAge string) error {
+	settings := []struct {
+		value    string
+		setting  string
+		expected string
+		apply    func(*CORSPolicy, string) error
+	}{
+		{value: methods, setting: "CORS methods", expected: "methods", apply: func(p *CORSPolicy, entry string) error {
+			p.Methods = splitList(strings.ToUpper(entry))
+			return nil
+		}},
+		{value: headers, setting: "CORS headers", expected: "headers", apply: func(p *CORSPolicy, entry string) error {
+			p.Headers = splitList(entry)
+			return nil
+		}},
+		{value: credentials, setting: "CORS credentials", expected: "true|false", apply: func(p *CORSPolicy, entry string) (err error) {
+			p.Credentials, err = strconv.ParseBool(entry)
+			return err
+		}},
+		{value: maxAge, setting: "CORS max age", expected: "seconds", apply: func(p *CORSPolicy, entry string) (err error) {
+			p.MaxAge, err = strconv.Atoi(entry)
+			return err
+		}},
+	}
+	for _, setting := range settings {
+		entries, err := parseApplicationEntries(setting.value, setting.setting, setting.expected)
+		if err != nil {
+			return err
+		}
+		for application, entry := range entries {
+			policy, ok := policies[application]
+			if !ok {
+				return fmt.Errorf("invalid %s of %s, the application has no CORS origins", setting.setting, application)
+			}
+			if err := setting.apply(&policy, entry); err != nil {
+				return fmt.Errorf("invalid %s of %s, expected %s", setting.setting, application, setting.expected)
+			}
+			policies[application] = policy
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, without the empty items.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,242 @@
+package managerid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCORSPolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	policies, err := ParseCORSPolicies(
+		"*=*;App=https://app.example.com, https://*.app.example.com",
+		"App=get,post,options",
+		"App=Content-Type,X-API-Key",
+		"App=true",
+		"App=600",
+	)
+	assert.NoError(err)
+	assert.Equal(map[string]CORSPolicy{
+		"*": {Origins: []string{"*"}},
+		"App": {
+			Origins:     []string{"https://app.example.com", "https://*.app.example.com"},
+			Methods:     []string{"GET", "POST", "OPTIONS"},
+			Headers:     []string{"Content-Type", "X-API-Key"},
+			Credentials: true,
+			MaxAge:      600,
+		},
+	}, policies)
+
+	tests := []struct {
+		Description string
+		Origins     string
+		Credentials string
+		MaxAge      string
+	}{
+		{Description: "when an entry has no application", Origins: "https://app.example.com"},
+		{Description: "when an application has no origins", Origins: "App=https://app.example.com", Credentials: "Other=true"},
+		{Description: "when credentials are not a bool", Origins: "App=https://app.example.com", Credentials: "App=yes"},
+		{Description: "when the max age is not a number", Origins: "App=https://app.example.com", MaxAge: "App=10m"},
+	}
+	for _, test := range tests {
+		_, err := ParseCORSPolicies(test.Origins, "", "", test.Credentials, test.MaxAge)
+		assert.Error(err, test.Description)
+	}
+}
+
+func TestNewCORSValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewCORS(map[string]CORSPolicy{
+		"*":     {Origins: []string{"*"}, Credentials: true},
+		"App":   {Origins: []string{"https://app.example.com", "app.example.com", "https://app.example.com/path"}, Methods: []string{"get"}},
+		"Other": {Origins: []string{"https://APP.example.com", "https://*.*.example.com", "https://*example.com", "https://app.*.example.com", "https://*.com"}, Headers: []string{"X Header"}, MaxAge: -1},
+		"Empty": {},
+		"All":   {Origins: []string{"*"}},
+	})
+	if assert.Error(err) {
+		// every problem is reported at once
+		for _, problem := range []string{
+			"* allows credentials",
+			`App has an invalid origin "app.example.com"`,
+			`App has an invalid origin "https://app.example.com/path"`,
+			`App has an invalid method "get"`,
+			`origin "https://APP.example.com" belongs to App and Other`,
+			`Other has an invalid origin "https://*.*.example.com"`,
+			`Other has an invalid origin "https://*example.com"`,
+			`Other has an invalid origin "https://app.*.example.com"`,
+			`Other has an invalid origin "https://*.com"`,
+			`Other has an invalid header "X Header"`,
+			"Other has a negative max age",
+			"Empty has no origins",
+			"All has the * origin",
+		} {
+			assert.Contains(err.Error(), problem)
+		}
+	}
+}
+
+func TestCORSHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := NewCORS(map[string]CORSPolicy{
+		"*": {Origins: []string{"*"}},
+		"App": {
+			Origins:     []string{"https://app.example.com", "https://*.landing.example.com"},
+			Methods:     []string{http.MethodGet, http.MethodPost},
+			Headers:     []string{"Content-Type", APIKeyHeader},
+			Credentials: true,
+			MaxAge:      600,
+		},
+		"Partner": {Origins: []string{"https://partner.example.org"}},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	handled := 0
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled++
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		Description      string
+		Method           string
+		Origin           string
+		RequestMethod    string
+		RequestHeaders   string
+		AllowOrigin      string
+		AllowCredentials string
+		AllowHeaders     string
+		MaxAge           string
+		Handled          int
+	}{
+		{Description: "when the preflight origin is allowed with credentials", Method: http.MethodOptions, Origin: "https://app.example.com", RequestMethod: http.MethodPost, RequestHeaders: "content-type, x-api-key", AllowOrigin: "https://app.example.com", AllowCredentials: "true", AllowHeaders: "Content-Type, X-Api-Key", MaxAge: "600"},
+		{Description: "when the preflight origin matches the wildcard", Method: http.MethodOptions, Origin: "https://promo.landing.example.com", RequestMethod: http.MethodPost, AllowOrigin: "https://promo.landing.example.com", AllowCredentials: "true", MaxAge: "600"},
+		{Description: "when the preflight method is not allowed", Method: http.MethodOptions, Origin: "https://app.example.com", RequestMethod: http.MethodDelete},
+		{Description: "when the preflight header is not allowed", Method: http.MethodOptions, Origin: "https://app.example.com", RequestMethod: http.MethodPost, RequestHeaders: "x-other"},
+		{Description: "when the preflight origin has the default headers", Method: http.MethodOptions, Origin: "https://partner.example.org", RequestMethod: http.MethodPost, RequestHeaders: "content-type", AllowOrigin: "https://partner.example.org", AllowHeaders: "Content-Type"},
+		{Description: "when the preflight origin is any other", Method: http.MethodOptions, Origin: "https://unknown.example.net", RequestMethod: http.MethodGet, AllowOrigin: "*"},
+		{Description: "when the request origin is allowed with credentials", Method: http.MethodPost, Origin: "https://app.example.com", AllowOrigin: "https://app.example.com", AllowCredentials: "true", Handled: 1},
+		{Description: "when the request origin is any other", Method: http.MethodGet, Origin: "https://unknown.example.net", AllowOrigin: "*", Handled: 1},
+		{Description: "when the request has no origin", Method: http.MethodGet, Handled: 1},
+	}
+
+	for _, test := range tests {
+		handled = 0
+		req := httptest.NewRequest(test.Method, "/id/settle", nil)
+		if test.Origin != "" {
+			req.Header.Set("Origin", test.Origin)
+		}
+		if test.RequestMethod != "" {
+			req.Header.Set("Access-Control-Request-Method", test.RequestMethod)
+		}
+		if test.RequestHeaders != "" {
+			req.Header.Set("Access-Control-Request-Headers", test.RequestHeaders)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(http.StatusOK, w.Code, test.Description)
+		assert.Equal(test.Handled, handled, test.Description)
+		assert.Equal(test.AllowOrigin, w.Header().Get("Access-Control-Allow-Origin"), test.Description)
+		assert.Equal(test.AllowCredentials, w.Header().Get("Access-Control-Allow-Credentials"), test.Description)
+		assert.Equal(test.AllowHeaders, w.Header().Get("Access-Control-Allow-Headers"), test.Description)
+		assert.Equal(test.MaxAge, w.Header().Get("Access-Control-Max-Age"), test.Description)
+		assert.Contains(w.Header()["Vary"], "Origin", test.Description)
+	}
+
+	// without the * application other origins are not allowed
+	c, _ = NewCORS(map[string]CORSPolicy{"App": {Origins: []string{"https://app.example.com"}}})
+	req := httptest.NewRequest(http.MethodOptions, "/id/settle", nil)
+	req.Header.Set("Origin", "https://unknown.example.net")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	w := httptest.NewRecorder()
+	c.Handler(http.NotFoundHandler()).ServeHTTP(w, req)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Empty(w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSHandlerApplication(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := NewCORS(map[string]CORSPolicy{
+		"*":       {Origins: []string{"*"}},
+		"App":     {Origins: []string{"https://app.example.com"}},
+		"Partner": {Origins: []string{"https://partner.example.org"}},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	ch := ClientHandler{
+		Querier: &FakeDb{
+			GetIdentityFunc: func(interaction Interaction) (*Identity, error) { return new(Identity), nil },
+			GetIdentitiesFunc: func(interactions []Interaction) ([]*Identity, error) {
+				idents := []*Identity{}
+				for range interactions {
+					idents = append(idents, new(Identity))
+				}
+				return idents, nil
+			},
+		},
+	}
+
+	tests := []struct {
+		Description string
+		Origin      string
+		Application string
+		StatusCode  int
+	}{
+		{Description: "when the application is the one of the origin", Origin: "https://app.example.com", Application: "App", StatusCode: http.StatusOK},
+		{Description: "when the application belongs to another origin", Origin: "https://app.example.com", Application: "Partner", StatusCode: http.StatusForbidden},
+		{Description: "when the * origin has an application without policy", Origin: "https://unknown.example.net", Application: "Other", StatusCode: http.StatusOK},
+		{Description: "when the * origin has an application with policy", Origin: "https://unknown.example.net", Application: "App", StatusCode: http.StatusForbidden},
+		{Description: "when the request has no origin", Application: "Partner", StatusCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		body := `{"ip": "127.0.0.1", "provider": "Prov", "application": "` + test.Application + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/id/settle", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if test.Origin != "" {
+			req.Header.Set("Origin", test.Origin)
+		}
+		w := httptest.NewRecorder()
+		c.Handler(ch.HandleFunction()).ServeHTTP(w, req)
+		assert.Equal(test.StatusCode, w.Code, test.Description)
+		if test.StatusCode == http.StatusForbidden {
+			response := errorEnvelope{}
+			if assert.NoError(json.NewDecoder(w.Body).Decode(&response), test.Description) {
+				assert.Equal(CodeForbidden, response.Error.Code, test.Description)
+			}
+		}
+	}
+
+	// the batch rejects the interactions of other applications
+	body := `[{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}, {"ip": "127.0.0.1", "provider": "Prov", "application": "Partner"}]`
+	req := httptest.NewRequest(http.MethodPost, "/id/settle/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+	c.Handler(ch.HandleBatch()).ServeHTTP(w, req)
+	assert.Equal(http.StatusOK, w.Code)
+	results := []BatchResult{}
+	if assert.NoError(json.NewDecoder(w.Body).Decode(&results)) && assert.Len(results, 2) {
+		assert.Nil(results[0].Error)
+		if assert.NotNil(results[1].Error) {
+			assert.Equal(CodeForbidden, results[1].Error.Code)
+		}
+	}
+
+	// the search must filter by the application of the origin
+	req = httptest.NewRequest(http.MethodGet, "/identities?application=Partner", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	c.Handler(ch.HandleSearch()).ServeHTTP(w, req)
+	assert.Equal(http.StatusForbidden, w.Code)
+}
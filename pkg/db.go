@@ -1,7 +1,9 @@
 package managerid
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql" // go mysql driver
@@ -21,29 +23,86 @@ type Database struct {
 	ParseTime string
 	Loc       string
 
+	// Events receives the outcome of the settles, nothing is published when it is not set.
+	Events *EventBus
+
+	// GeoIP sets the Geo of the new identities, it is left empty when it is not set.
+	GeoIP *GeoIP
+
 	db *gorm.DB
 }
 
+// ErrIdentityNotFound is returned when looking up an identity that does not exist.
+var ErrIdentityNotFound = errors.New("identity not found")
+
+// identityWindow is the period of time in which an identity is reused for
+// the same IP, provider and application.
+const identityWindow = 120 * time.Minute
+
 // Querier is an interface used to force client handler to implement
-// Open, GetIdentity, Close and CreateTable methods
+// Open, GetIdentity, GetIdentities, ImportIdentities, GroupSizes, GetIdentityByID,
+// GetGroup, SearchIdentities, AddVisit, GetVisits, CreateAPIKey, GetAPIKey,
+// GetAPIKeys, RevokeAPIKey, Close and CreateTable methods
 type Querier interface {
 	Open() error
 	GetIdentity(Interaction) (*Identity, error)
+	GetIdentities([]Interaction) ([]*Identity, error)
+	ImportIdentities([]ImportRecord) ([]*Identity, error)
+	GroupSizes([]string) (map[string]int, error)
+	GetIdentityByID(string) (*Identity, error)
+	GetGroup(string) ([]*Identity, error)
+	SearchIdentities(IdentityFilter) ([]*Identity, error)
+	AddVisit(string, VisitContext) error
+	GetVisits(string, int) ([]*Visit, error)
+	CreateAPIKey(*APIKey) error
+	GetAPIKey(string) (*APIKey, error)
+	GetAPIKeys() ([]*APIKey, error)
+	RevokeAPIKey(string, time.Time) (*APIKey, error)
 	Close()
 	CreateTable() error
 }
 
 // Identity is a struct that represents an identity element.
+// The indexes cover the lookups by IP of the resolution and the filters of SearchIdentities,
+// all of them sorted by createdat. Gorm lays out the columns of an index in field order, so
+// idx_identities_bsc_app_createdat is (provider, application, createdat) and the filters by
+// application alone use idx_identities_bsc_application_createdat.
 type Identity struct {
-	IP            string    `sql:"type:VARCHAR(255)" json:"-"`
-	Provider      string    `sql:"type:VARCHAR(255)" json:"-"`
-	Application   string    `sql:"type:VARCHAR(255)" json:"-"`
+	IP            string    `sql:"type:VARCHAR(255)" gorm:"index:idx_identities_bsc_ip_createdat" json:"-"`
+	Provider      string    `sql:"type:VARCHAR(255)" gorm:"index:idx_identities_bsc_app_createdat" json:"-"`
+	Application   string    `sql:"type:VARCHAR(255)" gorm:"index:idx_identities_bsc_app_createdat,idx_identities_bsc_application_createdat" json:"-"`
 	PassportIDGrp string    `sql:"type:VARCHAR(255)" json:"passport_id_group"`
 	PassportID    string    `sql:"type:VARCHAR(255)" json:"passport_id"`
-	Createdat     time.Time `json:"-"`
+	Createdat     time.Time `gorm:"index:idx_identities_bsc_createdat,idx_identities_bsc_ip_createdat,idx_identities_bsc_app_createdat,idx_identities_bsc_application_createdat" json:"-"`
 	Ididentity    *int      `gorm:"primary_key" json:"-"`
+	// IPNumber is the binary IP, 4 bytes for IPv4 and 16 for IPv6, indexed to
+	// search the IPs of a network with a range scan.
+	IPNumber []byte `sql:"type:VARBINARY(16)" gorm:"index:idx_identities_bsc_ip_number" json:"-"`
+	Geo      `json:"-"`
+	// Bot is the reason why the interaction that created the identity was
+	// classified as a bot, one of the Bot* reasons, or empty.
+	Bot string `sql:"type:VARCHAR(32)" json:"-"`
+	// Internal is set when the interaction that created the identity came from
+	// an internal network of its application.
+	Internal bool `json:"-"`
+
+	// Match is how the identity was resolved, one of the Match* constants.
+	Match string `gorm:"-" json:"-"`
 }
 
+// Values of Identity.Match.
+const (
+	// MatchNewGroup is set when the IP had no identities and a new group is created.
+	MatchNewGroup = "new_group"
+	// MatchNewInGroup is set when a new identity is created in the group of the IP.
+	MatchNewInGroup = "new_in_group"
+	// MatchReused is set when an identity inside the window is reused.
+	MatchReused = "reused"
+	// MatchEphemeral is set when a bot or an internal interaction gets a new
+	// identity that is not stored.
+	MatchEphemeral = "ephemeral"
+)
+
 // TableName sets the default table name
 func (Identity) TableName() string {
 	return "identities_bsc"
@@ -76,14 +135,22 @@ func (rg *Database) Close() {
 }
 
 // CreateTable automatically migrate your schema, to keep your schema update to date.
-// and create the table if not exists
+// and create the tables if not exists
+// The ip_number of the identities stored before it existed is filled from their ip.
 func (rg *Database) CreateTable() error {
-	rg.db.AutoMigrate(&Identity{})
+	rg.db.AutoMigrate(&Identity{}, &Visit{}, &APIKey{})
 
 	if !rg.db.HasTable(&Identity{}) {
 		rg.db.CreateTable(&Identity{})
 	}
-	return nil
+	if !rg.db.HasTable(&Visit{}) {
+		rg.db.CreateTable(&Visit{})
+	}
+	if !rg.db.HasTable(&APIKey{}) {
+		rg.db.CreateTable(&APIKey{})
+	}
+	// IPv4-mapped addresses are stored as IPv4, as ipNumber does
+	return rg.db.Exec("UPDATE " + Identity{}.TableName() + " SET ip_number = IF(IS_IPV4_MAPPED(INET6_ATON(ip)), SUBSTR(INET6_ATON(ip), 13), INET6_ATON(ip)) WHERE ip_number IS NULL").Error
 }
 
 // GetIdentity queries for matches for the interaction struct passed as parameter.
@@ -91,6 +158,7 @@ func (rg *Database) CreateTable() error {
 // In case of there are some matches for the IP value, checks if complains the time criteria.
 // If matches are returned, returns the identity element.
 // In other case, generates a new ID, and returns this identity element.
+// The visit context of the interaction is stored and the outcome is published to Events.
 func (rg *Database) GetIdentity(interaction Interaction) (*Identity, error) {
 
 	// check if there are no results =>  create idgroup and id and store in DB
@@ -99,15 +167,19 @@ func (rg *Database) GetIdentity(interaction Interaction) (*Identity, error) {
 		return nil, err
 	}
 
-	if out {
-		return ident, nil
+	if !out {
+		ident, err = rg.checkIdentitySecondLevel(interaction, ident.PassportIDGrp)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	ident, err = rg.checkIdentitySecondLevel(interaction, ident.PassportIDGrp)
-	if err != nil {
+	if err := storeVisit(rg.db, ident, interaction.VisitContext, time.Now()); err != nil {
 		return nil, err
 	}
 
+	rg.Events.publishIdentity(ident)
+
 	// returns the ident resultant object
 	return ident, nil
 }
@@ -125,7 +197,9 @@ func (rg *Database) checkIdentity(interaction Interaction) (*Identity, bool, err
 
 	if gorm.IsRecordNotFoundError(err) {
 		ident.createIdentity(interaction, "")
+		rg.GeoIP.enrich(ident)
 		rg.db.Create(ident)
+		ident.Match = MatchNewGroup
 		out = true
 	}
 	return ident, out, nil
@@ -136,7 +210,7 @@ func (rg *Database) checkIdentity(interaction Interaction) (*Identity, bool, err
 // returns a pointer to the matched identity
 func (rg *Database) checkIdentitySecondLevel(interaction Interaction, idgroup string) (*Identity, error) {
 	ident := new(Identity)
-	twoHoursLess := time.Now().Add(time.Duration(-120) * time.Minute)
+	twoHoursLess := time.Now().Add(-identityWindow)
 	timeFormatted := twoHoursLess.Format("2006-01-02 15:04:05")
 
 	err := rg.db.Where("ip = ? and provider = ? and application = ? and createdat > ?",
@@ -149,21 +223,200 @@ func (rg *Database) checkIdentitySecondLevel(interaction Interaction, idgroup st
 		return nil, err
 	}
 
+	ident.Match = MatchReused
 	if gorm.IsRecordNotFoundError(err) {
 		ident.createIdentity(interaction, idgroup)
+		rg.GeoIP.enrich(ident)
 		rg.db.Create(ident)
+		ident.Match = MatchNewInGroup
 	}
 
 	return ident, nil
 }
 
+// GroupSizes counts the identities of every group passed as param.
+// Returns the number of identities indexed by group, or nil and the error.
+func (rg *Database) GroupSizes(groups []string) (map[string]int, error) {
+	sizes := map[string]int{}
+	if len(groups) == 0 {
+		return sizes, nil
+	}
+
+	rows := []struct {
+		PassportIDGrp string
+		Size          int
+	}{}
+	err := rg.db.Model(&Identity{}).
+		Select("passport_id_grp, count(*) as size").
+		Where("passport_id_grp IN (?)", groups).
+		Group("passport_id_grp").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		sizes[row.PassportIDGrp] = row.Size
+	}
+	return sizes, nil
+}
+
+// GetIdentityByID looks up the identity with the passport id passed as param.
+// Returns the identity, or nil and ErrIdentityNotFound if there is none.
+func (rg *Database) GetIdentityByID(passportID string) (*Identity, error) {
+	ident := new(Identity)
+	err := rg.db.Where("passport_id = ?", passportID).Order("createdat desc").First(ident).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, ErrIdentityNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ident, nil
+}
+
+// GetGroup looks up the identities of the group passed as param, oldest first.
+// Returns the identities, an empty slice if the group does not exist, or nil and the error.
+func (rg *Database) GetGroup(idgroup string) ([]*Identity, error) {
+	idents := []*Identity{}
+	err := rg.db.Where("passport_id_grp = ?", idgroup).Order("createdat asc").Find(&idents).Error
+	if err != nil {
+		return nil, err
+	}
+	return idents, nil
+}
+
+// AddVisit stores the visit context passed as param for the identity with the passport id,
+// used when the identity is resolved without GetIdentity.
+func (rg *Database) AddVisit(passportID string, context VisitContext) error {
+	return storeVisit(rg.db, &Identity{PassportID: passportID}, context, time.Now())
+}
+
+// CreateAPIKey stores the API key passed as param.
+func (rg *Database) CreateAPIKey(key *APIKey) error {
+	return rg.db.Create(key).Error
+}
+
+// GetAPIKey looks up the API key of the key id passed as param, revoked or not.
+// Returns the key, or nil and ErrAPIKeyNotFound if there is none.
+func (rg *Database) GetAPIKey(keyID string) (*APIKey, error) {
+	key := new(APIKey)
+	err := rg.db.Where("key_id = ?", keyID).First(key).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// GetAPIKeys looks up every API key, newest first.
+// Returns the keys, an empty slice if there are none, or nil and the error.
+func (rg *Database) GetAPIKeys() ([]*APIKey, error) {
+	keys := []*APIKey{}
+	if err := rg.db.Order("createdat desc, idapikey desc").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey sets the revocation time of the API key of the key id passed as
+// param, unless it is already revoked.
+// Returns the key, or nil and ErrAPIKeyNotFound if there is none.
+func (rg *Database) RevokeAPIKey(keyID string, at time.Time) (*APIKey, error) {
+	err := rg.db.Model(&APIKey{}).Where("key_id = ? AND revokedat IS NULL", keyID).Update("revokedat", at).Error
+	if err != nil {
+		return nil, err
+	}
+	return rg.GetAPIKey(keyID)
+}
+
+// GetVisits looks up the latest visits of the identity passed as param, newest first,
+// up to limit.
+// Returns the visits, an empty slice if there are none, or nil and the error.
+func (rg *Database) GetVisits(passportID string, limit int) ([]*Visit, error) {
+	visits := []*Visit{}
+	err := rg.db.Where("passport_id = ?", passportID).Order("createdat desc, idvisit desc").
+		Limit(limit).Find(&visits).Error
+	if err != nil {
+		return nil, err
+	}
+	return visits, nil
+}
+
+// SearchIdentities looks up the identities that match the filter passed as param,
+// sorted by createdat and ididentity, starting after filter.After and up to filter.Limit.
+// Returns the identities, an empty slice if there are no matches, or nil and the error.
+func (rg *Database) SearchIdentities(filter IdentityFilter) ([]*Identity, error) {
+	query := rg.db
+	if filter.Provider != "" {
+		query = query.Where("provider = ?", filter.Provider)
+	}
+	if filter.Application != "" {
+		query = query.Where("application = ?", filter.Application)
+	}
+	if filter.Network != nil {
+		query = whereNetwork(query, filter.Network)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("createdat >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("createdat < ?", filter.To)
+	}
+
+	order, cmp := "desc", "<"
+	if filter.Ascending {
+		order, cmp = "asc", ">"
+	}
+	if filter.After != nil {
+		// the first condition is the one the indexes can seek to
+		query = query.Where(fmt.Sprintf("createdat %s= ? and (createdat %s ? or ididentity %s ?)", cmp, cmp, cmp),
+			filter.After.Createdat, filter.After.Createdat, filter.After.Ididentity)
+	}
+
+	idents := []*Identity{}
+	err := query.Order("createdat " + order).Order("ididentity " + order).Limit(filter.Limit).Find(&idents).Error
+	if err != nil {
+		return nil, err
+	}
+	return idents, nil
+}
+
+// whereNetwork adds the condition to match the IPs that belong to the network,
+// a range scan of the ip_number index. The length tells the IPv4 numbers from
+// the IPv6 ones that share their first bytes.
+func whereNetwork(db *gorm.DB, network *net.IPNet) *gorm.DB {
+	first := network.IP.Mask(network.Mask)
+	last := make(net.IP, len(first))
+	for i := range first {
+		last[i] = first[i] | ^network.Mask[i]
+	}
+	return db.Where("ip_number BETWEEN ? AND ? and LENGTH(ip_number) = ?",
+		[]byte(first), []byte(last), len(first))
+}
+
+// ipNumber returns the binary IP stored as Identity.IPNumber, with IPv4 and
+// IPv4-mapped addresses as 4 bytes, or nil if it is not valid.
+func ipNumber(ip string) []byte {
+	parsed := net.ParseIP(ip)
+	if ip4 := parsed.To4(); ip4 != nil {
+		return ip4
+	}
+	return parsed
+}
+
 // createIdentity creates an Identity object with proper values
 // If idgroup is setted you must use as Idgroup value
 func (ident *Identity) createIdentity(interaction Interaction, idgroup string) {
 
 	ident.Application = interaction.Application
 	ident.IP = interaction.IP
+	ident.IPNumber = ipNumber(interaction.IP)
 	ident.Provider = interaction.Provider
+	ident.Bot = interaction.Bot
+	ident.Internal = interaction.Internal
 	ident.Createdat = time.Now()
 	ident.PassportID = fmt.Sprintf("%s", uuid.NewV4())
 	ident.PassportIDGrp = fmt.Sprintf("%s", uuid.NewV4())
@@ -173,3 +426,174 @@ func (ident *Identity) createIdentity(interaction Interaction, idgroup string) {
 		ident.PassportIDGrp = idgroup
 	}
 }
+
+// GetIdentities resolves a batch of interactions in a single transaction.
+// The rows stored for every IP of the batch are fetched upfront, so the criteria
+// used by GetIdentity are applied in memory and in order, and only the new
+// identities hit the database.
+// The outcomes are published to Events once the transaction is committed.
+// Returns an identity per interaction, in the same order, or nil and the error.
+func (rg *Database) GetIdentities(interactions []Interaction) ([]*Identity, error) {
+	now := time.Now()
+	moments := make([]time.Time, len(interactions))
+	for i := range moments {
+		moments[i] = now
+	}
+
+	idents, err := rg.settle(interactions, moments)
+	if err != nil {
+		return nil, err
+	}
+	for _, ident := range idents {
+		rg.Events.publishIdentity(ident)
+	}
+	return idents, nil
+}
+
+// ImportIdentities resolves a batch of historical interactions in a single transaction,
+// applying the GetIdentity criteria at the moment of every record instead of now.
+// Records must be sorted by timestamp.
+// Returns an identity per record, in the same order, or nil and the error.
+func (rg *Database) ImportIdentities(records []ImportRecord) ([]*Identity, error) {
+	interactions := make([]Interaction, len(records))
+	moments := make([]time.Time, len(records))
+	for i, record := range records {
+		interactions[i] = record.Interaction
+		moments[i] = record.Timestamp
+	}
+	return rg.settle(interactions, moments)
+}
+
+// settle resolves every interaction at its moment, moments must be in ascending order,
+// and stores their visit contexts.
+// returns the identities in the same order as the interactions || nil error
+func (rg *Database) settle(interactions []Interaction, moments []time.Time) ([]*Identity, error) {
+	idents := make([]*Identity, len(interactions))
+	if len(interactions) == 0 {
+		return idents, nil
+	}
+
+	tx := rg.db.Begin()
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+
+	known, err := loadIdentities(tx, interactions, moments[0], moments[len(moments)-1])
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	for i, interaction := range interactions {
+		ident, created := known.resolve(interaction, moments[i])
+		if created {
+			rg.GeoIP.enrich(ident)
+			if err := tx.Create(ident).Error; err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			known.add(ident)
+		}
+		if err := storeVisit(tx, ident, interaction.VisitContext, moments[i]); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		idents[i] = ident
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return idents, nil
+}
+
+// identitySet holds the identities stored for a set of IPs, indexed by IP.
+type identitySet map[string][]*Identity
+
+// loadIdentities fetches the rows needed to resolve interactions between from and to:
+// the latest row of every IP before from, and every row of those IPs inside the window.
+// returns the identities indexed by IP || nil error
+func loadIdentities(db *gorm.DB, interactions []Interaction, from, to time.Time) (identitySet, error) {
+	ips := []string{}
+	seen := map[string]bool{}
+	for _, interaction := range interactions {
+		if !seen[interaction.IP] {
+			seen[interaction.IP] = true
+			ips = append(ips, interaction.IP)
+		}
+	}
+
+	latest := []*Identity{}
+	err := db.Raw(`SELECT t.* FROM identities_bsc t JOIN (
+		SELECT ip, MAX(createdat) AS createdat FROM identities_bsc
+		WHERE ip IN (?) AND createdat <= ? GROUP BY ip
+	) l ON t.ip = l.ip AND t.createdat = l.createdat`, ips, from).Scan(&latest).Error
+	if err != nil {
+		return nil, err
+	}
+
+	recent := []*Identity{}
+	err = db.Where("ip IN (?) and createdat > ? and createdat <= ?", ips, from.Add(-identityWindow), to).
+		Find(&recent).Error
+	if err != nil {
+		return nil, err
+	}
+
+	set := identitySet{}
+	added := map[int]bool{}
+	for _, ident := range append(latest, recent...) {
+		if ident.Ididentity != nil {
+			if added[*ident.Ididentity] {
+				continue
+			}
+			added[*ident.Ididentity] = true
+		}
+		set.add(ident)
+	}
+	return set, nil
+}
+
+// add appends the identity to the set.
+func (set identitySet) add(ident *Identity) {
+	set[ident.IP] = append(set[ident.IP], ident)
+}
+
+// resolve applies the GetIdentity criteria to the interaction at the moment passed as param.
+// If the IP has no rows, creates an identity with a new group.
+// If there is a row for the IP+Application+Provider inside the window, reuses it.
+// In other case, creates an identity in the group of the latest row of the IP.
+// returns the identity and true if it has to be stored
+func (set identitySet) resolve(interaction Interaction, at time.Time) (*Identity, bool) {
+	var latest, match *Identity
+	for _, ident := range set[interaction.IP] {
+		if ident.Createdat.After(at) {
+			continue
+		}
+		if latest == nil || !ident.Createdat.Before(latest.Createdat) {
+			latest = ident
+		}
+		if ident.Provider == interaction.Provider &&
+			ident.Application == interaction.Application &&
+			ident.Createdat.After(at.Add(-identityWindow)) &&
+			(match == nil || !ident.Createdat.Before(match.Createdat)) {
+			match = ident
+		}
+	}
+
+	if match != nil {
+		reused := *match
+		reused.Match = MatchReused
+		return &reused, false
+	}
+
+	ident := new(Identity)
+	ident.Match = MatchNewGroup
+	idgroup := ""
+	if latest != nil {
+		idgroup = latest.PassportIDGrp
+		ident.Match = MatchNewInGroup
+	}
+	ident.createIdentity(interaction, idgroup)
+	ident.Createdat = at
+	return ident, true
+}
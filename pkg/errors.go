@@ -0,0 +1,195 @@
+package managerid
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	uuid "github.com/satori/go.uuid"
+)
+
+// RequestIDHeader is the header used to correlate a request with its logs.
+const RequestIDHeader = "X-Request-ID"
+
+// Error codes returned in the APIError envelope.
+const (
+	CodeMethodNotAllowed      = "method_not_allowed"
+	CodeUnsupportedMediaType  = "unsupported_media_type"
+	CodeMalformedBody         = "malformed_body"
+	CodeInvalidPayload        = "invalid_payload"
+	CodeValidation            = "validation_failed"
+	CodeNotFound              = "not_found"
+	CodeUnauthorized          = "unauthorized"
+	CodeForbidden             = "forbidden"
+	CodeBotRejected           = "bot_rejected"
+	CodeInternalBlocked       = "internal_blocked"
+	CodeRateLimited           = "rate_limited"
+	CodePayloadTooLarge       = "payload_too_large"
+	CodeBatchTooLarge         = "batch_too_large"
+	CodeOutOfOrder            = "out_of_order"
+	CodeInvalidIdempotencyKey = "invalid_idempotency_key"
+	CodeIdempotencyConflict   = "idempotency_key_conflict"
+	CodeIdempotencyInFlight   = "idempotency_key_in_use"
+	CodeInternal              = "internal_error"
+	CodeUnavailable           = "service_unavailable"
+)
+
+// APIError is a struct that represents an error returned to the client.
+// Internal details are logged but never set in Message.
+type APIError struct {
+	Status    int          `json:"-"`
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	RequestID string       `json:"request_id,omitempty"`
+	Details   []FieldError `json:"details,omitempty"`
+}
+
+// Error implements the error interface.
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// errorEnvelope is the body of every error response.
+type errorEnvelope struct {
+	Error *APIError `json:"error"`
+}
+
+// WithRequestID is a middleware that sets the X-Request-ID header in the request
+// and in the response, using the one sent by the client if any.
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID(w, r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestID returns the id of the request, generating it if the request has none.
+// The id is set in the response headers.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" {
+		id = fmt.Sprintf("%s", uuid.NewV4())
+		r.Header.Set(RequestIDHeader, id)
+	}
+	w.Header().Set(RequestIDHeader, id)
+	return id
+}
+
+// writeError writes the APIError envelope with its status code.
+func writeError(w http.ResponseWriter, r *http.Request, apiErr *APIError) {
+	apiErr.RequestID = requestID(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(errorEnvelope{Error: apiErr})
+}
+
+// methodNotAllowed returns the APIError for a request with a not allowed method.
+func methodNotAllowed(r *http.Request) *APIError {
+	return &APIError{
+		Status:  http.StatusMethodNotAllowed,
+		Code:    CodeMethodNotAllowed,
+		Message: fmt.Sprintf("method %s not allowed", r.Method),
+	}
+}
+
+// checkContentType returns an APIError if the request declares a Content-Type
+// other than the one passed as param. Requests without Content-Type are accepted.
+func checkContentType(r *http.Request, expected string) *APIError {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err == nil && mediaType == expected {
+		return nil
+	}
+	return &APIError{
+		Status:  http.StatusUnsupportedMediaType,
+		Code:    CodeUnsupportedMediaType,
+		Message: fmt.Sprintf("content type %q not supported, use %s", header, expected),
+	}
+}
+
+// decodeError returns the APIError for an error decoding a json payload.
+// Well formed payloads with wrong types or unknown fields are unprocessable,
+// anything else is a bad request.
+func decodeError(err error) *APIError {
+	typeErr := &json.UnmarshalTypeError{}
+	if errors.As(err, &typeErr) {
+		message := fmt.Sprintf("value of type %s not allowed", typeErr.Value)
+		apiErr := &APIError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    CodeInvalidPayload,
+			Message: message,
+		}
+		if typeErr.Field != "" {
+			apiErr.Message = fmt.Sprintf("field %s: %s", typeErr.Field, message)
+			apiErr.Details = []FieldError{{Field: typeErr.Field, Message: message}}
+		}
+		return apiErr
+	}
+
+	// encoding/json has no typed error for unknown fields
+	if field := strings.TrimPrefix(err.Error(), "json: unknown field "); field != err.Error() {
+		field = strings.Trim(field, `"`)
+		return &APIError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    CodeInvalidPayload,
+			Message: fmt.Sprintf("unknown field %s", field),
+			Details: []FieldError{{Field: field, Message: "unknown field"}},
+		}
+	}
+
+	message := "malformed json payload"
+	syntaxErr := &json.SyntaxError{}
+	if errors.As(err, &syntaxErr) {
+		message = fmt.Sprintf("malformed json payload at offset %d", syntaxErr.Offset)
+	} else if errors.Is(err, io.EOF) {
+		message = "empty payload"
+	}
+	return &APIError{
+		Status:  http.StatusBadRequest,
+		Code:    CodeMalformedBody,
+		Message: message,
+	}
+}
+
+// internalError logs the error with the request id and writes a generic APIError,
+// service unavailable if the database can not be reached or internal error otherwise.
+func internalError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	apiErr := serverError(err)
+	log.Printf("[%s] %s, err: %v", requestID(w, r), message, err)
+	writeError(w, r, apiErr)
+}
+
+// serverError returns the generic APIError for a server side error.
+func serverError(err error) *APIError {
+	if isUnavailable(err) {
+		return &APIError{
+			Status:  http.StatusServiceUnavailable,
+			Code:    CodeUnavailable,
+			Message: "service temporarily unavailable, try again later",
+		}
+	}
+	return &APIError{
+		Status:  http.StatusInternalServerError,
+		Code:    CodeInternal,
+		Message: "internal error",
+	}
+}
+
+// isUnavailable checks if the error is caused by a lost database connection.
+func isUnavailable(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.As(err, &netErr)
+}
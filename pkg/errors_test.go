@@ -0,0 +1,121 @@
+package managerid
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleFunctionErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		Description  string
+		TypeRequest  string
+		ContentType  string
+		RequestID    string
+		Body         string
+		QuerierError error
+		StatusCode   int
+		Code         string
+	}{
+		{
+			Description: "when HandleFunction receive a GET request",
+			TypeRequest: http.MethodGet,
+			StatusCode:  http.StatusMethodNotAllowed,
+			Code:        CodeMethodNotAllowed,
+		},
+		{
+			Description: "when HandleFunction receive a body that is not json",
+			TypeRequest: http.MethodPost,
+			ContentType: "text/plain",
+			Body:        `{"ip": "127.0.0.1"}`,
+			StatusCode:  http.StatusUnsupportedMediaType,
+			Code:        CodeUnsupportedMediaType,
+		},
+		{
+			Description: "when HandleFunction receive a malformed body",
+			TypeRequest: http.MethodPost,
+			ContentType: "application/json; charset=utf-8",
+			Body:        `{"ip": "127.0.0.1"`,
+			StatusCode:  http.StatusBadRequest,
+			Code:        CodeMalformedBody,
+		},
+		{
+			Description: "when HandleFunction receive a body with wrong types",
+			TypeRequest: http.MethodPost,
+			Body:        `{"ip": 127}`,
+			StatusCode:  http.StatusUnprocessableEntity,
+			Code:        CodeInvalidPayload,
+		},
+		{
+			Description:  "when the database can not be reached",
+			TypeRequest:  http.MethodPost,
+			RequestID:    "test-request",
+			Body:         `{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}`,
+			QuerierError: &net.OpError{Op: "dial", Err: errors.New("connection refused")},
+			StatusCode:   http.StatusServiceUnavailable,
+			Code:         CodeUnavailable,
+		},
+		{
+			Description:  "when the query fails",
+			TypeRequest:  http.MethodPost,
+			Body:         `{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}`,
+			QuerierError: errors.New("Error 1054: Unknown column 'ip' in 'where clause'"),
+			StatusCode:   http.StatusInternalServerError,
+			Code:         CodeInternal,
+		},
+	}
+
+	for _, test := range tests {
+		ch := ClientHandler{
+			Querier: &FakeDb{
+				GetIdentityFunc: func(interaction Interaction) (*Identity, error) { return nil, test.QuerierError },
+			},
+		}
+		ts := httptest.NewServer(ch.HandleFunction())
+		defer ts.Close()
+
+		req, err := http.NewRequest(test.TypeRequest, ts.URL, strings.NewReader(test.Body))
+		if err != nil {
+			t.Errorf("error creating the test Request: Err: %v", err)
+			return
+		}
+		if test.ContentType != "" {
+			req.Header.Set("Content-Type", test.ContentType)
+		}
+		if test.RequestID != "" {
+			req.Header.Set(RequestIDHeader, test.RequestID)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("error sending test Request: Err: %v", err)
+			return
+		}
+
+		assert.Equal(test.StatusCode, resp.StatusCode, test.Description)
+		assert.Equal("application/json", resp.Header.Get("Content-Type"), test.Description)
+
+		envelope := errorEnvelope{}
+		if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+			t.Errorf("error unmarshaling the test response: Err: %v", err)
+			continue
+		}
+		assert.Equal(test.Code, envelope.Error.Code, test.Description)
+		assert.NotEmpty(envelope.Error.RequestID, test.Description)
+		assert.Equal(resp.Header.Get(RequestIDHeader), envelope.Error.RequestID, test.Description)
+		if test.RequestID != "" {
+			assert.Equal(test.RequestID, envelope.Error.RequestID, test.Description)
+		}
+		if test.QuerierError != nil {
+			assert.NotContains(envelope.Error.Message, test.QuerierError.Error(), test.Description)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package managerid
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultEventsBuffer is the number of events kept for a subscriber when no
+// buffer is passed to NewEventBus.
+const DefaultEventsBuffer = 256
+
+// eventsHeartbeat is the interval of the comments sent to keep idle streams open.
+var eventsHeartbeat = 15 * time.Second
+
+// IdentityEvent is a struct that represents the outcome of a settle.
+// Type is the match of the identity, one of the Match* constants.
+type IdentityEvent struct {
+	ID            uint64    `json:"-"`
+	Type          string    `json:"type"`
+	PassportID    string    `json:"passport_id"`
+	PassportIDGrp string    `json:"passport_id_group"`
+	IP            string    `json:"ip"`
+	Provider      string    `json:"provider"`
+	Application   string    `json:"application"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// EventFilter is a struct that represents the events a subscriber receives.
+// Empty values match every event.
+type EventFilter struct {
+	Provider    string
+	Application string
+}
+
+// match checks if the event passes the filter.
+func (filter EventFilter) match(event IdentityEvent) bool {
+	return (filter.Provider == "" || filter.Provider == event.Provider) &&
+		(filter.Application == "" || filter.Application == event.Application)
+}
+
+// Subscription is a struct that represents a subscriber of an EventBus.
+// Events is closed when the subscription ends, by Unsubscribe or because the
+// subscriber did not keep up with the events, in which case Overflowed is true.
+type Subscription struct {
+	Events <-chan IdentityEvent
+
+	events     chan IdentityEvent
+	filter     EventFilter
+	overflowed bool
+}
+
+// Overflowed checks if the subscription was ended because its buffer was full.
+// It must be called once Events is closed.
+func (s *Subscription) Overflowed() bool {
+	return s.overflowed
+}
+
+// EventBus is a struct used to broadcast the settle outcomes to its subscribers.
+// Publish never blocks: a subscriber whose buffer is full is dropped, so a slow
+// consumer does not delay the settles nor the other subscribers.
+type EventBus struct {
+	Buffer int
+
+	subscribers map[*Subscription]bool
+	lastID      uint64
+	sync.Mutex
+}
+
+// NewEventBus returns an EventBus that keeps up to buffer events per subscriber,
+// or DefaultEventsBuffer if buffer is not positive.
+func NewEventBus(buffer int) *EventBus {
+	if buffer <= 0 {
+		buffer = DefaultEventsBuffer
+	}
+	return &EventBus{
+		Buffer:      buffer,
+		subscribers: map[*Subscription]bool{},
+	}
+}
+
+// Subscribe registers a subscriber for the events that pass the filter.
+func (b *EventBus) Subscribe(filter EventFilter) *Subscription {
+	events := make(chan IdentityEvent, b.Buffer)
+	s := &Subscription{Events: events, events: events, filter: filter}
+
+	b.Lock()
+	defer b.Unlock()
+	b.subscribers[s] = true
+	return s
+}
+
+// Unsubscribe ends the subscription and closes its Events channel.
+func (b *EventBus) Unsubscribe(s *Subscription) {
+	b.Lock()
+	defer b.Unlock()
+	if b.subscribers[s] {
+		delete(b.subscribers, s)
+		close(s.events)
+	}
+}
+
+// Publish sends the event to the subscribers whose filter it passes.
+// It can be called on a nil EventBus, publishing nothing.
+func (b *EventBus) Publish(event IdentityEvent) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.lastID++
+	event.ID = b.lastID
+	for s := range b.subscribers {
+		if !s.filter.match(event) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			log.Printf("[events] subscriber dropped, buffer of %d events full", b.Buffer)
+			s.overflowed = true
+			delete(b.subscribers, s)
+			close(s.events)
+		}
+	}
+}
+
+// publishIdentity publishes the settle outcome of the identity.
+func (b *EventBus) publishIdentity(ident *Identity) {
+	b.Publish(IdentityEvent{
+		Type:          ident.Match,
+		PassportID:    ident.PassportID,
+		PassportIDGrp: ident.PassportIDGrp,
+		IP:            ident.IP,
+		Provider:      ident.Provider,
+		Application:   ident.Application,
+		CreatedAt:     ident.Createdat,
+	})
+}
+
+// HandleEvents is a function used to stream the settle outcomes as Server-Sent Events.
+// Only GET method accepted.
+// The query filters the events by provider and application, which must be
+// allowed by the API key when it is required. Every event is sent
+// with its match as event type and an IdentityEvent as data, and a comment is
+// sent periodically to keep the connection open. When the client does not keep up
+// with the events an overflow event is sent and the stream ends, the client may
+// reconnect.
+// Errors are returned as an APIError envelope:
+// StatusMethodNotAllowed if other kind of request is received.
+// StatusForbidden if the filter is out of the scope of the API key or of the CORS policy of the origin.
+// StatusServiceUnavailable if the events are not enabled.
+// StatusInternalServerError if the connection does not support streaming.
+func (ch *ClientHandler) HandleEvents() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, methodNotAllowed(r))
+			return
+		}
+
+		if ch.Events == nil {
+			writeError(w, r, &APIError{
+				Status:  http.StatusServiceUnavailable,
+				Code:    CodeUnavailable,
+				Message: "events are not enabled",
+			})
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			internalError(w, r, "error streaming events", fmt.Errorf("%T is not a http.Flusher", w))
+			return
+		}
+
+		filter := EventFilter{
+			Provider:    r.URL.Query().Get("provider"),
+			Application: r.URL.Query().Get("application"),
+		}
+		if key := apiKeyFromContext(r.Context()); key != nil && !key.Allows(filter.Application, filter.Provider) {
+			writeError(w, r, &APIError{
+				Status:  http.StatusForbidden,
+				Code:    CodeForbidden,
+				Message: "events must filter by an application and provider allowed by the API key",
+			})
+			return
+		}
+		if !corsScopeFromContext(r.Context()).allows(filter.Application) {
+			writeError(w, r, &APIError{
+				Status:  http.StatusForbidden,
+				Code:    CodeForbidden,
+				Message: "events must filter by an application allowed for the origin",
+			})
+			return
+		}
+
+		subscription := ch.Events.Subscribe(filter)
+		defer ch.Events.Unsubscribe(subscription)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, ": connected\n\n")
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(eventsHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+			case event, ok := <-subscription.Events:
+				if !ok {
+					if subscription.Overflowed() {
+						fmt.Fprint(w, "event: overflow\ndata: {}\n\n")
+						flusher.Flush()
+					}
+					return
+				}
+				data, _ := json.Marshal(event)
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			}
+			flusher.Flush()
+		}
+	})
+}
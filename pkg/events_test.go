@@ -0,0 +1,130 @@
+package managerid
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBus(t *testing.T) {
+	assert := assert.New(t)
+
+	bus := NewEventBus(2)
+	all := bus.Subscribe(EventFilter{})
+	app := bus.Subscribe(EventFilter{Provider: "Prov", Application: "App"})
+
+	bus.Publish(IdentityEvent{Type: MatchNewGroup, Provider: "Prov", Application: "App"})
+	bus.Publish(IdentityEvent{Type: MatchReused, Provider: "Prov", Application: "Other"})
+
+	assert.Equal(uint64(1), (<-all.Events).ID)
+	assert.Equal(uint64(2), (<-all.Events).ID)
+	assert.Equal(uint64(1), (<-app.Events).ID)
+	assert.Empty(app.Events, "events of other applications are filtered")
+
+	bus.Publish(IdentityEvent{Type: MatchNewGroup, Provider: "Prov", Application: "App"})
+	bus.Publish(IdentityEvent{Type: MatchNewGroup, Provider: "Prov", Application: "App"})
+	bus.Publish(IdentityEvent{Type: MatchNewGroup, Provider: "Prov", Application: "App"})
+
+	// both subscribers had room for two events only
+	for _, s := range []*Subscription{all, app} {
+		received := 0
+		for range s.Events {
+			received++
+		}
+		assert.Equal(2, received)
+		assert.True(s.Overflowed())
+	}
+	assert.Empty(bus.subscribers)
+
+	s := bus.Subscribe(EventFilter{})
+	bus.Unsubscribe(s)
+	bus.Unsubscribe(s)
+	_, ok := <-s.Events
+	assert.False(ok)
+	assert.False(s.Overflowed())
+
+	var nilBus *EventBus
+	nilBus.Publish(IdentityEvent{})
+}
+
+func TestHandleEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	ch := ClientHandler{Events: NewEventBus(10)}
+	ts := httptest.NewServer(ch.HandleEvents())
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"?application=App", nil)
+	if err != nil {
+		t.Errorf("error creating the test Request: Err: %v", err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("error sending test Request: Err: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		lines := []string{}
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Errorf("error reading the test stream: Err: %v", err)
+				return ""
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+	assert.Equal(": connected\n", readEvent())
+
+	createdat := time.Date(2020, 5, 4, 10, 21, 0, 0, time.UTC)
+	ch.Events.publishIdentity(&Identity{IP: "127.0.0.1", Provider: "Prov", Application: "Other", Match: MatchNewGroup})
+	ch.Events.publishIdentity(&Identity{
+		IP:            "127.0.0.1",
+		Provider:      "Prov",
+		Application:   "App",
+		PassportID:    "id",
+		PassportIDGrp: "group",
+		Createdat:     createdat,
+		Match:         MatchNewInGroup,
+	})
+
+	event := readEvent()
+	assert.True(strings.HasPrefix(event, "id: 2\nevent: new_in_group\ndata: "), event)
+	data := IdentityEvent{}
+	if assert.NoError(json.Unmarshal([]byte(strings.SplitN(event, "data: ", 2)[1]), &data)) {
+		assert.Equal(IdentityEvent{
+			Type:          MatchNewInGroup,
+			PassportID:    "id",
+			PassportIDGrp: "group",
+			IP:            "127.0.0.1",
+			Provider:      "Prov",
+			Application:   "App",
+			CreatedAt:     createdat,
+		}, data)
+	}
+
+	cancel()
+	assert.Eventually(func() bool {
+		ch.Events.Lock()
+		defer ch.Events.Unlock()
+		return len(ch.Events.subscribers) == 0
+	}, time.Second, 10*time.Millisecond, "the subscription ends with the request")
+}
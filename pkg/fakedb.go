@@ -1,17 +1,44 @@
 package managerid
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 // FakeDb is a struct used to test Db functionality with fake methods.
 type FakeDb struct {
-	OpenFunc         func() error
-	OpenCalls        int
-	GetIdentityFunc  func(Interaction) (*Identity, error)
-	GetIdentityCalls int
-	CloseFunc        func() error
-	CloseCalls       int
-	CreateTableFunc  func() error
-	CreateTableCalls int
+	OpenFunc              func() error
+	OpenCalls             int
+	GetIdentityFunc       func(Interaction) (*Identity, error)
+	GetIdentityCalls      int
+	GetIdentitiesFunc     func([]Interaction) ([]*Identity, error)
+	GetIdentitiesCalls    int
+	ImportIdentitiesFunc  func([]ImportRecord) ([]*Identity, error)
+	ImportIdentitiesCalls int
+	GroupSizesFunc        func([]string) (map[string]int, error)
+	GroupSizesCalls       int
+	GetIdentityByIDFunc   func(string) (*Identity, error)
+	GetIdentityByIDCalls  int
+	GetGroupFunc          func(string) ([]*Identity, error)
+	GetGroupCalls         int
+	SearchIdentitiesFunc  func(IdentityFilter) ([]*Identity, error)
+	SearchIdentitiesCalls int
+	AddVisitFunc          func(string, VisitContext) error
+	AddVisitCalls         int
+	GetVisitsFunc         func(string, int) ([]*Visit, error)
+	GetVisitsCalls        int
+	CreateAPIKeyFunc      func(*APIKey) error
+	CreateAPIKeyCalls     int
+	GetAPIKeyFunc         func(string) (*APIKey, error)
+	GetAPIKeyCalls        int
+	GetAPIKeysFunc        func() ([]*APIKey, error)
+	GetAPIKeysCalls       int
+	RevokeAPIKeyFunc      func(string, time.Time) (*APIKey, error)
+	RevokeAPIKeyCalls     int
+	CloseFunc             func() error
+	CloseCalls            int
+	CreateTableFunc       func() error
+	CreateTableCalls      int
 
 	sync.Mutex
 }
@@ -32,6 +59,102 @@ func (f *FakeDb) GetIdentity(interaction Interaction) (*Identity, error) {
 	return f.GetIdentityFunc(interaction)
 }
 
+// GetIdentities is a method to test GetIdentities function
+func (f *FakeDb) GetIdentities(interactions []Interaction) ([]*Identity, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.GetIdentitiesCalls++
+	return f.GetIdentitiesFunc(interactions)
+}
+
+// ImportIdentities is a method to test ImportIdentities function
+func (f *FakeDb) ImportIdentities(records []ImportRecord) ([]*Identity, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.ImportIdentitiesCalls++
+	return f.ImportIdentitiesFunc(records)
+}
+
+// GroupSizes is a method to test GroupSizes function
+func (f *FakeDb) GroupSizes(groups []string) (map[string]int, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.GroupSizesCalls++
+	return f.GroupSizesFunc(groups)
+}
+
+// GetIdentityByID is a method to test GetIdentityByID function
+func (f *FakeDb) GetIdentityByID(passportID string) (*Identity, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.GetIdentityByIDCalls++
+	return f.GetIdentityByIDFunc(passportID)
+}
+
+// GetGroup is a method to test GetGroup function
+func (f *FakeDb) GetGroup(idgroup string) ([]*Identity, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.GetGroupCalls++
+	return f.GetGroupFunc(idgroup)
+}
+
+// SearchIdentities is a method to test SearchIdentities function
+func (f *FakeDb) SearchIdentities(filter IdentityFilter) ([]*Identity, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.SearchIdentitiesCalls++
+	return f.SearchIdentitiesFunc(filter)
+}
+
+// AddVisit is a method to test AddVisit function
+func (f *FakeDb) AddVisit(passportID string, context VisitContext) error {
+	f.Lock()
+	defer f.Unlock()
+	f.AddVisitCalls++
+	return f.AddVisitFunc(passportID, context)
+}
+
+// GetVisits is a method to test GetVisits function
+func (f *FakeDb) GetVisits(passportID string, limit int) ([]*Visit, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.GetVisitsCalls++
+	return f.GetVisitsFunc(passportID, limit)
+}
+
+// CreateAPIKey is a method to test CreateAPIKey function
+func (f *FakeDb) CreateAPIKey(key *APIKey) error {
+	f.Lock()
+	defer f.Unlock()
+	f.CreateAPIKeyCalls++
+	return f.CreateAPIKeyFunc(key)
+}
+
+// GetAPIKey is a method to test GetAPIKey function
+func (f *FakeDb) GetAPIKey(keyID string) (*APIKey, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.GetAPIKeyCalls++
+	return f.GetAPIKeyFunc(keyID)
+}
+
+// GetAPIKeys is a method to test GetAPIKeys function
+func (f *FakeDb) GetAPIKeys() ([]*APIKey, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.GetAPIKeysCalls++
+	return f.GetAPIKeysFunc()
+}
+
+// RevokeAPIKey is a method to test RevokeAPIKey function
+func (f *FakeDb) RevokeAPIKey(keyID string, at time.Time) (*APIKey, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.RevokeAPIKeyCalls++
+	return f.RevokeAPIKeyFunc(keyID, at)
+}
+
 // Close is a method to test Close function
 func (f *FakeDb) Close() {
 	f.Lock()
@@ -0,0 +1,194 @@
+package managerid
+
+import (
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/josedelrio85/managerid/pkg/mmdb"
+)
+
+// DefaultGeoIPReloadInterval is how often GeoIP checks if its databases changed
+// when no interval is passed to NewGeoIP.
+const DefaultGeoIPReloadInterval = time.Minute
+
+// Geo is a struct that represents the location and the network of an IP.
+// Country is the ISO 3166-1 code, Region and City are the English names.
+type Geo struct {
+	Country string `sql:"type:VARCHAR(2)" json:"country,omitempty"`
+	Region  string `sql:"type:VARCHAR(255)" json:"region,omitempty"`
+	City    string `sql:"type:VARCHAR(255)" json:"city,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+}
+
+// GeoIP is a struct used to look up the Geo of the IPs in local MaxMind databases,
+// like GeoLite2-City and GeoLite2-ASN. The databases are reloaded in background
+// when their files change, so the lookups never read the files.
+type GeoIP struct {
+	// databases holds the []*geoDatabase in use, replaced as a whole on reload.
+	databases atomic.Value
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// geoDatabase is a database loaded from a file, with the state of the file.
+type geoDatabase struct {
+	path    string
+	modTime time.Time
+	size    int64
+	reader  *mmdb.Reader
+}
+
+// NewGeoIP loads the databases of the paths passed as param, the fields of the
+// first ones take precedence, and checks their files for changes every
+// reloadInterval, or DefaultGeoIPReloadInterval if it is not positive, until
+// the GeoIP is closed.
+// Returns the GeoIP or the error of the first database that can not be loaded.
+func NewGeoIP(paths []string, reloadInterval time.Duration) (*GeoIP, error) {
+	databases := []*geoDatabase{}
+	for _, path := range paths {
+		database, err := loadGeoDatabase(path)
+		if err != nil {
+			return nil, err
+		}
+		databases = append(databases, database)
+	}
+	if reloadInterval <= 0 {
+		reloadInterval = DefaultGeoIPReloadInterval
+	}
+
+	g := &GeoIP{stop: make(chan struct{})}
+	g.databases.Store(databases)
+	go g.watch(reloadInterval)
+	return g, nil
+}
+
+// Close stops the reload of the databases. It is safe to call on a nil GeoIP.
+func (g *GeoIP) Close() {
+	if g != nil {
+		g.closeOnce.Do(func() { close(g.stop) })
+	}
+}
+
+// Lookup returns the Geo of the IP passed as param, empty if it is not found.
+// It is safe to call on a nil GeoIP.
+func (g *GeoIP) Lookup(value string) Geo {
+	geo := Geo{}
+	ip := net.ParseIP(value)
+	if g == nil || ip == nil {
+		return geo
+	}
+
+	for _, database := range g.current() {
+		record, err := database.reader.Lookup(ip)
+		if err != nil {
+			log.Printf("error looking up %s in GeoIP database %s. err: %s", value, database.path, err)
+			continue
+		}
+		fields, _ := record.(map[string]interface{})
+		if geo.Country == "" {
+			geo.Country = geoString(fields, "country", "iso_code")
+		}
+		if geo.Region == "" {
+			if subdivisions, ok := fields["subdivisions"].([]interface{}); ok && len(subdivisions) > 0 {
+				subdivision, _ := subdivisions[0].(map[string]interface{})
+				geo.Region = geoString(subdivision, "names", "en")
+			}
+		}
+		if geo.City == "" {
+			geo.City = geoString(fields, "city", "names", "en")
+		}
+		if number, ok := fields["autonomous_system_number"].(uint64); ok && geo.ASN == 0 {
+			geo.ASN = uint(number)
+		}
+	}
+	return geo
+}
+
+// enrich sets the Geo of the IP of the identity. It is safe to call on a nil GeoIP.
+func (g *GeoIP) enrich(ident *Identity) {
+	if g != nil {
+		ident.Geo = g.Lookup(ident.IP)
+	}
+}
+
+// current returns the loaded databases.
+func (g *GeoIP) current() []*geoDatabase {
+	return g.databases.Load().([]*geoDatabase)
+}
+
+// watch reloads the databases every interval until the GeoIP is closed.
+func (g *GeoIP) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.reload()
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// reload reads the databases whose files changed and swaps them in at once, the
+// lookups keep using the loaded databases meanwhile. It is only called by
+// watch, so the reloads do not overlap.
+func (g *GeoIP) reload() {
+	databases := g.current()
+	reloaded := make([]*geoDatabase, len(databases))
+	changed := false
+	for i, database := range databases {
+		reloaded[i] = database
+		info, err := os.Stat(database.path)
+		if err != nil {
+			log.Printf("error checking GeoIP database %s, the loaded one is kept. err: %s", database.path, err)
+			continue
+		}
+		if info.ModTime().Equal(database.modTime) && info.Size() == database.size {
+			continue
+		}
+		fresh, err := loadGeoDatabase(database.path)
+		if err != nil {
+			log.Printf("error reloading GeoIP database %s, the loaded one is kept. err: %s", database.path, err)
+			continue
+		}
+		log.Printf("GeoIP database %s reloaded", database.path)
+		reloaded[i] = fresh
+		changed = true
+	}
+
+	if changed {
+		g.databases.Store(reloaded)
+	}
+}
+
+// loadGeoDatabase reads the database of the file passed as param.
+func loadGeoDatabase(path string) (*geoDatabase, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := mmdb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &geoDatabase{path: path, modTime: info.ModTime(), size: info.Size(), reader: reader}, nil
+}
+
+// geoString returns the string found following the keys of nested maps, or an empty string.
+func geoString(fields map[string]interface{}, keys ...string) string {
+	var value interface{} = fields
+	for _, key := range keys {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[key]
+	}
+	str, _ := value.(string)
+	return str
+}
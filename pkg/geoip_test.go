@@ -0,0 +1,141 @@
+package managerid
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoIP(t *testing.T) {
+	assert := assert.New(t)
+
+	geoip, err := NewGeoIP([]string{"mmdb/testdata/city.mmdb", "mmdb/testdata/asn.mmdb"}, 0)
+	if !assert.NoError(err) {
+		return
+	}
+	defer geoip.Close()
+
+	tests := []struct {
+		Description string
+		IP          string
+		Expected    Geo
+	}{
+		{
+			Description: "when the IPv4 is in both databases",
+			IP:          "81.2.69.160",
+			Expected:    Geo{Country: "GB", Region: "England", City: "London", ASN: 20712},
+		},
+		{
+			Description: "when the IPv6 is in both databases",
+			IP:          "2001:db8::1",
+			Expected:    Geo{Country: "SE", Region: "Stockholm County", City: "Stockholm", ASN: 64496},
+		},
+		{
+			Description: "when the IP is not in the databases",
+			IP:          "192.0.2.1",
+			Expected:    Geo{},
+		},
+		{
+			Description: "when the IP is not valid",
+			IP:          "garbage",
+			Expected:    Geo{},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.Expected, geoip.Lookup(test.IP), test.Description)
+	}
+
+	var disabled *GeoIP
+	assert.Equal(Geo{}, disabled.Lookup("81.2.69.160"))
+	disabled.Close()
+
+	_, err = NewGeoIP([]string{"mmdb/testdata/missing.mmdb"}, 0)
+	assert.Error(err)
+}
+
+func TestGeoIPReload(t *testing.T) {
+	assert := assert.New(t)
+
+	city, _ := ioutil.ReadFile("mmdb/testdata/city.mmdb")
+	asn, _ := ioutil.ReadFile("mmdb/testdata/asn.mmdb")
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatalf("error creating the test directory: Err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "geoip.mmdb")
+	if err := ioutil.WriteFile(path, city, 0644); err != nil {
+		t.Fatalf("error writing the test database: Err: %v", err)
+	}
+
+	geoip, err := NewGeoIP([]string{path}, 10*time.Millisecond)
+	if !assert.NoError(err) {
+		return
+	}
+	defer geoip.Close()
+	assert.Equal("GB", geoip.Lookup("81.2.69.160").Country)
+
+	// the file is replaced by other database, the lookups do not reload it
+	assert.NoError(ioutil.WriteFile(path, asn, 0644))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(os.Chtimes(path, later, later))
+	assert.Eventually(func() bool {
+		return geoip.Lookup("81.2.69.160") == Geo{ASN: 20712}
+	}, time.Second, 10*time.Millisecond)
+
+	// a broken file keeps the loaded database
+	assert.NoError(ioutil.WriteFile(path, []byte("garbage"), 0644))
+	geoip.reload()
+	assert.Equal(Geo{ASN: 20712}, geoip.Lookup("81.2.69.160"))
+
+	// closing it twice is safe
+	geoip.Close()
+}
+
+func TestHandleSettleV2Geo(t *testing.T) {
+	assert := assert.New(t)
+
+	createdat := time.Date(2020, 5, 4, 10, 21, 0, 0, time.UTC)
+	querier := &FakeDb{
+		GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+			return &Identity{
+				PassportID: "id", PassportIDGrp: "group", Createdat: createdat, Match: MatchNewGroup,
+				Geo: Geo{Country: "GB", Region: "England", City: "London", ASN: 20712},
+			}, nil
+		},
+		GroupSizesFunc: func(groups []string) (map[string]int, error) {
+			return map[string]int{"group": 1}, nil
+		},
+	}
+	ch := ClientHandler{Querier: querier}
+
+	body := `{"ip": "81.2.69.160", "provider": "Prov", "application": "App"}`
+	w := httptest.NewRecorder()
+	ch.HandleSettleV2().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v2/id/settle", strings.NewReader(body)))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`{
+		"passport_id": "id",
+		"passport_id_group": "group",
+		"created_at": "2020-05-04T10:21:00Z",
+		"match": "new_group",
+		"group_size": 1,
+		"geo": {"country": "GB", "region": "England", "city": "London", "asn": 20712}
+	}`, w.Body.String())
+
+	// v1 responses are not changed
+	w = httptest.NewRecorder()
+	ch.HandleFunction().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/id/settle", strings.NewReader(body)))
+	response := map[string]interface{}{}
+	if assert.NoError(json.NewDecoder(w.Body).Decode(&response)) {
+		assert.Equal(map[string]interface{}{"passport_id": "id", "passport_id_group": "group"}, response)
+	}
+}
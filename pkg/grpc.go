@@ -0,0 +1,405 @@
+package managerid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/josedelrio85/managerid/pkg/identitypb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// IdentityServer is a struct that implements the gRPC IdentityService.
+// It shares the Querier, the validation and the resolution logic of the
+// ClientHandler passed as Handler.
+type IdentityServer struct {
+	identitypb.UnimplementedIdentityServiceServer
+	Handler *ClientHandler
+}
+
+// authenticate checks the API key of the x-api-key metadata, or the bearer token
+// of the authorization metadata, when ClientHandler.RequireAPIKey is set.
+// Returns the key, nil if no key is required, or Unauthenticated if it is
+// missing, not valid or revoked.
+func (s *IdentityServer) authenticate(ctx context.Context) (*APIKey, error) {
+	if !s.Handler.RequireAPIKey {
+		return nil, nil
+	}
+	value := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(strings.ToLower(APIKeyHeader)); len(values) > 0 {
+			value = values[0]
+		} else {
+			value = bearerToken(firstMetadata(md, "authorization"))
+		}
+	}
+	key, err := s.Handler.authenticate(value)
+	if apiErr, ok := err.(*APIError); ok {
+		return nil, grpcError(apiErr)
+	}
+	if err != nil {
+		return nil, grpcServerError("error performing GetAPIKey", err)
+	}
+	return key, nil
+}
+
+// authenticateLookup checks the credentials of the calls that return the stored
+// identities, as WithLookupAccess does: the API key when ClientHandler.RequireAPIKey
+// is set, and the admin token of the authorization metadata otherwise.
+// Returns the key, nil if the admin token is used, Unauthenticated if the
+// credentials are missing or not valid, or Unavailable if no admin token is set.
+func (s *IdentityServer) authenticateLookup(ctx context.Context) (*APIKey, error) {
+	if s.Handler.RequireAPIKey {
+		return s.authenticate(ctx)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if apiErr := s.Handler.checkAdmin(bearerToken(firstMetadata(md, "authorization"))); apiErr != nil {
+		return nil, grpcError(apiErr)
+	}
+	return nil, nil
+}
+
+// firstMetadata returns the first value of the key in the metadata, or empty.
+func firstMetadata(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// rateLimit throttles the call with ClientHandler.RateLimits, as WithRateLimit
+// does, by the IP of the peer and by the applications of the interactions.
+// Returns ResourceExhausted if it is throttled, or InvalidArgument if the
+// interactions of an application exceed its burst.
+func (s *IdentityServer) rateLimit(ctx context.Context, interactions []Interaction) error {
+	if s.Handler.RateLimits == nil {
+		return nil
+	}
+	ip := ""
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		ip = p.Addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+	applications := func() map[string]int {
+		counts := map[string]int{}
+		for _, interaction := range interactions {
+			if interaction.Application != "" {
+				counts[interaction.Application]++
+			}
+		}
+		return counts
+	}
+	if apiErr, _ := s.Handler.rateLimit(ip, applications); apiErr != nil {
+		return grpcError(apiErr)
+	}
+	return nil
+}
+
+// Settle resolves the identity of an interaction.
+// Returns Unauthenticated if the API key is required and not valid,
+// ResourceExhausted if it is throttled by the rate limits,
+// InvalidArgument with the invalid fields if the interaction is not valid,
+// PermissionDenied if it is out of the scope of the API key, or it is a bot or
+// internal and its application rejects them.
+func (s *IdentityServer) Settle(ctx context.Context, req *identitypb.SettleRequest) (*identitypb.SettleResponse, error) {
+	key, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	interaction := interactionFromProto(ctx, req.GetInteraction())
+	if err := s.rateLimit(ctx, []Interaction{interaction}); err != nil {
+		return nil, err
+	}
+	if errs := interaction.Validate(); len(errs) > 0 {
+		return nil, grpcError(validationError(errs))
+	}
+	if apiErr := key.authorize(interaction); apiErr != nil {
+		return nil, grpcError(apiErr)
+	}
+
+	interaction, identity, apiErr := s.Handler.screen(interaction)
+	if apiErr != nil {
+		return nil, grpcError(apiErr)
+	}
+	if identity == nil {
+		var err error
+		if identity, err = s.Handler.Querier.GetIdentity(interaction); err != nil {
+			return nil, grpcServerError("error performing interaction's CheckIdentity", err)
+		}
+	}
+
+	responses, err := s.Handler.settleResponses([]*Identity{identity})
+	if err != nil {
+		return nil, grpcServerError("error performing GroupSizes", err)
+	}
+	return settleResponseToProto(identity, responses[0]), nil
+}
+
+// SettleBatch resolves the identities of several interactions, in order.
+// The result of an invalid interaction holds its error instead of the identity.
+// Returns Unauthenticated if the API key is required and not valid,
+// ResourceExhausted if it is throttled by the rate limits, or InvalidArgument if
+// the batch exceeds the maximum batch size or the burst of an application.
+func (s *IdentityServer) SettleBatch(ctx context.Context, req *identitypb.SettleBatchRequest) (*identitypb.SettleBatchResponse, error) {
+	key, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if max := s.Handler.maxBatchSize(); len(req.GetInteractions()) > max {
+		return nil, grpcError(&APIError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    CodeBatchTooLarge,
+			Message: fmt.Sprintf("batch of %d interactions exceeds the maximum of %d", len(req.GetInteractions()), max),
+		})
+	}
+
+	interactions := make([]Interaction, len(req.GetInteractions()))
+	for i, interaction := range req.GetInteractions() {
+		interactions[i] = interactionFromProto(ctx, interaction)
+	}
+	if err := s.rateLimit(ctx, interactions); err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(interactions))
+	if err := s.Handler.resolveBatch(key, nil, interactions, results); err != nil {
+		return nil, grpcServerError("error performing batch GetIdentities", err)
+	}
+
+	identities := []*Identity{}
+	for _, result := range results {
+		if result.Identity != nil {
+			identities = append(identities, result.Identity)
+		}
+	}
+	responses, err := s.Handler.settleResponses(identities)
+	if err != nil {
+		return nil, grpcServerError("error performing GroupSizes", err)
+	}
+
+	res := &identitypb.SettleBatchResponse{
+		Results: make([]*identitypb.SettleBatchResult, len(results)),
+	}
+	for i, result := range results {
+		if result.Identity == nil {
+			res.Results[i] = &identitypb.SettleBatchResult{
+				Result: &identitypb.SettleBatchResult_Error{Error: errorToProto(result.Error)},
+			}
+			continue
+		}
+		res.Results[i] = &identitypb.SettleBatchResult{
+			Result: &identitypb.SettleBatchResult_Settle{Settle: settleResponseToProto(result.Identity, responses[0])},
+		}
+		responses = responses[1:]
+	}
+	return res, nil
+}
+
+// GetIdentity looks up an identity by its passport id, with its latest visits.
+// Returns Unauthenticated or Unavailable if the credentials are not valid, see
+// authenticateLookup, or NotFound if there is no identity with that passport id
+// or it is not allowed by the API key.
+func (s *IdentityServer) GetIdentity(ctx context.Context, req *identitypb.GetIdentityRequest) (*identitypb.Identity, error) {
+	key, err := s.authenticateLookup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetPassportId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "passport_id is required")
+	}
+
+	identity, err := s.Handler.Querier.GetIdentityByID(req.GetPassportId())
+	if err == nil && key != nil && !key.Allows(identity.Application, identity.Provider) {
+		err = ErrIdentityNotFound
+	}
+	if errors.Is(err, ErrIdentityNotFound) {
+		return nil, status.Errorf(codes.NotFound, "identity %s not found", req.GetPassportId())
+	}
+	if err != nil {
+		return nil, grpcServerError("error performing GetIdentityByID", err)
+	}
+
+	visits, err := s.Handler.Querier.GetVisits(identity.PassportID, DefaultVisitsLimit)
+	if err != nil {
+		return nil, grpcServerError("error performing GetVisits", err)
+	}
+
+	res := identityToProto(identity)
+	for _, visit := range visits {
+		res.Visits = append(res.Visits, &identitypb.Visit{
+			Context:   visitContextToProto(visit.VisitContext),
+			CreatedAt: timestamppb.New(visit.Createdat),
+		})
+	}
+	return res, nil
+}
+
+// GetGroup looks up the identities of a group, oldest first, only the ones
+// allowed by the API key.
+// Returns Unauthenticated or Unavailable if the credentials are not valid, see
+// authenticateLookup, or NotFound if the group has no identities allowed.
+func (s *IdentityServer) GetGroup(ctx context.Context, req *identitypb.GetGroupRequest) (*identitypb.GetGroupResponse, error) {
+	key, err := s.authenticateLookup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetPassportIdGroup() == "" {
+		return nil, status.Error(codes.InvalidArgument, "passport_id_group is required")
+	}
+
+	identities, err := s.Handler.Querier.GetGroup(req.GetPassportIdGroup())
+	if err != nil {
+		return nil, grpcServerError("error performing GetGroup", err)
+	}
+	if key != nil {
+		allowed := []*Identity{}
+		for _, identity := range identities {
+			if key.Allows(identity.Application, identity.Provider) {
+				allowed = append(allowed, identity)
+			}
+		}
+		identities = allowed
+	}
+	if len(identities) == 0 {
+		return nil, status.Errorf(codes.NotFound, "group %s not found", req.GetPassportIdGroup())
+	}
+
+	res := &identitypb.GetGroupResponse{}
+	for _, identity := range identities {
+		res.Identities = append(res.Identities, identityToProto(identity))
+	}
+	return res, nil
+}
+
+// grpcError converts an APIError to a gRPC status error.
+func grpcError(apiErr *APIError) error {
+	code := codes.InvalidArgument
+	switch apiErr.Status {
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	case http.StatusInternalServerError:
+		code = codes.Internal
+	}
+
+	message := apiErr.Message
+	if len(apiErr.Details) > 0 {
+		details := []string{}
+		for _, detail := range apiErr.Details {
+			details = append(details, detail.Field+" "+detail.Message)
+		}
+		message = fmt.Sprintf("%s: %s", message, strings.Join(details, ", "))
+	}
+	return status.Error(code, message)
+}
+
+// grpcServerError logs the error and returns a generic gRPC status error.
+func grpcServerError(message string, err error) error {
+	log.Printf("[grpc] %s, err: %v", message, err)
+	return grpcError(serverError(err))
+}
+
+// interactionFromProto converts a protobuf interaction.
+// The user agent is taken from the user-agent metadata when the interaction has none.
+func interactionFromProto(ctx context.Context, interaction *identitypb.Interaction) Interaction {
+	userAgent := interaction.GetUserAgent()
+	if userAgent == "" {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get("user-agent"); len(values) > 0 {
+				userAgent = values[0]
+			}
+		}
+	}
+	return Interaction{
+		IP:          interaction.GetIp(),
+		Provider:    interaction.GetProvider(),
+		Application: interaction.GetApplication(),
+		UserAgent:   userAgent,
+		VisitContext: VisitContext{
+			PageURL:     interaction.GetVisit().GetPageUrl(),
+			Referrer:    interaction.GetVisit().GetReferrer(),
+			UTMSource:   interaction.GetVisit().GetUtmSource(),
+			UTMMedium:   interaction.GetVisit().GetUtmMedium(),
+			UTMCampaign: interaction.GetVisit().GetUtmCampaign(),
+			UTMTerm:     interaction.GetVisit().GetUtmTerm(),
+			UTMContent:  interaction.GetVisit().GetUtmContent(),
+			Gclid:       interaction.GetVisit().GetGclid(),
+			Fbclid:      interaction.GetVisit().GetFbclid(),
+		},
+	}
+}
+
+// visitContextToProto converts a visit context to protobuf.
+func visitContextToProto(context VisitContext) *identitypb.VisitContext {
+	return &identitypb.VisitContext{
+		PageUrl:     context.PageURL,
+		Referrer:    context.Referrer,
+		UtmSource:   context.UTMSource,
+		UtmMedium:   context.UTMMedium,
+		UtmCampaign: context.UTMCampaign,
+		UtmTerm:     context.UTMTerm,
+		UtmContent:  context.UTMContent,
+		Gclid:       context.Gclid,
+		Fbclid:      context.Fbclid,
+	}
+}
+
+// identityToProto converts an identity to protobuf.
+func identityToProto(identity *Identity) *identitypb.Identity {
+	return &identitypb.Identity{
+		PassportId:      identity.PassportID,
+		PassportIdGroup: identity.PassportIDGrp,
+		Ip:              identity.IP,
+		Provider:        identity.Provider,
+		Application:     identity.Application,
+		CreatedAt:       timestamppb.New(identity.Createdat),
+		Match:           matchToProto[identity.Match],
+		Bot:             identity.Bot,
+		Internal:        identity.Internal,
+	}
+}
+
+// settleResponseToProto converts a resolved identity and its SettleResponse to protobuf.
+func settleResponseToProto(identity *Identity, response *SettleResponse) *identitypb.SettleResponse {
+	return &identitypb.SettleResponse{
+		Identity:  identityToProto(identity),
+		GroupSize: int32(response.GroupSize),
+		Token:     response.Token,
+	}
+}
+
+// errorToProto converts the APIError of a batch result to protobuf.
+func errorToProto(apiErr *APIError) *identitypb.Error {
+	res := &identitypb.Error{
+		Code:    apiErr.Code,
+		Message: apiErr.Message,
+	}
+	for _, detail := range apiErr.Details {
+		res.Details = append(res.Details, &identitypb.FieldError{Field: detail.Field, Message: detail.Message})
+	}
+	return res
+}
+
+// matchToProto maps the values of Identity.Match to protobuf.
+var matchToProto = map[string]identitypb.Match{
+	MatchNewGroup:   identitypb.Match_MATCH_NEW_GROUP,
+	MatchNewInGroup: identitypb.Match_MATCH_NEW_IN_GROUP,
+	MatchReused:     identitypb.Match_MATCH_REUSED,
+	MatchEphemeral:  identitypb.Match_MATCH_EPHEMERAL,
+}
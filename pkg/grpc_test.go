@@ -0,0 +1,224 @@
+package managerid
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/josedelrio85/managerid/pkg/identitypb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestIdentityServer(t *testing.T) {
+	assert := assert.New(t)
+
+	createdat := time.Date(2020, 5, 4, 10, 21, 0, 0, time.UTC)
+	stored := &Identity{IP: "127.0.0.1", Provider: "Prov", Application: "App", PassportID: "id", PassportIDGrp: "group", Createdat: createdat}
+	ch := &ClientHandler{
+		Querier: &FakeDb{
+			GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+				return &Identity{IP: interaction.IP, PassportID: "id", PassportIDGrp: "group", Createdat: createdat, Match: MatchNewGroup}, nil
+			},
+			GetIdentitiesFunc: func(interactions []Interaction) ([]*Identity, error) {
+				idents := []*Identity{}
+				for _, interaction := range interactions {
+					idents = append(idents, &Identity{IP: interaction.IP, PassportID: interaction.IP, PassportIDGrp: "group", Match: MatchReused})
+				}
+				return idents, nil
+			},
+			GroupSizesFunc: func(groups []string) (map[string]int, error) {
+				return map[string]int{"group": 2}, nil
+			},
+			GetIdentityByIDFunc: func(passportID string) (*Identity, error) {
+				if passportID != stored.PassportID {
+					return nil, ErrIdentityNotFound
+				}
+				return stored, nil
+			},
+			GetGroupFunc: func(idgroup string) ([]*Identity, error) {
+				if idgroup != stored.PassportIDGrp {
+					return []*Identity{}, nil
+				}
+				return []*Identity{stored}, nil
+			},
+			GetVisitsFunc: func(passportID string, limit int) ([]*Visit, error) {
+				return []*Visit{{VisitContext: VisitContext{PageURL: "https://example.com/", UTMSource: "news"}, Createdat: createdat}}, nil
+			},
+		},
+		MaxBatchSize: 3,
+		AdminToken:   "admin",
+		Bots: &BotPolicy{
+			Classifier: &BotClassifier{UserAgents: DefaultBotUserAgents},
+			Actions:    map[string]BotAction{"Ephemeral": BotEphemeral, "Rejected": BotReject},
+		},
+	}
+
+	client := helperGRPCClient(t, ch)
+	ctx := context.Background()
+
+	settle, err := client.Settle(ctx, &identitypb.SettleRequest{
+		Interaction: &identitypb.Interaction{Ip: "127.0.0.1", Provider: "Prov", Application: "App"},
+	})
+	if assert.NoError(err) {
+		assert.Equal("id", settle.GetIdentity().GetPassportId())
+		assert.Equal("group", settle.GetIdentity().GetPassportIdGroup())
+		assert.Equal(identitypb.Match_MATCH_NEW_GROUP, settle.GetIdentity().GetMatch())
+		assert.Equal(createdat, settle.GetIdentity().GetCreatedAt().AsTime())
+		assert.Equal(int32(2), settle.GetGroupSize())
+	}
+
+	_, err = client.Settle(ctx, &identitypb.SettleRequest{
+		Interaction: &identitypb.Interaction{Ip: "garbage", Provider: "Prov", Application: "App"},
+	})
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+	assert.Contains(status.Convert(err).Message(), "ip must be a valid IPv4 or IPv6 address")
+
+	_, err = client.Settle(ctx, &identitypb.SettleRequest{
+		Interaction: &identitypb.Interaction{
+			Ip: "127.0.0.1", Provider: "Prov", Application: "App",
+			Visit: &identitypb.VisitContext{PageUrl: "/landing"},
+		},
+	})
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+	assert.Contains(status.Convert(err).Message(), "page_url must be an absolute URL")
+
+	settle, err = client.Settle(ctx, &identitypb.SettleRequest{
+		Interaction: &identitypb.Interaction{Ip: "127.0.0.1", Provider: "Prov", Application: "Ephemeral", UserAgent: "curl/7.68.0"},
+	})
+	if assert.NoError(err) {
+		assert.Equal(identitypb.Match_MATCH_EPHEMERAL, settle.GetIdentity().GetMatch())
+		assert.Equal(BotUserAgent, settle.GetIdentity().GetBot())
+		assert.Equal(int32(1), settle.GetGroupSize())
+	}
+
+	_, err = client.Settle(ctx, &identitypb.SettleRequest{
+		Interaction: &identitypb.Interaction{Ip: "127.0.0.1", Provider: "Prov", Application: "Rejected", UserAgent: "curl/7.68.0"},
+	})
+	assert.Equal(codes.PermissionDenied, status.Code(err))
+
+	batch, err := client.SettleBatch(ctx, &identitypb.SettleBatchRequest{
+		Interactions: []*identitypb.Interaction{
+			{Ip: "127.0.0.1", Provider: "Prov", Application: "App"},
+			{Ip: "127.0.0.2"},
+			{Ip: "127.0.0.3", Provider: "Prov", Application: "App"},
+		},
+	})
+	if assert.NoError(err) && assert.Len(batch.GetResults(), 3) {
+		assert.Equal("127.0.0.1", batch.GetResults()[0].GetSettle().GetIdentity().GetPassportId())
+		assert.Equal(CodeValidation, batch.GetResults()[1].GetError().GetCode())
+		assert.Len(batch.GetResults()[1].GetError().GetDetails(), 2)
+		assert.Equal("127.0.0.3", batch.GetResults()[2].GetSettle().GetIdentity().GetPassportId())
+	}
+
+	_, err = client.SettleBatch(ctx, &identitypb.SettleBatchRequest{
+		Interactions: []*identitypb.Interaction{{}, {}, {}, {}},
+	})
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+
+	// the lookups require the admin token when API keys are not required
+	_, err = client.GetIdentity(ctx, &identitypb.GetIdentityRequest{PassportId: "id"})
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+	_, err = client.GetGroup(ctx, &identitypb.GetGroupRequest{PassportIdGroup: "group"})
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer admin")
+	identity, err := client.GetIdentity(ctx, &identitypb.GetIdentityRequest{PassportId: "id"})
+	if assert.NoError(err) {
+		assert.Equal("127.0.0.1", identity.GetIp())
+		assert.Equal("Prov", identity.GetProvider())
+		assert.Equal(identitypb.Match_MATCH_UNSPECIFIED, identity.GetMatch())
+		if assert.Len(identity.GetVisits(), 1) {
+			assert.Equal("https://example.com/", identity.GetVisits()[0].GetContext().GetPageUrl())
+			assert.Equal("news", identity.GetVisits()[0].GetContext().GetUtmSource())
+			assert.Equal(createdat, identity.GetVisits()[0].GetCreatedAt().AsTime())
+		}
+	}
+
+	_, err = client.GetIdentity(ctx, &identitypb.GetIdentityRequest{PassportId: "unknown"})
+	assert.Equal(codes.NotFound, status.Code(err))
+
+	group, err := client.GetGroup(ctx, &identitypb.GetGroupRequest{PassportIdGroup: "group"})
+	if assert.NoError(err) {
+		assert.Len(group.GetIdentities(), 1)
+	}
+
+	_, err = client.GetGroup(ctx, &identitypb.GetGroupRequest{PassportIdGroup: "unknown"})
+	assert.Equal(codes.NotFound, status.Code(err))
+}
+
+// helperGRPCClient serves an IdentityServer in memory and returns a client connected to it.
+func helperGRPCClient(t *testing.T, ch *ClientHandler) identitypb.IdentityServiceClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	identitypb.RegisterIdentityServiceServer(server, &IdentityServer{Handler: ch})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatalf("error dialing the test gRPC server: Err: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return identitypb.NewIdentityServiceClient(conn)
+}
+
+func TestInteractionFromProto(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("user-agent", "curl/7.68.0"))
+	interaction := interactionFromProto(ctx, &identitypb.Interaction{Ip: "127.0.0.1", Provider: "Prov", Application: "App"})
+	assert.Equal("curl/7.68.0", interaction.UserAgent)
+
+	// the user agent of the interaction takes precedence over the metadata
+	interaction = interactionFromProto(ctx, &identitypb.Interaction{UserAgent: "Mozilla/5.0"})
+	assert.Equal("Mozilla/5.0", interaction.UserAgent)
+
+	interaction = interactionFromProto(context.Background(), &identitypb.Interaction{})
+	assert.Empty(interaction.UserAgent)
+}
+
+func TestIdentityServerRateLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	ch := &ClientHandler{
+		Querier: &FakeDb{
+			GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+				return &Identity{PassportID: "id", PassportIDGrp: "group"}, nil
+			},
+			GetIdentitiesFunc: func(interactions []Interaction) ([]*Identity, error) {
+				idents := []*Identity{}
+				for range interactions {
+					idents = append(idents, &Identity{PassportID: "id", PassportIDGrp: "group"})
+				}
+				return idents, nil
+			},
+			GroupSizesFunc: func(groups []string) (map[string]int, error) {
+				return map[string]int{"group": 1}, nil
+			},
+		},
+		RateLimits: NewRateLimiter(RateLimit{}, map[string]RateLimit{"App": {Rate: 1.0 / 60, Burst: 2}}),
+	}
+	client := helperGRPCClient(t, ch)
+	ctx := context.Background()
+	interaction := &identitypb.Interaction{Ip: "127.0.0.1", Provider: "Prov", Application: "App"}
+
+	// a batch bigger than the burst is never allowed
+	_, err := client.SettleBatch(ctx, &identitypb.SettleBatchRequest{Interactions: []*identitypb.Interaction{interaction, interaction, interaction}})
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+
+	_, err = client.SettleBatch(ctx, &identitypb.SettleBatchRequest{Interactions: []*identitypb.Interaction{interaction}})
+	assert.NoError(err)
+	_, err = client.Settle(ctx, &identitypb.SettleRequest{Interaction: interaction})
+	assert.NoError(err)
+	_, err = client.Settle(ctx, &identitypb.SettleRequest{Interaction: interaction})
+	assert.Equal(codes.ResourceExhausted, status.Code(err))
+}
@@ -0,0 +1,325 @@
+package managerid
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader is the header used by clients to make a request idempotent.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set to true in the responses replayed from the store.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	// DefaultIdempotencyTTL is the time a response is stored when no TTL is passed
+	// to NewMemoryIdempotencyStore.
+	DefaultIdempotencyTTL = 24 * time.Hour
+	// DefaultIdempotencyMaxEntries is the number of keys kept when no maximum is
+	// passed to NewMemoryIdempotencyStore.
+	DefaultIdempotencyMaxEntries = 100000
+
+	// idempotencySweepInterval is how often the expired keys are removed, at most.
+	idempotencySweepInterval = time.Minute
+
+	// maxIdempotencyKey is the maximum length of an idempotency key.
+	maxIdempotencyKey = 255
+)
+
+// idempotentHeaders are the response headers stored along with the body, besides
+// Content-Type, like the signed cookie of a settle.
+var idempotentHeaders = []string{"Set-Cookie"}
+
+var (
+	// ErrIdempotencyConflict is returned when a key is reused with a different request.
+	ErrIdempotencyConflict = errors.New("idempotency key already used with a different request")
+	// ErrIdempotencyInFlight is returned when a key is reused while its first request is running.
+	ErrIdempotencyInFlight = errors.New("idempotency key in use by a request in progress")
+)
+
+// StoredResponse is a struct that represents a response kept to be replayed.
+type StoredResponse struct {
+	Status      int
+	ContentType string
+	// Header holds the idempotentHeaders of the response.
+	Header http.Header
+	Body   []byte
+}
+
+// IdempotencyStore is an interface used to keep the responses of idempotent requests.
+// Reserve returns the stored response of the key, or reserves the key for a new
+// request if there is none. Complete stores the response of a reserved key, and
+// Release frees a reserved key without storing anything.
+type IdempotencyStore interface {
+	Reserve(key, fingerprint string) (*StoredResponse, error)
+	Complete(key string, response *StoredResponse)
+	Release(key string)
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore that keeps the responses in memory
+// during TTL. At most MaxEntries keys are kept: when it is full the oldest key is
+// evicted to reserve a new one.
+type MemoryIdempotencyStore struct {
+	TTL        time.Duration
+	MaxEntries int
+
+	entries map[string]*idempotencyEntry
+	// order holds the keys of the entries, the first to expire first.
+	order     *list.List
+	lastSweep time.Time
+	sync.Mutex
+}
+
+// idempotencyEntry is a reserved or completed key.
+type idempotencyEntry struct {
+	fingerprint string
+	response    *StoredResponse
+	expires     time.Time
+	element     *list.Element
+}
+
+// NewMemoryIdempotencyStore returns a MemoryIdempotencyStore that keeps the
+// responses during ttl, or DefaultIdempotencyTTL if ttl is not positive, of
+// maxEntries keys at most, or DefaultIdempotencyMaxEntries if it is not positive.
+func NewMemoryIdempotencyStore(ttl time.Duration, maxEntries int) *MemoryIdempotencyStore {
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultIdempotencyMaxEntries
+	}
+	return &MemoryIdempotencyStore{
+		TTL:        ttl,
+		MaxEntries: maxEntries,
+		entries:    map[string]*idempotencyEntry{},
+		order:      list.New(),
+	}
+}
+
+// Reserve implements the IdempotencyStore interface.
+// Returns ErrIdempotencyConflict if the key was used with other fingerprint, and
+// ErrIdempotencyInFlight if the key is reserved but not completed yet.
+func (s *MemoryIdempotencyStore) Reserve(key, fingerprint string) (*StoredResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	entry, ok := s.entries[key]
+	if ok && now.Before(entry.expires) {
+		if entry.fingerprint != fingerprint {
+			return nil, ErrIdempotencyConflict
+		}
+		if entry.response == nil {
+			return nil, ErrIdempotencyInFlight
+		}
+		return entry.response, nil
+	}
+
+	if ok {
+		s.remove(key)
+	}
+	for len(s.entries) >= s.MaxEntries {
+		s.remove(s.order.Front().Value.(string))
+	}
+	s.entries[key] = &idempotencyEntry{
+		fingerprint: fingerprint,
+		expires:     now.Add(s.TTL),
+		element:     s.order.PushBack(key),
+	}
+	return nil, nil
+}
+
+// Complete implements the IdempotencyStore interface.
+func (s *MemoryIdempotencyStore) Complete(key string, response *StoredResponse) {
+	s.Lock()
+	defer s.Unlock()
+
+	if entry, ok := s.entries[key]; ok {
+		entry.response = response
+		entry.expires = time.Now().Add(s.TTL)
+		s.order.MoveToBack(entry.element)
+	}
+}
+
+// Release implements the IdempotencyStore interface.
+func (s *MemoryIdempotencyStore) Release(key string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.remove(key)
+}
+
+// remove deletes the entry of the key, if any.
+func (s *MemoryIdempotencyStore) remove(key string) {
+	if entry, ok := s.entries[key]; ok {
+		s.order.Remove(entry.element)
+		delete(s.entries, key)
+	}
+}
+
+// sweep deletes the expired entries, at most once per idempotencySweepInterval.
+func (s *MemoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < idempotencySweepInterval {
+		return
+	}
+	for element := s.order.Front(); element != nil; {
+		key := element.Value.(string)
+		element = element.Next()
+		if now.Before(s.entries[key].expires) {
+			break
+		}
+		s.remove(key)
+	}
+	s.lastSweep = now
+}
+
+// WithIdempotency is a middleware that makes the requests with an Idempotency-Key
+// header idempotent. The first response of a key is stored and replayed byte for
+// byte, with its signed cookie, to the requests that repeat the same method, path
+// and body with that key.
+// The keys are scoped by the API key and the signing client of the request, so
+// a caller can not replay the responses of another one.
+// Server errors are not stored, so the request can be retried.
+// Requests without the header, or when ClientHandler.Idempotency is not set, are not affected.
+// Errors are returned as an APIError envelope:
+// StatusBadRequest if the key is too long.
+// StatusUnprocessableEntity if the key was used with a different request.
+// StatusConflict if the first request of the key is still in progress.
+func (ch *ClientHandler) WithIdempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if ch.Idempotency == nil || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKey {
+			writeError(w, r, &APIError{
+				Status:  http.StatusBadRequest,
+				Code:    CodeInvalidIdempotencyKey,
+				Message: "Idempotency-Key must be at most 255 characters",
+			})
+			return
+		}
+
+		body, err := ioutil.ReadAll(&limitedBody{r: r.Body, n: ch.maxBodySize()})
+		if errors.Is(err, errBodyTooLarge) {
+			writeError(w, r, bodyTooLarge(ch.maxBodySize()))
+			return
+		}
+		if err != nil {
+			writeError(w, r, &APIError{
+				Status:  http.StatusBadRequest,
+				Code:    CodeMalformedBody,
+				Message: "error reading the request body",
+			})
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		scope := idempotencyScope(r)
+		key = scope + "\n" + key
+		hash := sha256.New()
+		hash.Write([]byte(scope + "\n" + r.Method + " " + r.URL.Path + "\n"))
+		hash.Write(body)
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		stored, err := ch.Idempotency.Reserve(key, fingerprint)
+		switch {
+		case errors.Is(err, ErrIdempotencyConflict):
+			writeError(w, r, &APIError{
+				Status:  http.StatusUnprocessableEntity,
+				Code:    CodeIdempotencyConflict,
+				Message: err.Error(),
+			})
+			return
+		case errors.Is(err, ErrIdempotencyInFlight):
+			writeError(w, r, &APIError{
+				Status:  http.StatusConflict,
+				Code:    CodeIdempotencyInFlight,
+				Message: err.Error(),
+			})
+			return
+		case err != nil:
+			internalError(w, r, "error reserving idempotency key", err)
+			return
+		case stored != nil:
+			for name, values := range stored.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Content-Type", stored.ContentType)
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		// the key is released if the handler panics
+		done := false
+		defer func() {
+			if !done {
+				ch.Idempotency.Release(key)
+			}
+		}()
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		done = true
+
+		if recorder.status >= http.StatusInternalServerError {
+			ch.Idempotency.Release(key)
+			return
+		}
+		header := http.Header{}
+		for _, name := range idempotentHeaders {
+			if values := recorder.Header().Values(name); len(values) > 0 {
+				header[name] = append([]string{}, values...)
+			}
+		}
+		ch.Idempotency.Complete(key, &StoredResponse{
+			Status:      recorder.status,
+			ContentType: recorder.Header().Get("Content-Type"),
+			Header:      header,
+			Body:        recorder.body.Bytes(),
+		})
+	})
+}
+
+// idempotencyScope returns the caller of the request that scopes its idempotency
+// key: the id of the API key authenticated by WithAPIKey and the client of the
+// signature verified by WithSignature, empty when neither is used.
+func idempotencyScope(r *http.Request) string {
+	keyID := ""
+	if key := apiKeyFromContext(r.Context()); key != nil {
+		keyID = key.KeyID
+	}
+	return "key=" + keyID + ";client=" + signingClientFromContext(r.Context())
+}
+
+// responseRecorder is a http.ResponseWriter that keeps a copy of the status and
+// the body written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
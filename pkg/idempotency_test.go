@@ -0,0 +1,204 @@
+package managerid
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithIdempotency(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	fail := false
+	querier := &FakeDb{
+		GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+			calls++
+			if fail {
+				return nil, errors.New("Error 1054: Unknown column")
+			}
+			return &Identity{PassportID: fmt.Sprintf("id-%d", calls), PassportIDGrp: "group"}, nil
+		},
+	}
+	ch := ClientHandler{
+		Querier:     querier,
+		Idempotency: NewMemoryIdempotencyStore(time.Hour, 0),
+	}
+	r := mux.NewRouter()
+	ch.Routes(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	body := `{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}`
+	other := `{"ip": "127.0.0.2", "provider": "Prov", "application": "App"}`
+
+	tests := []struct {
+		Description   string
+		Key           string
+		Path          string
+		Body          string
+		Fail          bool
+		StatusCode    int
+		ExpectedBody  string
+		Replayed      bool
+		ExpectedCalls int
+	}{
+		{
+			Description:   "first request of a key is resolved",
+			Key:           "key-1",
+			Path:          "/v1/id/settle",
+			Body:          body,
+			StatusCode:    http.StatusOK,
+			ExpectedBody:  `{"passport_id_group":"group","passport_id":"id-1"}` + "\n",
+			ExpectedCalls: 1,
+		},
+		{
+			Description:   "repeated request of a key is replayed",
+			Key:           "key-1",
+			Path:          "/v1/id/settle",
+			Body:          body,
+			StatusCode:    http.StatusOK,
+			ExpectedBody:  `{"passport_id_group":"group","passport_id":"id-1"}` + "\n",
+			Replayed:      true,
+			ExpectedCalls: 1,
+		},
+		{
+			Description:   "same key with a different body is a conflict",
+			Key:           "key-1",
+			Path:          "/v1/id/settle",
+			Body:          other,
+			StatusCode:    http.StatusUnprocessableEntity,
+			ExpectedCalls: 1,
+		},
+		{
+			Description:   "same key in a different endpoint is a conflict",
+			Key:           "key-1",
+			Path:          "/v2/id/settle",
+			Body:          body,
+			StatusCode:    http.StatusUnprocessableEntity,
+			ExpectedCalls: 1,
+		},
+		{
+			Description:   "requests without key are not affected",
+			Path:          "/v1/id/settle",
+			Body:          body,
+			StatusCode:    http.StatusOK,
+			ExpectedBody:  `{"passport_id_group":"group","passport_id":"id-2"}` + "\n",
+			ExpectedCalls: 2,
+		},
+		{
+			Description:   "server errors are not stored",
+			Key:           "key-2",
+			Path:          "/v1/id/settle",
+			Body:          body,
+			Fail:          true,
+			StatusCode:    http.StatusInternalServerError,
+			ExpectedCalls: 3,
+		},
+		{
+			Description:   "a key whose request failed can be retried",
+			Key:           "key-2",
+			Path:          "/v1/id/settle",
+			Body:          body,
+			StatusCode:    http.StatusOK,
+			ExpectedBody:  `{"passport_id_group":"group","passport_id":"id-4"}` + "\n",
+			ExpectedCalls: 4,
+		},
+		{
+			Description:   "keys too long are rejected",
+			Key:           strings.Repeat("k", 256),
+			Path:          "/v1/id/settle",
+			Body:          body,
+			StatusCode:    http.StatusBadRequest,
+			ExpectedCalls: 4,
+		},
+	}
+
+	for _, test := range tests {
+		fail = test.Fail
+		req, err := http.NewRequest(http.MethodPost, ts.URL+test.Path, strings.NewReader(test.Body))
+		if err != nil {
+			t.Errorf("error creating the test Request: Err: %v", err)
+			return
+		}
+		if test.Key != "" {
+			req.Header.Set(IdempotencyKeyHeader, test.Key)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("error sending test Request: Err: %v", err)
+			return
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(err)
+
+		assert.Equal(test.StatusCode, resp.StatusCode, test.Description)
+		if test.ExpectedBody != "" {
+			assert.Equal(test.ExpectedBody, string(content), test.Description)
+			assert.Equal("application/json", resp.Header.Get("Content-Type"), test.Description)
+		}
+		assert.Equal(test.Replayed, resp.Header.Get(IdempotentReplayedHeader) == "true", test.Description)
+		assert.Equal(test.ExpectedCalls, calls, test.Description)
+	}
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	assert := assert.New(t)
+
+	store := NewMemoryIdempotencyStore(50*time.Millisecond, 2)
+
+	stored, err := store.Reserve("key", "fingerprint")
+	assert.Nil(stored)
+	assert.NoError(err)
+
+	_, err = store.Reserve("key", "fingerprint")
+	assert.Equal(ErrIdempotencyInFlight, err)
+
+	response := &StoredResponse{Status: http.StatusOK, Body: []byte("body")}
+	store.Complete("key", response)
+
+	stored, err = store.Reserve("key", "fingerprint")
+	assert.Equal(response, stored)
+	assert.NoError(err)
+
+	_, err = store.Reserve("key", "other")
+	assert.Equal(ErrIdempotencyConflict, err)
+
+	time.Sleep(60 * time.Millisecond)
+
+	stored, err = store.Reserve("key", "other")
+	assert.Nil(stored, "expired keys can be reused")
+	assert.NoError(err)
+	assert.Len(store.entries, 1)
+
+	// the oldest key is evicted when the store is full
+	store.Complete("key", response)
+	_, err = store.Reserve("second", "fingerprint")
+	assert.NoError(err)
+	_, err = store.Reserve("third", "fingerprint")
+	assert.NoError(err)
+	assert.Len(store.entries, 2)
+	assert.Equal(2, store.order.Len())
+	stored, err = store.Reserve("key", "fingerprint")
+	assert.Nil(stored, "evicted keys can be reused")
+	assert.NoError(err)
+	_, err = store.Reserve("third", "fingerprint")
+	assert.Equal(ErrIdempotencyInFlight, err)
+
+	// the expired keys are swept
+	time.Sleep(60 * time.Millisecond)
+	store.lastSweep = time.Time{}
+	_, err = store.Reserve("fourth", "fingerprint")
+	assert.NoError(err)
+	assert.Len(store.entries, 1)
+	assert.Equal(1, store.order.Len())
+}
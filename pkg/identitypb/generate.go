@@ -0,0 +1,5 @@
+// Package identitypb holds the protobuf definition of the gRPC identity service
+// and its generated code.
+package identitypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative identity.proto
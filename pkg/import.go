@@ -0,0 +1,263 @@
+package managerid
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultImportWindow is the number of records buffered by an Importer to
+	// sort them by timestamp when Importer.Window is not set.
+	DefaultImportWindow = 1000
+	// DefaultImportChunkSize is the number of records resolved together by an
+	// Importer when Importer.ChunkSize is not set.
+	DefaultImportChunkSize = 100
+
+	// maxImportLine is the maximum length of a NDJSON line.
+	maxImportLine = 1024 * 1024
+)
+
+// ImportRecord is a struct that represents a historical interaction, with the
+// moment it happened.
+type ImportRecord struct {
+	Interaction
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ImportResult is a struct that represents the outcome of a single NDJSON line
+// of an import. Only one of Identity or Error is set.
+type ImportResult struct {
+	Line      int        `json:"line"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	*Identity
+	Error *APIError `json:"error,omitempty"`
+}
+
+// Importer is a struct that resolves streams of historical interactions.
+// Records are resolved in timestamp order using a buffer of Window records, so
+// the input only needs to be roughly sorted: a record older than any record
+// already resolved is reported as an error.
+// Records out of the scope of APIKey, or of the CORS policy of the origin of the
+// request, are reported as errors when they are set, and so are the records
+// throttled by the application limits of RateLimits.
+// Records are screened by the Internal and Bots policies as the settled
+// interactions are: the blocked or rejected ones are reported as errors and the
+// excluded or ephemeral ones get an identity that is not stored.
+type Importer struct {
+	Querier    Querier
+	Window     int
+	ChunkSize  int
+	APIKey     *APIKey
+	RateLimits *RateLimiter
+	Internal   *InternalPolicy
+	Bots       *BotPolicy
+	origin     *corsScope
+}
+
+// importItem is a record waiting in the Importer buffer.
+type importItem struct {
+	line   int
+	record ImportRecord
+}
+
+// importQueue is a min-heap of records ordered by timestamp and line.
+type importQueue []importItem
+
+func (q importQueue) Len() int      { return len(q) }
+func (q importQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q importQueue) Less(i, j int) bool {
+	if q[i].record.Timestamp.Equal(q[j].record.Timestamp) {
+		return q[i].line < q[j].line
+	}
+	return q[i].record.Timestamp.Before(q[j].record.Timestamp)
+}
+func (q *importQueue) Push(x interface{}) { *q = append(*q, x.(importItem)) }
+func (q *importQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// Import reads NDJSON records from r, resolves them in timestamp order and writes
+// an ImportResult per line to w as NDJSON, as soon as every chunk is resolved.
+// Lines that can not be decoded are reported without stopping the import.
+// Returns an error if reading, resolving or writing fails.
+func (im *Importer) Import(r io.Reader, w io.Writer) error {
+	window := im.Window
+	if window <= 0 {
+		window = DefaultImportWindow
+	}
+	chunkSize := im.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultImportChunkSize
+	}
+
+	encoder := json.NewEncoder(w)
+	queue := &importQueue{}
+	chunk := []importItem{}
+	var last time.Time
+
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		records := make([]ImportRecord, len(chunk))
+		for i, item := range chunk {
+			records[i] = item.record
+		}
+		idents, err := im.Querier.ImportIdentities(records)
+		if err != nil {
+			return fmt.Errorf("error resolving lines %d to %d, err: %w", chunk[0].line, chunk[len(chunk)-1].line, err)
+		}
+		for i, item := range chunk {
+			timestamp := item.record.Timestamp
+			if err := encoder.Encode(ImportResult{Line: item.line, Timestamp: &timestamp, Identity: idents[i]}); err != nil {
+				return err
+			}
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		chunk = chunk[:0]
+		return nil
+	}
+
+	next := func() error {
+		item := heap.Pop(queue).(importItem)
+		last = item.record.Timestamp
+		chunk = append(chunk, item)
+		if len(chunk) >= chunkSize {
+			return flush()
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		record := ImportRecord{}
+		var apiErr *APIError
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			apiErr = decodeError(err)
+		} else if record.Timestamp.IsZero() {
+			apiErr = &APIError{
+				Status:  http.StatusUnprocessableEntity,
+				Code:    CodeInvalidPayload,
+				Message: "timestamp is required",
+			}
+		} else if errs := record.Validate(); len(errs) > 0 {
+			apiErr = validationError(errs)
+		} else if scopeErr := im.APIKey.authorize(record.Interaction); scopeErr != nil {
+			apiErr = scopeErr
+		} else if scopeErr := im.origin.authorize(record.Interaction); scopeErr != nil {
+			apiErr = scopeErr
+		} else if im.RateLimits != nil && im.rateLimited(record.Application) {
+			apiErr = rateLimited("too many requests for the application")
+		} else if record.Timestamp.Before(last) {
+			apiErr = &APIError{
+				Status:  http.StatusUnprocessableEntity,
+				Code:    CodeOutOfOrder,
+				Message: fmt.Sprintf("timestamp %s is older than records already imported, sort the input", record.Timestamp.Format(time.RFC3339)),
+			}
+		}
+		var ephemeral *Identity
+		if apiErr == nil {
+			record.Interaction, ephemeral, apiErr = screen(im.Internal, im.Bots, record.Interaction)
+		}
+		if apiErr != nil {
+			if err := encoder.Encode(ImportResult{Line: line, Error: apiErr}); err != nil {
+				return err
+			}
+			continue
+		}
+		if ephemeral != nil {
+			timestamp := record.Timestamp
+			if err := encoder.Encode(ImportResult{Line: line, Timestamp: &timestamp, Identity: ephemeral}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		heap.Push(queue, importItem{line: line, record: record})
+		if queue.Len() > window {
+			if err := next(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading line %d, err: %w", line+1, err)
+	}
+
+	for queue.Len() > 0 {
+		if err := next(); err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// rateLimited takes a token of the application of a record from RateLimits.
+// Returns true if the record is throttled.
+func (im *Importer) rateLimited(application string) bool {
+	wait, err := im.RateLimits.AllowApplications(map[string]int{application: 1})
+	return err != nil || wait > 0
+}
+
+// HandleImport is a function used to manage import requests.
+// Only POST method accepted.
+// The body is read as NDJSON ImportRecord elements and the response is streamed
+// as NDJSON ImportResult elements while the records are resolved.
+// Errors are returned as an APIError envelope:
+// StatusMethodNotAllowed if other kind of request is received.
+// StatusUnsupportedMediaType if the body is not declared as NDJSON.
+// If the import fails once the response is started, the last line holds the error.
+func (ch *ClientHandler) HandleImport() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, r, methodNotAllowed(r))
+			return
+		}
+
+		if apiErr := checkContentType(r, "application/x-ndjson"); apiErr != nil {
+			writeError(w, r, apiErr)
+			return
+		}
+
+		id := requestID(w, r)
+
+		// results are written while the body is still being read
+		if duplex, ok := w.(interface{ EnableFullDuplex() error }); ok {
+			duplex.EnableFullDuplex()
+		}
+
+		w.Header().Add("Content-Type", "application/x-ndjson")
+		importer := Importer{
+			Querier:    ch.Querier,
+			APIKey:     apiKeyFromContext(r.Context()),
+			RateLimits: ch.RateLimits,
+			Internal:   ch.Internal,
+			Bots:       ch.Bots,
+			origin:     corsScopeFromContext(r.Context()),
+		}
+		if err := importer.Import(r.Body, w); err != nil {
+			log.Printf("[%s] error importing interactions, err: %v", id, err)
+			apiErr := serverError(err)
+			apiErr.RequestID = id
+			json.NewEncoder(w).Encode(ImportResult{Error: apiErr})
+		}
+	})
+}
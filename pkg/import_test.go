@@ -0,0 +1,172 @@
+package managerid
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImporterImport(t *testing.T) {
+	assert := assert.New(t)
+
+	networks, _ := ParseNetworks("10.0.0.0/8")
+	tests := []struct {
+		Description   string
+		Input         string
+		Window        int
+		ChunkSize     int
+		RateLimits    *RateLimiter
+		Internal      *InternalPolicy
+		Bots          *BotPolicy
+		ExpectedLines []int
+		ExpectedErrs  []bool
+		ExpectedCalls int
+	}{
+		{
+			Description: "records inside the window are resolved in timestamp order",
+			Input: `{"ip": "1.1.1.1", "provider": "Prov", "application": "App", "timestamp": "2020-01-01T10:00:00Z"}
+{"ip": "1.1.1.2", "provider": "Prov", "application": "App", "timestamp": "2020-01-01T09:00:00Z"}
+{"ip": "1.1.1.3", "provider": "Prov", "application": "App", "timestamp": "2020-01-01T11:00:00Z"}`,
+			Window:        5,
+			ChunkSize:     2,
+			ExpectedLines: []int{2, 1, 3},
+			ExpectedErrs:  []bool{false, false, false},
+			ExpectedCalls: 2,
+		},
+		{
+			Description: "records older than the resolved ones and invalid lines are reported as errors",
+			Input: `{"ip": "1.1.1.1", "provider": "Prov", "application": "App", "timestamp": "2020-01-01T10:00:00Z"}
+{"ip": "1.1.1.2", "provider": "Prov", "application": "App", "timestamp": "2020-01-01T11:00:00Z"}
+{"ip": "1.1.1.3", "provider": "Prov", "application": "App", "timestamp": "2020-01-01T09:00:00Z"}
+garbage
+
+{"ip": "1.1.1.4", "provider": "Prov", "application": "App"}`,
+			Window:        1,
+			ChunkSize:     10,
+			ExpectedLines: []int{3, 4, 6, 1, 2},
+			ExpectedErrs:  []bool{true, true, true, false, false},
+			ExpectedCalls: 1,
+		},
+		{
+			Description: "records throttled by the application limits are reported as errors",
+			Input: `{"ip": "1.1.1.1", "provider": "Prov", "application": "App", "timestamp": "2020-01-01T10:00:00Z"}
+{"ip": "1.1.1.2", "provider": "Prov", "application": "App", "timestamp": "2020-01-01T11:00:00Z"}
+{"ip": "1.1.1.3", "provider": "Prov", "application": "App", "timestamp": "2020-01-01T12:00:00Z"}`,
+			Window:        5,
+			ChunkSize:     10,
+			RateLimits:    NewRateLimiter(RateLimit{}, map[string]RateLimit{"App": {Rate: 1.0 / 60, Burst: 2}}),
+			ExpectedLines: []int{3, 1, 2},
+			ExpectedErrs:  []bool{true, false, false},
+			ExpectedCalls: 1,
+		},
+		{
+			Description: "records blocked by the internal and bot policies are reported as errors and the excluded ones are not stored",
+			Input: `{"ip": "10.0.0.1", "provider": "Prov", "application": "Blocked", "timestamp": "2020-01-01T10:00:00Z"}
+{"ip": "10.0.0.2", "provider": "Prov", "application": "App", "timestamp": "2020-01-01T11:00:00Z"}
+{"ip": "1.1.1.3", "provider": "Prov", "application": "App", "user_agent": "Googlebot/2.1", "timestamp": "2020-01-01T12:00:00Z"}
+{"ip": "1.1.1.4", "provider": "Prov", "application": "App", "timestamp": "2020-01-01T13:00:00Z"}`,
+			Window:    5,
+			ChunkSize: 10,
+			Internal: &InternalPolicy{
+				Networks: map[string][]*net.IPNet{"*": networks},
+				Actions:  map[string]InternalAction{"Blocked": InternalBlock, "*": InternalExclude},
+			},
+			Bots: &BotPolicy{
+				Classifier: &BotClassifier{UserAgents: DefaultBotUserAgents},
+				Actions:    map[string]BotAction{"*": BotReject},
+			},
+			ExpectedLines: []int{1, 2, 3, 4},
+			ExpectedErrs:  []bool{true, false, true, false},
+			ExpectedCalls: 1,
+		},
+	}
+
+	for _, test := range tests {
+		querier := &FakeDb{
+			ImportIdentitiesFunc: func(records []ImportRecord) ([]*Identity, error) {
+				idents := []*Identity{}
+				for _, record := range records {
+					idents = append(idents, &Identity{PassportID: record.IP})
+				}
+				return idents, nil
+			},
+		}
+		importer := Importer{
+			Querier:    querier,
+			Window:     test.Window,
+			ChunkSize:  test.ChunkSize,
+			RateLimits: test.RateLimits,
+			Internal:   test.Internal,
+			Bots:       test.Bots,
+		}
+
+		output := &bytes.Buffer{}
+		err := importer.Import(strings.NewReader(test.Input), output)
+		assert.NoError(err, test.Description)
+
+		lines := []int{}
+		errs := []bool{}
+		scanner := bufio.NewScanner(output)
+		for scanner.Scan() {
+			result := ImportResult{}
+			if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+				t.Errorf("error unmarshaling the import result: Err: %v", err)
+			}
+			lines = append(lines, result.Line)
+			errs = append(errs, result.Error != nil)
+			if result.Error == nil {
+				assert.NotEmpty(result.PassportID, test.Description)
+				assert.NotNil(result.Timestamp, test.Description)
+			}
+		}
+
+		assert.Equal(test.ExpectedLines, lines, test.Description)
+		assert.Equal(test.ExpectedErrs, errs, test.Description)
+		assert.Equal(test.ExpectedCalls, querier.ImportIdentitiesCalls, test.Description)
+	}
+}
+
+func TestHandleImport(t *testing.T) {
+	assert := assert.New(t)
+
+	ch := ClientHandler{
+		Querier: &FakeDb{
+			ImportIdentitiesFunc: func(records []ImportRecord) ([]*Identity, error) {
+				return []*Identity{{PassportID: "id", PassportIDGrp: "group"}}, nil
+			},
+		},
+	}
+	ts := httptest.NewServer(ch.HandleImport())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Errorf("error sending test Request: Err: %v", err)
+		return
+	}
+	assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+
+	body := `{"ip": "1.1.1.1", "provider": "Prov", "application": "App", "timestamp": "2020-01-01T10:00:00Z"}`
+	resp, err = http.Post(ts.URL, "application/x-ndjson", strings.NewReader(body))
+	if err != nil {
+		t.Errorf("error sending test Request: Err: %v", err)
+		return
+	}
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	result := ImportResult{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Errorf("error unmarshaling the test response: Err: %v", err)
+	}
+	assert.Equal(1, result.Line)
+	assert.Equal("id", result.PassportID)
+	assert.Equal("group", result.PassportIDGrp)
+}
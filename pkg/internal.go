@@ -0,0 +1,78 @@
+package managerid
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// InternalAction is what is done with the interactions of internal networks.
+type InternalAction string
+
+// Values of InternalAction.
+const (
+	// InternalTag resolves the interaction as usual, the new identities are marked as internal.
+	InternalTag InternalAction = "tag"
+	// InternalExclude returns a new identity that is neither stored nor published.
+	InternalExclude InternalAction = "exclude"
+	// InternalBlock rejects the interaction with StatusForbidden.
+	InternalBlock InternalAction = "block"
+)
+
+// InternalPolicy is a struct that holds the internal networks, like the offices
+// and QA environments, and the action taken for their interactions, for every
+// application.
+type InternalPolicy struct {
+	// Networks are the internal networks of every application, the "*" ones are
+	// internal for every application.
+	Networks map[string][]*net.IPNet
+	// Actions are the actions of every application, the "*" one is used by the
+	// applications that are not listed. InternalTag is used when neither is set.
+	Actions map[string]InternalAction
+}
+
+// Contains checks if the IP of the interaction belongs to an internal network
+// of its application.
+func (p *InternalPolicy) Contains(interaction Interaction) bool {
+	ip := net.ParseIP(interaction.IP)
+	if ip == nil {
+		return false
+	}
+	for _, application := range []string{interaction.Application, "*"} {
+		for _, network := range p.Networks[application] {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// action returns the action for the internal interactions of the application.
+func (p *InternalPolicy) action(application string) InternalAction {
+	if action, ok := p.Actions[application]; ok {
+		return action
+	}
+	if action, ok := p.Actions["*"]; ok {
+		return action
+	}
+	return InternalTag
+}
+
+// classify checks if the interaction is internal and returns the action for its
+// application. It is safe to call on a nil InternalPolicy.
+func (p *InternalPolicy) classify(interaction Interaction) (bool, InternalAction) {
+	if p == nil || !p.Contains(interaction) {
+		return false, ""
+	}
+	return true, p.action(interaction.Application)
+}
+
+// parseInternalAction parses the case insensitive name of the InternalAction of the application.
+func parseInternalAction(application, value string) (InternalAction, error) {
+	switch action := InternalAction(strings.ToLower(value)); action {
+	case InternalTag, InternalExclude, InternalBlock:
+		return action, nil
+	}
+	return "", fmt.Errorf("invalid internal action %q of %s, expected tag, exclude or block", value, application)
+}
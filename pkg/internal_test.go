@@ -0,0 +1,124 @@
+package managerid
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInternalPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	policy, err := InternalConfig{
+		Networks: map[string][]string{"*": {"10.0.0.0/8"}, "App": {"203.0.113.0/24", "198.51.100.7"}},
+		Actions:  map[string]string{"*": "tag", "App": "Exclude", "Other": "block"},
+	}.Policy()
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(map[string]InternalAction{"*": InternalTag, "App": InternalExclude, "Other": InternalBlock}, policy.Actions)
+
+	tests := []struct {
+		Description string
+		Interaction Interaction
+		Expected    bool
+	}{
+		{Description: "when the IP is in a network of every application", Interaction: Interaction{IP: "10.1.2.3", Application: "Other"}, Expected: true},
+		{Description: "when the IP is in a network of the application", Interaction: Interaction{IP: "203.0.113.9", Application: "App"}, Expected: true},
+		{Description: "when the IP is an address of the application", Interaction: Interaction{IP: "198.51.100.7", Application: "App"}, Expected: true},
+		{Description: "when the IP is in a network of other application", Interaction: Interaction{IP: "203.0.113.9", Application: "Other"}, Expected: false},
+		{Description: "when the IP is not internal", Interaction: Interaction{IP: "192.0.2.1", Application: "App"}, Expected: false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.Expected, policy.Contains(test.Interaction), test.Description)
+	}
+
+	assert.Equal(InternalExclude, policy.action("App"))
+	assert.Equal(InternalTag, policy.action("Unknown"))
+	assert.Equal(InternalTag, (&InternalPolicy{}).action("App"))
+
+	_, err = InternalConfig{Networks: map[string][]string{"App": {"10.0.0.0/33"}}}.Policy()
+	assert.Error(err)
+	_, err = InternalConfig{Networks: map[string][]string{"*": {"10.0.0.0/8"}}, Actions: map[string]string{"App": "drop"}}.Policy()
+	assert.Error(err)
+}
+
+func TestHandleSettleV2Internal(t *testing.T) {
+	assert := assert.New(t)
+
+	settled := []Interaction{}
+	querier := &FakeDb{
+		GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+			settled = append(settled, interaction)
+			ident := &Identity{}
+			ident.createIdentity(interaction, "")
+			ident.Match = MatchNewGroup
+			return ident, nil
+		},
+		GroupSizesFunc: func(groups []string) (map[string]int, error) {
+			sizes := map[string]int{}
+			for _, group := range groups {
+				sizes[group] = 1
+			}
+			return sizes, nil
+		},
+	}
+	networks, _ := ParseNetworks("10.0.0.0/8")
+	ch := ClientHandler{
+		Querier: querier,
+		Internal: &InternalPolicy{
+			Networks: map[string][]*net.IPNet{"*": networks},
+			Actions:  map[string]InternalAction{"Tagged": InternalTag, "Excluded": InternalExclude, "Blocked": InternalBlock},
+		},
+		Bots: &BotPolicy{
+			Classifier: &BotClassifier{UserAgents: DefaultBotUserAgents},
+			Actions:    map[string]BotAction{"*": BotReject},
+		},
+	}
+
+	tests := []struct {
+		Description string
+		IP          string
+		Application string
+		UserAgent   string
+		StatusCode  int
+		Code        string
+		Match       string
+		Internal    bool
+		Settled     int
+	}{
+		{Description: "when the interaction is not internal", IP: "192.0.2.1", Application: "Blocked", StatusCode: http.StatusOK, Match: MatchNewGroup, Settled: 1},
+		{Description: "when the internal interaction is tagged", IP: "10.0.0.1", Application: "Tagged", StatusCode: http.StatusOK, Match: MatchNewGroup, Internal: true, Settled: 1},
+		{Description: "when the internal interaction is excluded", IP: "10.0.0.1", Application: "Excluded", StatusCode: http.StatusOK, Match: MatchEphemeral, Internal: true},
+		{Description: "when the internal interaction is blocked", IP: "10.0.0.1", Application: "Blocked", StatusCode: http.StatusForbidden, Code: CodeInternalBlocked},
+		{Description: "when the excluded interaction is also a bot", IP: "10.0.0.1", Application: "Excluded", UserAgent: "curl/7.68.0", StatusCode: http.StatusOK, Match: MatchEphemeral, Internal: true},
+		{Description: "when the tagged interaction is also a bot", IP: "10.0.0.1", Application: "Tagged", UserAgent: "curl/7.68.0", StatusCode: http.StatusForbidden, Code: CodeBotRejected},
+	}
+
+	for _, test := range tests {
+		settled = []Interaction{}
+		body := `{"ip": "` + test.IP + `", "provider": "Prov", "application": "` + test.Application + `", "user_agent": "` + test.UserAgent + `"}`
+		w := httptest.NewRecorder()
+		ch.HandleSettleV2().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v2/id/settle", strings.NewReader(body)))
+		assert.Equal(test.StatusCode, w.Code, test.Description)
+		assert.Len(settled, test.Settled, test.Description)
+		if test.StatusCode != http.StatusOK {
+			response := errorEnvelope{}
+			if assert.NoError(json.NewDecoder(w.Body).Decode(&response)) {
+				assert.Equal(test.Code, response.Error.Code, test.Description)
+			}
+			continue
+		}
+		response := SettleResponse{}
+		if assert.NoError(json.NewDecoder(w.Body).Decode(&response), test.Description) {
+			assert.Equal(test.Match, response.Match, test.Description)
+			assert.Equal(test.Internal, response.Internal, test.Description)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package managerid
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HandleMetrics is a function used to expose the metrics of the service in the
+// Prometheus text format, currently the requests throttled by
+// ClientHandler.RateLimits per limit and application.
+// Only GET method accepted.
+// Errors are returned as an APIError envelope:
+// StatusMethodNotAllowed if other kind of request is received.
+func (ch *ClientHandler) HandleMetrics() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, methodNotAllowed(r))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if ch.RateLimits == nil {
+			return
+		}
+		ch.RateLimits.writeMetrics(w)
+	})
+}
+
+// metricLabel quotes a label value of the Prometheus text format.
+func metricLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
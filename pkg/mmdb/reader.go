@@ -0,0 +1,378 @@
+// Package mmdb reads MaxMind DB files, like the GeoIP2 and GeoLite2 databases,
+// without network access nor external dependencies.
+// See https://maxmind.github.io/MaxMind-DB/ for the format.
+package mmdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+)
+
+// metadataMarker precedes the metadata at the end of the file.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// maxMetadataSize is how far from the end of the file the metadata is searched.
+const maxMetadataSize = 128 * 1024
+
+// maxDepth is the maximum nesting of the decoded values, pointers included.
+const maxDepth = 64
+
+// dataSectionSeparator is the size of the zeros between the search tree and the data section.
+const dataSectionSeparator = 16
+
+// ErrInvalidDatabase is returned when the file is not a valid MaxMind DB.
+var ErrInvalidDatabase = errors.New("invalid MaxMind DB")
+
+// Metadata is a struct that represents the description of a database.
+type Metadata struct {
+	NodeCount    uint
+	RecordSize   uint
+	IPVersion    uint
+	DatabaseType string
+	BuildEpoch   uint64
+}
+
+// Reader is a struct used to look up the records of a database loaded in memory.
+// It is safe for concurrent use.
+type Reader struct {
+	Metadata Metadata
+
+	buf       []byte
+	data      []byte
+	ipv4Start uint
+}
+
+// Open reads the database of the file passed as param.
+func Open(path string) (*Reader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(buf)
+}
+
+// FromBytes reads the database of the buffer passed as param.
+func FromBytes(buf []byte) (*Reader, error) {
+	from := len(buf) - maxMetadataSize
+	if from < 0 {
+		from = 0
+	}
+	index := bytes.LastIndex(buf[from:], metadataMarker)
+	if index < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", ErrInvalidDatabase)
+	}
+	metadataStart := from + index + len(metadataMarker)
+
+	value, _, err := decoder{buf: buf[metadataStart:]}.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata: %v", ErrInvalidDatabase, err)
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrInvalidDatabase)
+	}
+
+	metadata := Metadata{
+		NodeCount:  uint(toUint(fields["node_count"])),
+		RecordSize: uint(toUint(fields["record_size"])),
+		IPVersion:  uint(toUint(fields["ip_version"])),
+		BuildEpoch: toUint(fields["build_epoch"]),
+	}
+	metadata.DatabaseType, _ = fields["database_type"].(string)
+
+	if metadata.RecordSize != 24 && metadata.RecordSize != 28 && metadata.RecordSize != 32 {
+		return nil, fmt.Errorf("%w: unsupported record size %d", ErrInvalidDatabase, metadata.RecordSize)
+	}
+	if metadata.IPVersion != 4 && metadata.IPVersion != 6 {
+		return nil, fmt.Errorf("%w: unsupported IP version %d", ErrInvalidDatabase, metadata.IPVersion)
+	}
+	treeSize := metadata.NodeCount * metadata.RecordSize / 4
+	if treeSize+dataSectionSeparator > uint(from+index) {
+		return nil, fmt.Errorf("%w: search tree exceeds the file", ErrInvalidDatabase)
+	}
+
+	r := &Reader{
+		Metadata: metadata,
+		buf:      buf,
+		data:     buf[treeSize+dataSectionSeparator : from+index],
+	}
+	if metadata.IPVersion == 6 {
+		// IPv4 addresses are stored in the ::/96 subtree
+		for i := 0; i < 96 && r.ipv4Start < metadata.NodeCount; i++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// Lookup finds the record of the network the IP belongs to.
+// Returns the record, decoded as maps, slices, strings, bools, float64, float32,
+// int32, uint64 and *big.Int values, or nil if the IP is not in the database.
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	node, bits := uint(0), ip.To4()
+	if bits != nil {
+		if r.Metadata.IPVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else {
+		if bits = ip.To16(); bits == nil {
+			return nil, fmt.Errorf("invalid IP %v", ip)
+		}
+		if r.Metadata.IPVersion == 4 {
+			return nil, fmt.Errorf("IPv6 address %v looked up in an IPv4 database", ip)
+		}
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.Metadata.NodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+
+	if node == r.Metadata.NodeCount {
+		return nil, nil
+	}
+	if node < r.Metadata.NodeCount {
+		return nil, fmt.Errorf("%w: search tree is deeper than the address", ErrInvalidDatabase)
+	}
+	offset := node - r.Metadata.NodeCount - dataSectionSeparator
+	if offset >= uint(len(r.data)) {
+		return nil, fmt.Errorf("%w: record points outside the data section", ErrInvalidDatabase)
+	}
+	value, _, err := decoder{buf: r.data}.decode(offset)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDatabase, err)
+	}
+	return value, nil
+}
+
+// record returns the left (0) or right (1) record of the node.
+func (r *Reader) record(node, bit uint) uint {
+	size := r.Metadata.RecordSize
+	b := r.buf[node*size/4:]
+	switch size {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		b = b[bit*4:]
+		return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+	}
+}
+
+// Types of the data section.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// decoder decodes the values of a data section, pointers are offsets of buf.
+type decoder struct {
+	buf []byte
+}
+
+// decode decodes the value at offset.
+// Returns the value and the offset of the next one.
+func (d decoder) decode(offset uint) (interface{}, uint, error) {
+	return d.value(offset, 0)
+}
+
+// value decodes the value at offset, nested depth levels.
+// Returns the value and the offset of the next one.
+func (d decoder) value(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, fmt.Errorf("value at %d exceeds the maximum depth", offset)
+	}
+	kind, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if kind == typePointer {
+		pointer, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.value(pointer, depth+1)
+		return value, next, err
+	}
+
+	switch kind {
+	case typeMap:
+		// every entry takes at least a byte for the key and another for the value
+		if !d.fits(offset, 2*size) {
+			return nil, 0, fmt.Errorf("map at %d has more entries than the data section holds", offset)
+		}
+		value := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.value(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key at %d is not a string", offset)
+			}
+			if value[name], offset, err = d.value(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return value, offset, nil
+	case typeArray:
+		if !d.fits(offset, size) {
+			return nil, 0, fmt.Errorf("array at %d has more items than the data section holds", offset)
+		}
+		value := make([]interface{}, size)
+		for i := range value {
+			if value[i], offset, err = d.value(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return value, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, fmt.Errorf("value at %d exceeds the data section", offset)
+	}
+	b, next := d.buf[offset:offset+size], offset+size
+	switch kind {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte{}, b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("double at %d has size %d", offset, size)
+		}
+		return math.Float64frombits(uint64(toUintBytes(b))), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("float at %d has size %d", offset, size)
+		}
+		return math.Float32frombits(uint32(toUintBytes(b))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("unsigned integer at %d has size %d", offset, size)
+		}
+		return toUintBytes(b), next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("int32 at %d has size %d", offset, size)
+		}
+		return int32(uint32(toUintBytes(b))), next, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(b), next, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported type %d at %d", kind, offset)
+}
+
+// fits checks if the bytes left after offset are at least n, the minimum the
+// values of a map or an array take, so their size is checked before allocating.
+func (d decoder) fits(offset, n uint) bool {
+	return offset <= uint(len(d.buf)) && n <= uint(len(d.buf))-offset
+}
+
+// control decodes the control byte at offset.
+// Returns the type, the size and the offset of the payload.
+func (d decoder) control(offset uint) (int, uint, uint, error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, fmt.Errorf("offset %d exceeds the data section", offset)
+	}
+	ctrl := d.buf[offset]
+	offset++
+
+	kind := int(ctrl >> 5)
+	if kind == typeExtended {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, fmt.Errorf("extended type at %d exceeds the data section", offset)
+		}
+		kind = 7 + int(d.buf[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if kind == typePointer || size < 29 {
+		return kind, size, offset, nil
+	}
+	extra := size - 28
+	if offset+extra > uint(len(d.buf)) {
+		return 0, 0, 0, fmt.Errorf("size at %d exceeds the data section", offset)
+	}
+	value := uint(toUintBytes(d.buf[offset : offset+extra]))
+	switch extra {
+	case 1:
+		size = 29 + value
+	case 2:
+		size = 285 + value
+	default:
+		size = 65821 + value
+	}
+	return kind, size, offset + extra, nil
+}
+
+// pointer decodes the pointer whose control byte had the size bits passed as
+// param and its payload at offset.
+// Returns the offset it points to and the offset of the next value.
+func (d decoder) pointer(size, offset uint) (uint, uint, error) {
+	length := (size>>3)&0x3 + 1
+	if offset+length > uint(len(d.buf)) {
+		return 0, 0, fmt.Errorf("pointer at %d exceeds the data section", offset)
+	}
+	value := uint(toUintBytes(d.buf[offset : offset+length]))
+	switch length {
+	case 1:
+		value |= (size & 0x7) << 8
+	case 2:
+		value = ((size&0x7)<<16 | value) + 2048
+	case 3:
+		value = ((size&0x7)<<24 | value) + 526336
+	}
+	return value, offset + length, nil
+}
+
+// toUintBytes decodes a big endian unsigned integer.
+func toUintBytes(b []byte) uint64 {
+	value := uint64(0)
+	for _, c := range b {
+		value = value<<8 | uint64(c)
+	}
+	return value
+}
+
+// toUint returns the unsigned integer value of a decoded value, or 0.
+func toUint(value interface{}) uint64 {
+	switch v := value.(type) {
+	case uint64:
+		return v
+	case int32:
+		if v >= 0 {
+			return uint64(v)
+		}
+	}
+	return 0
+}
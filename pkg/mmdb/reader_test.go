@@ -0,0 +1,347 @@
+package mmdb
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "update the databases of testdata")
+
+// testdata are the databases written to testdata, used by the GeoIP tests of managerid.
+var testdata = map[string][]helperNetwork{
+	"city.mmdb": {
+		{Network: "81.2.69.0/24", Record: map[string]interface{}{
+			"country":      map[string]interface{}{"iso_code": "GB", "names": map[string]interface{}{"en": "United Kingdom"}},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "ENG", "names": map[string]interface{}{"en": "England"}}},
+			"city":         map[string]interface{}{"names": map[string]interface{}{"en": "London"}},
+		}},
+		{Network: "2001:db8::/32", Record: map[string]interface{}{
+			"country":      map[string]interface{}{"iso_code": "SE", "names": map[string]interface{}{"en": "Sweden"}},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "AB", "names": map[string]interface{}{"en": "Stockholm County"}}},
+			"city":         map[string]interface{}{"names": map[string]interface{}{"en": "Stockholm"}},
+		}},
+	},
+	"asn.mmdb": {
+		{Network: "81.2.69.0/24", Record: map[string]interface{}{
+			"autonomous_system_number":       uint32(20712),
+			"autonomous_system_organization": "Andrews & Arnold Ltd",
+		}},
+		{Network: "2001:db8::/32", Record: map[string]interface{}{
+			"autonomous_system_number":       uint32(64496),
+			"autonomous_system_organization": "Documentation",
+		}},
+	},
+}
+
+func TestReader(t *testing.T) {
+	assert := assert.New(t)
+
+	networks := []helperNetwork{
+		{Network: "81.2.69.0/24", Record: map[string]interface{}{
+			"string": "London",
+			"uint16": uint16(443),
+			"uint32": uint32(20712),
+			"uint64": uint64(1) << 40,
+			"int32":  int32(-7),
+			"double": 51.5142,
+			"bool":   true,
+			"array":  []interface{}{"a", "b"},
+			"long":   string(bytes.Repeat([]byte("x"), 300)),
+		}},
+		{Network: "10.0.0.0/8", Record: map[string]interface{}{"same": helperPointer(0)}},
+		{Network: "2001:db8::/32", Record: "documentation"},
+	}
+
+	for _, recordSize := range []int{24, 28, 32} {
+		r, err := FromBytes(helperWrite(networks, recordSize))
+		if !assert.NoError(err, "record size %d", recordSize) {
+			continue
+		}
+		assert.Equal(uint(recordSize), r.Metadata.RecordSize)
+		assert.Equal(uint(6), r.Metadata.IPVersion)
+		assert.Equal("Test", r.Metadata.DatabaseType)
+
+		record, err := r.Lookup(net.ParseIP("81.2.69.160"))
+		assert.NoError(err)
+		assert.Equal(map[string]interface{}{
+			"string": "London",
+			"uint16": uint64(443),
+			"uint32": uint64(20712),
+			"uint64": uint64(1) << 40,
+			"int32":  int32(-7),
+			"double": 51.5142,
+			"bool":   true,
+			"array":  []interface{}{"a", "b"},
+			"long":   string(bytes.Repeat([]byte("x"), 300)),
+		}, record, "record size %d", recordSize)
+
+		record, err = r.Lookup(net.ParseIP("10.1.2.3"))
+		assert.NoError(err)
+		if fields, ok := record.(map[string]interface{}); assert.True(ok) {
+			assert.Equal("London", fields["same"].(map[string]interface{})["string"])
+		}
+
+		record, err = r.Lookup(net.ParseIP("2001:db8::1"))
+		assert.NoError(err)
+		assert.Equal("documentation", record)
+
+		record, err = r.Lookup(net.ParseIP("192.0.2.1"))
+		assert.NoError(err)
+		assert.Nil(record)
+
+		record, err = r.Lookup(net.ParseIP("2001:db9::1"))
+		assert.NoError(err)
+		assert.Nil(record)
+	}
+}
+
+func TestReaderInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := FromBytes([]byte("not a database"))
+	assert.ErrorIs(err, ErrInvalidDatabase)
+
+	valid := helperWrite([]helperNetwork{{Network: "10.0.0.0/8", Record: "a"}}, 24)
+	_, err = FromBytes(valid[len(valid)/2:])
+	assert.ErrorIs(err, ErrInvalidDatabase)
+
+	// a pointer to itself
+	r := decoder{buf: []byte{0x20, 0x00}}
+	_, _, err = r.decode(0)
+	assert.Error(err)
+
+	// a map and an array with more values than the data section holds
+	_, _, err = decoder{buf: []byte{0xff, 0xff, 0xff, 0xff, 0x41, 0x61}}.decode(0)
+	assert.Error(err)
+	_, _, err = decoder{buf: []byte{0x1f, 0x04, 0xff, 0xff, 0xff, 0x41, 0x61}}.decode(0)
+	assert.Error(err)
+
+	value, _, err := decoder{buf: []byte{0x02, 0x03, 0x01, 0x00}}.decode(0)
+	assert.NoError(err)
+	assert.Equal(big.NewInt(256), value)
+}
+
+func TestTestdata(t *testing.T) {
+	assert := assert.New(t)
+
+	for name, networks := range testdata {
+		path := filepath.Join("testdata", name)
+		content := helperWrite(networks, 28)
+		if *update {
+			if err := ioutil.WriteFile(path, content, 0644); err != nil {
+				t.Fatalf("error writing %s: Err: %v", path, err)
+			}
+		}
+
+		stored, err := ioutil.ReadFile(path)
+		if assert.NoError(err) {
+			assert.Equal(content, stored, "%s is outdated, run the tests with -update", path)
+		}
+	}
+}
+
+// helperNetwork is a network and its record written by helperWrite.
+type helperNetwork struct {
+	Network string
+	Record  interface{}
+}
+
+// helperPointer is a pointer to an offset of the data section written by helperWrite.
+type helperPointer uint
+
+// helperNode is a node of the search tree written by helperWrite.
+type helperNode struct {
+	children [2]*helperNode
+	record   int
+	number   int
+}
+
+// helperWrite writes an IPv6 database with the networks passed as param, that
+// must not overlap. The records are written in order.
+func helperWrite(networks []helperNetwork, recordSize int) []byte {
+	root := &helperNode{record: -1}
+	data := []byte{}
+	offsets := []int{}
+	for i, network := range networks {
+		_, ipnet, err := net.ParseCIDR(network.Network)
+		if err != nil {
+			panic(err)
+		}
+		ones, _ := ipnet.Mask.Size()
+		ip := ipnet.IP.To16()
+		if ipnet.IP.To4() != nil {
+			ip = append(make(net.IP, 12), ipnet.IP.To4()...)
+			ones += 96
+		}
+
+		node := root
+		for bit := 0; bit < ones; bit++ {
+			b := ip[bit/8] >> (7 - uint(bit%8)) & 1
+			if node.children[b] == nil {
+				node.children[b] = &helperNode{record: -1}
+			}
+			node = node.children[b]
+		}
+		node.record = i
+
+		offsets = append(offsets, len(data))
+		data = append(data, helperEncode(network.Record)...)
+	}
+
+	// internal nodes are numbered breadth first
+	nodes := []*helperNode{}
+	queue := []*helperNode{root}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if node.record >= 0 {
+			continue
+		}
+		node.number = len(nodes)
+		nodes = append(nodes, node)
+		for _, child := range node.children {
+			if child != nil {
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	tree := []byte{}
+	for _, node := range nodes {
+		records := [2]uint{}
+		for i, child := range node.children {
+			switch {
+			case child == nil:
+				records[i] = uint(len(nodes))
+			case child.record >= 0:
+				records[i] = uint(len(nodes) + dataSectionSeparator + offsets[child.record])
+			default:
+				records[i] = uint(child.number)
+			}
+		}
+		left, right := records[0], records[1]
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(left>>24<<4|right>>24&0x0f),
+				byte(right>>16), byte(right>>8), byte(right))
+		default:
+			tree = append(tree, byte(left>>24), byte(left>>16), byte(left>>8), byte(left),
+				byte(right>>24), byte(right>>16), byte(right>>8), byte(right))
+		}
+	}
+
+	content := append(tree, make([]byte, dataSectionSeparator)...)
+	content = append(content, data...)
+	content = append(content, metadataMarker...)
+	return append(content, helperEncode(map[string]interface{}{
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(recordSize),
+		"ip_version":                  uint16(6),
+		"database_type":               "Test",
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1588587660),
+		"description":                 map[string]interface{}{"en": "managerid test database"},
+	})...)
+}
+
+// helperEncode encodes a value of the data section.
+func helperEncode(value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		return append(helperControl(typeString, len(v)), v...)
+	case float64:
+		return append(helperControl(typeDouble, 8), helperBigEndian(math.Float64bits(v), 8)...)
+	case uint16:
+		b := helperTrim(helperBigEndian(uint64(v), 2))
+		return append(helperControl(typeUint16, len(b)), b...)
+	case uint32:
+		b := helperTrim(helperBigEndian(uint64(v), 4))
+		return append(helperControl(typeUint32, len(b)), b...)
+	case uint64:
+		b := helperTrim(helperBigEndian(v, 8))
+		return append(helperControl(typeUint64, len(b)), b...)
+	case int32:
+		b := helperBigEndian(uint64(uint32(v)), 4)
+		return append(helperControl(typeInt32, len(b)), b...)
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		return helperControl(typeBool, size)
+	case []interface{}:
+		b := helperControl(typeArray, len(v))
+		for _, item := range v {
+			b = append(b, helperEncode(item)...)
+		}
+		return b
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b := helperControl(typeMap, len(keys))
+		for _, key := range keys {
+			b = append(b, helperEncode(key)...)
+			b = append(b, helperEncode(v[key])...)
+		}
+		return b
+	case helperPointer:
+		if v >= 2048 {
+			panic("helperEncode only writes pointers below 2048")
+		}
+		return []byte{byte(typePointer<<5 | v>>8), byte(v)}
+	}
+	panic("helperEncode can not encode the value")
+}
+
+// helperControl encodes the control byte of a value of the type and size passed as param.
+func helperControl(kind, size int) []byte {
+	sizeBits, extra := size, []byte{}
+	switch {
+	case size >= 65821:
+		sizeBits, extra = 31, helperBigEndian(uint64(size-65821), 3)
+	case size >= 285:
+		sizeBits, extra = 30, helperBigEndian(uint64(size-285), 2)
+	case size >= 29:
+		sizeBits, extra = 29, []byte{byte(size - 29)}
+	}
+
+	b := []byte{byte(kind<<5 | sizeBits)}
+	if kind > typeMap {
+		b = []byte{byte(sizeBits), byte(kind - 7)}
+	}
+	return append(b, extra...)
+}
+
+// helperBigEndian encodes value in size bytes.
+func helperBigEndian(value uint64, size int) []byte {
+	b := make([]byte, size)
+	for i := size - 1; i >= 0; i-- {
+		b[i] = byte(value)
+		value >>= 8
+	}
+	return b
+}
+
+// helperTrim removes the leading zeros of an unsigned integer.
+func helperTrim(b []byte) []byte {
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
@@ -0,0 +1,850 @@
+package managerid
+
+import (
+	"net/http"
+)
+
+// HandleOpenAPI is a function used to serve the OpenAPI specification of the API.
+// Only GET method accepted.
+func HandleOpenAPI() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, methodNotAllowed(r))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write([]byte(openAPISpec))
+	})
+}
+
+// openAPISpec is the OpenAPI 3 document describing every endpoint of the API.
+// The contract tests validate the handlers responses against it, keep it updated.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "ManagerID",
+    "description": "Lead ID manager used to identify visitors in landing pages and services.",
+    "version": "2.0.0"
+  },
+  "paths": {
+    "/v1/id/settle": {
+      "post": {
+        "summary": "Resolve the identity of an interaction",
+        "operationId": "settleV1",
+        "tags": ["v1"],
+        "security": [{"ApiKey": []}, {"BearerKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/IdempotencyKey"}],
+        "requestBody": {"$ref": "#/components/requestBodies/Interaction"},
+        "responses": {
+          "200": {
+            "description": "Resolved identity",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Identity"}}}
+          },
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/id/settle": {
+      "post": {
+        "summary": "Alias of /v1/id/settle",
+        "operationId": "settle",
+        "tags": ["v1"],
+        "security": [{"ApiKey": []}, {"BearerKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/IdempotencyKey"}],
+        "requestBody": {"$ref": "#/components/requestBodies/Interaction"},
+        "responses": {
+          "200": {
+            "description": "Resolved identity",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Identity"}}}
+          },
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/id/settle/batch": {
+      "post": {
+        "summary": "Resolve the identities of several interactions",
+        "operationId": "settleBatchV1",
+        "tags": ["v1"],
+        "security": [{"ApiKey": []}, {"BearerKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/IdempotencyKey"}],
+        "requestBody": {"$ref": "#/components/requestBodies/Batch"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/BatchResults"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/id/settle/batch": {
+      "post": {
+        "summary": "Alias of /v1/id/settle/batch",
+        "operationId": "settleBatch",
+        "tags": ["v1"],
+        "security": [{"ApiKey": []}, {"BearerKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/IdempotencyKey"}],
+        "requestBody": {"$ref": "#/components/requestBodies/Batch"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/BatchResults"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/id/import": {
+      "post": {
+        "summary": "Import historical interactions",
+        "operationId": "importV1",
+        "tags": ["v1"],
+        "security": [{"ApiKey": []}, {"BearerKey": []}],
+        "requestBody": {"$ref": "#/components/requestBodies/Import"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/ImportResults"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/id/import": {
+      "post": {
+        "summary": "Alias of /v1/id/import",
+        "operationId": "import",
+        "tags": ["v1"],
+        "security": [{"ApiKey": []}, {"BearerKey": []}],
+        "requestBody": {"$ref": "#/components/requestBodies/Import"},
+        "responses": {
+          "200": {"$ref": "#/components/responses/ImportResults"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/id/pixel.gif": {
+      "get": {
+        "summary": "Settle the visitor of a page that can not run JavaScript",
+        "operationId": "pixelV1",
+        "tags": ["v1"],
+        "description": "The IP is taken from the connection, or from the forwarding headers of the trusted proxies. The passport id is set in the passport_id cookie.",
+        "parameters": [
+          {"name": "provider", "in": "query", "required": true, "schema": {"type": "string", "maxLength": 255}},
+          {"name": "application", "in": "query", "required": true, "schema": {"type": "string", "maxLength": 255}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Transparent 1x1 GIF",
+            "content": {"image/gif": {"schema": {"type": "string", "format": "binary"}}}
+          },
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/id/pixel.gif": {
+      "get": {
+        "summary": "Alias of /v1/id/pixel.gif",
+        "operationId": "pixel",
+        "tags": ["v1"],
+        "description": "The IP is taken from the connection, or from the forwarding headers of the trusted proxies. The passport id is set in the passport_id cookie.",
+        "parameters": [
+          {"name": "provider", "in": "query", "required": true, "schema": {"type": "string", "maxLength": 255}},
+          {"name": "application", "in": "query", "required": true, "schema": {"type": "string", "maxLength": 255}}
+        ],
+        "responses": {
+          "200": {
+            "description": "Transparent 1x1 GIF",
+            "content": {"image/gif": {"schema": {"type": "string", "format": "binary"}}}
+          },
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/identities": {
+      "get": {
+        "summary": "Search the stored identities",
+        "operationId": "searchV1",
+        "tags": ["v1"],
+        "security": [{"ApiKey": []}, {"BearerKey": []}, {"AdminToken": []}],
+        "parameters": [
+          {"$ref": "#/components/parameters/Provider"},
+          {"$ref": "#/components/parameters/Application"},
+          {"$ref": "#/components/parameters/IP"},
+          {"$ref": "#/components/parameters/CreatedFrom"},
+          {"$ref": "#/components/parameters/CreatedTo"},
+          {"$ref": "#/components/parameters/Sort"},
+          {"$ref": "#/components/parameters/Limit"},
+          {"$ref": "#/components/parameters/Cursor"}
+        ],
+        "responses": {
+          "200": {
+            "description": "A page of identities",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SearchResponse"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/identities": {
+      "get": {
+        "summary": "Alias of /v1/identities",
+        "operationId": "search",
+        "tags": ["v1"],
+        "security": [{"ApiKey": []}, {"BearerKey": []}, {"AdminToken": []}],
+        "parameters": [
+          {"$ref": "#/components/parameters/Provider"},
+          {"$ref": "#/components/parameters/Application"},
+          {"$ref": "#/components/parameters/IP"},
+          {"$ref": "#/components/parameters/CreatedFrom"},
+          {"$ref": "#/components/parameters/CreatedTo"},
+          {"$ref": "#/components/parameters/Sort"},
+          {"$ref": "#/components/parameters/Limit"},
+          {"$ref": "#/components/parameters/Cursor"}
+        ],
+        "responses": {
+          "200": {
+            "description": "A page of identities",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SearchResponse"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/identities/{passport_id}": {
+      "get": {
+        "summary": "Look up an identity with its latest visits",
+        "operationId": "identityV1",
+        "tags": ["v1"],
+        "security": [{"ApiKey": []}, {"BearerKey": []}, {"AdminToken": []}],
+        "parameters": [
+          {"name": "passport_id", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The identity with its latest visits",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IdentityDetail"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/identities/{passport_id}": {
+      "get": {
+        "summary": "Alias of /v1/identities/{passport_id}",
+        "operationId": "identity",
+        "tags": ["v1"],
+        "security": [{"ApiKey": []}, {"BearerKey": []}, {"AdminToken": []}],
+        "parameters": [
+          {"name": "passport_id", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The identity with its latest visits",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IdentityDetail"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/events": {
+      "get": {
+        "summary": "Stream the settle outcomes",
+        "operationId": "eventsV1",
+        "tags": ["v1"],
+        "security": [{"ApiKey": []}, {"BearerKey": []}, {"AdminToken": []}],
+        "parameters": [
+          {"$ref": "#/components/parameters/Provider"},
+          {"$ref": "#/components/parameters/Application"}
+        ],
+        "responses": {
+          "200": {
+            "description": "Server-Sent Events stream. Every settle is sent with its match as event type and an IdentityEvent as data. An overflow event ends the stream when the client does not keep up.",
+            "content": {"text/event-stream": {"schema": {"type": "string"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/events": {
+      "get": {
+        "summary": "Alias of /v1/events",
+        "operationId": "events",
+        "tags": ["v1"],
+        "security": [{"ApiKey": []}, {"BearerKey": []}, {"AdminToken": []}],
+        "parameters": [
+          {"$ref": "#/components/parameters/Provider"},
+          {"$ref": "#/components/parameters/Application"}
+        ],
+        "responses": {
+          "200": {
+            "description": "Server-Sent Events stream. Every settle is sent with its match as event type and an IdentityEvent as data. An overflow event ends the stream when the client does not keep up.",
+            "content": {"text/event-stream": {"schema": {"type": "string"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/id/settle": {
+      "post": {
+        "summary": "Resolve the identity of an interaction",
+        "operationId": "settleV2",
+        "tags": ["v2"],
+        "security": [{"ApiKey": []}, {"BearerKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/IdempotencyKey"}],
+        "requestBody": {"$ref": "#/components/requestBodies/Interaction"},
+        "responses": {
+          "200": {
+            "description": "Resolved identity",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SettleResponse"}}}
+          },
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/id/settle/batch": {
+      "post": {
+        "summary": "Resolve the identities of several interactions",
+        "operationId": "settleBatchV2",
+        "tags": ["v2"],
+        "security": [{"ApiKey": []}, {"BearerKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/IdempotencyKey"}],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BatchRequestV2"}}}
+        },
+        "responses": {
+          "200": {
+            "description": "A result per interaction, in the same order",
+            "content": {
+              "application/json": {
+                "schema": {"type": "array", "items": {"$ref": "#/components/schemas/BatchResultV2"}}
+              }
+            }
+          },
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/js/v1/managerid.js": {
+      "get": {
+        "summary": "JavaScript snippet that settles the visitors of a page",
+        "operationId": "script",
+        "tags": ["js"],
+        "responses": {
+          "200": {
+            "description": "The snippet, configured with the data attributes of its script tag",
+            "content": {"application/javascript; charset=utf-8": {"schema": {"type": "string"}}}
+          }
+        }
+      }
+    },
+    "/js/v1/settle": {
+      "post": {
+        "summary": "Resolve the identity of the visitor of the JavaScript snippet",
+        "operationId": "scriptSettle",
+        "tags": ["js"],
+        "description": "The IP is taken from the connection, or from the forwarding headers of the trusted proxies. The body is also accepted as text/plain, as sent by navigator.sendBeacon.",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {"schema": {"$ref": "#/components/schemas/ScriptSettleRequest"}},
+            "text/plain": {"schema": {"$ref": "#/components/schemas/ScriptSettleRequest"}}
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "Resolved identity",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SettleResponse"}}}
+          },
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/r": {
+      "get": {
+        "summary": "Settle the visitor of an ad click and redirect to the landing page",
+        "operationId": "redirect",
+        "description": "The IP is taken from the connection, or from the forwarding headers of the trusted proxies. The destination must be allowed for the application, and the passport id is added to it as the passport_id query parameter.",
+        "parameters": [
+          {"name": "provider", "in": "query", "required": true, "schema": {"type": "string", "maxLength": 255}},
+          {"name": "application", "in": "query", "required": true, "schema": {"type": "string", "maxLength": 255}},
+          {"name": "url", "in": "query", "required": true, "schema": {"type": "string", "format": "uri"}}
+        ],
+        "responses": {
+          "302": {
+            "description": "Redirect to the destination with the passport id",
+            "headers": {"Location": {"schema": {"type": "string", "format": "uri"}}},
+            "content": {"text/html; charset=utf-8": {"schema": {"type": "string"}}}
+          },
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/admin/api-keys": {
+      "get": {
+        "summary": "List the API keys, newest first",
+        "operationId": "listAPIKeys",
+        "tags": ["admin"],
+        "security": [{"AdminToken": []}],
+        "responses": {
+          "200": {
+            "description": "The API keys, without their secrets",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/APIKey"}}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Create an API key",
+        "operationId": "createAPIKey",
+        "tags": ["admin"],
+        "security": [{"AdminToken": []}],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/APIKeyRequest"}}}
+        },
+        "responses": {
+          "201": {
+            "description": "The created API key, the only response that holds the key",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/APIKey"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/admin/api-keys/{id}": {
+      "delete": {
+        "summary": "Revoke an API key",
+        "operationId": "revokeAPIKey",
+        "tags": ["admin"],
+        "security": [{"AdminToken": []}],
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The revoked API key",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/APIKey"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/.well-known/jwks.json": {
+      "get": {
+        "summary": "Key set that verifies the passport tokens",
+        "operationId": "keySet",
+        "responses": {
+          "200": {
+            "description": "Ed25519 public keys of the passport tokens, empty when they are signed with HMAC",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/KeySet"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "summary": "Metrics of the service in the Prometheus text format",
+        "operationId": "metrics",
+        "responses": {
+          "200": {
+            "description": "Counters of the requests throttled by the rate limits",
+            "content": {"text/plain; version=0.0.4": {"schema": {"type": "string"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "This OpenAPI document",
+        "operationId": "openapi",
+        "responses": {
+          "200": {
+            "description": "OpenAPI document",
+            "content": {"application/json": {"schema": {"type": "object"}}}
+          }
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "ApiKey": {
+        "type": "apiKey",
+        "in": "header",
+        "name": "X-API-Key",
+        "description": "API key of the applications and providers of the request, required when the server enables them"
+      },
+      "BearerKey": {"type": "http", "scheme": "bearer", "description": "API key sent as bearer token"},
+      "AdminToken": {"type": "http", "scheme": "bearer", "description": "Admin token of the server, required by the lookup and events operations when the server does not enable API keys"},
+      "Signature": {
+        "type": "apiKey",
+        "in": "header",
+        "name": "X-Signature",
+        "description": "Hex HMAC-SHA256 of the X-Signature-Timestamp, the method, the path with its query and the body, separated by new lines, with the secret of the X-Client-ID client. Imports can sign the X-Content-SHA256 hex digest of the body instead, so it is not limited by the maximum body size. Optional unless the server requires it, on the same operations as the API key."
+      }
+    },
+    "parameters": {
+      "IdempotencyKey": {
+        "name": "Idempotency-Key",
+        "in": "header",
+        "required": false,
+        "description": "Makes the request idempotent: the first response of the key is replayed, with the Idempotent-Replayed header, to the requests that repeat it with the same body. Reusing a key with a different body is rejected with 422, and while its first request is in progress with 409.",
+        "schema": {"type": "string", "maxLength": 255}
+      },
+      "Provider": {"name": "provider", "in": "query", "schema": {"type": "string"}},
+      "Application": {"name": "application", "in": "query", "schema": {"type": "string"}},
+      "IP": {
+        "name": "ip",
+        "in": "query",
+        "description": "IP address or CIDR network",
+        "schema": {"type": "string"}
+      },
+      "CreatedFrom": {
+        "name": "created_from",
+        "in": "query",
+        "description": "Inclusive lower bound of the creation time",
+        "schema": {"type": "string", "format": "date-time"}
+      },
+      "CreatedTo": {
+        "name": "created_to",
+        "in": "query",
+        "description": "Exclusive upper bound of the creation time",
+        "schema": {"type": "string", "format": "date-time"}
+      },
+      "Sort": {
+        "name": "sort",
+        "in": "query",
+        "schema": {"type": "string", "enum": ["created_at", "-created_at"], "default": "-created_at"}
+      },
+      "Limit": {
+        "name": "limit",
+        "in": "query",
+        "schema": {"type": "integer", "minimum": 1, "maximum": 1000, "default": 100}
+      },
+      "Cursor": {
+        "name": "cursor",
+        "in": "query",
+        "description": "next_cursor of the previous page, sent with the same search parameters",
+        "schema": {"type": "string"}
+      }
+    },
+    "requestBodies": {
+      "Interaction": {
+        "required": true,
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Interaction"}}}
+      },
+      "Batch": {
+        "required": true,
+        "content": {
+          "application/json": {
+            "schema": {"type": "array", "items": {"$ref": "#/components/schemas/Interaction"}}
+          }
+        }
+      },
+      "Import": {
+        "required": true,
+        "content": {"application/x-ndjson": {"schema": {"$ref": "#/components/schemas/ImportRecord"}}}
+      }
+    },
+    "responses": {
+      "BatchResults": {
+        "description": "A result per interaction, in the same order",
+        "content": {
+          "application/json": {
+            "schema": {"type": "array", "items": {"$ref": "#/components/schemas/BatchResult"}}
+          }
+        }
+      },
+      "ImportResults": {
+        "description": "A result per line, streamed while the interactions are resolved",
+        "content": {"application/x-ndjson": {"schema": {"$ref": "#/components/schemas/ImportResult"}}}
+      },
+      "Error": {
+        "description": "Error",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorEnvelope"}}}
+      },
+      "TooManyRequests": {
+        "description": "Throttled by the rate limits of the client IP or of the application",
+        "headers": {"Retry-After": {"description": "Seconds to wait before retrying", "schema": {"type": "integer"}}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorEnvelope"}}}
+      }
+    },
+    "schemas": {
+      "Interaction": {
+        "type": "object",
+        "required": ["ip", "provider", "application"],
+        "properties": {
+          "ip": {"type": "string", "description": "IPv4 or IPv6 address of the visitor. In settle requests it is optional or ignored when the server derives it from the request."},
+          "provider": {"type": "string", "maxLength": 255},
+          "application": {"type": "string", "maxLength": 255},
+          "user_agent": {"type": "string", "description": "User agent of the visitor, only used to classify bots, the User-Agent header when it is empty. It is not stored."},
+          "page_url": {"type": "string", "format": "uri", "maxLength": 2048, "description": "Absolute URL of the page. Its utm_* and click id parameters fill the fields that are not sent."},
+          "referrer": {"type": "string", "format": "uri", "maxLength": 2048},
+          "utm_source": {"type": "string", "maxLength": 255},
+          "utm_medium": {"type": "string", "maxLength": 255},
+          "utm_campaign": {"type": "string", "maxLength": 255},
+          "utm_term": {"type": "string", "maxLength": 255},
+          "utm_content": {"type": "string", "maxLength": 255},
+          "gclid": {"type": "string", "maxLength": 255},
+          "fbclid": {"type": "string", "maxLength": 255}
+        }
+      },
+      "Identity": {
+        "type": "object",
+        "required": ["passport_id_group", "passport_id"],
+        "properties": {
+          "passport_id_group": {"type": "string"},
+          "passport_id": {"type": "string"}
+        }
+      },
+      "BatchResult": {
+        "type": "object",
+        "description": "Identity fields, or error if the interaction could not be resolved",
+        "properties": {
+          "passport_id_group": {"type": "string"},
+          "passport_id": {"type": "string"},
+          "error": {"$ref": "#/components/schemas/Error"}
+        }
+      },
+      "ImportRecord": {
+        "type": "object",
+        "required": ["ip", "provider", "application", "timestamp"],
+        "properties": {
+          "ip": {"type": "string"},
+          "provider": {"type": "string", "maxLength": 255},
+          "application": {"type": "string", "maxLength": 255},
+          "timestamp": {"type": "string", "format": "date-time"},
+          "page_url": {"type": "string", "format": "uri", "maxLength": 2048, "description": "Absolute URL of the page. Its utm_* and click id parameters fill the fields that are not sent."},
+          "referrer": {"type": "string", "format": "uri", "maxLength": 2048},
+          "utm_source": {"type": "string", "maxLength": 255},
+          "utm_medium": {"type": "string", "maxLength": 255},
+          "utm_campaign": {"type": "string", "maxLength": 255},
+          "utm_term": {"type": "string", "maxLength": 255},
+          "utm_content": {"type": "string", "maxLength": 255},
+          "gclid": {"type": "string", "maxLength": 255},
+          "fbclid": {"type": "string", "maxLength": 255}
+        }
+      },
+      "ImportResult": {
+        "type": "object",
+        "description": "Identity fields, or error if the line could not be imported",
+        "properties": {
+          "line": {"type": "integer"},
+          "timestamp": {"type": "string", "format": "date-time"},
+          "passport_id_group": {"type": "string"},
+          "passport_id": {"type": "string"},
+          "error": {"$ref": "#/components/schemas/Error"}
+        }
+      },
+      "SettleResponse": {
+        "type": "object",
+        "required": ["passport_id", "passport_id_group", "created_at", "match", "group_size"],
+        "properties": {
+          "passport_id": {"type": "string"},
+          "passport_id_group": {"type": "string"},
+          "created_at": {"type": "string", "format": "date-time"},
+          "match": {"type": "string", "enum": ["new_group", "new_in_group", "reused", "ephemeral"]},
+          "group_size": {"type": "integer"},
+          "geo": {"$ref": "#/components/schemas/Geo"},
+          "bot": {"type": "string", "enum": ["user_agent", "network", "asn"], "description": "Set when the identity was created by an interaction classified as a bot"},
+          "internal": {"type": "boolean", "description": "Set when the identity was created by an interaction of an internal network"},
+          "token": {"type": "string", "description": "Compact JWS of the passport id, group, application and issue time, set when the server enables the passport tokens and the identity is not ephemeral. Verified with the key set of /.well-known/jwks.json"}
+        }
+      },
+      "Geo": {
+        "type": "object",
+        "description": "Location and network of the IP, set when it is found in the GeoIP databases",
+        "properties": {
+          "country": {"type": "string", "description": "ISO 3166-1 code"},
+          "region": {"type": "string"},
+          "city": {"type": "string"},
+          "asn": {"type": "integer"}
+        }
+      },
+      "ScriptSettleRequest": {
+        "type": "object",
+        "required": ["provider", "application"],
+        "properties": {
+          "provider": {"type": "string", "maxLength": 255},
+          "application": {"type": "string", "maxLength": 255},
+          "passport_id": {"type": "string", "description": "Passport id stored by the snippet, its identity is reused when it belongs to the provider and application and there is no valid signed cookie"},
+          "passport_id_group": {"type": "string", "description": "Passport id group stored by the snippet, it must match the one of passport_id"},
+          "page_url": {"type": "string", "format": "uri", "maxLength": 2048, "description": "Absolute URL of the page. Its utm_* and click id parameters fill the fields that are not sent."},
+          "referrer": {"type": "string", "format": "uri", "maxLength": 2048},
+          "utm_source": {"type": "string", "maxLength": 255},
+          "utm_medium": {"type": "string", "maxLength": 255},
+          "utm_campaign": {"type": "string", "maxLength": 255},
+          "utm_term": {"type": "string", "maxLength": 255},
+          "utm_content": {"type": "string", "maxLength": 255},
+          "gclid": {"type": "string", "maxLength": 255},
+          "fbclid": {"type": "string", "maxLength": 255}
+        }
+      },
+      "BatchRequestV2": {
+        "type": "object",
+        "required": ["interactions"],
+        "properties": {
+          "interactions": {"type": "array", "items": {"$ref": "#/components/schemas/Interaction"}}
+        }
+      },
+      "BatchResultV2": {
+        "type": "object",
+        "description": "SettleResponse fields, or error if the interaction could not be resolved",
+        "properties": {
+          "passport_id": {"type": "string"},
+          "passport_id_group": {"type": "string"},
+          "created_at": {"type": "string", "format": "date-time"},
+          "match": {"type": "string", "enum": ["new_group", "new_in_group", "reused", "ephemeral"]},
+          "group_size": {"type": "integer"},
+          "geo": {"$ref": "#/components/schemas/Geo"},
+          "bot": {"type": "string", "enum": ["user_agent", "network", "asn"], "description": "Set when the identity was created by an interaction classified as a bot"},
+          "internal": {"type": "boolean", "description": "Set when the identity was created by an interaction of an internal network"},
+          "token": {"type": "string", "description": "Passport token, see SettleResponse"},
+          "error": {"$ref": "#/components/schemas/Error"}
+        }
+      },
+      "IdentityResponse": {
+        "type": "object",
+        "required": ["passport_id", "passport_id_group", "ip", "provider", "application", "created_at"],
+        "properties": {
+          "passport_id": {"type": "string"},
+          "passport_id_group": {"type": "string"},
+          "ip": {"type": "string"},
+          "provider": {"type": "string"},
+          "application": {"type": "string"},
+          "created_at": {"type": "string", "format": "date-time"},
+          "bot": {"type": "string", "enum": ["user_agent", "network", "asn"], "description": "Set when the identity was created by an interaction classified as a bot"},
+          "internal": {"type": "boolean", "description": "Set when the identity was created by an interaction of an internal network"}
+        }
+      },
+      "IdentityDetail": {
+        "type": "object",
+        "required": ["passport_id", "passport_id_group", "ip", "provider", "application", "created_at", "visits"],
+        "properties": {
+          "passport_id": {"type": "string"},
+          "passport_id_group": {"type": "string"},
+          "ip": {"type": "string"},
+          "provider": {"type": "string"},
+          "application": {"type": "string"},
+          "created_at": {"type": "string", "format": "date-time"},
+          "bot": {"type": "string", "enum": ["user_agent", "network", "asn"], "description": "Set when the identity was created by an interaction classified as a bot"},
+          "internal": {"type": "boolean", "description": "Set when the identity was created by an interaction of an internal network"},
+          "visits": {"type": "array", "description": "Latest visits, newest first", "items": {"$ref": "#/components/schemas/Visit"}}
+        }
+      },
+      "Visit": {
+        "type": "object",
+        "required": ["created_at"],
+        "properties": {
+          "page_url": {"type": "string", "format": "uri", "maxLength": 2048, "description": "Absolute URL of the page. Its utm_* and click id parameters fill the fields that are not sent."},
+          "referrer": {"type": "string", "format": "uri", "maxLength": 2048},
+          "utm_source": {"type": "string", "maxLength": 255},
+          "utm_medium": {"type": "string", "maxLength": 255},
+          "utm_campaign": {"type": "string", "maxLength": 255},
+          "utm_term": {"type": "string", "maxLength": 255},
+          "utm_content": {"type": "string", "maxLength": 255},
+          "gclid": {"type": "string", "maxLength": 255},
+          "fbclid": {"type": "string", "maxLength": 255},
+          "created_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "SearchResponse": {
+        "type": "object",
+        "required": ["identities"],
+        "properties": {
+          "identities": {"type": "array", "items": {"$ref": "#/components/schemas/IdentityResponse"}},
+          "next_cursor": {"type": "string", "description": "Set when there may be more identities"}
+        }
+      },
+      "IdentityEvent": {
+        "type": "object",
+        "required": ["type", "passport_id", "passport_id_group", "ip", "provider", "application", "created_at"],
+        "properties": {
+          "type": {"type": "string", "enum": ["new_group", "new_in_group", "reused"]},
+          "passport_id": {"type": "string"},
+          "passport_id_group": {"type": "string"},
+          "ip": {"type": "string"},
+          "provider": {"type": "string"},
+          "application": {"type": "string"},
+          "created_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "ErrorEnvelope": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {
+          "error": {"$ref": "#/components/schemas/Error"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "required": ["code", "message"],
+        "properties": {
+          "code": {"type": "string"},
+          "message": {"type": "string"},
+          "request_id": {"type": "string"},
+          "details": {"type": "array", "items": {"$ref": "#/components/schemas/FieldError"}}
+        }
+      },
+      "KeySet": {
+        "type": "object",
+        "required": ["keys"],
+        "properties": {
+          "keys": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "required": ["kty", "crv", "x", "kid", "alg", "use"],
+              "properties": {
+                "kty": {"type": "string", "enum": ["OKP"]},
+                "crv": {"type": "string", "enum": ["Ed25519"]},
+                "x": {"type": "string", "description": "Unpadded base64url of the public key"},
+                "kid": {"type": "string"},
+                "alg": {"type": "string", "enum": ["EdDSA"]},
+                "use": {"type": "string", "enum": ["sig"]}
+              }
+            }
+          }
+        }
+      },
+      "APIKeyRequest": {
+        "type": "object",
+        "required": ["name", "applications"],
+        "properties": {
+          "name": {"type": "string", "maxLength": 255},
+          "applications": {"type": "array", "minItems": 1, "items": {"type": "string", "maxLength": 255}},
+          "providers": {"type": "array", "description": "Allowed providers, every provider is allowed when it is empty", "items": {"type": "string", "maxLength": 255}}
+        }
+      },
+      "APIKey": {
+        "type": "object",
+        "required": ["id", "name", "applications", "providers", "created_at"],
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "applications": {"type": "array", "items": {"type": "string"}},
+          "providers": {"type": "array", "items": {"type": "string"}},
+          "created_at": {"type": "string", "format": "date-time"},
+          "revoked_at": {"type": "string", "format": "date-time"},
+          "key": {"type": "string", "description": "The key, only returned when it is created"}
+        }
+      },
+      "FieldError": {
+        "type": "object",
+        "required": ["field", "message"],
+        "properties": {
+          "field": {"type": "string"},
+          "message": {"type": "string"}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,387 @@
+package managerid
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAPIRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := helperSpec(t)
+	paths := spec["paths"].(map[string]interface{})
+
+	r := mux.NewRouter()
+	ch := ClientHandler{Querier: &FakeDb{}}
+	ch.Routes(r)
+
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		assert.Contains(paths, template, "route %s is not documented", template)
+		return nil
+	})
+	assert.NoError(err)
+}
+
+func TestOpenAPIContract(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := helperSpec(t)
+	createdat := time.Date(2020, 5, 4, 10, 21, 0, 0, time.UTC)
+	tokens, err := ParseTokenSigner("", "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8", "", "")
+	if err != nil {
+		t.Fatalf("error creating the test token signer: Err: %v", err)
+	}
+	ch := ClientHandler{
+		Tokens:     tokens,
+		AdminToken: "admin",
+		Redirects:  RedirectAllowlist{"App": {"landing.example.com"}},
+		Querier: &FakeDb{
+			GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+				if interaction.Provider == "fail" {
+					return nil, errors.New("Error 1054: Unknown column")
+				}
+				return &Identity{PassportID: "id", PassportIDGrp: "group", Createdat: createdat, Match: MatchNewGroup, Geo: Geo{Country: "GB", City: "London", ASN: 20712}}, nil
+			},
+			GetIdentitiesFunc: func(interactions []Interaction) ([]*Identity, error) {
+				idents := []*Identity{}
+				for range interactions {
+					idents = append(idents, &Identity{PassportID: "id", PassportIDGrp: "group", Createdat: createdat, Match: MatchReused})
+				}
+				return idents, nil
+			},
+			ImportIdentitiesFunc: func(records []ImportRecord) ([]*Identity, error) {
+				idents := []*Identity{}
+				for range records {
+					idents = append(idents, &Identity{PassportID: "id", PassportIDGrp: "group"})
+				}
+				return idents, nil
+			},
+			GroupSizesFunc: func(groups []string) (map[string]int, error) {
+				return map[string]int{"group": 2}, nil
+			},
+			GetIdentityByIDFunc: func(passportID string) (*Identity, error) {
+				if passportID != "id" {
+					return nil, ErrIdentityNotFound
+				}
+				return &Identity{IP: "127.0.0.1", Provider: "Prov", Application: "App", PassportID: "id", PassportIDGrp: "group", Createdat: createdat}, nil
+			},
+			GetVisitsFunc: func(passportID string, limit int) ([]*Visit, error) {
+				return []*Visit{{VisitContext: VisitContext{PageURL: "https://example.com/?utm_source=news", UTMSource: "news"}, Createdat: createdat}}, nil
+			},
+			CreateAPIKeyFunc: func(key *APIKey) error {
+				return nil
+			},
+			GetAPIKeysFunc: func() ([]*APIKey, error) {
+				return []*APIKey{{KeyID: "key", Name: "Backend", Applications: "App", Createdat: createdat, Revokedat: &createdat}}, nil
+			},
+			RevokeAPIKeyFunc: func(keyID string, at time.Time) (*APIKey, error) {
+				if keyID != "key" {
+					return nil, ErrAPIKeyNotFound
+				}
+				return &APIKey{KeyID: "key", Name: "Backend", Applications: "App", Providers: "Prov", Createdat: createdat, Revokedat: &at}, nil
+			},
+			SearchIdentitiesFunc: func(filter IdentityFilter) ([]*Identity, error) {
+				id := 1
+				return []*Identity{
+					{IP: "127.0.0.1", Provider: "Prov", Application: "App", PassportID: "id", PassportIDGrp: "group", Createdat: createdat, Ididentity: &id},
+					{IP: "127.0.0.1", Provider: "Prov", Application: "App", PassportID: "id", PassportIDGrp: "group", Createdat: createdat, Ididentity: &id},
+				}, nil
+			},
+		},
+	}
+	r := mux.NewRouter()
+	ch.Routes(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	valid := `{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}`
+	invalid := `{"ip": "garbage", "provider": "Prov", "application": "App"}`
+	record := `{"ip": "127.0.0.1", "provider": "Prov", "application": "App", "timestamp": "2020-05-04T10:21:00Z"}`
+
+	tests := []struct {
+		Description string
+		Method      string
+		Path        string
+		ContentType string
+		Token       string
+		Body        string
+		StatusCode  int
+	}{
+		{Description: "v1 settle", Method: http.MethodPost, Path: "/v1/id/settle", Body: valid, StatusCode: http.StatusOK},
+		{Description: "settle alias", Method: http.MethodPost, Path: "/id/settle", Body: valid, StatusCode: http.StatusOK},
+		{Description: "v1 settle invalid", Method: http.MethodPost, Path: "/v1/id/settle", Body: invalid, StatusCode: http.StatusUnprocessableEntity},
+		{Description: "v1 settle malformed", Method: http.MethodPost, Path: "/v1/id/settle", Body: "{", StatusCode: http.StatusBadRequest},
+		{Description: "v1 settle method", Method: http.MethodGet, Path: "/v1/id/settle", StatusCode: http.StatusMethodNotAllowed},
+		{Description: "v1 settle server error", Method: http.MethodPost, Path: "/v1/id/settle", Body: `{"ip": "127.0.0.1", "provider": "fail", "application": "App"}`, StatusCode: http.StatusInternalServerError},
+		{Description: "v1 batch", Method: http.MethodPost, Path: "/v1/id/settle/batch", Body: "[" + valid + "," + invalid + "]", StatusCode: http.StatusOK},
+		{Description: "batch alias", Method: http.MethodPost, Path: "/id/settle/batch", Body: "[" + valid + "]", StatusCode: http.StatusOK},
+		{Description: "v1 import", Method: http.MethodPost, Path: "/v1/id/import", ContentType: "application/x-ndjson", Body: record + "\ngarbage\n", StatusCode: http.StatusOK},
+		{Description: "import alias", Method: http.MethodPost, Path: "/id/import", ContentType: "application/x-ndjson", Body: record, StatusCode: http.StatusOK},
+		{Description: "v2 settle", Method: http.MethodPost, Path: "/v2/id/settle", Body: valid, StatusCode: http.StatusOK},
+		{Description: "v2 settle unsupported", Method: http.MethodPost, Path: "/v2/id/settle", ContentType: "text/plain", Body: valid, StatusCode: http.StatusUnsupportedMediaType},
+		{Description: "v2 batch", Method: http.MethodPost, Path: "/v2/id/settle/batch", Body: `{"interactions": [` + valid + "," + invalid + "]}", StatusCode: http.StatusOK},
+		{Description: "v1 pixel", Method: http.MethodGet, Path: "/v1/id/pixel.gif?provider=Prov&application=App", StatusCode: http.StatusOK},
+		{Description: "pixel alias invalid", Method: http.MethodGet, Path: "/id/pixel.gif?provider=Prov", StatusCode: http.StatusUnprocessableEntity},
+		{Description: "v1 search", Method: http.MethodGet, Path: "/v1/identities?ip=127.0.0.0/8&limit=1", Token: "admin", StatusCode: http.StatusOK},
+		{Description: "search alias", Method: http.MethodGet, Path: "/identities", Token: "admin", StatusCode: http.StatusOK},
+		{Description: "v1 search invalid", Method: http.MethodGet, Path: "/v1/identities?limit=0", Token: "admin", StatusCode: http.StatusUnprocessableEntity},
+		{Description: "search unauthorized", Method: http.MethodGet, Path: "/v1/identities", StatusCode: http.StatusUnauthorized},
+		{Description: "v1 identity", Method: http.MethodGet, Path: "/v1/identities/id", Token: "admin", StatusCode: http.StatusOK},
+		{Description: "identity alias not found", Method: http.MethodGet, Path: "/identities/unknown", Token: "admin", StatusCode: http.StatusNotFound},
+		{Description: "v1 settle with visit", Method: http.MethodPost, Path: "/v1/id/settle", Body: `{"ip": "127.0.0.1", "provider": "Prov", "application": "App", "page_url": "https://example.com/", "gclid": "abc"}`, StatusCode: http.StatusOK},
+		{Description: "v1 events method", Method: http.MethodPost, Path: "/v1/events", Token: "admin", StatusCode: http.StatusMethodNotAllowed},
+		{Description: "events alias disabled", Method: http.MethodGet, Path: "/events", Token: "admin", StatusCode: http.StatusServiceUnavailable},
+		{Description: "script", Method: http.MethodGet, Path: "/js/v1/managerid.js", StatusCode: http.StatusOK},
+		{Description: "script settle", Method: http.MethodPost, Path: "/js/v1/settle", ContentType: "text/plain;charset=UTF-8", Body: `{"provider": "Prov", "application": "App"}`, StatusCode: http.StatusOK},
+		{Description: "script settle invalid", Method: http.MethodPost, Path: "/js/v1/settle", Body: `{"provider": "Prov"}`, StatusCode: http.StatusUnprocessableEntity},
+		{Description: "redirect", Method: http.MethodGet, Path: "/r?provider=Prov&application=App&url=https://landing.example.com/", StatusCode: http.StatusFound},
+		{Description: "redirect not allowed", Method: http.MethodGet, Path: "/r?provider=Prov&application=App&url=https://evil.example.com/", StatusCode: http.StatusUnprocessableEntity},
+		{Description: "admin list keys", Method: http.MethodGet, Path: "/admin/api-keys", Token: "admin", StatusCode: http.StatusOK},
+		{Description: "admin create key", Method: http.MethodPost, Path: "/admin/api-keys", Token: "admin", Body: `{"name": "Backend", "applications": ["App"]}`, StatusCode: http.StatusCreated},
+		{Description: "admin create key invalid", Method: http.MethodPost, Path: "/admin/api-keys", Token: "admin", Body: `{"name": "Backend"}`, StatusCode: http.StatusUnprocessableEntity},
+		{Description: "admin revoke key", Method: http.MethodDelete, Path: "/admin/api-keys/key", Token: "admin", StatusCode: http.StatusOK},
+		{Description: "admin revoke key not found", Method: http.MethodDelete, Path: "/admin/api-keys/unknown", Token: "admin", StatusCode: http.StatusNotFound},
+		{Description: "admin unauthorized", Method: http.MethodGet, Path: "/admin/api-keys", Token: "wrong", StatusCode: http.StatusUnauthorized},
+		{Description: "key set", Method: http.MethodGet, Path: "/.well-known/jwks.json", StatusCode: http.StatusOK},
+		{Description: "openapi", Method: http.MethodGet, Path: "/openapi.json", StatusCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.Method, ts.URL+test.Path, strings.NewReader(test.Body))
+		if err != nil {
+			t.Errorf("error creating the test Request: Err: %v", err)
+			return
+		}
+		contentType := test.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		req.Header.Set("Content-Type", contentType)
+		if test.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.Token)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("error sending test Request: Err: %v", err)
+			return
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(err)
+		assert.Equal(test.StatusCode, resp.StatusCode, test.Description)
+
+		path := strings.SplitN(test.Path, "?", 2)[0]
+		mediaType, schema, err := helperResponseSchema(spec, path, test.Method, resp.StatusCode)
+		if !assert.NoError(err, test.Description) {
+			continue
+		}
+		assert.Equal(mediaType, resp.Header.Get("Content-Type"), test.Description)
+
+		if !strings.HasSuffix(mediaType, "json") {
+			continue
+		}
+		documents := [][]byte{content}
+		if mediaType == "application/x-ndjson" {
+			documents = [][]byte{}
+			scanner := bufio.NewScanner(bytes.NewReader(content))
+			for scanner.Scan() {
+				documents = append(documents, append([]byte{}, scanner.Bytes()...))
+			}
+		}
+		for _, document := range documents {
+			var value interface{}
+			if err := json.Unmarshal(document, &value); err != nil {
+				t.Errorf("%s: error unmarshaling the test response: Err: %v", test.Description, err)
+				continue
+			}
+			assert.Empty(helperValidate(spec, schema, value, "$"), test.Description)
+		}
+	}
+}
+
+// helperSpec decodes the served OpenAPI document.
+func helperSpec(t *testing.T) map[string]interface{} {
+	spec := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(openAPISpec), &spec); err != nil {
+		t.Fatalf("error unmarshaling the OpenAPI document: Err: %v", err)
+	}
+	return spec
+}
+
+// helperResponseSchema finds the media type and schema documented for a response.
+func helperResponseSchema(spec map[string]interface{}, path, method string, status int) (string, map[string]interface{}, error) {
+	item, ok := spec["paths"].(map[string]interface{})[helperPathTemplate(spec, path)].(map[string]interface{})
+	if !ok {
+		return "", nil, fmt.Errorf("path %s not documented", path)
+	}
+	operation, ok := item[strings.ToLower(method)].(map[string]interface{})
+	if !ok {
+		operation, ok = helperAnyOperation(item)
+		if !ok || status != http.StatusMethodNotAllowed {
+			return "", nil, fmt.Errorf("operation %s %s not documented", method, path)
+		}
+	}
+	responses := operation["responses"].(map[string]interface{})
+	response, ok := responses[strconv.Itoa(status)].(map[string]interface{})
+	if !ok {
+		if response, ok = responses["default"].(map[string]interface{}); !ok {
+			return "", nil, fmt.Errorf("response %d of %s %s not documented", status, method, path)
+		}
+	}
+	response = helperResolve(spec, response)
+
+	content := response["content"].(map[string]interface{})
+	mediaTypes := []string{}
+	for mediaType := range content {
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	sort.Strings(mediaTypes)
+	schema := content[mediaTypes[0]].(map[string]interface{})["schema"].(map[string]interface{})
+	return mediaTypes[0], schema, nil
+}
+
+// helperPathTemplate finds the documented path that matches the request path,
+// its {param} segments match any value.
+func helperPathTemplate(spec map[string]interface{}, path string) string {
+	paths := spec["paths"].(map[string]interface{})
+	if _, ok := paths[path]; ok {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	for template := range paths {
+		templateSegments := strings.Split(template, "/")
+		if len(templateSegments) != len(segments) {
+			continue
+		}
+		match := true
+		for i, segment := range templateSegments {
+			match = match && (segment == segments[i] || strings.HasPrefix(segment, "{"))
+		}
+		if match {
+			return template
+		}
+	}
+	return path
+}
+
+// helperAnyOperation returns the first operation of a path item.
+func helperAnyOperation(item map[string]interface{}) (map[string]interface{}, bool) {
+	for _, method := range []string{"get", "post", "put", "delete"} {
+		if operation, ok := item[method].(map[string]interface{}); ok {
+			return operation, true
+		}
+	}
+	return nil, false
+}
+
+// helperResolve follows the $ref of an element of the document.
+func helperResolve(spec map[string]interface{}, element map[string]interface{}) map[string]interface{} {
+	ref, ok := element["$ref"].(string)
+	if !ok {
+		return element
+	}
+	var node interface{} = spec
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		node = node.(map[string]interface{})[part]
+	}
+	return helperResolve(spec, node.(map[string]interface{}))
+}
+
+// helperValidate validates a json value against the subset of JSON Schema used
+// by the document. Properties not documented are reported so the document
+// can not fall behind the handlers.
+func helperValidate(spec map[string]interface{}, schema map[string]interface{}, value interface{}, at string) []string {
+	schema = helperResolve(spec, schema)
+	errs := []string{}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			found = found || option == value
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: %v not in enum %v", at, value, enum))
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected object, got %T", at, value))
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required property %s", at, name))
+			}
+		}
+		properties, ok := schema["properties"].(map[string]interface{})
+		if !ok {
+			return errs
+		}
+		for name, property := range object {
+			propertySchema, ok := properties[name].(map[string]interface{})
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s: property %s not documented", at, name))
+				continue
+			}
+			errs = append(errs, helperValidate(spec, propertySchema, property, at+"."+name)...)
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected array, got %T", at, value))
+		}
+		items := schema["items"].(map[string]interface{})
+		for i, item := range array {
+			errs = append(errs, helperValidate(spec, items, item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected string, got %T", at, value))
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a date-time", at, str))
+			}
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != float64(int64(number)) {
+			errs = append(errs, fmt.Sprintf("%s: expected integer, got %v", at, value))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected number, got %T", at, value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected boolean, got %T", at, value))
+		}
+	}
+	return errs
+}
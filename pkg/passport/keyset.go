@@ -0,0 +1,105 @@
+package passport
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+)
+
+// maxKeySetSize is the maximum size in bytes of a fetched key set.
+const maxKeySetSize = 1024 * 1024
+
+// KeySet is a struct that represents a JSON Web Key Set of public keys.
+type KeySet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is a struct that represents an Ed25519 public key as a JSON Web Key.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+// newJWK returns the JWK of the public key.
+func newJWK(kid string, key ed25519.PublicKey) JWK {
+	return JWK{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(key),
+		KeyID:     kid,
+		Algorithm: EdDSA,
+		Use:       "sig",
+	}
+}
+
+// PublicKeys returns the Ed25519 public keys of the key set by key id. The keys
+// of other types or uses are ignored.
+// Returns an error if an Ed25519 key is not valid.
+func (set KeySet) PublicKeys() (map[string]ed25519.PublicKey, error) {
+	keys := map[string]ed25519.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.KeyType != "OKP" || jwk.Curve != "Ed25519" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key %q", jwk.KeyID)
+		}
+		keys[jwk.KeyID] = ed25519.PublicKey(x)
+	}
+	return keys, nil
+}
+
+// ParseKeySet parses a JSON Web Key Set.
+// Returns its Ed25519 public keys by key id, see KeySet.PublicKeys.
+func ParseKeySet(data []byte) (map[string]ed25519.PublicKey, error) {
+	set := KeySet{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid key set: %w", err)
+	}
+	return set.PublicKeys()
+}
+
+// FetchKeySet downloads the key set of the url, usually the
+// /.well-known/jwks.json endpoint of managerid.
+// Returns its Ed25519 public keys by key id, see KeySet.PublicKeys.
+func FetchKeySet(ctx context.Context, client *http.Client, url string) (map[string]ed25519.PublicKey, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching key set, status %d", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxKeySetSize))
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeySet(data)
+}
+
+// sortedKeys returns the key ids of the keys, sorted.
+func sortedKeys(keys map[string]ed25519.PublicKey) []string {
+	kids := []string{}
+	for kid := range keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	return kids
+}
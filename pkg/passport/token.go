@@ -0,0 +1,236 @@
+// Package passport issues and verifies the passport tokens of managerid: compact
+// JWS tokens, signed with Ed25519 (EdDSA) or HMAC-SHA256 (HS256), that prove a
+// passport id was issued by managerid without calling it.
+//
+// Services that only verify tokens need this package alone:
+//
+//	keys, err := passport.FetchKeySet(ctx, http.DefaultClient, "https://managerid.example.com/.well-known/jwks.json")
+//	verifier := &passport.Verifier{Keys: keys}
+//	claims, err := verifier.Verify(token)
+package passport
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Algorithms of the tokens, as the alg of their header.
+const (
+	EdDSA = "EdDSA"
+	HS256 = "HS256"
+)
+
+// Errors returned by Verifier.Verify.
+var (
+	ErrMalformed        = errors.New("malformed passport token")
+	ErrUnknownKey       = errors.New("unknown key of passport token")
+	ErrInvalidSignature = errors.New("invalid signature of passport token")
+	ErrExpired          = errors.New("expired passport token")
+)
+
+// Claims is a struct that represents the payload of a passport token.
+type Claims struct {
+	PassportID    string `json:"sub"`
+	PassportIDGrp string `json:"grp"`
+	Application   string `json:"app"`
+	// IssuedAt is the time the token was issued, in Unix seconds.
+	IssuedAt int64 `json:"iat"`
+}
+
+// Issued returns the time the token was issued.
+func (c *Claims) Issued() time.Time {
+	return time.Unix(c.IssuedAt, 0)
+}
+
+// header is the JOSE header of a token.
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Type      string `json:"typ"`
+}
+
+// Signer is a struct used to issue tokens with an Ed25519 private key or an
+// HMAC secret. Use NewEd25519Signer or NewHMACSigner to create it.
+type Signer struct {
+	// KeyID identifies the key in the header of the tokens and in the key set.
+	KeyID string
+	// Published are other public keys published in the key set along with the
+	// signing one, like the ones rotated out whose tokens are still verified.
+	Published map[string]ed25519.PublicKey
+
+	algorithm string
+	private   ed25519.PrivateKey
+	secret    []byte
+}
+
+// NewEd25519Signer returns a Signer of the EdDSA tokens of the private key, that
+// can be its 32 bytes seed or its 64 bytes. The key id is derived from the
+// public key when kid is empty.
+func NewEd25519Signer(key []byte, kid string) (*Signer, error) {
+	var private ed25519.PrivateKey
+	switch len(key) {
+	case ed25519.SeedSize:
+		private = ed25519.NewKeyFromSeed(key)
+	case ed25519.PrivateKeySize:
+		private = ed25519.PrivateKey(append([]byte{}, key...))
+	default:
+		return nil, fmt.Errorf("invalid Ed25519 key of %d bytes, expected %d or %d", len(key), ed25519.SeedSize, ed25519.PrivateKeySize)
+	}
+	if kid == "" {
+		kid = deriveKeyID(private.Public().(ed25519.PublicKey))
+	}
+	return &Signer{KeyID: kid, algorithm: EdDSA, private: private}, nil
+}
+
+// NewHMACSigner returns a Signer of the HS256 tokens of the secret, which is
+// shared with the verifiers and never published. The key id is derived from
+// the secret when kid is empty.
+func NewHMACSigner(secret []byte, kid string) (*Signer, error) {
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("invalid HMAC secret of %d bytes, expected at least 32", len(secret))
+	}
+	if kid == "" {
+		kid = deriveKeyID(secret)
+	}
+	return &Signer{KeyID: kid, algorithm: HS256, secret: append([]byte{}, secret...)}, nil
+}
+
+// deriveKeyID returns the hex of the first 8 bytes of the SHA-256 of the key.
+func deriveKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Algorithm returns the alg of the tokens of the signer.
+func (s *Signer) Algorithm() string {
+	return s.algorithm
+}
+
+// Sign returns the compact JWS of the claims.
+func (s *Signer) Sign(claims Claims) (string, error) {
+	head, err := json.Marshal(header{Algorithm: s.algorithm, KeyID: s.KeyID, Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := encode(head) + "." + encode(payload)
+
+	var signature []byte
+	switch s.algorithm {
+	case EdDSA:
+		signature = ed25519.Sign(s.private, []byte(input))
+	case HS256:
+		signature = hmacSHA256(s.secret, input)
+	default:
+		return "", fmt.Errorf("unsupported passport token algorithm %q", s.algorithm)
+	}
+	return input + "." + encode(signature), nil
+}
+
+// KeySet returns the public keys that verify the tokens: the signing one, if it
+// is Ed25519, and the published ones.
+func (s *Signer) KeySet() KeySet {
+	set := KeySet{Keys: []JWK{}}
+	if s.algorithm == EdDSA {
+		set.Keys = append(set.Keys, newJWK(s.KeyID, s.private.Public().(ed25519.PublicKey)))
+	}
+	for _, kid := range sortedKeys(s.Published) {
+		set.Keys = append(set.Keys, newJWK(kid, s.Published[kid]))
+	}
+	return set
+}
+
+// Verifier is a struct used to verify tokens with the public keys of a key set
+// or with the shared HMAC secret.
+type Verifier struct {
+	// Keys are the Ed25519 public keys of every key id, see FetchKeySet.
+	Keys map[string]ed25519.PublicKey
+	// Secret is the HMAC secret of the HS256 tokens, which are rejected when it is not set.
+	Secret []byte
+	// MaxAge rejects the tokens issued longer ago. Tokens do not expire when it is not set.
+	MaxAge time.Duration
+	// Now returns the current time, time.Now is used when it is not set.
+	Now func() time.Time
+}
+
+// Verify checks the signature of the token and its age.
+// Returns its claims, or ErrMalformed, ErrUnknownKey, ErrInvalidSignature or ErrExpired.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	head, payload, signature := []byte{}, []byte{}, []byte{}
+	for i, part := range []*[]byte{&head, &payload, &signature} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		*part = data
+	}
+
+	h := header{}
+	if err := json.Unmarshal(head, &h); err != nil {
+		return nil, ErrMalformed
+	}
+	input := parts[0] + "." + parts[1]
+	switch h.Algorithm {
+	case EdDSA:
+		key, ok := v.Keys[h.KeyID]
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+		if !ed25519.Verify(key, []byte(input), signature) {
+			return nil, ErrInvalidSignature
+		}
+	case HS256:
+		if len(v.Secret) == 0 {
+			return nil, ErrUnknownKey
+		}
+		if !hmac.Equal(signature, hmacSHA256(v.Secret, input)) {
+			return nil, ErrInvalidSignature
+		}
+	default:
+		return nil, ErrMalformed
+	}
+
+	claims := &Claims{}
+	if err := json.Unmarshal(payload, claims); err != nil || claims.PassportID == "" {
+		return nil, ErrMalformed
+	}
+	if v.MaxAge > 0 && v.now().Sub(claims.Issued()) > v.MaxAge {
+		return nil, ErrExpired
+	}
+	return claims, nil
+}
+
+// now returns the current time of the verifier.
+func (v *Verifier) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return time.Now()
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the input.
+func hmacSHA256(secret []byte, input string) []byte {
+	hash := hmac.New(sha256.New, secret)
+	hash.Write([]byte(input))
+	return hash.Sum(nil)
+}
+
+// encode returns the unpadded base64url of the data.
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
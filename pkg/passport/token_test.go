@@ -0,0 +1,133 @@
+package passport
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	seed := make([]byte, ed25519.SeedSize)
+	signer, err := NewEd25519Signer(seed, "")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(signer.KeyID, 16)
+	assert.Equal(EdDSA, signer.Algorithm())
+
+	issued := time.Date(2020, 5, 4, 10, 21, 0, 0, time.UTC)
+	claims := Claims{PassportID: "id", PassportIDGrp: "group", Application: "App", IssuedAt: issued.Unix()}
+	token, err := signer.Sign(claims)
+	if !assert.NoError(err) {
+		return
+	}
+
+	keys, err := signer.KeySet().PublicKeys()
+	if !assert.NoError(err) {
+		return
+	}
+	verifier := &Verifier{Keys: keys}
+	verified, err := verifier.Verify(token)
+	if assert.NoError(err) {
+		assert.Equal(claims, *verified)
+		assert.Equal(issued, verified.Issued().UTC())
+	}
+
+	verifier.MaxAge = time.Hour
+	verifier.Now = func() time.Time { return issued.Add(2 * time.Hour) }
+	_, err = verifier.Verify(token)
+	assert.Equal(ErrExpired, err)
+	verifier.Now = func() time.Time { return issued.Add(time.Minute) }
+	_, err = verifier.Verify(token)
+	assert.NoError(err)
+
+	parts := strings.Split(token, ".")
+	other, _ := NewEd25519Signer(append([]byte{1}, seed[1:]...), signer.KeyID)
+	forged, _ := other.Sign(claims)
+	tests := []struct {
+		Description string
+		Token       string
+		Err         error
+	}{
+		{Description: "when the token is not a JWS", Token: "garbage", Err: ErrMalformed},
+		{Description: "when a part is not base64url", Token: parts[0] + ".*." + parts[2], Err: ErrMalformed},
+		{Description: "when the payload is changed", Token: parts[0] + "." + encode([]byte(`{"sub":"other"}`)) + "." + parts[2], Err: ErrInvalidSignature},
+		{Description: "when it is signed with other key", Token: forged, Err: ErrInvalidSignature},
+		{Description: "when the key is unknown", Token: encode([]byte(`{"alg":"EdDSA","kid":"unknown"}`)) + "." + parts[1] + "." + parts[2], Err: ErrUnknownKey},
+		{Description: "when the algorithm is none", Token: encode([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".", Err: ErrMalformed},
+		{Description: "when it is HS256 without secret", Token: encode([]byte(`{"alg":"HS256"}`)) + "." + parts[1] + "." + parts[2], Err: ErrUnknownKey},
+	}
+	for _, test := range tests {
+		_, err := verifier.Verify(test.Token)
+		assert.Equal(test.Err, err, test.Description)
+	}
+}
+
+func TestHMACSigner(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewHMACSigner([]byte("short"), "")
+	assert.Error(err)
+
+	secret := []byte(strings.Repeat("s", 32))
+	signer, err := NewHMACSigner(secret, "hmac")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Empty(signer.KeySet().Keys)
+
+	token, err := signer.Sign(Claims{PassportID: "id", PassportIDGrp: "group", Application: "App", IssuedAt: time.Now().Unix()})
+	if !assert.NoError(err) {
+		return
+	}
+	claims, err := (&Verifier{Secret: secret}).Verify(token)
+	if assert.NoError(err) {
+		assert.Equal("id", claims.PassportID)
+	}
+	_, err = (&Verifier{Secret: []byte(strings.Repeat("x", 32))}).Verify(token)
+	assert.Equal(ErrInvalidSignature, err)
+	_, err = (&Verifier{}).Verify(token)
+	assert.Equal(ErrUnknownKey, err)
+}
+
+func TestFetchKeySet(t *testing.T) {
+	assert := assert.New(t)
+
+	signer, _ := NewEd25519Signer(make([]byte, ed25519.SeedSize), "current")
+	previous, _ := NewEd25519Signer([]byte(strings.Repeat("p", ed25519.SeedSize)), "")
+	signer.Published = map[string]ed25519.PublicKey{"previous": previous.private.Public().(ed25519.PublicKey)}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		set := signer.KeySet()
+		// keys of other types are ignored
+		set.Keys = append(set.Keys, JWK{KeyType: "RSA", KeyID: "rsa"})
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer ts.Close()
+
+	keys, err := FetchKeySet(context.Background(), ts.Client(), ts.URL)
+	if assert.NoError(err) {
+		assert.Len(keys, 2)
+		assert.Contains(keys, "current")
+		assert.Contains(keys, "previous")
+	}
+
+	_, err = ParseKeySet([]byte(`{"keys": [{"kty": "OKP", "crv": "Ed25519", "x": "short", "kid": "bad"}]}`))
+	assert.Error(err)
+	_, err = ParseKeySet([]byte(`garbage`))
+	assert.Error(err)
+
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	_, err = FetchKeySet(context.Background(), notFound.Client(), notFound.URL)
+	assert.Error(err)
+}
@@ -0,0 +1,96 @@
+package managerid
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// PassportCookie is the name of the cookie that holds the passport id.
+	PassportCookie = "passport_id"
+
+	// passportCookieAge is the lifetime of the passport id cookie.
+	passportCookieAge = 365 * 24 * time.Hour
+)
+
+// pixelGIF is a transparent 1x1 GIF image.
+var pixelGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// HandlePixel is a function used to settle visitors from pages that can not send
+// json requests, like emails or AMP pages.
+// Only GET method accepted.
+// The IP is taken from the request, see ClientHandler.ClientIP, and the provider
+// and application from the query. The interaction is validated and resolved as
+// HandleFunction does, and the response is a not cacheable 1x1 GIF that sets the
+// passport id in a cookie.
+// Errors are returned as an APIError envelope:
+// StatusMethodNotAllowed if other kind of request is received.
+// StatusUnprocessableEntity with the invalid fields when the interaction is not valid.
+// StatusForbidden if the interaction is a bot or internal and its application rejects them.
+// StatusInternalServerError or StatusServiceUnavailable when the identity can not be resolved.
+func (ch *ClientHandler) HandlePixel() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, methodNotAllowed(r))
+			return
+		}
+
+		identity, ok := ch.resolve(w, r, Interaction{
+			IP:          ch.clientIP(r),
+			Provider:    r.URL.Query().Get("provider"),
+			Application: r.URL.Query().Get("application"),
+			UserAgent:   r.UserAgent(),
+		})
+		if !ok {
+			return
+		}
+
+		if identity.Match != MatchEphemeral {
+			setPassportCookie(w, r, identity)
+		}
+		w.Header().Set("Content-Type", "image/gif")
+		w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, private")
+		w.Header().Set("Pragma", "no-cache")
+		w.Header().Set("Expires", "0")
+		w.Write(pixelGIF)
+	})
+}
+
+// remoteIP returns the IP address of the client connection.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// setPassportCookie sets the passport id of the identity in the response cookies.
+func setPassportCookie(w http.ResponseWriter, r *http.Request, identity *Identity) {
+	http.SetCookie(w, newCookie(r, PassportCookie, identity.PassportID, passportCookieAge))
+}
+
+// newCookie returns an HttpOnly cookie for the whole site.
+// Requests received over https get a cross-site cookie, so it is also set when
+// the response is embedded in a page of another site.
+func newCookie(r *http.Request, name, value string, maxAge time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  time.Now().Add(maxAge),
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	return cookie
+}
@@ -0,0 +1,100 @@
+package managerid
+
+import (
+	"bytes"
+	"image/gif"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlePixel(t *testing.T) {
+	assert := assert.New(t)
+
+	interactions := []Interaction{}
+	querier := &FakeDb{
+		GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+			interactions = append(interactions, interaction)
+			return &Identity{PassportID: "id", PassportIDGrp: "group"}, nil
+		},
+	}
+	ch := ClientHandler{Querier: querier}
+
+	tests := []struct {
+		Description string
+		Method      string
+		Query       string
+		Header      http.Header
+		StatusCode  int
+		Secure      bool
+	}{
+		{
+			Description: "when the pixel is requested with provider and application",
+			Method:      http.MethodGet,
+			Query:       "?provider=Prov&application=App",
+			StatusCode:  http.StatusOK,
+		},
+		{
+			Description: "when the pixel is requested over https",
+			Method:      http.MethodGet,
+			Query:       "?provider=Prov&application=App",
+			Header:      http.Header{"X-Forwarded-Proto": {"https"}},
+			StatusCode:  http.StatusOK,
+			Secure:      true,
+		},
+		{
+			Description: "when the application is missing",
+			Method:      http.MethodGet,
+			Query:       "?provider=Prov",
+			StatusCode:  http.StatusUnprocessableEntity,
+		},
+		{
+			Description: "when the pixel receives a POST request",
+			Method:      http.MethodPost,
+			StatusCode:  http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.Method, "/id/pixel.gif"+test.Query, nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		for name, values := range test.Header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		ch.HandlePixel().ServeHTTP(w, req)
+		resp := w.Result()
+
+		assert.Equal(test.StatusCode, resp.StatusCode, test.Description)
+		if test.StatusCode != http.StatusOK {
+			assert.Empty(resp.Cookies(), test.Description)
+			continue
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(err)
+		assert.Equal("image/gif", resp.Header.Get("Content-Type"), test.Description)
+		assert.Contains(resp.Header.Get("Cache-Control"), "no-store", test.Description)
+		image, err := gif.Decode(bytes.NewReader(body))
+		if assert.NoError(err, test.Description) {
+			assert.Equal(1, image.Bounds().Dx())
+			assert.Equal(1, image.Bounds().Dy())
+		}
+
+		if assert.Len(resp.Cookies(), 1, test.Description) {
+			cookie := resp.Cookies()[0]
+			assert.Equal(PassportCookie, cookie.Name)
+			assert.Equal("id", cookie.Value)
+			assert.True(cookie.HttpOnly)
+			assert.Equal(test.Secure, cookie.Secure, test.Description)
+		}
+	}
+
+	assert.Equal([]Interaction{
+		{IP: "192.0.2.10", Provider: "Prov", Application: "App"},
+		{IP: "192.0.2.10", Provider: "Prov", Application: "App"},
+	}, interactions)
+}
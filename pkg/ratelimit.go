@@ -0,0 +1,348 @@
+package managerid
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of RateLimiter, used as the limit label of the throttled metrics.
+const (
+	RateLimitIP          = "ip"
+	RateLimitApplication = "application"
+)
+
+// rateLimitSweepInterval is how often the full buckets are removed.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is a struct that represents the sustained rate and the burst of a token bucket.
+type RateLimit struct {
+	// Rate is the number of requests per second refilled in the bucket.
+	Rate float64
+	// Burst is the size of the bucket, the number of requests allowed at once.
+	Burst int
+}
+
+// ParseRateLimit parses a limit written as count/unit, where the unit is s, m or
+// h, with an optional burst after a colon, like "10/s", "600/m:50" or "1000/h".
+// The burst is the count when it is not set.
+func ParseRateLimit(value string) (RateLimit, error) {
+	value = strings.TrimSpace(value)
+	rate, burst := value, ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		rate, burst = value[:i], value[i+1:]
+	}
+	parts := strings.SplitN(rate, "/", 2)
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if len(parts) != 2 || err != nil || count <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected count/unit like 10/s", value)
+	}
+	units := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+	unit, ok := units[strings.TrimSpace(parts[1])]
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, the unit must be s, m or h", value)
+	}
+
+	limit := RateLimit{Rate: float64(count) / unit.Seconds(), Burst: count}
+	if burst != "" {
+		if limit.Burst, err = strconv.Atoi(strings.TrimSpace(burst)); err != nil || limit.Burst <= 0 {
+			return RateLimit{}, fmt.Errorf("invalid rate limit %q, the burst must be a positive number", value)
+		}
+	}
+	return limit, nil
+}
+
+// RateLimiter is a struct used to throttle the requests with token buckets kept
+// in memory, per client IP and per application.
+type RateLimiter struct {
+	// IP is the limit of every client IP. The IPs are not limited when its rate is 0.
+	IP RateLimit
+	// Applications are the limits of every application, the "*" one is used by
+	// the applications that are not listed. The applications are not limited
+	// when neither is set.
+	Applications map[string]RateLimit
+
+	buckets   map[string]*tokenBucket
+	throttled map[throttledKey]uint64
+	lastSweep time.Time
+	sync.Mutex
+}
+
+// tokenBucket is the bucket of a client IP or an application.
+type tokenBucket struct {
+	limit   RateLimit
+	tokens  float64
+	updated time.Time
+}
+
+// bucketRequest is a number of tokens requested from the bucket of a key.
+type bucketRequest struct {
+	key   string
+	limit RateLimit
+	n     int
+}
+
+// throttledKey identifies a counter of throttled requests.
+type throttledKey struct {
+	limit       string
+	application string
+}
+
+// NewRateLimiter returns a RateLimiter with the limits passed as param.
+func NewRateLimiter(ip RateLimit, applications map[string]RateLimit) *RateLimiter {
+	return &RateLimiter{
+		IP:           ip,
+		Applications: applications,
+		buckets:      map[string]*tokenBucket{},
+		throttled:    map[throttledKey]uint64{},
+		lastSweep:    time.Now(),
+	}
+}
+
+// AllowIP takes a token of the bucket of the IP.
+// Returns 0 if the request is allowed, or how long the client must wait.
+func (l *RateLimiter) AllowIP(ip string) time.Duration {
+	if l.IP.Rate <= 0 {
+		return 0
+	}
+	wait, short := l.take([]bucketRequest{{key: RateLimitIP + ":" + ip, limit: l.IP, n: 1}})
+	if len(short) > 0 {
+		l.count(RateLimitIP, "")
+	}
+	return wait
+}
+
+// AllowApplications takes a token per interaction of every application, only if
+// all the buckets have enough of them.
+// Returns 0 if the request is allowed, or how long the client must wait, or an
+// error if the interactions of an application exceed its burst, which no wait allows.
+func (l *RateLimiter) AllowApplications(interactions map[string]int) (time.Duration, error) {
+	requests := []bucketRequest{}
+	for application, n := range interactions {
+		limit, ok := l.Applications[application]
+		if !ok {
+			limit, ok = l.Applications["*"]
+		}
+		if !ok || limit.Rate <= 0 {
+			continue
+		}
+		if n > limit.Burst {
+			l.count(RateLimitApplication, application)
+			return 0, fmt.Errorf("%d interactions of %s exceed its rate limit burst of %d", n, application, limit.Burst)
+		}
+		requests = append(requests, bucketRequest{key: RateLimitApplication + ":" + application, limit: limit, n: n})
+	}
+
+	wait, short := l.take(requests)
+	for _, i := range short {
+		l.count(RateLimitApplication, strings.TrimPrefix(requests[i].key, RateLimitApplication+":"))
+	}
+	return wait, nil
+}
+
+// take takes the tokens of every request, only if all the buckets have enough.
+// Returns 0 if the tokens are taken, or the longest wait until they are refilled
+// and the positions of the requests whose buckets do not have enough.
+func (l *RateLimiter) take(requests []bucketRequest) (time.Duration, []int) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	wait, short := time.Duration(0), []int{}
+	buckets := make([]*tokenBucket, len(requests))
+	for i, request := range requests {
+		bucket, ok := l.buckets[request.key]
+		if !ok || bucket.limit != request.limit {
+			bucket = &tokenBucket{limit: request.limit, tokens: float64(request.limit.Burst), updated: now}
+			l.buckets[request.key] = bucket
+		}
+		bucket.refill(now)
+		buckets[i] = bucket
+
+		if missing := float64(request.n) - bucket.tokens; missing > 0 {
+			short = append(short, i)
+			w := time.Duration(math.Ceil(missing / request.limit.Rate * float64(time.Second)))
+			if w > wait {
+				wait = w
+			}
+		}
+	}
+	if len(short) > 0 {
+		return wait, short
+	}
+
+	for i, request := range requests {
+		buckets[i].tokens -= float64(request.n)
+	}
+	return 0, nil
+}
+
+// count increments the throttled requests of the limit and application.
+func (l *RateLimiter) count(limit, application string) {
+	l.Lock()
+	defer l.Unlock()
+	l.throttled[throttledKey{limit: limit, application: application}]++
+}
+
+// writeMetrics writes the counters of throttled requests in the Prometheus text format.
+func (l *RateLimiter) writeMetrics(w io.Writer) {
+	l.Lock()
+	keys := []throttledKey{}
+	for key := range l.throttled {
+		keys = append(keys, key)
+	}
+	counts := make([]uint64, len(keys))
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].limit != keys[j].limit {
+			return keys[i].limit < keys[j].limit
+		}
+		return keys[i].application < keys[j].application
+	})
+	for i, key := range keys {
+		counts[i] = l.throttled[key]
+	}
+	l.Unlock()
+
+	fmt.Fprintln(w, "# HELP managerid_throttled_requests_total Requests rejected by the rate limits.")
+	fmt.Fprintln(w, "# TYPE managerid_throttled_requests_total counter")
+	for i, key := range keys {
+		labels := "limit=" + metricLabel(key.limit)
+		if key.application != "" {
+			labels += fmt.Sprintf(",application=%s", metricLabel(key.application))
+		}
+		fmt.Fprintf(w, "managerid_throttled_requests_total{%s} %d\n", labels, counts[i])
+	}
+}
+
+// sweep removes the buckets that are full, at most once per rateLimitSweepInterval.
+// It must be called with the lock held.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= float64(bucket.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// refill adds the tokens of the time passed since the last update.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*b.limit.Rate)
+	b.updated = now
+}
+
+// WithRateLimit is a middleware that throttles the requests with
+// ClientHandler.RateLimits, first by the client IP and then by the applications
+// of the query or of the interactions of the body, taking a token per interaction.
+// The NDJSON bodies of imports are not read, their records are limited by the Importer.
+// Throttled requests are rejected with StatusTooManyRequests and the Retry-After
+// header, in seconds, and the batches with more interactions of an application
+// than its burst with StatusRequestEntityTooLarge. No request is throttled when
+// ClientHandler.RateLimits is not set.
+func (ch *ClientHandler) WithRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ch.RateLimits == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		applications := func() map[string]int { return ch.requestApplications(r) }
+		if apiErr, wait := ch.rateLimit(ch.clientIP(r), applications); apiErr != nil {
+			if wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			}
+			writeError(w, r, apiErr)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimit takes the tokens of a request of the IP, and of its interactions of
+// every application, only read when the applications are limited.
+// Returns nil if the request is allowed, or the APIError and how long the client
+// must wait, 0 when no wait allows the request.
+func (ch *ClientHandler) rateLimit(ip string, applications func() map[string]int) (*APIError, time.Duration) {
+	if wait := ch.RateLimits.AllowIP(ip); wait > 0 {
+		return rateLimited("too many requests from the client"), wait
+	}
+	if len(ch.RateLimits.Applications) == 0 {
+		return nil, 0
+	}
+	wait, err := ch.RateLimits.AllowApplications(applications())
+	if err != nil {
+		return &APIError{Status: http.StatusRequestEntityTooLarge, Code: CodeBatchTooLarge, Message: err.Error()}, 0
+	}
+	if wait > 0 {
+		return rateLimited("too many requests for the application"), wait
+	}
+	return nil, 0
+}
+
+// requestApplications returns the number of interactions of every application of
+// the request: the application of the query, or the ones of the body, which is
+// read and restored. A body that can not be decoded, or an NDJSON one, has no
+// applications.
+func (ch *ClientHandler) requestApplications(r *http.Request) map[string]int {
+	applications := map[string]int{}
+	if application := r.URL.Query().Get("application"); application != "" {
+		applications[application] = 1
+		return applications
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); r.Body == nil || mediaType == "application/x-ndjson" {
+		return applications
+	}
+
+	max := ch.maxBodySize()
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil || int64(len(body)) > max {
+		return applications
+	}
+
+	type item struct {
+		Application string `json:"application"`
+	}
+	items := []item{}
+	object := struct {
+		item
+		Interactions []item `json:"interactions"`
+	}{}
+	if json.Unmarshal(body, &items) != nil {
+		if json.Unmarshal(body, &object) != nil {
+			return applications
+		}
+		items = append(object.Interactions, object.item)
+	}
+	for _, item := range items {
+		if item.Application != "" {
+			applications[item.Application]++
+		}
+	}
+	return applications
+}
+
+// rateLimited returns the APIError of a throttled request.
+func rateLimited(message string) *APIError {
+	return &APIError{
+		Status:  http.StatusTooManyRequests,
+		Code:    CodeRateLimited,
+		Message: message + ", retry later",
+	}
+}
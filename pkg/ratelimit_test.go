@@ -0,0 +1,209 @@
+package managerid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		Value    string
+		Expected RateLimit
+	}{
+		{Value: "10/s", Expected: RateLimit{Rate: 10, Burst: 10}},
+		{Value: " 600/m:50 ", Expected: RateLimit{Rate: 10, Burst: 50}},
+		{Value: "3600/h", Expected: RateLimit{Rate: 1, Burst: 3600}},
+	}
+	for _, test := range tests {
+		limit, err := ParseRateLimit(test.Value)
+		assert.NoError(err, test.Value)
+		assert.Equal(test.Expected, limit, test.Value)
+	}
+
+	for _, value := range []string{"", "10", "0/s", "10/d", "10/s:0", "10/s:x", "x/s"} {
+		_, err := ParseRateLimit(value)
+		assert.Error(err, value)
+	}
+
+	limiter, err := RateLimitConfig{Applications: map[string]string{"*": "100/s", "App": "1/s:2"}}.Limiter()
+	if assert.NoError(err) {
+		assert.Equal(map[string]RateLimit{"*": {Rate: 100, Burst: 100}, "App": {Rate: 1, Burst: 2}}, limiter.Applications)
+	}
+	_, err = RateLimitConfig{Applications: map[string]string{"App": "fast"}}.Limiter()
+	assert.Error(err)
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter := NewRateLimiter(RateLimit{Rate: 1.0 / 60, Burst: 2}, map[string]RateLimit{
+		"*":   {Rate: 1, Burst: 100},
+		"App": {Rate: 1.0 / 60, Burst: 3},
+	})
+
+	assert.Zero(limiter.AllowIP("127.0.0.1"))
+	assert.Zero(limiter.AllowIP("127.0.0.1"))
+	wait := limiter.AllowIP("127.0.0.1")
+	assert.True(wait > 59*time.Second && wait <= time.Minute, "wait %s", wait)
+	// other IPs have their own bucket
+	assert.Zero(limiter.AllowIP("127.0.0.2"))
+
+	allow := func(interactions map[string]int) time.Duration {
+		wait, err := limiter.AllowApplications(interactions)
+		assert.NoError(err)
+		return wait
+	}
+	assert.Zero(allow(map[string]int{"App": 2, "Other": 50}))
+	// the tokens are taken only if every application has enough
+	assert.NotZero(allow(map[string]int{"App": 2, "Other": 1}))
+	assert.Zero(allow(map[string]int{"Other": 50}))
+	assert.Zero(allow(map[string]int{"App": 1}))
+	assert.NotZero(allow(map[string]int{"App": 1}))
+	// a batch bigger than the burst is never allowed
+	_, err := limiter.AllowApplications(map[string]int{"App": 10})
+	assert.Error(err)
+
+	// the IPs are not limited without rate
+	unlimited := NewRateLimiter(RateLimit{}, nil)
+	for i := 0; i < 10; i++ {
+		assert.Zero(unlimited.AllowIP("127.0.0.1"))
+	}
+	wait, err = unlimited.AllowApplications(map[string]int{"App": 10})
+	assert.NoError(err)
+	assert.Zero(wait)
+}
+
+func TestWithRateLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	querier := &FakeDb{
+		GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+			return &Identity{PassportID: "id", PassportIDGrp: "group"}, nil
+		},
+		GetIdentitiesFunc: func(interactions []Interaction) ([]*Identity, error) {
+			idents := []*Identity{}
+			for range interactions {
+				idents = append(idents, &Identity{PassportID: "id", PassportIDGrp: "group"})
+			}
+			return idents, nil
+		},
+		GroupSizesFunc: func(groups []string) (map[string]int, error) {
+			return map[string]int{"group": 1}, nil
+		},
+	}
+	ch := ClientHandler{
+		Querier: querier,
+		RateLimits: NewRateLimiter(RateLimit{Rate: 1.0 / 60, Burst: 2}, map[string]RateLimit{
+			"App": {Rate: 1.0 / 60, Burst: 2},
+		}),
+	}
+	r := mux.NewRouter()
+	ch.Routes(r)
+
+	settle := func(path, body, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	body := `{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}`
+	assert.Equal(http.StatusOK, settle("/id/settle", body, "192.0.2.1:1234").Code)
+	// the body is still read by the handler
+	w := settle("/v2/id/settle", body, "192.0.2.2:1234")
+	assert.Equal(http.StatusOK, w.Code)
+
+	// the application bucket is empty
+	w = settle("/id/settle", body, "192.0.2.3:1234")
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	assert.Equal("60", w.Header().Get("Retry-After"))
+	response := errorEnvelope{}
+	if assert.NoError(json.NewDecoder(w.Body).Decode(&response)) {
+		assert.Equal(CodeRateLimited, response.Error.Code)
+		assert.Equal("too many requests for the application, retry later", response.Error.Message)
+	}
+
+	// other applications are not limited, until the IP bucket is empty
+	other := `[{"ip": "127.0.0.1", "provider": "Prov", "application": "Other"}]`
+	assert.Equal(http.StatusOK, settle("/id/settle/batch", other, "192.0.2.1:1234").Code)
+	w = settle("/id/settle/batch", other, "192.0.2.1:1234")
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	if assert.NoError(json.NewDecoder(w.Body).Decode(&response)) {
+		assert.Equal("too many requests from the client, retry later", response.Error.Message)
+	}
+
+	// a batch bigger than the burst is charged per interaction, so it is never allowed
+	batch := `[` + strings.Repeat(`{"ip": "127.0.0.1", "provider": "Prov", "application": "App"},`, 2) + `{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}]`
+	w = settle("/id/settle/batch", batch, "192.0.2.5:1234")
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	if assert.NoError(json.NewDecoder(w.Body).Decode(&response)) {
+		assert.Equal(CodeBatchTooLarge, response.Error.Code)
+		assert.Equal("3 interactions of App exceed its rate limit burst of 2", response.Error.Message)
+	}
+
+	// the pixel takes the application from the query
+	req := httptest.NewRequest(http.MethodGet, "/id/pixel.gif?provider=Prov&application=App", nil)
+	req.RemoteAddr = "192.0.2.4:1234"
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`# HELP managerid_throttled_requests_total Requests rejected by the rate limits.
+# TYPE managerid_throttled_requests_total counter
+managerid_throttled_requests_total{limit="application",application="App"} 3
+managerid_throttled_requests_total{limit="ip"} 1
+`, w.Body.String())
+}
+
+func TestWithRateLimitAPIKey(t *testing.T) {
+	assert := assert.New(t)
+
+	key, secret, _ := NewAPIKey("Backend", []string{"App"}, nil)
+	ch := ClientHandler{
+		RequireAPIKey: true,
+		Querier: &FakeDb{
+			GetAPIKeyFunc: func(keyID string) (*APIKey, error) {
+				if keyID == key.KeyID {
+					return key, nil
+				}
+				return nil, ErrAPIKeyNotFound
+			},
+			GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+				return &Identity{PassportID: "id", PassportIDGrp: "group"}, nil
+			},
+		},
+		RateLimits: NewRateLimiter(RateLimit{}, map[string]RateLimit{"App": {Rate: 1.0 / 60, Burst: 1}}),
+	}
+	r := mux.NewRouter()
+	ch.Routes(r)
+
+	settle := func(apiKey string) int {
+		req := httptest.NewRequest(http.MethodPost, "/id/settle", strings.NewReader(`{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}`))
+		if apiKey != "" {
+			req.Header.Set(APIKeyHeader, apiKey)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// unauthenticated requests do not take the tokens of the application
+	for i := 0; i < 3; i++ {
+		assert.Equal(http.StatusUnauthorized, settle(""))
+	}
+	assert.Equal(http.StatusOK, settle(secret))
+	assert.Equal(http.StatusTooManyRequests, settle(secret))
+}
@@ -0,0 +1,120 @@
+package managerid
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RedirectPassportParam is the query parameter of the passport id in the
+// destinations of HandleRedirect.
+const RedirectPassportParam = "passport_id"
+
+// RedirectAllowlist holds the destination hosts allowed for every application.
+// A host starting with "*." allows the subdomains of the rest of the host.
+type RedirectAllowlist map[string][]string
+
+// ParseRedirectAllowlist parses an allowlist written as application=host,host
+// entries separated by semicolons, like "App=example.com,*.example.org;Other=other.com".
+func ParseRedirectAllowlist(value string) (RedirectAllowlist, error) {
+	allowlist := RedirectAllowlist{}
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		application := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || application == "" {
+			return nil, fmt.Errorf("invalid redirect allowlist entry %q, expected application=host,host", entry)
+		}
+		for _, host := range strings.Split(parts[1], ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				allowlist[application] = append(allowlist[application], strings.ToLower(host))
+			}
+		}
+	}
+	return allowlist, nil
+}
+
+// Allowed checks if the destination is an absolute http or https URL whose host
+// is allowed for the application.
+func (allowlist RedirectAllowlist) Allowed(application string, destination *url.URL) bool {
+	if destination.Scheme != "http" && destination.Scheme != "https" {
+		return false
+	}
+	if destination.User != nil {
+		return false
+	}
+	host := strings.ToLower(destination.Hostname())
+	if host == "" {
+		return false
+	}
+	for _, allowed := range allowlist[application] {
+		if host == allowed {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleRedirect is a function used to settle the visitors of an ad click before
+// sending them to the landing page.
+// Only GET method accepted.
+// The IP is taken from the request, see ClientHandler.ClientIP, and the provider,
+// application and url destination from the query. The destination must be
+// allowed for the application by ClientHandler.Redirects. The interaction is
+// validated and resolved as HandleFunction does, and the response redirects to
+// the destination with the passport id added as the passport_id query parameter.
+// Errors are returned as an APIError envelope:
+// StatusMethodNotAllowed if other kind of request is received.
+// StatusUnprocessableEntity with the invalid fields when the interaction or the destination are not valid.
+// StatusForbidden if the interaction is a bot or internal and its application rejects them.
+// StatusInternalServerError or StatusServiceUnavailable when the identity can not be resolved.
+func (ch *ClientHandler) HandleRedirect() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, methodNotAllowed(r))
+			return
+		}
+
+		query := r.URL.Query()
+		interaction := Interaction{
+			IP:          ch.clientIP(r),
+			Provider:    query.Get("provider"),
+			Application: query.Get("application"),
+			UserAgent:   r.UserAgent(),
+		}
+
+		// the destination is checked before resolving, rejected clicks are not stored
+		errs := interaction.Validate()
+		destination, err := url.Parse(query.Get("url"))
+		if query.Get("url") == "" {
+			errs = append(errs, FieldError{Field: "url", Message: "is required"})
+		} else if err != nil || !ch.Redirects.Allowed(interaction.Application, destination) {
+			errs = append(errs, FieldError{Field: "url", Message: "is not an allowed destination of the application"})
+		}
+		if len(errs) > 0 {
+			writeError(w, r, validationError(errs))
+			return
+		}
+
+		identity, ok := ch.resolve(w, r, interaction)
+		if !ok {
+			return
+		}
+
+		param := RedirectPassportParam + "=" + url.QueryEscape(identity.PassportID)
+		if destination.RawQuery == "" {
+			destination.RawQuery = param
+		} else {
+			destination.RawQuery += "&" + param
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, destination.String(), http.StatusFound)
+	})
+}
@@ -0,0 +1,138 @@
+package managerid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleRedirect(t *testing.T) {
+	assert := assert.New(t)
+
+	querier := &FakeDb{
+		GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+			return &Identity{PassportID: "id", PassportIDGrp: "group"}, nil
+		},
+	}
+	ch := ClientHandler{
+		Querier: querier,
+		Redirects: RedirectAllowlist{
+			"App": {"landing.example.com", "*.example.org"},
+		},
+	}
+
+	tests := []struct {
+		Description string
+		Method      string
+		Application string
+		URL         string
+		StatusCode  int
+		Location    string
+		Fields      []string
+	}{
+		{
+			Description: "when the destination is allowed",
+			Method:      http.MethodGet,
+			Application: "App",
+			URL:         "https://landing.example.com/offer",
+			StatusCode:  http.StatusFound,
+			Location:    "https://landing.example.com/offer?passport_id=id",
+		},
+		{
+			Description: "when the destination has a query",
+			Method:      http.MethodGet,
+			Application: "App",
+			URL:         "https://www.example.org/offer?utm_source=ads&b=1#form",
+			StatusCode:  http.StatusFound,
+			Location:    "https://www.example.org/offer?utm_source=ads&b=1&passport_id=id#form",
+		},
+		{
+			Description: "when the destination is allowed for other application",
+			Method:      http.MethodGet,
+			Application: "Other",
+			URL:         "https://landing.example.com/offer",
+			StatusCode:  http.StatusUnprocessableEntity,
+			Fields:      []string{"url"},
+		},
+		{
+			Description: "when the destination only shares the suffix of an allowed host",
+			Method:      http.MethodGet,
+			Application: "App",
+			URL:         "https://evillanding.example.com/",
+			StatusCode:  http.StatusUnprocessableEntity,
+			Fields:      []string{"url"},
+		},
+		{
+			Description: "when the destination is a relative URL",
+			Method:      http.MethodGet,
+			Application: "App",
+			URL:         "//landing.example.com@evil.com/",
+			StatusCode:  http.StatusUnprocessableEntity,
+			Fields:      []string{"url"},
+		},
+		{
+			Description: "when the destination is not http",
+			Method:      http.MethodGet,
+			Application: "App",
+			URL:         "javascript://landing.example.com/%0aalert(1)",
+			StatusCode:  http.StatusUnprocessableEntity,
+			Fields:      []string{"url"},
+		},
+		{
+			Description: "when the destination and the application are missing",
+			Method:      http.MethodGet,
+			StatusCode:  http.StatusUnprocessableEntity,
+			Fields:      []string{"application", "url"},
+		},
+		{
+			Description: "when the redirect receives a POST request",
+			Method:      http.MethodPost,
+			StatusCode:  http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		query := url.Values{"provider": {"Prov"}}
+		if test.Application != "" {
+			query.Set("application", test.Application)
+		}
+		if test.URL != "" {
+			query.Set("url", test.URL)
+		}
+		req := httptest.NewRequest(test.Method, "/r?"+query.Encode(), nil)
+		w := httptest.NewRecorder()
+		ch.HandleRedirect().ServeHTTP(w, req)
+
+		assert.Equal(test.StatusCode, w.Code, test.Description)
+		assert.Equal(test.Location, w.Header().Get("Location"), test.Description)
+		if test.Fields != nil {
+			envelope := struct{ Error APIError }{}
+			if assert.NoError(json.NewDecoder(w.Body).Decode(&envelope)) {
+				fields := []string{}
+				for _, detail := range envelope.Error.Details {
+					fields = append(fields, detail.Field)
+				}
+				assert.Equal(test.Fields, fields, test.Description)
+			}
+		}
+	}
+	assert.Equal(2, querier.GetIdentityCalls, "rejected clicks are not resolved")
+}
+
+func TestParseRedirectAllowlist(t *testing.T) {
+	assert := assert.New(t)
+
+	allowlist, err := ParseRedirectAllowlist(" App = Landing.example.com, *.example.org ;Other App=other.com;")
+	assert.NoError(err)
+	assert.Equal(RedirectAllowlist{
+		"App":       {"landing.example.com", "*.example.org"},
+		"Other App": {"other.com"},
+	}, allowlist)
+
+	_, err = ParseRedirectAllowlist("landing.example.com")
+	assert.Error(err)
+}
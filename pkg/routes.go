@@ -0,0 +1,37 @@
+package managerid
+
+import "github.com/gorilla/mux"
+
+// Routes registers the endpoints of every version of the API in the router.
+// v1 routes are also served without prefix, as they were before versioning.
+// Settle routes accept the Idempotency-Key header, and the routes that settle
+// identities are throttled by the rate limits. The server to server settle,
+// import, lookup and events routes require an API key and a signature when they
+// are enabled, checked before the rate limits so unauthenticated requests do not
+// take the tokens of an application. The lookup and events routes require the
+// admin token when API keys are not enabled, see WithLookupAccess.
+func (ch *ClientHandler) Routes(r *mux.Router) {
+	for _, prefix := range []string{"/v1", ""} {
+		r.Path(prefix + "/id/settle/batch").Handler(ch.WithSignature(ch.WithAPIKey(ch.WithRateLimit(ch.WithIdempotency(ch.HandleBatch())))))
+		r.Path(prefix + "/id/import").Handler(ch.WithStreamingSignature(ch.WithAPIKey(ch.WithRateLimit(ch.HandleImport()))))
+		r.Path(prefix + "/id/pixel.gif").Handler(ch.WithRateLimit(ch.HandlePixel()))
+		r.Path(prefix + "/identities").Handler(ch.WithSignature(ch.WithLookupAccess(ch.HandleSearch())))
+		r.Path(prefix + "/identities/{passport_id}").Handler(ch.WithSignature(ch.WithLookupAccess(ch.HandleIdentity())))
+		r.Path(prefix + "/events").Handler(ch.WithSignature(ch.WithLookupAccess(ch.HandleEvents())))
+		r.PathPrefix(prefix + "/id/settle").Handler(ch.WithSignature(ch.WithAPIKey(ch.WithRateLimit(ch.WithIdempotency(ch.HandleFunction())))))
+	}
+
+	r.Path("/v2/id/settle/batch").Handler(ch.WithSignature(ch.WithAPIKey(ch.WithRateLimit(ch.WithIdempotency(ch.HandleBatchV2())))))
+	r.Path("/v2/id/settle").Handler(ch.WithSignature(ch.WithAPIKey(ch.WithRateLimit(ch.WithIdempotency(ch.HandleSettleV2())))))
+
+	r.Path("/js/" + ScriptVersion + "/managerid.js").Handler(HandleScript())
+	r.Path("/js/" + ScriptVersion + "/settle").Handler(ch.WithRateLimit(ch.HandleScriptSettle()))
+
+	r.Path("/r").Handler(ch.WithRateLimit(ch.HandleRedirect()))
+	r.Path("/admin/api-keys").Handler(ch.WithAdmin(ch.HandleAPIKeys()))
+	r.Path("/admin/api-keys/{id}").Handler(ch.WithAdmin(ch.HandleAPIKey()))
+
+	r.Path("/.well-known/jwks.json").Handler(ch.HandleKeySet())
+	r.Path("/metrics").Handler(ch.HandleMetrics())
+	r.Path("/openapi.json").Handler(HandleOpenAPI())
+}
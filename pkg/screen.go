@@ -0,0 +1,56 @@
+package managerid
+
+import "net/http"
+
+// screen applies the internal and bot policies to a valid interaction before it
+// is resolved, the internal one first.
+// Returns the interaction to resolve, marked as internal or bot when it is
+// tagged, the ephemeral identity that replaces the resolution if any, or the
+// APIError of a rejected interaction.
+func (ch *ClientHandler) screen(interaction Interaction) (Interaction, *Identity, *APIError) {
+	return screen(ch.Internal, ch.Bots, interaction)
+}
+
+// screen applies the internal and bot policies, that may be nil, to the
+// interaction, see ClientHandler.screen.
+func screen(internalPolicy *InternalPolicy, bots *BotPolicy, interaction Interaction) (Interaction, *Identity, *APIError) {
+	internal, internalAction := internalPolicy.classify(interaction)
+	if internal {
+		interaction.Internal = true
+		switch internalAction {
+		case InternalBlock:
+			return interaction, nil, &APIError{
+				Status:  http.StatusForbidden,
+				Code:    CodeInternalBlocked,
+				Message: "internal traffic is not accepted for the application",
+			}
+		case InternalExclude:
+			return interaction, ephemeralIdentity(interaction), nil
+		}
+	}
+
+	reason, botAction := bots.classify(interaction)
+	if reason == "" {
+		return interaction, nil, nil
+	}
+	interaction.Bot = reason
+	switch botAction {
+	case BotReject:
+		return interaction, nil, &APIError{
+			Status:  http.StatusForbidden,
+			Code:    CodeBotRejected,
+			Message: "automated traffic is not accepted for the application",
+		}
+	case BotEphemeral:
+		return interaction, ephemeralIdentity(interaction), nil
+	}
+	return interaction, nil, nil
+}
+
+// ephemeralIdentity returns a new identity of the interaction that is not stored.
+func ephemeralIdentity(interaction Interaction) *Identity {
+	ident := &Identity{}
+	ident.createIdentity(interaction, "")
+	ident.Match = MatchEphemeral
+	return ident
+}
@@ -0,0 +1,243 @@
+package managerid
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// ScriptVersion is the version of the served JavaScript snippet, part of its path.
+const ScriptVersion = "v1"
+
+// scriptSettleRequest is the body sent by the JavaScript snippet, with the URL
+// and the referrer of the page, and the ids it stored, as the cookies of the
+// managerid host are not sent from the pages of other origins.
+type scriptSettleRequest struct {
+	Provider      string `json:"provider"`
+	Application   string `json:"application"`
+	PassportID    string `json:"passport_id,omitempty"`
+	PassportIDGrp string `json:"passport_id_group,omitempty"`
+	VisitContext
+}
+
+// HandleScript is a function used to serve the JavaScript snippet that settles
+// the visitors of a page. See scriptSource for its configuration.
+// Only GET method accepted.
+func HandleScript() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, methodNotAllowed(r))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Write([]byte(scriptSource))
+	})
+}
+
+// HandleScriptSettle is a function used to manage the settle requests of the
+// JavaScript snippet.
+// Only POST method accepted.
+// Decode the json body, sent as application/json or as text/plain by
+// navigator.sendBeacon, with the provider, application and visit context. The IP
+// is taken from the request, see ClientHandler.ClientIP, and the interaction is
+// validated and resolved as HandleFunction does. The identity of the stored
+// passport id and group sent by the snippet is reused when there is no valid
+// signed cookie, see knownIdentity. The response is the same as HandleSettleV2 one.
+// Errors are returned as an APIError envelope, see HandleFunction.
+func (ch *ClientHandler) HandleScriptSettle() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, r, methodNotAllowed(r))
+			return
+		}
+
+		if checkContentType(r, "text/plain") != nil {
+			if apiErr := checkContentType(r, "application/json"); apiErr != nil {
+				writeError(w, r, apiErr)
+				return
+			}
+		}
+
+		request := scriptSettleRequest{}
+		if apiErr := ch.decodeBody(r, &request); apiErr != nil {
+			writeError(w, r, apiErr)
+			return
+		}
+		if request.PassportID != "" {
+			stored := cookiePayload{PassportID: request.PassportID, PassportIDGrp: request.PassportIDGrp}
+			r = r.WithContext(context.WithValue(r.Context(), storedIDsContextKey{}, stored))
+		}
+
+		identity, ok := ch.resolve(w, r, Interaction{
+			IP:           ch.clientIP(r),
+			Provider:     request.Provider,
+			Application:  request.Application,
+			UserAgent:    r.UserAgent(),
+			VisitContext: request.VisitContext,
+		})
+		if !ok {
+			return
+		}
+
+		responses, err := ch.settleResponses([]*Identity{identity})
+		if err != nil {
+			internalError(w, r, "error performing GroupSizes", err)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(responses[0])
+	})
+}
+
+// scriptSource is the JavaScript snippet served by HandleScript.
+// It is configured with the data attributes of its script tag:
+// data-provider and data-application of the interaction (required),
+// data-endpoint to settle (the /js/v1/settle of the host serving the snippet),
+// data-storage where the ids are kept (local, cookie, both or none, local by default),
+// data-cookie and data-cookie-domain of the cookie (managerid_ids and the page host),
+// data-global name of the global object (ManagerID),
+// data-mode of the automatic settle (fetch, beacon or none, fetch by default).
+const scriptSource = `/*! managerid.js v1 */
+(function (window, document) {
+  "use strict";
+
+  var script = document.currentScript;
+  if (!script) {
+    return;
+  }
+
+  function attr(name, fallback) {
+    var value = script.getAttribute("data-" + name);
+    return value === null || value === "" ? fallback : value;
+  }
+
+  var provider = attr("provider");
+  var application = attr("application");
+  var endpoint = attr("endpoint", script.src.replace(/\/js\/v1\/managerid\.js([?#].*)?$/, "/js/v1/settle"));
+  var storage = attr("storage", "local");
+  var cookieName = attr("cookie", "managerid_ids");
+  var cookieDomain = attr("cookie-domain", "");
+  var mode = attr("mode", "fetch");
+  var globalName = attr("global", "ManagerID");
+  var storageKey = "managerid";
+
+  var api = window[globalName] = window[globalName] || {};
+  api.version = "1";
+
+  function useLocal() {
+    return storage === "local" || storage === "both";
+  }
+
+  function useCookie() {
+    return storage === "cookie" || storage === "both";
+  }
+
+  function load() {
+    var value = null;
+    try {
+      if (useLocal()) {
+        value = window.localStorage.getItem(storageKey);
+      }
+      if (!value && useCookie()) {
+        var match = document.cookie.match(new RegExp("(?:^|; )" + cookieName + "=([^;]*)"));
+        value = match && decodeURIComponent(match[1]);
+      }
+      return value ? JSON.parse(value) : null;
+    } catch (e) {
+      return null;
+    }
+  }
+
+  function store(ids) {
+    var value = JSON.stringify(ids);
+    try {
+      if (useLocal()) {
+        window.localStorage.setItem(storageKey, value);
+      }
+    } catch (e) {
+      // storage disabled or full, the ids are still exposed in the global
+    }
+    if (useCookie()) {
+      document.cookie = cookieName + "=" + encodeURIComponent(value) + "; path=/; max-age=31536000; SameSite=Lax" +
+        (cookieDomain ? "; domain=" + cookieDomain : "") +
+        (window.location.protocol === "https:" ? "; Secure" : "");
+    }
+  }
+
+  function expose(ids) {
+    if (ids) {
+      api.passportId = ids.passport_id;
+      api.passportIdGroup = ids.passport_id_group;
+    }
+    return ids;
+  }
+
+  function web(url) {
+    return /^https?:\/\//.test(url) ? url : undefined;
+  }
+
+  // payload sends back the stored ids, the cookies of the endpoint are not sent
+  // from the pages of other origins.
+  function payload() {
+    var ids = load() || {};
+    return JSON.stringify({
+      provider: provider,
+      application: application,
+      passport_id: ids.passport_id,
+      passport_id_group: ids.passport_id_group,
+      page_url: web(window.location.href),
+      referrer: web(document.referrer)
+    });
+  }
+
+  // settle resolves the visitor, stores and exposes the ids, and resolves with them.
+  api.settle = function () {
+    return window.fetch(endpoint, {
+      method: "POST",
+      headers: {"Content-Type": "application/json"},
+      body: payload(),
+      credentials: "same-origin",
+      keepalive: true
+    }).then(function (response) {
+      if (!response.ok) {
+        throw new Error("managerid: settle failed with status " + response.status);
+      }
+      return response.json();
+    }).then(function (response) {
+      var ids = {passport_id: response.passport_id, passport_id_group: response.passport_id_group};
+      store(ids);
+      expose(ids);
+      if (typeof window.CustomEvent === "function") {
+        document.dispatchEvent(new window.CustomEvent("managerid:ready", {detail: response}));
+      }
+      return ids;
+    });
+  };
+
+  // beacon settles the visitor without waiting for the response, also while the page unloads.
+  api.beacon = function () {
+    if (!window.navigator.sendBeacon) {
+      return false;
+    }
+    return window.navigator.sendBeacon(endpoint, new window.Blob([payload()], {type: "text/plain"}));
+  };
+
+  var stored = expose(load());
+  if (mode === "fetch" && window.fetch) {
+    api.ready = api.settle()["catch"](function (err) {
+      if (window.console) {
+        window.console.warn(err);
+      }
+      return stored;
+    });
+  } else {
+    if (mode !== "none") {
+      api.beacon();
+    }
+    api.ready = window.Promise ? window.Promise.resolve(stored) : undefined;
+  }
+})(window, document);
+`
@@ -0,0 +1,180 @@
+package managerid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleScript(t *testing.T) {
+	assert := assert.New(t)
+
+	w := httptest.NewRecorder()
+	HandleScript().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/js/v1/managerid.js", nil))
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("application/javascript; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(w.Header().Get("Cache-Control"), "max-age")
+	assert.True(strings.HasPrefix(w.Body.String(), "/*! managerid.js "+ScriptVersion+" */"))
+	assert.Contains(w.Body.String(), "/js/"+ScriptVersion+"/settle")
+}
+
+func TestHandleScriptSettle(t *testing.T) {
+	assert := assert.New(t)
+
+	interactions := []Interaction{}
+	querier := &FakeDb{
+		GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+			interactions = append(interactions, interaction)
+			return &Identity{PassportID: "id", PassportIDGrp: "group", Match: MatchNewGroup}, nil
+		},
+		GroupSizesFunc: func(groups []string) (map[string]int, error) {
+			return map[string]int{"group": 1}, nil
+		},
+	}
+	ch := ClientHandler{Querier: querier}
+
+	tests := []struct {
+		Description string
+		Method      string
+		ContentType string
+		Body        string
+		StatusCode  int
+	}{
+		{
+			Description: "when the snippet sends json",
+			Method:      http.MethodPost,
+			ContentType: "application/json",
+			Body:        `{"provider": "Prov", "application": "App"}`,
+			StatusCode:  http.StatusOK,
+		},
+		{
+			Description: "when the snippet sends a beacon",
+			Method:      http.MethodPost,
+			ContentType: "text/plain;charset=UTF-8",
+			Body:        `{"provider": "Prov", "application": "App"}`,
+			StatusCode:  http.StatusOK,
+		},
+		{
+			Description: "when the body is not json nor text",
+			Method:      http.MethodPost,
+			ContentType: "application/x-www-form-urlencoded",
+			Body:        `provider=Prov&application=App`,
+			StatusCode:  http.StatusUnsupportedMediaType,
+		},
+		{
+			Description: "when the application is missing",
+			Method:      http.MethodPost,
+			ContentType: "application/json",
+			Body:        `{"provider": "Prov"}`,
+			StatusCode:  http.StatusUnprocessableEntity,
+		},
+		{
+			Description: "when the settle receives a GET request",
+			Method:      http.MethodGet,
+			StatusCode:  http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.Method, "/js/v1/settle", strings.NewReader(test.Body))
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set("Content-Type", test.ContentType)
+		w := httptest.NewRecorder()
+		ch.HandleScriptSettle().ServeHTTP(w, req)
+
+		assert.Equal(test.StatusCode, w.Code, test.Description)
+		if test.StatusCode != http.StatusOK {
+			continue
+		}
+		response := SettleResponse{}
+		if assert.NoError(json.NewDecoder(w.Body).Decode(&response), test.Description) {
+			assert.Equal("id", response.PassportID, test.Description)
+			assert.Equal(1, response.GroupSize, test.Description)
+		}
+	}
+
+	assert.Equal([]Interaction{
+		{IP: "192.0.2.10", Provider: "Prov", Application: "App"},
+		{IP: "192.0.2.10", Provider: "Prov", Application: "App"},
+	}, interactions)
+}
+
+func TestHandleScriptSettleStoredIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	resolved := 0
+	visits := []string{}
+	querier := &FakeDb{
+		GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+			resolved++
+			return &Identity{PassportID: "new", PassportIDGrp: "newgroup", Match: MatchNewGroup}, nil
+		},
+		GetIdentityByIDFunc: func(passportID string) (*Identity, error) {
+			if passportID != "stored" {
+				return nil, ErrIdentityNotFound
+			}
+			return &Identity{PassportID: "stored", PassportIDGrp: "group", Provider: "Prov", Application: "App"}, nil
+		},
+		AddVisitFunc: func(passportID string, visit VisitContext) error {
+			visits = append(visits, passportID)
+			return nil
+		},
+		GroupSizesFunc: func(groups []string) (map[string]int, error) {
+			return map[string]int{"group": 2, "newgroup": 1}, nil
+		},
+	}
+	ch := ClientHandler{Querier: querier}
+
+	tests := []struct {
+		Description string
+		Body        string
+		Expected    string
+		Match       string
+	}{
+		{
+			Description: "when the stored ids belong to the application they are reused",
+			Body:        `{"provider": "Prov", "application": "App", "passport_id": "stored", "passport_id_group": "group", "page_url": "https://example.com/"}`,
+			Expected:    "stored",
+			Match:       MatchReused,
+		},
+		{
+			Description: "when the stored group does not match the interaction is resolved",
+			Body:        `{"provider": "Prov", "application": "App", "passport_id": "stored", "passport_id_group": "other"}`,
+			Expected:    "new",
+			Match:       MatchNewGroup,
+		},
+		{
+			Description: "when the stored ids belong to other application the interaction is resolved",
+			Body:        `{"provider": "Prov", "application": "Other", "passport_id": "stored", "passport_id_group": "group"}`,
+			Expected:    "new",
+			Match:       MatchNewGroup,
+		},
+		{
+			Description: "when the stored ids are unknown the interaction is resolved",
+			Body:        `{"provider": "Prov", "application": "App", "passport_id": "unknown", "passport_id_group": "group"}`,
+			Expected:    "new",
+			Match:       MatchNewGroup,
+		},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/js/v1/settle", strings.NewReader(test.Body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ch.HandleScriptSettle().ServeHTTP(w, req)
+
+		assert.Equal(http.StatusOK, w.Code, test.Description)
+		response := SettleResponse{}
+		if assert.NoError(json.NewDecoder(w.Body).Decode(&response), test.Description) {
+			assert.Equal(test.Expected, response.PassportID, test.Description)
+			assert.Equal(test.Match, response.Match, test.Description)
+		}
+	}
+	assert.Equal(3, resolved)
+	assert.Equal([]string{"stored"}, visits)
+}
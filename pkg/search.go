@@ -0,0 +1,290 @@
+package managerid
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultSearchLimit is the number of identities of a page when no limit is requested.
+	DefaultSearchLimit = 100
+	// MaxSearchLimit is the maximum number of identities of a page.
+	MaxSearchLimit = 1000
+
+	sortAscending  = "created_at"
+	sortDescending = "-created_at"
+)
+
+// IdentityFilter is a struct that represents the criteria of an identities search.
+// Zero values are not used to filter.
+type IdentityFilter struct {
+	Provider    string
+	Application string
+	// Network holds the IPs to match, a single IP is a network with a full mask.
+	Network *net.IPNet
+	// From is the inclusive lower bound of the creation time.
+	From time.Time
+	// To is the exclusive upper bound of the creation time.
+	To time.Time
+	// Ascending sorts the oldest identities first, the newest are the first otherwise.
+	Ascending bool
+	// After is the position of the last identity of the previous page.
+	After *Cursor
+	Limit int
+}
+
+// Cursor is a struct that represents the position of an identity in the search order.
+type Cursor struct {
+	Createdat  time.Time `json:"t"`
+	Ididentity int       `json:"i"`
+	// Search is the fingerprint of the criteria of the search the cursor belongs to.
+	Search string `json:"s"`
+}
+
+// IdentityResponse is a struct that represents an identity in the search and lookup results.
+type IdentityResponse struct {
+	PassportID    string    `json:"passport_id"`
+	PassportIDGrp string    `json:"passport_id_group"`
+	IP            string    `json:"ip"`
+	Provider      string    `json:"provider"`
+	Application   string    `json:"application"`
+	CreatedAt     time.Time `json:"created_at"`
+	Bot           string    `json:"bot,omitempty"`
+	Internal      bool      `json:"internal,omitempty"`
+}
+
+// identityResponse converts the identity to its IdentityResponse.
+func identityResponse(identity *Identity) *IdentityResponse {
+	return &IdentityResponse{
+		PassportID:    identity.PassportID,
+		PassportIDGrp: identity.PassportIDGrp,
+		IP:            identity.IP,
+		Provider:      identity.Provider,
+		Application:   identity.Application,
+		CreatedAt:     identity.Createdat,
+		Bot:           identity.Bot,
+		Internal:      identity.Internal,
+	}
+}
+
+// SearchResponse is a struct that represents a page of search results.
+// NextCursor is set when there may be more results.
+type SearchResponse struct {
+	Identities []*IdentityResponse `json:"identities"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+// HandleSearch is a function used to search the stored identities.
+// Only GET method accepted.
+// The query filters by provider, application, ip (a single IP or a CIDR network)
+// and the created_from (inclusive) and created_to (exclusive) RFC 3339 times.
+// Results are sorted by sort, created_at or -created_at (the default), and split
+// in pages of limit identities. The next page is requested sending the same query
+// with the next_cursor of the response as cursor.
+// Errors are returned as an APIError envelope:
+// StatusMethodNotAllowed if other kind of request is received.
+// StatusUnprocessableEntity with the invalid parameters when the query is not valid.
+// StatusForbidden if the application or provider are not allowed by the API key,
+// which requires to filter by them, or the application is not allowed for the origin.
+// StatusInternalServerError or StatusServiceUnavailable when the search fails.
+func (ch *ClientHandler) HandleSearch() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, methodNotAllowed(r))
+			return
+		}
+
+		filter, search, errs := parseIdentityFilter(r.URL.Query())
+		if len(errs) > 0 {
+			writeError(w, r, &APIError{
+				Status:  http.StatusUnprocessableEntity,
+				Code:    CodeValidation,
+				Message: "search has invalid parameters",
+				Details: errs,
+			})
+			return
+		}
+
+		if key := apiKeyFromContext(r.Context()); key != nil && !key.Allows(filter.Application, filter.Provider) {
+			writeError(w, r, &APIError{
+				Status:  http.StatusForbidden,
+				Code:    CodeForbidden,
+				Message: "search must filter by an application and provider allowed by the API key",
+			})
+			return
+		}
+		if !corsScopeFromContext(r.Context()).allows(filter.Application) {
+			writeError(w, r, &APIError{
+				Status:  http.StatusForbidden,
+				Code:    CodeForbidden,
+				Message: "search must filter by an application allowed for the origin",
+			})
+			return
+		}
+
+		// one more identity is requested to know if there is a next page
+		limit := filter.Limit
+		filter.Limit++
+		identities, err := ch.Querier.SearchIdentities(filter)
+		if err != nil {
+			internalError(w, r, "error performing SearchIdentities", err)
+			return
+		}
+
+		response := SearchResponse{Identities: []*IdentityResponse{}}
+		if len(identities) > limit {
+			identities = identities[:limit]
+			last := identities[limit-1]
+			response.NextCursor = encodeCursor(Cursor{
+				Createdat:  last.Createdat,
+				Ididentity: *last.Ididentity,
+				Search:     search,
+			})
+		}
+		for _, identity := range identities {
+			response.Identities = append(response.Identities, identityResponse(identity))
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// parseIdentityFilter reads the search parameters of the query.
+// Returns the filter, the fingerprint of its criteria and the invalid parameters found.
+func parseIdentityFilter(query url.Values) (IdentityFilter, string, []FieldError) {
+	errs := []FieldError{}
+	filter := IdentityFilter{
+		Provider:    query.Get("provider"),
+		Application: query.Get("application"),
+		Limit:       DefaultSearchLimit,
+	}
+
+	if ip := query.Get("ip"); ip != "" {
+		network, err := parseNetwork(ip)
+		if err != nil {
+			errs = append(errs, FieldError{Field: "ip", Message: "must be a valid IP address or CIDR network"})
+		}
+		filter.Network = network
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{
+		{"created_from", &filter.From},
+		{"created_to", &filter.To},
+	} {
+		if value := query.Get(param.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				errs = append(errs, FieldError{Field: param.name, Message: "must be a RFC 3339 date-time"})
+			}
+			*param.value = t
+		}
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.To.After(filter.From) {
+		errs = append(errs, FieldError{Field: "created_to", Message: "must be after created_from"})
+	}
+
+	switch query.Get("sort") {
+	case "", sortDescending:
+	case sortAscending:
+		filter.Ascending = true
+	default:
+		errs = append(errs, FieldError{Field: "sort", Message: fmt.Sprintf("must be %s or %s", sortAscending, sortDescending)})
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MaxSearchLimit {
+			errs = append(errs, FieldError{Field: "limit", Message: fmt.Sprintf("must be an integer between 1 and %d", MaxSearchLimit)})
+		}
+		filter.Limit = n
+	}
+
+	search := searchFingerprint(query)
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			errs = append(errs, FieldError{Field: "cursor", Message: "is not valid"})
+		} else if after.Search != search {
+			errs = append(errs, FieldError{Field: "cursor", Message: "belongs to a search with other parameters"})
+		}
+		filter.After = after
+	}
+	return filter, search, errs
+}
+
+// ParseNetworks parses a comma separated list of IP addresses and CIDR networks,
+// see parseNetwork.
+func ParseNetworks(value string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		network, err := parseNetwork(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", item)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parseNetwork parses an IP address or a CIDR network.
+// A single IP is returned as a network with a full mask.
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return network, err
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+}
+
+// searchFingerprint returns the fingerprint of the search criteria of the query,
+// the parameters that do not change between its pages.
+func searchFingerprint(query url.Values) string {
+	hash := sha256.New()
+	for _, param := range []string{"provider", "application", "ip", "created_from", "created_to", "sort"} {
+		fmt.Fprintf(hash, "%s=%q\n", param, query.Get(param))
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+// encodeCursor returns the opaque representation of the cursor sent to the client.
+func encodeCursor(cursor Cursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reads a cursor encoded by encodeCursor.
+func decodeCursor(value string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &Cursor{}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
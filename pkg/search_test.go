@@ -0,0 +1,237 @@
+package managerid
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleSearch(t *testing.T) {
+	assert := assert.New(t)
+
+	createdat := time.Date(2020, 5, 4, 10, 21, 0, 0, time.UTC)
+	stored := []*Identity{}
+	for i := 1; i <= 5; i++ {
+		id := i
+		stored = append(stored, &Identity{
+			IP:            "10.0.0.1",
+			Provider:      "Prov",
+			Application:   "App",
+			PassportID:    string(rune('a' + i)),
+			PassportIDGrp: "group",
+			Createdat:     createdat.Add(time.Duration(-i) * time.Minute),
+			Ididentity:    &id,
+		})
+	}
+
+	filters := []IdentityFilter{}
+	querier := &FakeDb{
+		SearchIdentitiesFunc: func(filter IdentityFilter) ([]*Identity, error) {
+			filters = append(filters, filter)
+			start := 0
+			if filter.After != nil {
+				start = filter.After.Ididentity
+			}
+			end := start + filter.Limit
+			if end > len(stored) {
+				end = len(stored)
+			}
+			return stored[start:end], nil
+		},
+	}
+	ch := ClientHandler{Querier: querier}
+	ts := httptest.NewServer(ch.HandleSearch())
+	defer ts.Close()
+
+	query := url.Values{"provider": {"Prov"}, "ip": {"10.0.0.0/24"}, "limit": {"2"}}
+	pages := [][]string{}
+	for {
+		resp, err := http.Get(ts.URL + "?" + query.Encode())
+		if err != nil {
+			t.Errorf("error sending test Request: Err: %v", err)
+			return
+		}
+		assert.Equal(http.StatusOK, resp.StatusCode)
+
+		response := SearchResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Errorf("error unmarshaling the test response: Err: %v", err)
+			return
+		}
+		page := []string{}
+		for _, identity := range response.Identities {
+			page = append(page, identity.PassportID)
+		}
+		pages = append(pages, page)
+
+		if response.NextCursor == "" || len(pages) > 5 {
+			break
+		}
+		query.Set("cursor", response.NextCursor)
+	}
+
+	assert.Equal([][]string{{"b", "c"}, {"d", "e"}, {"f"}}, pages)
+	if assert.Len(filters, 3) {
+		assert.Equal("Prov", filters[0].Provider)
+		assert.Equal("10.0.0.0/24", filters[0].Network.String())
+		assert.Equal(3, filters[0].Limit)
+		assert.Nil(filters[0].After)
+		assert.Equal(2, filters[1].After.Ididentity)
+		assert.Equal(createdat.Add(-2*time.Minute), filters[1].After.Createdat)
+	}
+
+	query.Set("provider", "Other")
+	resp, err := http.Get(ts.URL + "?" + query.Encode())
+	if err != nil {
+		t.Errorf("error sending test Request: Err: %v", err)
+		return
+	}
+	assert.Equal(http.StatusUnprocessableEntity, resp.StatusCode, "cursors are bound to the search parameters")
+
+	resp, err = http.Post(ts.URL, "application/json", nil)
+	if err != nil {
+		t.Errorf("error sending test Request: Err: %v", err)
+		return
+	}
+	assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestParseIdentityFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		Description string
+		Query       string
+		Network     string
+		Ascending   bool
+		Limit       int
+		Fields      []string
+	}{
+		{
+			Description: "when the query is empty",
+			Limit:       DefaultSearchLimit,
+			Fields:      []string{},
+		},
+		{
+			Description: "when the ip is a single IPv4 address",
+			Query:       "ip=127.0.0.1&sort=created_at&limit=10",
+			Network:     "127.0.0.1/32",
+			Ascending:   true,
+			Limit:       10,
+			Fields:      []string{},
+		},
+		{
+			Description: "when the ip is an IPv6 network",
+			Query:       "ip=2001:db8::/32",
+			Network:     "2001:db8::/32",
+			Limit:       DefaultSearchLimit,
+			Fields:      []string{},
+		},
+		{
+			Description: "when every parameter is invalid",
+			Query:       "ip=garbage&created_from=yesterday&created_to=today&sort=ip&limit=5000&cursor=garbage",
+			Fields:      []string{"ip", "created_from", "created_to", "sort", "limit", "cursor"},
+		},
+		{
+			Description: "when the time range is empty",
+			Query:       "created_from=2020-05-04T10:00:00Z&created_to=2020-05-04T10:00:00Z",
+			Fields:      []string{"created_to"},
+		},
+	}
+
+	for _, test := range tests {
+		query, err := url.ParseQuery(test.Query)
+		if err != nil {
+			t.Errorf("error parsing the test query: Err: %v", err)
+			return
+		}
+
+		filter, _, errs := parseIdentityFilter(query)
+
+		fields := []string{}
+		for _, fieldErr := range errs {
+			fields = append(fields, fieldErr.Field)
+		}
+		assert.Equal(test.Fields, fields, test.Description)
+		if len(errs) > 0 {
+			continue
+		}
+		if test.Network != "" {
+			assert.Equal(test.Network, filter.Network.String(), test.Description)
+		}
+		assert.Equal(test.Ascending, filter.Ascending, test.Description)
+		assert.Equal(test.Limit, filter.Limit, test.Description)
+	}
+}
+
+func TestIPNumber(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]byte{10, 20, 30, 1}, ipNumber("10.20.30.1"))
+	assert.Equal([]byte{10, 20, 30, 1}, ipNumber("::ffff:10.20.30.1"))
+	assert.Equal([]byte(net.ParseIP("2001:db8::1")), ipNumber("2001:DB8::1"))
+	assert.Nil(ipNumber("not an ip"))
+}
+
+func TestSearchIdentities(t *testing.T) {
+	assert := assert.New(t)
+
+	if err := dbInstance.Open(); err != nil {
+		t.Errorf("error opening database connection. err: %s", err)
+	}
+
+	provider := helperRandstring(10)
+	idents, err := dbInstance.GetIdentities([]Interaction{
+		{IP: "10.20.30.1", Provider: provider, Application: "TestApp"},
+		{IP: "10.20.31.1", Provider: provider, Application: "TestApp"},
+		{IP: "2001:db8::1", Provider: provider, Application: "TestApp"},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	for _, ident := range idents {
+		identities = append(identities, *ident)
+	}
+
+	network, _ := parseNetwork("10.20.30.0/24")
+	found, err := dbInstance.SearchIdentities(IdentityFilter{Provider: provider, Network: network, Limit: 10})
+	assert.NoError(err)
+	if assert.Len(found, 1) {
+		assert.Equal(idents[0].PassportID, found[0].PassportID)
+	}
+
+	network, _ = parseNetwork("2001:db8::/32")
+	found, err = dbInstance.SearchIdentities(IdentityFilter{Provider: provider, Network: network, Limit: 10})
+	assert.NoError(err)
+	if assert.Len(found, 1) {
+		assert.Equal(idents[2].PassportID, found[0].PassportID)
+	}
+
+	network, _ = parseNetwork("10.20.31.1")
+	found, err = dbInstance.SearchIdentities(IdentityFilter{Provider: provider, Network: network, Limit: 10})
+	assert.NoError(err)
+	if assert.Len(found, 1) {
+		assert.Equal(idents[1].PassportID, found[0].PassportID)
+	}
+
+	// every identity of the batch has the same createdat, pages are split by ididentity
+	filter := IdentityFilter{Provider: provider, Ascending: true, Limit: 1}
+	for _, ident := range idents {
+		found, err = dbInstance.SearchIdentities(filter)
+		assert.NoError(err)
+		if !assert.Len(found, 1) {
+			return
+		}
+		assert.Equal(ident.PassportID, found[0].PassportID)
+		filter.After = &Cursor{Createdat: found[0].Createdat, Ididentity: *found[0].Ididentity}
+	}
+	found, err = dbInstance.SearchIdentities(filter)
+	assert.NoError(err)
+	assert.Empty(found)
+}
@@ -0,0 +1,364 @@
+package managerid
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of the signed requests.
+const (
+	// SignatureClientHeader is the id of the client that signs the request.
+	SignatureClientHeader = "X-Client-ID"
+	// SignatureTimestampHeader is the time of the signature, in Unix seconds.
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	// SignatureHeader is the hex HMAC-SHA256 of the request, see SignRequest.
+	SignatureHeader = "X-Signature"
+	// SignatureDigestHeader is the hex SHA-256 of the body of a streamed request,
+	// signed instead of the body, see SignRequestDigest.
+	SignatureDigestHeader = "X-Content-SHA256"
+)
+
+// errBodyDigest is returned when a spooled body does not match its signed digest.
+var errBodyDigest = errors.New("request body does not match the signed digest")
+
+// DefaultSignatureWindow is how far the timestamp of a signed request can be
+// from the server time when SignatureVerifier.Window is not set.
+const DefaultSignatureWindow = 5 * time.Minute
+
+// SignatureVerifier is a struct used to verify the requests signed with
+// HMAC-SHA256 by the backend clients, rejecting the timestamps out of the replay
+// window and the signatures already used within it.
+type SignatureVerifier struct {
+	// Clients are the secrets of every client id. A request signed with any
+	// secret of its client is valid, so a secret is rotated adding the new one,
+	// moving the client to it, and removing the old one.
+	Clients map[string][]string
+	// Window is how far the timestamp can be from the server time, in both ways.
+	// DefaultSignatureWindow is used when it is not set.
+	Window time.Duration
+	// Required rejects the requests that are not signed. Otherwise only the
+	// signed requests are verified.
+	Required bool
+
+	seen      map[string]time.Time
+	lastSweep time.Time
+	sync.Mutex
+}
+
+// NewSignatureVerifier returns a SignatureVerifier of the clients passed as param.
+func NewSignatureVerifier(clients map[string][]string, window time.Duration, required bool) *SignatureVerifier {
+	return &SignatureVerifier{
+		Clients:   clients,
+		Window:    window,
+		Required:  required,
+		seen:      map[string]time.Time{},
+		lastSweep: time.Now(),
+	}
+}
+
+// ParseSigningClients parses the secrets written as client=secret entries
+// separated by semicolons, with the secrets of a client separated by commas,
+// like "crm=s3cr3t;billing=new,old".
+func ParseSigningClients(value string) (map[string][]string, error) {
+	clients := map[string][]string{}
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		client := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || client == "" {
+			return nil, fmt.Errorf("invalid signing client entry %q, expected client=secret", entry)
+		}
+		for _, secret := range strings.Split(parts[1], ",") {
+			if secret = strings.TrimSpace(secret); secret != "" {
+				clients[client] = append(clients[client], secret)
+			}
+		}
+		if len(clients[client]) == 0 {
+			return nil, fmt.Errorf("invalid signing client entry %q, the client has no secret", entry)
+		}
+	}
+	return clients, nil
+}
+
+// SignRequest signs the request with the secret of the client at the time
+// passed as param, setting the signature headers. The body is read and restored.
+func SignRequest(r *http.Request, clientID, secret string, at time.Time) error {
+	body := []byte{}
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	r.Header.Set(SignatureClientHeader, clientID)
+	r.Header.Set(SignatureTimestampHeader, timestamp)
+	r.Header.Set(SignatureHeader, hex.EncodeToString(requestMAC(secret, timestamp, r.Method, r.URL.RequestURI(), body)))
+	return nil
+}
+
+// SignRequestDigest signs the request with the secret of the client at the time
+// passed as param, setting the signature headers, without reading its body. The
+// digest is the SHA-256 of the body, so a large body is hashed beforehand and
+// then streamed. Only the routes that stream the body accept it, like /id/import.
+func SignRequestDigest(r *http.Request, clientID, secret string, digest []byte, at time.Time) {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	r.Header.Set(SignatureClientHeader, clientID)
+	r.Header.Set(SignatureTimestampHeader, timestamp)
+	r.Header.Set(SignatureDigestHeader, hex.EncodeToString(digest))
+	r.Header.Set(SignatureHeader, hex.EncodeToString(digestMAC(secret, timestamp, r.Method, r.URL.RequestURI(), hex.EncodeToString(digest))))
+}
+
+// requestMAC returns the HMAC-SHA256 of the timestamp, the method, the URI with
+// its query and the body of a request, separated by new lines.
+func requestMAC(secret, timestamp, method, uri string, body []byte) []byte {
+	hash := hmac.New(sha256.New, []byte(secret))
+	hash.Write([]byte(timestamp + "\n" + method + "\n" + uri + "\n"))
+	hash.Write(body)
+	return hash.Sum(nil)
+}
+
+// digestMAC returns the HMAC-SHA256 of the hex digest of the body, the timestamp,
+// the method and the URI with its query of a request, separated by new lines.
+// The digest goes first with a prefix, so it can not be taken as the timestamp of
+// a requestMAC.
+func digestMAC(secret, timestamp, method, uri, digest string) []byte {
+	hash := hmac.New(sha256.New, []byte(secret))
+	hash.Write([]byte("sha256:" + digest + "\n" + timestamp + "\n" + method + "\n" + uri))
+	return hash.Sum(nil)
+}
+
+// verify checks the signature headers of the request against the MAC of every
+// secret of its client, as mac computes it with the timestamp.
+// Returns the APIError of a request that is not signed as required, or whose
+// signature is not valid, out of the window or replayed, or nil.
+func (v *SignatureVerifier) verify(r *http.Request, mac func(secret, timestamp string) []byte, now time.Time) *APIError {
+	unauthorized := func(message string) *APIError {
+		return &APIError{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: message}
+	}
+
+	clientID := r.Header.Get(SignatureClientHeader)
+	timestamp := r.Header.Get(SignatureTimestampHeader)
+	signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if clientID == "" || timestamp == "" || err != nil || len(signature) == 0 {
+		return unauthorized("request signature is required")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return unauthorized("signature timestamp is not valid")
+	}
+	signed := time.Unix(seconds, 0)
+	window := v.window()
+	if signed.Before(now.Add(-window)) || signed.After(now.Add(window)) {
+		return unauthorized("signature timestamp is out of the replay window")
+	}
+
+	valid := false
+	for _, secret := range v.Clients[clientID] {
+		if hmac.Equal(signature, mac(secret, timestamp)) {
+			valid = true
+		}
+	}
+	if !valid {
+		return unauthorized("request signature is not valid")
+	}
+
+	if !v.remember(clientID+":"+hex.EncodeToString(signature), signed.Add(window), now) {
+		return unauthorized("request signature was already used")
+	}
+	return nil
+}
+
+// remember records a signature until it expires.
+// Returns false if it was already recorded.
+func (v *SignatureVerifier) remember(signature string, expires, now time.Time) bool {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.seen == nil {
+		v.seen = map[string]time.Time{}
+	}
+	if now.Sub(v.lastSweep) >= v.window() {
+		v.lastSweep = now
+		for key, at := range v.seen {
+			if now.After(at) {
+				delete(v.seen, key)
+			}
+		}
+	}
+
+	if at, ok := v.seen[signature]; ok && !now.After(at) {
+		return false
+	}
+	v.seen[signature] = expires
+	return true
+}
+
+// window returns the configured replay window or the default one.
+func (v *SignatureVerifier) window() time.Duration {
+	if v.Window > 0 {
+		return v.Window
+	}
+	return DefaultSignatureWindow
+}
+
+// WithSignature is a middleware that verifies the requests signed with
+// ClientHandler.Signatures. The body is read, up to the maximum body size, and
+// restored for the handler. Requests are not verified when it is not set.
+// Errors are returned as an APIError envelope:
+// StatusUnauthorized if the signature is required and missing, not valid, out
+// of the replay window or already used.
+// StatusRequestEntityTooLarge if the body of a signed request exceeds the maximum body size.
+func (ch *ClientHandler) WithSignature(next http.Handler) http.Handler {
+	return ch.withSignature(next, false)
+}
+
+// WithStreamingSignature is a middleware like WithSignature that also accepts
+// the requests signed with SignRequestDigest, whose body is not limited by the
+// maximum body size: it is spooled to a temporary file while it is hashed, and
+// the handler only gets it once it matches the digest.
+// Errors are returned as an APIError envelope:
+// StatusUnauthorized if the body does not match the digest.
+func (ch *ClientHandler) WithStreamingSignature(next http.Handler) http.Handler {
+	return ch.withSignature(next, true)
+}
+
+// withSignature verifies the signed requests, spooling the body of the ones
+// signed with a digest when streaming is set.
+func (ch *ClientHandler) withSignature(next http.Handler, streaming bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := ch.Signatures
+		if v == nil || (!v.Required && r.Header.Get(SignatureHeader) == "") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if digest := r.Header.Get(SignatureDigestHeader); streaming && digest != "" {
+			expected, err := hex.DecodeString(digest)
+			if err != nil || len(expected) != sha256.Size {
+				writeError(w, r, &APIError{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: "body digest is not a hex SHA-256"})
+				return
+			}
+			mac := func(secret, timestamp string) []byte {
+				return digestMAC(secret, timestamp, r.Method, r.URL.RequestURI(), strings.ToLower(digest))
+			}
+			if apiErr := v.verify(r, mac, time.Now()); apiErr != nil {
+				writeError(w, r, apiErr)
+				return
+			}
+			body := io.Reader(http.NoBody)
+			if r.Body != nil {
+				body = r.Body
+			}
+			spooled, err := spoolBody(body, expected)
+			if errors.Is(err, errBodyDigest) {
+				writeError(w, r, &APIError{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Message: err.Error()})
+				return
+			}
+			if err != nil {
+				internalError(w, r, "error spooling the signed body", err)
+				return
+			}
+			defer spooled.Close()
+			r.Body = spooled
+			next.ServeHTTP(w, withSigningClient(r))
+			return
+		}
+
+		body := []byte{}
+		if r.Body != nil {
+			max := ch.maxBodySize()
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+			if err != nil {
+				writeError(w, r, decodeError(err))
+				return
+			}
+			if int64(len(body)) > max {
+				writeError(w, r, bodyTooLarge(max))
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		mac := func(secret, timestamp string) []byte {
+			return requestMAC(secret, timestamp, r.Method, r.URL.RequestURI(), body)
+		}
+		if apiErr := v.verify(r, mac, time.Now()); apiErr != nil {
+			writeError(w, r, apiErr)
+			return
+		}
+		next.ServeHTTP(w, withSigningClient(r))
+	})
+}
+
+// withSigningClient returns the request with the client of its verified signature in the context.
+func withSigningClient(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), signingClientContextKey{}, r.Header.Get(SignatureClientHeader)))
+}
+
+// spooledBody is a request body spooled to a temporary file, removed when it is closed.
+type spooledBody struct {
+	*os.File
+}
+
+// spoolBody copies the body to a temporary file while it is hashed.
+// Returns the file rewound, errBodyDigest if the body does not match the
+// expected digest, or the error reading the body or writing the file.
+func spoolBody(body io.Reader, expected []byte) (*spooledBody, error) {
+	file, err := ioutil.TempFile("", "managerid-body-")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &spooledBody{File: file}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), body); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	if !hmac.Equal(hash.Sum(nil), expected) {
+		spooled.Close()
+		return nil, errBodyDigest
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	return spooled, nil
+}
+
+// Close closes and removes the file.
+func (b *spooledBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.Name())
+	return err
+}
+
+// signingClientContextKey is the key of the client of a verified signature in the request context.
+type signingClientContextKey struct{}
+
+// signingClientFromContext returns the client whose signature WithSignature
+// verified, or an empty string.
+func signingClientFromContext(ctx context.Context) string {
+	client, _ := ctx.Value(signingClientContextKey{}).(string)
+	return client
+}
@@ -0,0 +1,201 @@
+package managerid
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSigningClients(t *testing.T) {
+	assert := assert.New(t)
+
+	clients, err := ParseSigningClients("crm=new, old; billing=secret;")
+	assert.NoError(err)
+	assert.Equal(map[string][]string{"crm": {"new", "old"}, "billing": {"secret"}}, clients)
+
+	for _, value := range []string{"crm", "=secret", "crm= , "} {
+		_, err := ParseSigningClients(value)
+		assert.Error(err, value)
+	}
+}
+
+func TestWithSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	settled := 0
+	ch := ClientHandler{
+		MaxBodySize: 1024,
+		Querier: &FakeDb{
+			GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+				settled++
+				return &Identity{PassportID: "id", PassportIDGrp: "group"}, nil
+			},
+			GroupSizesFunc: func(groups []string) (map[string]int, error) {
+				return map[string]int{"group": 1}, nil
+			},
+		},
+		Signatures: NewSignatureVerifier(map[string][]string{"crm": {"new", "old"}}, time.Minute, true),
+	}
+	r := mux.NewRouter()
+	ch.Routes(r)
+
+	body := `{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}`
+	now := time.Now()
+	signed := func(client, secret string, at time.Time, body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/v2/id/settle?debug=1", strings.NewReader(body))
+		assert.NoError(SignRequest(req, client, secret, at))
+		return req
+	}
+	replayed := signed("crm", "new", now, body)
+	tampered := signed("crm", "new", now.Add(time.Second), body)
+	tampered.URL.Path = "/id/settle"
+	badTimestamp := signed("crm", "new", now, body)
+	badTimestamp.Header.Set(SignatureTimestampHeader, "yesterday")
+
+	tests := []struct {
+		Description string
+		Request     *http.Request
+		StatusCode  int
+		Message     string
+	}{
+		{Description: "when the request is not signed", Request: httptest.NewRequest(http.MethodPost, "/v2/id/settle", strings.NewReader(body)), StatusCode: http.StatusUnauthorized, Message: "request signature is required"},
+		{Description: "when the request is signed", Request: replayed, StatusCode: http.StatusOK},
+		{Description: "when the signature is replayed", Request: signed("crm", "new", now, body), StatusCode: http.StatusUnauthorized, Message: "request signature was already used"},
+		{Description: "when the request is signed with the old secret", Request: signed("crm", "old", now, body), StatusCode: http.StatusOK},
+		{Description: "when the secret is wrong", Request: signed("crm", "other", now, body), StatusCode: http.StatusUnauthorized, Message: "request signature is not valid"},
+		{Description: "when the client is unknown", Request: signed("billing", "new", now, body), StatusCode: http.StatusUnauthorized, Message: "request signature is not valid"},
+		{Description: "when the path is changed", Request: tampered, StatusCode: http.StatusUnauthorized, Message: "request signature is not valid"},
+		{Description: "when the timestamp is not valid", Request: badTimestamp, StatusCode: http.StatusUnauthorized, Message: "signature timestamp is not valid"},
+		{Description: "when the timestamp is too old", Request: signed("crm", "new", now.Add(-2*time.Minute), body), StatusCode: http.StatusUnauthorized, Message: "signature timestamp is out of the replay window"},
+		{Description: "when the timestamp is in the future", Request: signed("crm", "new", now.Add(2*time.Minute), body), StatusCode: http.StatusUnauthorized, Message: "signature timestamp is out of the replay window"},
+		{Description: "when the body is too large", Request: signed("crm", "new", now, body+strings.Repeat(" ", 1024)), StatusCode: http.StatusRequestEntityTooLarge, Message: "request body exceeds the maximum of 1024 bytes"},
+	}
+
+	for _, test := range tests {
+		settled = 0
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, test.Request)
+		assert.Equal(test.StatusCode, w.Code, test.Description)
+		if test.StatusCode == http.StatusOK {
+			assert.Equal(1, settled, test.Description)
+			continue
+		}
+		assert.Zero(settled, test.Description)
+		response := errorEnvelope{}
+		if assert.NoError(json.NewDecoder(w.Body).Decode(&response), test.Description) {
+			assert.Equal(test.Message, response.Error.Message, test.Description)
+		}
+	}
+
+	// the body is also signed
+	req := signed("crm", "new", now.Add(-time.Second), body)
+	req.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Replace(body, "App", "Other", 1))).Body
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	// unsigned requests are accepted when the signature is optional
+	ch.Signatures.Required = false
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v2/id/settle", strings.NewReader(body)))
+	assert.Equal(http.StatusOK, w.Code)
+}
+
+func TestWithStreamingSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	imported := 0
+	ch := ClientHandler{
+		MaxBodySize: 1024,
+		Querier: &FakeDb{
+			ImportIdentitiesFunc: func(records []ImportRecord) ([]*Identity, error) {
+				imported += len(records)
+				idents := []*Identity{}
+				for range records {
+					idents = append(idents, &Identity{PassportID: "id", PassportIDGrp: "group"})
+				}
+				return idents, nil
+			},
+		},
+		Signatures: NewSignatureVerifier(map[string][]string{"crm": {"secret"}}, time.Minute, true),
+	}
+	r := mux.NewRouter()
+	ch.Routes(r)
+
+	// the body is larger than the maximum body size
+	lines := []string{}
+	for i := 0; i < 50; i++ {
+		lines = append(lines, fmt.Sprintf(`{"ip": "127.0.0.%d", "provider": "Prov", "application": "App", "timestamp": "2020-01-01T10:00:00Z"}`, i))
+	}
+	body := strings.Join(lines, "\n") + "\n"
+	digest := sha256.Sum256([]byte(body))
+	now := time.Now()
+	signed := func(path, body string, at time.Time) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		SignRequestDigest(req, "crm", "secret", digest[:], at)
+		return req
+	}
+	results := func(w *httptest.ResponseRecorder) []ImportResult {
+		results := []ImportResult{}
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			result := ImportResult{}
+			assert.NoError(json.Unmarshal(scanner.Bytes(), &result))
+			results = append(results, result)
+		}
+		return results
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, signed("/id/import", body, now))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Len(results(w), 50)
+	assert.Equal(50, imported)
+
+	// a body that does not match the digest is rejected before any record is imported
+	imported = 0
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, signed("/id/import", strings.Replace(body, "127.0.0.1", "127.0.0.9", 1), now.Add(time.Second)))
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Zero(imported)
+	response := errorEnvelope{}
+	if assert.NoError(json.NewDecoder(w.Body).Decode(&response)) {
+		assert.Equal(CodeUnauthorized, response.Error.Code)
+		assert.Equal("request body does not match the signed digest", response.Error.Message)
+	}
+
+	// the digest is not accepted by the routes that buffer the body
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, signed("/v2/id/settle", `{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}`, now))
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	req := signed("/id/import", body, now.Add(2*time.Second))
+	req.Header.Set(SignatureDigestHeader, "garbage")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+}
+
+func TestSignatureVerifierRemember(t *testing.T) {
+	assert := assert.New(t)
+
+	v := NewSignatureVerifier(nil, time.Minute, false)
+	now := time.Now()
+	assert.True(v.remember("crm:1", now.Add(time.Minute), now))
+	assert.False(v.remember("crm:1", now.Add(time.Minute), now.Add(30*time.Second)))
+
+	// the expired signatures are swept
+	assert.True(v.remember("crm:2", now.Add(3*time.Minute), now.Add(2*time.Minute)))
+	assert.Len(v.seen, 1)
+	assert.Contains(v.seen, "crm:2")
+}
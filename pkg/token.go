@@ -0,0 +1,116 @@
+package managerid
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/josedelrio85/managerid/pkg/passport"
+)
+
+// ParseTokenSigner parses the settings of the passport tokens signer: the
+// algorithm, EdDSA (the default) or HS256, the key, the base64 Ed25519 seed or
+// private key, or the HMAC secret, the key id, derived from the key when it is
+// empty, and the published keys, written as kid=base64 Ed25519 public key
+// entries separated by semicolons.
+func ParseTokenSigner(algorithm, key, kid, published string) (*passport.Signer, error) {
+	publishedKeys := map[string]string{}
+	for _, entry := range strings.Split(published, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		id := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || id == "" {
+			return nil, fmt.Errorf("invalid published key entry %q, expected kid=key", entry)
+		}
+		publishedKeys[id] = strings.TrimSpace(parts[1])
+	}
+	return NewTokenSigner(algorithm, key, kid, publishedKeys)
+}
+
+// NewTokenSigner returns the passport tokens signer of the settings passed as
+// param, as in ParseTokenSigner, with the published keys by key id.
+func NewTokenSigner(algorithm, key, kid string, published map[string]string) (*passport.Signer, error) {
+	var signer *passport.Signer
+	var err error
+	switch algorithm {
+	case "", passport.EdDSA:
+		seed, decodeErr := decodeBase64(key)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("invalid Ed25519 key, expected base64: %w", decodeErr)
+		}
+		signer, err = passport.NewEd25519Signer(seed, kid)
+	case passport.HS256:
+		signer, err = passport.NewHMACSigner([]byte(key), kid)
+	default:
+		return nil, fmt.Errorf("invalid token algorithm %q, expected %s or %s", algorithm, passport.EdDSA, passport.HS256)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer.Published = map[string]ed25519.PublicKey{}
+	for id, key := range published {
+		public, err := decodeBase64(key)
+		if err != nil || len(public) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid published key %q, expected a base64 Ed25519 public key", id)
+		}
+		signer.Published[id] = ed25519.PublicKey(public)
+	}
+	return signer, nil
+}
+
+// decodeBase64 decodes standard or URL base64, padded or not.
+func decodeBase64(value string) ([]byte, error) {
+	value = strings.TrimRight(strings.TrimSpace(value), "=")
+	if strings.ContainsAny(value, "-_") {
+		return base64.RawURLEncoding.DecodeString(value)
+	}
+	return base64.RawStdEncoding.DecodeString(value)
+}
+
+// passportToken returns the passport token of the identity, or an empty string
+// if ClientHandler.Tokens is not set or the identity is ephemeral.
+func (ch *ClientHandler) passportToken(identity *Identity) (string, error) {
+	if ch.Tokens == nil || identity.Match == MatchEphemeral {
+		return "", nil
+	}
+	return ch.Tokens.Sign(passport.Claims{
+		PassportID:    identity.PassportID,
+		PassportIDGrp: identity.PassportIDGrp,
+		Application:   identity.Application,
+		IssuedAt:      time.Now().Unix(),
+	})
+}
+
+// HandleKeySet is a function used to publish the JSON Web Key Set that verifies
+// the passport tokens. The key set of HS256 tokens is empty, their secret is shared.
+// Only GET method accepted.
+// Errors are returned as an APIError envelope:
+// StatusMethodNotAllowed if other kind of request is received.
+// StatusServiceUnavailable if the passport tokens are not enabled.
+func (ch *ClientHandler) HandleKeySet() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, methodNotAllowed(r))
+			return
+		}
+		if ch.Tokens == nil {
+			writeError(w, r, &APIError{
+				Status:  http.StatusServiceUnavailable,
+				Code:    CodeUnavailable,
+				Message: "passport tokens are not enabled",
+			})
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(ch.Tokens.KeySet())
+	})
+}
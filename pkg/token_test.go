@@ -0,0 +1,116 @@
+package managerid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/josedelrio85/managerid/pkg/passport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTokenSigner(t *testing.T) {
+	assert := assert.New(t)
+
+	// the same seed in standard and URL base64
+	signer, err := ParseTokenSigner("", "+/8AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", "", "")
+	if !assert.NoError(err) {
+		return
+	}
+	urlSigner, err := ParseTokenSigner(passport.EdDSA, "-_8AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", "", "")
+	if assert.NoError(err) {
+		assert.Equal(signer.KeySet(), urlSigner.KeySet())
+	}
+
+	published := signer.KeySet().Keys[0].X
+	signer, err = ParseTokenSigner("", "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8", "current", "previous="+published)
+	if assert.NoError(err) {
+		assert.Equal("current", signer.KeyID)
+		assert.Len(signer.KeySet().Keys, 2)
+	}
+
+	signer, err = ParseTokenSigner(passport.HS256, strings.Repeat("s", 32), "", "")
+	if assert.NoError(err) {
+		assert.Equal(passport.HS256, signer.Algorithm())
+	}
+
+	tests := []struct {
+		Algorithm string
+		Key       string
+		Published string
+	}{
+		{Algorithm: "RS256", Key: "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8"},
+		{Key: "not base64!"},
+		{Key: "AAEC"},
+		{Algorithm: passport.HS256, Key: "short"},
+		{Key: "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8", Published: "previous"},
+		{Key: "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8", Published: "previous=AAEC"},
+	}
+	for _, test := range tests {
+		_, err := ParseTokenSigner(test.Algorithm, test.Key, "", test.Published)
+		assert.Error(err, test)
+	}
+}
+
+func TestHandleSettleV2Token(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens, _ := ParseTokenSigner("", "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8", "", "")
+	ch := ClientHandler{
+		Querier: &FakeDb{
+			GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+				ident := &Identity{}
+				ident.createIdentity(interaction, "")
+				ident.Match = MatchNewGroup
+				return ident, nil
+			},
+			GroupSizesFunc: func(groups []string) (map[string]int, error) {
+				return map[string]int{}, nil
+			},
+		},
+		Bots: &BotPolicy{
+			Classifier: &BotClassifier{UserAgents: DefaultBotUserAgents},
+			Actions:    map[string]BotAction{"*": BotEphemeral},
+		},
+		Tokens: tokens,
+	}
+
+	w := httptest.NewRecorder()
+	ch.HandleKeySet().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	keys, err := passport.ParseKeySet(w.Body.Bytes())
+	if !assert.NoError(err) {
+		return
+	}
+
+	body := `{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}`
+	w = httptest.NewRecorder()
+	ch.HandleSettleV2().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v2/id/settle", strings.NewReader(body)))
+	response := SettleResponse{}
+	if assert.NoError(json.NewDecoder(w.Body).Decode(&response)) {
+		claims, err := (&passport.Verifier{Keys: keys}).Verify(response.Token)
+		if assert.NoError(err) {
+			assert.Equal(response.PassportID, claims.PassportID)
+			assert.Equal(response.PassportIDGrp, claims.PassportIDGrp)
+			assert.Equal("App", claims.Application)
+		}
+	}
+
+	// ephemeral identities have no token
+	body = `{"ip": "127.0.0.1", "provider": "Prov", "application": "App", "user_agent": "curl/7.68.0"}`
+	w = httptest.NewRecorder()
+	ch.HandleSettleV2().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v2/id/settle", strings.NewReader(body)))
+	response = SettleResponse{}
+	if assert.NoError(json.NewDecoder(w.Body).Decode(&response)) {
+		assert.Equal(MatchEphemeral, response.Match)
+		assert.Empty(response.Token)
+	}
+
+	// the key set is unavailable without tokens
+	ch.Tokens = nil
+	w = httptest.NewRecorder()
+	ch.HandleKeySet().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+}
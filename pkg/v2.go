@@ -0,0 +1,151 @@
+package managerid
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// SettleResponse is a struct that represents a resolved identity in the v2 API.
+// Geo is set when the IP of the identity was found in the GeoIP databases, Bot
+// and Internal when the identity was created by a bot or internal interaction,
+// and Token when the passport tokens are enabled and the identity is not ephemeral.
+type SettleResponse struct {
+	PassportID    string    `json:"passport_id"`
+	PassportIDGrp string    `json:"passport_id_group"`
+	CreatedAt     time.Time `json:"created_at"`
+	Match         string    `json:"match"`
+	GroupSize     int       `json:"group_size"`
+	Geo           *Geo      `json:"geo,omitempty"`
+	Bot           string    `json:"bot,omitempty"`
+	Internal      bool      `json:"internal,omitempty"`
+	Token         string    `json:"token,omitempty"`
+}
+
+// BatchRequestV2 is a struct that represents the body of a v2 batch request.
+type BatchRequestV2 struct {
+	Interactions []json.RawMessage `json:"interactions"`
+}
+
+// BatchResultV2 is a struct that represents the outcome of a single interaction
+// of a v2 batch request. Only one of SettleResponse or Error is set.
+type BatchResultV2 struct {
+	*SettleResponse
+	Error *APIError `json:"error,omitempty"`
+}
+
+// HandleSettleV2 is a function used to manage v2 settle requests.
+// The request and the resolution are the same as HandleFunction ones, and the
+// response is a SettleResponse with the creation time, how the identity was
+// matched and the size of its group.
+// Errors are returned as an APIError envelope, see HandleFunction.
+func (ch *ClientHandler) HandleSettleV2() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := ch.settle(w, r)
+		if !ok {
+			return
+		}
+
+		responses, err := ch.settleResponses([]*Identity{identity})
+		if err != nil {
+			internalError(w, r, "error performing GroupSizes", err)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(responses[0])
+	})
+}
+
+// HandleBatchV2 is a function used to manage v2 batch requests.
+// Decode the json request as a BatchRequestV2, the interactions are validated and
+// resolved as HandleBatch does, and the response holds a BatchResultV2 for each
+// one, in the same order.
+// Errors are returned as an APIError envelope, see HandleBatch.
+func (ch *ClientHandler) HandleBatchV2() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ch.checkBatchRequest(w, r) {
+			return
+		}
+
+		request := BatchRequestV2{}
+		if apiErr := ch.decodeBody(r, &request); apiErr != nil {
+			writeError(w, r, apiErr)
+			return
+		}
+
+		results, ok := ch.settleBatch(w, r, request.Interactions)
+		if !ok {
+			return
+		}
+
+		identities := []*Identity{}
+		for _, result := range results {
+			if result.Identity != nil {
+				identities = append(identities, result.Identity)
+			}
+		}
+
+		responses, err := ch.settleResponses(identities)
+		if err != nil {
+			internalError(w, r, "error performing GroupSizes", err)
+			return
+		}
+
+		resultsV2 := make([]BatchResultV2, len(results))
+		for i, result := range results {
+			if result.Identity == nil {
+				resultsV2[i].Error = result.Error
+				continue
+			}
+			resultsV2[i].SettleResponse = responses[0]
+			responses = responses[1:]
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resultsV2)
+	})
+}
+
+// settleResponses builds the v2 representation of the identities, querying the
+// size of their groups at once.
+// Returns a SettleResponse per identity, in the same order, or nil and the error.
+func (ch *ClientHandler) settleResponses(identities []*Identity) ([]*SettleResponse, error) {
+	groups := []string{}
+	seen := map[string]bool{}
+	for _, identity := range identities {
+		if identity.Match != MatchEphemeral && !seen[identity.PassportIDGrp] {
+			seen[identity.PassportIDGrp] = true
+			groups = append(groups, identity.PassportIDGrp)
+		}
+	}
+
+	sizes, err := ch.Querier.GroupSizes(groups)
+	if err != nil {
+		return nil, err
+	}
+
+	responses := make([]*SettleResponse, len(identities))
+	for i, identity := range identities {
+		responses[i] = &SettleResponse{
+			PassportID:    identity.PassportID,
+			PassportIDGrp: identity.PassportIDGrp,
+			CreatedAt:     identity.Createdat,
+			Match:         identity.Match,
+			GroupSize:     sizes[identity.PassportIDGrp],
+			Bot:           identity.Bot,
+			Internal:      identity.Internal,
+		}
+		if identity.Match == MatchEphemeral {
+			responses[i].GroupSize = 1
+		}
+		if identity.Geo != (Geo{}) {
+			geo := identity.Geo
+			responses[i].Geo = &geo
+		}
+		if responses[i].Token, err = ch.passportToken(identity); err != nil {
+			return nil, err
+		}
+	}
+	return responses, nil
+}
@@ -0,0 +1,153 @@
+package managerid
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleSettleV2(t *testing.T) {
+	assert := assert.New(t)
+
+	createdat := time.Date(2020, 5, 4, 10, 21, 0, 0, time.UTC)
+	querier := &FakeDb{
+		GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+			return &Identity{PassportID: "id", PassportIDGrp: "group", Createdat: createdat, Match: MatchNewInGroup}, nil
+		},
+		GroupSizesFunc: func(groups []string) (map[string]int, error) {
+			return map[string]int{"group": 3}, nil
+		},
+	}
+	ch := ClientHandler{Querier: querier}
+	ts := httptest.NewServer(ch.HandleSettleV2())
+	defer ts.Close()
+
+	body := `{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}`
+	resp, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Errorf("error sending test Request: Err: %v", err)
+		return
+	}
+
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	response := SettleResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Errorf("error unmarshaling the test response: Err: %v", err)
+	}
+	assert.Equal(SettleResponse{
+		PassportID:    "id",
+		PassportIDGrp: "group",
+		CreatedAt:     createdat,
+		Match:         MatchNewInGroup,
+		GroupSize:     3,
+	}, response)
+	assert.Equal(1, querier.GroupSizesCalls)
+}
+
+func TestHandleBatchV2(t *testing.T) {
+	assert := assert.New(t)
+
+	querier := &FakeDb{
+		GetIdentitiesFunc: func(interactions []Interaction) ([]*Identity, error) {
+			idents := []*Identity{}
+			for _, interaction := range interactions {
+				idents = append(idents, &Identity{PassportID: interaction.IP, PassportIDGrp: "group", Match: MatchReused})
+			}
+			return idents, nil
+		},
+		GroupSizesFunc: func(groups []string) (map[string]int, error) {
+			assert.Equal([]string{"group"}, groups)
+			return map[string]int{"group": 2}, nil
+		},
+	}
+	ch := ClientHandler{Querier: querier}
+	ts := httptest.NewServer(ch.HandleBatchV2())
+	defer ts.Close()
+
+	body := `{"interactions": [
+		{"ip": "127.0.0.1", "provider": "Prov", "application": "App"},
+		{"ip": "127.0.0.2"},
+		{"ip": "127.0.0.3", "provider": "Prov", "application": "App"}
+	]}`
+	resp, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Errorf("error sending test Request: Err: %v", err)
+		return
+	}
+
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	results := []BatchResultV2{}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Errorf("error unmarshaling the test response: Err: %v", err)
+	}
+	if assert.Len(results, 3) {
+		assert.Equal("127.0.0.1", results[0].PassportID)
+		assert.Equal(2, results[0].GroupSize)
+		assert.Equal(MatchReused, results[0].Match)
+		assert.Nil(results[1].SettleResponse)
+		assert.Equal(CodeValidation, results[1].Error.Code)
+		assert.Equal("127.0.0.3", results[2].PassportID)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	ch := ClientHandler{
+		Querier: &FakeDb{
+			GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+				return &Identity{PassportID: "id", PassportIDGrp: "group", Match: MatchReused}, nil
+			},
+			GroupSizesFunc: func(groups []string) (map[string]int, error) {
+				return map[string]int{"group": 1}, nil
+			},
+		},
+	}
+	r := mux.NewRouter()
+	ch.Routes(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		Description string
+		Path        string
+		Expected    string
+	}{
+		{
+			Description: "v1 keeps the original contract",
+			Path:        "/v1/id/settle",
+			Expected:    `{"passport_id_group":"group","passport_id":"id"}`,
+		},
+		{
+			Description: "unversioned path is an alias of v1",
+			Path:        "/id/settle",
+			Expected:    `{"passport_id_group":"group","passport_id":"id"}`,
+		},
+		{
+			Description: "v2 returns the settle response",
+			Path:        "/v2/id/settle",
+			Expected:    `{"passport_id":"id","passport_id_group":"group","created_at":"0001-01-01T00:00:00Z","match":"reused","group_size":1}`,
+		},
+	}
+
+	for _, test := range tests {
+		body := `{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}`
+		resp, err := http.Post(ts.URL+test.Path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Errorf("error sending test Request: Err: %v", err)
+			return
+		}
+
+		content, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(err)
+		assert.Equal(http.StatusOK, resp.StatusCode, test.Description)
+		assert.JSONEq(test.Expected, string(content), test.Description)
+	}
+}
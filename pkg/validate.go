@@ -0,0 +1,217 @@
+package managerid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultMaxBodySize is the maximum size in bytes of a request body when
+	// ClientHandler.MaxBodySize is not set.
+	DefaultMaxBodySize = 1 << 20
+
+	// maxFieldLength is the length of the VARCHAR columns of identities_bsc.
+	maxFieldLength = 255
+	// maxURLLength is the length of the URL columns of visits.
+	maxURLLength = 2048
+)
+
+// errBodyTooLarge is returned when reading a body that exceeds the maximum size.
+var errBodyTooLarge = errors.New("request body too large")
+
+// FieldError is a struct that represents a validation error of a single field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Validate checks the values of the interaction.
+// The IP must be a valid IPv4 or IPv6 address, provider and application are required,
+// must be printable text and fit in the database columns.
+// The visit context is optional, page_url and referrer must be absolute URLs.
+// Returns the errors found, or an empty slice if the interaction is valid.
+func (interaction Interaction) Validate() []FieldError {
+	errs := []FieldError{}
+	if interaction.IP == "" {
+		errs = append(errs, FieldError{Field: "ip", Message: "is required"})
+	} else if net.ParseIP(interaction.IP) == nil {
+		errs = append(errs, FieldError{Field: "ip", Message: "must be a valid IPv4 or IPv6 address"})
+	}
+	if message := validateText(interaction.Provider); message != "" {
+		errs = append(errs, FieldError{Field: "provider", Message: message})
+	}
+	if message := validateText(interaction.Application); message != "" {
+		errs = append(errs, FieldError{Field: "application", Message: message})
+	}
+	return append(errs, interaction.VisitContext.validate()...)
+}
+
+// validate checks the optional values of the visit context.
+func (context VisitContext) validate() []FieldError {
+	errs := []FieldError{}
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"page_url", context.PageURL},
+		{"referrer", context.Referrer},
+	} {
+		if message := validateURL(field.value); message != "" {
+			errs = append(errs, FieldError{Field: field.name, Message: message})
+		}
+	}
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"utm_source", context.UTMSource},
+		{"utm_medium", context.UTMMedium},
+		{"utm_campaign", context.UTMCampaign},
+		{"utm_term", context.UTMTerm},
+		{"utm_content", context.UTMContent},
+		{"gclid", context.Gclid},
+		{"fbclid", context.Fbclid},
+	} {
+		if field.value == "" {
+			continue
+		}
+		if strings.TrimSpace(field.value) == "" {
+			errs = append(errs, FieldError{Field: field.name, Message: "must not be blank"})
+		} else if message := validateText(field.value); message != "" {
+			errs = append(errs, FieldError{Field: field.name, Message: message})
+		}
+	}
+	return errs
+}
+
+// validateURL returns the reason why value is not a valid optional URL field, or
+// an empty string if it is valid.
+func validateURL(value string) string {
+	if value == "" {
+		return ""
+	}
+	if !utf8.ValidString(value) {
+		return "must be valid UTF-8 text"
+	}
+	if utf8.RuneCountInString(value) > maxURLLength {
+		return fmt.Sprintf("must be at most %d characters", maxURLLength)
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || !parsed.IsAbs() || parsed.Host == "" {
+		return "must be an absolute URL"
+	}
+	return ""
+}
+
+// validateText returns the reason why value is not a valid text field, or an
+// empty string if it is valid.
+func validateText(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "is required"
+	}
+	if !utf8.ValidString(value) {
+		return "must be valid UTF-8 text"
+	}
+	if utf8.RuneCountInString(value) > maxFieldLength {
+		return fmt.Sprintf("must be at most %d characters", maxFieldLength)
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return "must not contain control characters"
+		}
+	}
+	return ""
+}
+
+// validationError returns the APIError for an interaction with invalid fields.
+func validationError(errs []FieldError) *APIError {
+	return &APIError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    CodeValidation,
+		Message: "interaction has invalid fields",
+		Details: errs,
+	}
+}
+
+// decodeBody decodes the json body of the request into v, enforcing the maximum
+// body size and, in strict mode, rejecting unknown fields.
+// Returns the APIError to send to the client or nil if success.
+func (ch *ClientHandler) decodeBody(r *http.Request, v interface{}) *APIError {
+	max := ch.maxBodySize()
+	if r.ContentLength > max {
+		return bodyTooLarge(max)
+	}
+
+	decoder := json.NewDecoder(&limitedBody{r: r.Body, n: max})
+	if ch.StrictDecoding {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		if errors.Is(err, errBodyTooLarge) {
+			return bodyTooLarge(max)
+		}
+		return decodeError(err)
+	}
+	return nil
+}
+
+// decodeItem decodes a json element of a batch into v, rejecting unknown fields
+// in strict mode.
+// Returns the APIError of the element or nil if success.
+func (ch *ClientHandler) decodeItem(item json.RawMessage, v interface{}) *APIError {
+	decoder := json.NewDecoder(strings.NewReader(string(item)))
+	if ch.StrictDecoding {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	return nil
+}
+
+// maxBodySize returns the configured maximum body size or the default one.
+func (ch *ClientHandler) maxBodySize() int64 {
+	if ch.MaxBodySize > 0 {
+		return ch.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+// bodyTooLarge returns the APIError for a body bigger than max bytes.
+func bodyTooLarge(max int64) *APIError {
+	return &APIError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    CodePayloadTooLarge,
+		Message: fmt.Sprintf("request body exceeds the maximum of %d bytes", max),
+	}
+}
+
+// limitedBody is a reader that fails with errBodyTooLarge once more than n bytes are read.
+type limitedBody struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements the io.Reader interface.
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
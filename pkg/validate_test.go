@@ -0,0 +1,155 @@
+package managerid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInteractionValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		Description string
+		Interaction Interaction
+		Expected    []FieldError
+	}{
+		{
+			Description: "valid IPv4 interaction",
+			Interaction: Interaction{IP: "127.0.0.1", Provider: "Prov", Application: "App"},
+			Expected:    []FieldError{},
+		},
+		{
+			Description: "valid IPv6 interaction",
+			Interaction: Interaction{IP: "2001:db8::1", Provider: "Prov", Application: "App"},
+			Expected:    []FieldError{},
+		},
+		{
+			Description: "empty interaction",
+			Interaction: Interaction{},
+			Expected: []FieldError{
+				{Field: "ip", Message: "is required"},
+				{Field: "provider", Message: "is required"},
+				{Field: "application", Message: "is required"},
+			},
+		},
+		{
+			Description: "garbage values",
+			Interaction: Interaction{IP: "not an ip", Provider: "Prov\x00", Application: strings.Repeat("a", 256)},
+			Expected: []FieldError{
+				{Field: "ip", Message: "must be a valid IPv4 or IPv6 address"},
+				{Field: "provider", Message: "must not contain control characters"},
+				{Field: "application", Message: "must be at most 255 characters"},
+			},
+		},
+		{
+			Description: "valid visit context",
+			Interaction: Interaction{IP: "127.0.0.1", Provider: "Prov", Application: "App", VisitContext: VisitContext{
+				PageURL: "https://example.com/landing?utm_source=news", Referrer: "android-app://com.example", Gclid: "abc",
+			}},
+			Expected: []FieldError{},
+		},
+		{
+			Description: "invalid visit context",
+			Interaction: Interaction{IP: "127.0.0.1", Provider: "Prov", Application: "App", VisitContext: VisitContext{
+				PageURL: "/landing", Referrer: "https://example.com/" + strings.Repeat("a", 2048), UTMSource: " ", Fbclid: "a\n",
+			}},
+			Expected: []FieldError{
+				{Field: "page_url", Message: "must be an absolute URL"},
+				{Field: "referrer", Message: "must be at most 2048 characters"},
+				{Field: "utm_source", Message: "must not be blank"},
+				{Field: "fbclid", Message: "must not contain control characters"},
+			},
+		},
+		{
+			Description: "multibyte values are measured in characters",
+			Interaction: Interaction{IP: "127.0.0.1", Provider: strings.Repeat("ñ", 255), Application: "App"},
+			Expected:    []FieldError{},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.Expected, test.Interaction.Validate(), test.Description)
+	}
+}
+
+func TestHandleFunctionValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		Description     string
+		Body            string
+		MaxBodySize     int64
+		StrictDecoding  bool
+		StatusCode      int
+		Code            string
+		ExpectedDetails []FieldError
+	}{
+		{
+			Description: "when the body exceeds the maximum size",
+			Body:        `{"ip": "127.0.0.1", "provider": "Prov", "application": "App"}`,
+			MaxBodySize: 10,
+			StatusCode:  http.StatusRequestEntityTooLarge,
+			Code:        CodePayloadTooLarge,
+		},
+		{
+			Description:    "when strict decoding is enabled and the body has unknown fields",
+			Body:           `{"ip": "127.0.0.1", "provider": "Prov", "application": "App", "extra": 1}`,
+			StrictDecoding: true,
+			StatusCode:     http.StatusUnprocessableEntity,
+			Code:           CodeInvalidPayload,
+			ExpectedDetails: []FieldError{
+				{Field: "extra", Message: "unknown field"},
+			},
+		},
+		{
+			Description: "when strict decoding is disabled unknown fields are ignored",
+			Body:        `{"ip": "127.0.0.1", "provider": "Prov", "application": "App", "extra": 1}`,
+			StatusCode:  http.StatusOK,
+		},
+		{
+			Description: "when the interaction has invalid fields",
+			Body:        `{"ip": "", "provider": "Prov"}`,
+			StatusCode:  http.StatusUnprocessableEntity,
+			Code:        CodeValidation,
+			ExpectedDetails: []FieldError{
+				{Field: "ip", Message: "is required"},
+				{Field: "application", Message: "is required"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		ch := ClientHandler{
+			Querier: &FakeDb{
+				GetIdentityFunc: func(interaction Interaction) (*Identity, error) { return new(Identity), nil },
+			},
+			MaxBodySize:    test.MaxBodySize,
+			StrictDecoding: test.StrictDecoding,
+		}
+		ts := httptest.NewServer(ch.HandleFunction())
+		defer ts.Close()
+
+		resp, err := http.Post(ts.URL, "application/json", strings.NewReader(test.Body))
+		if err != nil {
+			t.Errorf("error sending test Request: Err: %v", err)
+			return
+		}
+
+		assert.Equal(test.StatusCode, resp.StatusCode, test.Description)
+
+		if test.Code != "" {
+			envelope := errorEnvelope{}
+			if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+				t.Errorf("error unmarshaling the test response: Err: %v", err)
+				continue
+			}
+			assert.Equal(test.Code, envelope.Error.Code, test.Description)
+			assert.Equal(test.ExpectedDetails, envelope.Error.Details, test.Description)
+		}
+	}
+}
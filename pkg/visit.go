@@ -0,0 +1,148 @@
+package managerid
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// DefaultVisitsLimit is the number of visits returned by the identity lookups.
+const DefaultVisitsLimit = 100
+
+// VisitContext is a struct that represents the page and the campaign of an interaction.
+// Every field is optional.
+type VisitContext struct {
+	PageURL     string `sql:"type:VARCHAR(2048)" json:"page_url,omitempty"`
+	Referrer    string `sql:"type:VARCHAR(2048)" json:"referrer,omitempty"`
+	UTMSource   string `sql:"type:VARCHAR(255)" json:"utm_source,omitempty"`
+	UTMMedium   string `sql:"type:VARCHAR(255)" json:"utm_medium,omitempty"`
+	UTMCampaign string `sql:"type:VARCHAR(255)" json:"utm_campaign,omitempty"`
+	UTMTerm     string `sql:"type:VARCHAR(255)" json:"utm_term,omitempty"`
+	UTMContent  string `sql:"type:VARCHAR(255)" json:"utm_content,omitempty"`
+	Gclid       string `sql:"type:VARCHAR(255)" json:"gclid,omitempty"`
+	Fbclid      string `sql:"type:VARCHAR(255)" json:"fbclid,omitempty"`
+}
+
+// Visit is a struct that represents the context of an interaction resolved as
+// the identity with PassportID.
+type Visit struct {
+	Idvisit    *int   `gorm:"primary_key" json:"-"`
+	PassportID string `sql:"type:VARCHAR(255)" gorm:"index:idx_visits_passport_id_createdat" json:"-"`
+	VisitContext
+	Createdat time.Time `gorm:"index:idx_visits_passport_id_createdat" json:"created_at"`
+}
+
+// TableName sets the default table name
+func (Visit) TableName() string {
+	return "visits"
+}
+
+// IdentityDetail is a struct that represents an identity with its latest visits.
+type IdentityDetail struct {
+	*IdentityResponse
+	Visits []*Visit `json:"visits"`
+}
+
+// withCampaign returns the context with the campaign parameters of the page URL
+// set in the fields that were not sent.
+func (context VisitContext) withCampaign() VisitContext {
+	page, err := url.Parse(context.PageURL)
+	if err != nil {
+		return context
+	}
+	query := page.Query()
+	for _, param := range []struct {
+		name  string
+		value *string
+	}{
+		{"utm_source", &context.UTMSource},
+		{"utm_medium", &context.UTMMedium},
+		{"utm_campaign", &context.UTMCampaign},
+		{"utm_term", &context.UTMTerm},
+		{"utm_content", &context.UTMContent},
+		{"gclid", &context.Gclid},
+		{"fbclid", &context.Fbclid},
+	} {
+		if *param.value == "" {
+			*param.value = truncate(query.Get(param.name), maxFieldLength)
+		}
+	}
+	return context
+}
+
+// truncate returns the first max characters of value.
+func truncate(value string, max int) string {
+	runes := []rune(value)
+	if len(runes) > max {
+		return string(runes[:max])
+	}
+	return value
+}
+
+// storeVisit stores the context of the interaction resolved as ident at the
+// moment passed as param, if it has any.
+func storeVisit(db *gorm.DB, ident *Identity, context VisitContext, at time.Time) error {
+	if context == (VisitContext{}) {
+		return nil
+	}
+	return db.Create(&Visit{
+		PassportID:   ident.PassportID,
+		VisitContext: context.withCampaign(),
+		Createdat:    at,
+	}).Error
+}
+
+// HandleIdentity is a function used to look up an identity with its latest visits.
+// Only GET method accepted.
+// The passport id is taken from the path.
+// Errors are returned as an APIError envelope:
+// StatusMethodNotAllowed if other kind of request is received.
+// StatusNotFound if there is no identity with that passport id, or it is not
+// allowed by the API key or the CORS policy of the origin.
+// StatusInternalServerError or StatusServiceUnavailable when the lookup fails.
+func (ch *ClientHandler) HandleIdentity() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, methodNotAllowed(r))
+			return
+		}
+
+		passportID := mux.Vars(r)["passport_id"]
+		identity, err := ch.Querier.GetIdentityByID(passportID)
+		if key := apiKeyFromContext(r.Context()); err == nil && key != nil && !key.Allows(identity.Application, identity.Provider) {
+			err = ErrIdentityNotFound
+		}
+		if err == nil && !corsScopeFromContext(r.Context()).allows(identity.Application) {
+			err = ErrIdentityNotFound
+		}
+		if errors.Is(err, ErrIdentityNotFound) {
+			writeError(w, r, &APIError{
+				Status:  http.StatusNotFound,
+				Code:    CodeNotFound,
+				Message: "identity " + passportID + " not found",
+			})
+			return
+		}
+		if err != nil {
+			internalError(w, r, "error performing GetIdentityByID", err)
+			return
+		}
+
+		visits, err := ch.Querier.GetVisits(passportID, DefaultVisitsLimit)
+		if err != nil {
+			internalError(w, r, "error performing GetVisits", err)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(IdentityDetail{
+			IdentityResponse: identityResponse(identity),
+			Visits:           visits,
+		})
+	})
+}
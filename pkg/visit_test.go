@@ -0,0 +1,196 @@
+package managerid
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVisitContextWithCampaign(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		Description string
+		Context     VisitContext
+		Expected    VisitContext
+	}{
+		{
+			Description: "when the page URL has campaign parameters they fill the context",
+			Context:     VisitContext{PageURL: "https://example.com/?utm_source=news&utm_medium=email&utm_campaign=spring&gclid=abc"},
+			Expected: VisitContext{
+				PageURL:     "https://example.com/?utm_source=news&utm_medium=email&utm_campaign=spring&gclid=abc",
+				UTMSource:   "news",
+				UTMMedium:   "email",
+				UTMCampaign: "spring",
+				Gclid:       "abc",
+			},
+		},
+		{
+			Description: "when the fields are sent they are kept",
+			Context:     VisitContext{PageURL: "https://example.com/?utm_source=news&fbclid=xyz", UTMSource: "ads"},
+			Expected:    VisitContext{PageURL: "https://example.com/?utm_source=news&fbclid=xyz", UTMSource: "ads", Fbclid: "xyz"},
+		},
+		{
+			Description: "when the parameters are too long they are truncated",
+			Context:     VisitContext{PageURL: "https://example.com/?utm_term=" + strings.Repeat("a", 300)},
+			Expected:    VisitContext{PageURL: "https://example.com/?utm_term=" + strings.Repeat("a", 300), UTMTerm: strings.Repeat("a", 255)},
+		},
+		{
+			Description: "when there is no page URL",
+			Context:     VisitContext{Referrer: "https://search.example.com/?utm_source=news"},
+			Expected:    VisitContext{Referrer: "https://search.example.com/?utm_source=news"},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.Expected, test.Context.withCampaign(), test.Description)
+	}
+}
+
+func TestHandleIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	createdat := time.Date(2020, 5, 4, 10, 21, 0, 0, time.UTC)
+	querier := &FakeDb{
+		GetIdentityByIDFunc: func(passportID string) (*Identity, error) {
+			switch passportID {
+			case "id":
+				return &Identity{IP: "127.0.0.1", Provider: "Prov", Application: "App", PassportID: "id", PassportIDGrp: "group", Createdat: createdat}, nil
+			case "fail":
+				return nil, errors.New("Error 1054: Unknown column")
+			}
+			return nil, ErrIdentityNotFound
+		},
+		GetVisitsFunc: func(passportID string, limit int) ([]*Visit, error) {
+			return []*Visit{
+				{VisitContext: VisitContext{PageURL: "https://example.com/b"}, Createdat: createdat.Add(time.Minute)},
+				{VisitContext: VisitContext{PageURL: "https://example.com/a", Gclid: "abc"}, Createdat: createdat},
+			}, nil
+		},
+	}
+	ch := ClientHandler{Querier: querier}
+	r := mux.NewRouter()
+	r.Path("/identities/{passport_id}").Handler(ch.HandleIdentity())
+
+	tests := []struct {
+		Description string
+		Method      string
+		Path        string
+		StatusCode  int
+	}{
+		{Description: "when the identity exists", Method: http.MethodGet, Path: "/identities/id", StatusCode: http.StatusOK},
+		{Description: "when the identity does not exist", Method: http.MethodGet, Path: "/identities/unknown", StatusCode: http.StatusNotFound},
+		{Description: "when the lookup fails", Method: http.MethodGet, Path: "/identities/fail", StatusCode: http.StatusInternalServerError},
+		{Description: "when the lookup receives a POST request", Method: http.MethodPost, Path: "/identities/id", StatusCode: http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(test.Method, test.Path, nil))
+		assert.Equal(test.StatusCode, w.Code, test.Description)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/identities/id", nil))
+	assert.JSONEq(`{
+		"passport_id": "id",
+		"passport_id_group": "group",
+		"ip": "127.0.0.1",
+		"provider": "Prov",
+		"application": "App",
+		"created_at": "2020-05-04T10:21:00Z",
+		"visits": [
+			{"page_url": "https://example.com/b", "created_at": "2020-05-04T10:22:00Z"},
+			{"page_url": "https://example.com/a", "gclid": "abc", "created_at": "2020-05-04T10:21:00Z"}
+		]
+	}`, w.Body.String())
+}
+
+func TestHandleFunctionVisit(t *testing.T) {
+	assert := assert.New(t)
+
+	stored := &Identity{IP: "127.0.0.1", Provider: "Prov", Application: "App", PassportID: "id", PassportIDGrp: "group"}
+	settled := []Interaction{}
+	added := []VisitContext{}
+	querier := &FakeDb{
+		GetIdentityFunc: func(interaction Interaction) (*Identity, error) {
+			settled = append(settled, interaction)
+			return stored, nil
+		},
+		GetIdentityByIDFunc: func(passportID string) (*Identity, error) {
+			return stored, nil
+		},
+		AddVisitFunc: func(passportID string, context VisitContext) error {
+			added = append(added, context)
+			return nil
+		},
+	}
+	signer := &SignedCookie{Secret: []byte("secret")}
+	ch := ClientHandler{Querier: querier, Cookie: signer}
+
+	body := `{"ip": "127.0.0.1", "provider": "Prov", "application": "App", "page_url": "https://example.com/", "referrer": "https://search.example.com/", "fbclid": "xyz"}`
+	context := VisitContext{PageURL: "https://example.com/", Referrer: "https://search.example.com/", Fbclid: "xyz"}
+
+	w := httptest.NewRecorder()
+	ch.HandleFunction().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/id/settle", strings.NewReader(body)))
+	assert.Equal(http.StatusOK, w.Code)
+	if assert.Len(settled, 1) {
+		assert.Equal(context, settled[0].VisitContext)
+	}
+
+	// the identity of the cookie is reused without GetIdentity, the visit is still stored
+	req := httptest.NewRequest(http.MethodPost, "/id/settle", strings.NewReader(body))
+	req.AddCookie(w.Result().Cookies()[0])
+	w = httptest.NewRecorder()
+	ch.HandleFunction().ServeHTTP(w, req)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Len(settled, 1)
+	assert.Equal([]VisitContext{context}, added)
+
+	w = httptest.NewRecorder()
+	ch.HandleFunction().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/id/settle",
+		strings.NewReader(`{"ip": "127.0.0.1", "provider": "Prov", "application": "App", "page_url": "/landing"}`)))
+	assert.Equal(http.StatusUnprocessableEntity, w.Code)
+	response := errorEnvelope{}
+	if assert.NoError(json.NewDecoder(w.Body).Decode(&response)) {
+		assert.Equal([]FieldError{{Field: "page_url", Message: "must be an absolute URL"}}, response.Error.Details)
+	}
+}
+
+func TestGetVisits(t *testing.T) {
+	assert := assert.New(t)
+
+	if err := dbInstance.Open(); err != nil {
+		t.Errorf("error opening database connection. err: %s", err)
+	}
+
+	provider := helperRandstring(10)
+	ident, err := dbInstance.GetIdentity(Interaction{
+		IP: helperRandstring(10), Provider: provider, Application: "TestApp",
+		VisitContext: VisitContext{PageURL: "https://example.com/?utm_source=news"},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	identities = append(identities, *ident)
+
+	assert.NoError(dbInstance.AddVisit(ident.PassportID, VisitContext{Referrer: "https://search.example.com/"}))
+
+	visits, err := dbInstance.GetVisits(ident.PassportID, DefaultVisitsLimit)
+	assert.NoError(err)
+	if assert.Len(visits, 2) {
+		assert.Equal("https://search.example.com/", visits[0].Referrer)
+		assert.Equal("news", visits[1].UTMSource)
+	}
+
+	visits, err = dbInstance.GetVisits(ident.PassportID, 1)
+	assert.NoError(err)
+	assert.Len(visits, 1)
+}